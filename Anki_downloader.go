@@ -1,15 +1,14 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/csv"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
-	"github.com/atselvan/ankiconnect"
+	"github.com/Michael-Manning/commuter-flashcards/pkg/ankiexport"
 	"github.com/privatesquare/bkst-go-utils/utils/errors"
 )
 
@@ -19,152 +18,867 @@ func must[T any](v T, err *errors.RestErr) T {
 			fmt.Println("REST error: Make sure Anki is running with Anki-connect enabled.")
 		}
 		fmt.Printf("REST error details: %v\n", err)
-		panic(err)
+		if currentRun != nil {
+			currentRun.Errors = append(currentRun.Errors, err.Message)
+			finishRun("failed")
+		}
+		// Retries are used up by now, a stack trace would only bury the error
+		os.Exit(1)
 	}
 	return v
 }
 
 type card struct {
+	noteID     int64
+	cardID     int64
+	deck       string
+	template   int64
+	language   string
+	tags       []string
 	word       string
 	definition string
+	reading    string
+	// answer is the answer side of a cloze note's text with --cloze both
+	answer     string
+	audioFile  string
+	// extraAudio holds the files played after audioFile with --sound_tags all
+	extraAudio []string
+	audioPath  string
+	audioHash  string
+	audioSize  int
+	image      string
+	// fields holds the other note fields of --fields
+	fields map[string]string
+	// sources holds the --enrich source or TTS voice of each value the note left empty
+	sources map[string]string
+	// number names the card's clips. An --incremental export keeps it from run to run
+	number int
+
+	// Scheduling info, used by lesson ordering
+	interval int64
+	reps     int64
+	lapses   int64
+	cardType int64
+	due      bool
 }
 
 var (
-	cardQuery       = flag.String("card_query", "", "Anki search query for data to download (e.g., 'deck:MyDeck')")
-	wordField       = flag.String("word_field", "", "Field name where words are stored on cards")
-	definitionField = flag.String("definition_field", "", "Field name where word definitions are stored on cards")
-	scrapeAudio     = flag.Bool("get_audio", false, "Download word pronunciation audio files from cards")
-	wordAudioField  = flag.String("word_audio_field", "", "Field name where word pronunciation audio files are stored on cards")
-	wordFolder      = flag.String("word_folder", "words_anki", "Directory to store downloaded word audio files")
-	csvName         = flag.String("csv_name", "cards.csv", "Output CSV file name for word/definition pairs")
+	cardQuery           = flag.String("card_query", "", "Anki search query for data to download (e.g., 'deck:MyDeck')")
+	dueOnly             = flag.Bool("due_only", false, "Only export the cards of --card_query that are due for review today")
+	dueWithin           = flag.String("due_within", "", "Only export the cards of --card_query due for review within this many days, e.g. 2d")
+	cardOrder           = flag.String("order", "anki", "Order to write the cards in ("+strings.Join(ankiexport.OrdererNames(), ", ")+")")
+	frequencyField      = flag.String("frequency_field", "Frequency", "Field holding the frequency rank cards are sorted by with --order frequency")
+	wordField           = flag.String("word_field", "", "Field name where words are stored on cards")
+	definitionField     = flag.String("definition_field", "", "Field name where word definitions are stored on cards")
+	scrapeAudio         = flag.Bool("get_audio", false, "Download word pronunciation audio files from cards")
+	concurrency         = flag.Int("concurrency", 4, "Number of audio files to download from Anki at the same time with --get_audio")
+	wordAudioField      = flag.String("word_audio_field", "", "Field name where word pronunciation audio files are stored on cards")
+	soundTags           = flag.String("sound_tags", "first", "Which file the word's clip plays when the audio field has several [sound:] tags: first, last, the number of the tag, or all of them one after the other")
+	recordingAudioField = flag.String("recording_field", "", "Field holding your own recording of the word, e.g. from the memos command, downloaded instead of --word_audio_field when a note has one")
+	wordFolder          = flag.String("word_folder", "words_anki", "Directory to store downloaded word audio files")
+	ttsEngineName       = flag.String("tts_engine", "", "Text-to-speech engine to read the words of cards without audio with ("+strings.Join(ttsEngineNames, ", ")+")")
+	ttsWords            = flag.String("tts_words", "all", "Which words --tts_engine reads with --get_audio: all (cards with an empty audio field or a file Anki doesn't have), missing (only cards whose audio file is gone from Anki, e.g. deleted media) or none (only --tts_definitions)")
+	ttsVoice            = flag.String("tts_voice", "", "Voice of --tts_engine for words, or the voice model for piper (default: one for each card's language)")
+	ttsDefinitions      = flag.Bool("tts_definitions", false, "Also read the definition of every card with --tts_engine into --definition_folder")
+	ttsDefVoice         = flag.String("tts_definition_voice", "", "Voice of --tts_engine for definitions (default: one for --tts_definition_language)")
+	ttsDefLanguage      = flag.String("tts_definition_language", "en", "Language of the definitions for --tts_definitions")
+	definitionDir       = flag.String("definition_folder", "definitions", "Directory to write definition clips to with --tts_definitions")
+	playlistName        = flag.String("playlist", "", "M3U playlist to write of the downloaded clips in the order of the cards, e.g. cards.m3u8 (optional)")
+	playlistPairs       = flag.Bool("playlist_pairs", false, "Follow each word in --playlist with its definition clip from --definition_folder")
+	apiKeyFile          = flag.String("API_key_file", "API_keys.json", "File containing TTS API keys, shared with audio_sourcer.py")
+	bwlimit             = flag.String("bwlimit", "", "Most bytes per second to download from --tts_engine, e.g. 500K or 2M (default: no limit)")
+	transferHours       = flag.String("transfer_window", "", "Time of day to download from --tts_engine in, e.g. 02:00-06:00, waiting until it opens (default: any time)")
+	csvName             = flag.String("csv_name", "cards.csv", "Output CSV file name for word/definition pairs")
+	outputFormat        = flag.String("format", "csv", "Output format (csv, json, jsonl, sqlite, epub)")
+	jsonName            = flag.String("json_name", "", "Output file name for --format json or jsonl (default: cards.json or cards.jsonl)")
+	dbName              = flag.String("db_name", "cards.db", "Output database file name for --format sqlite")
+	sqliteName          = flag.String("sqlite", "", "Also write the cards to this SQLite database, e.g. cards.db, updating the notes and cards of earlier exports and keeping their history (optional)")
+	epubName            = flag.String("epub_name", "cards.epub", "Output e-book file name for --format epub")
+	epubTitle           = flag.String("epub_title", "", "Title of the e-book for --format epub (default: the card query)")
+	epubChapterSize     = flag.Int("epub_chapter_size", 15, "Cards per e-book chapter, matching your lesson ranges (0 for one chapter)")
+	attribution         = flag.String("attribution", "", "Credit for the deck, e.g. \"JP1K deck by Refold\", written into the e-book (default: the cards' attribution:: tags)")
+	license             = flag.String("license", "", "License of the deck, e.g. \"CC BY-SA 4.0\", written into the e-book (default: the cards' license:: tags)")
+	spreadsheetSafe     = flag.Bool("spreadsheet_safe", false, "Prefix CSV cells starting with =, +, - or @ with ' so spreadsheets don't run them as formulas")
+	csvQuoting          = flag.String("csv_quoting", "minimal", "Which CSV cells to quote: minimal (only those that need it) or all")
+	multiValue          = flag.String("multi_value", "join", "How to write columns with several values per card, like tags, in the CSV ("+strings.Join(multiValueModes, ", ")+")")
+	multiValueSep       = flag.String("multi_value_separator", " ", "Separator between the values of a cell with --multi_value join")
+	clozeMode           = flag.String("cloze", "keep", "How to export the {{c1::answer::hint}} markup of cloze notes: keep, strip (leaving the answers), full (the answer side), question (the card's deletions as [...]) or both (question, with the answer side in an Answer column)")
+	stripHTML           = flag.Bool("strip_html", false, "Convert HTML in word/definition fields to plain text, repairing malformed markup")
+	duplicatePolicy     = flag.String("duplicates", "keep", "How to handle the same word in several decks with different definitions (keep, merge, prefer, both)")
+	preferDeck          = flag.String("prefer_deck", "", "Deck whose definition wins with --duplicates prefer")
+	autoSwap            = flag.Bool("auto_swap_mismatched", false, "Swap the word and definition of cards that look like they have them the wrong way around")
+	maxCards            = flag.Int("max_cards", 10000, "Ask for confirmation when a query matches more cards than this (0 for no limit)")
+	assumeYes           = flag.Bool("yes", false, "Answer yes to confirmation prompts")
+	audioNameTemplate   = flag.String("audio_name_template", "", "Template for the names of the downloaded word clips, e.g. \"{{.Index}}_{{.Word}}\", from .Index, .Word, .Reading, .Deck and .NoteID (default: word_0000.mp3)")
+	audioNameASCII      = flag.Bool("audio_name_ascii", false, "Only use ASCII letters and digits for the words in --audio_name_template names")
+	byNote              = flag.Bool("by_note", false, "Write each note once, as its first card, instead of a row per card for note types with several cards per note")
+	skipErrors          = flag.Bool("skip_errors", false, "Skip the cards missing a field and list them at the end, instead of stopping at the first")
+	errorsCSV           = flag.String("errors_csv", "", "With --skip_errors, also write the skipped cards to this CSV, e.g. errors.csv")
+	enrichList          = flag.String("enrich", "", "Comma separated sources to fill in empty definitions, readings and frequency ranks from, first wins: dictionary:FILE (word, definition and reading separated by tabs) or frequency:FILE (a word per line, most frequent first)")
+	regenerate          = flag.String("regenerate", "", "Comma separated --enrich sources, or kinds like dictionary, whose values --incremental fills in again, e.g. after updating the file")
+	dryRun              = flag.Bool("dry_run", false, "Query the cards and check their fields, printing what would be exported and downloaded without writing anything")
+	cacheDir            = flag.String("cache_dir", defaultCacheDir(), "Shared cache directory for downloaded media (empty to disable)")
+	queryCacheTTL       = flag.Duration("query_cache", 0, "Reuse the cards --card_query matched for this long, e.g. 10m, instead of asking Anki again (0 to always ask)")
+	historyFile         = flag.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	buriedFile          = flag.String("buried_file", defaultBuriedFile, "Cards buried by `bury`, unburied on the next day's export")
+	incremental         = flag.Bool("incremental", false, "Only fetch the cards added or changed since the last --incremental export, and their audio")
+	exportStateFile     = flag.String("export_state_file", defaultExportStateFile, "What the last --incremental export wrote, to find the cards that changed since")
+	language            = flag.String("language", "", "Language code for every card, overriding per-note hints (e.g. ja)")
+	languageField       = flag.String("language_field", "Language", "Field holding a note's language code, if present")
+	readingField        = flag.String("reading_field", "", "Field holding how the word is read, e.g. its kana, written to a Reading column for TTS")
+	defaultLanguage     = flag.String("default_language", "", "Language code for cards without a language hint")
+	imagePolicy         = flag.String("image_policy", "keep", "How to handle images in word/definition fields ("+imagePolicyNames()+")")
+	imageFolder         = flag.String("image_folder", "images", "Directory to download images to with --image_policy reference")
+	workspaceRoot       = workspaceFlag(flag.CommandLine)
+	metadataColumns     = flag.String("metadata_columns", "", "Comma separated card metadata columns to add to the CSV ("+metadataColumnNames()+")")
+	fieldList           = flag.String("fields", "", "Comma separated note fields to write as CSV columns, in order, e.g. \"Front,Back,Example\" (default: the word and definition fields)")
 )
 
 func main() {
 
-	flag.Parse()
+	// The config command reads the config file itself.
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfig(os.Args[2:])
+		return
+	}
+
+	// The config file's settings go in first, so they can hold any of the flags below.
+	os.Args = append(os.Args[:1], extractConfigFlag(os.Args[1:])...)
+	os.Args = append(os.Args[:1], renameFlags(os.Args[1:])...)
+
+	// Developer flags are handled first so every command supports them.
+	os.Args = append(os.Args[:1], extractDevFlags(os.Args[1:])...)
+	os.Args = append(os.Args[:1], extractSnapshotFlag(os.Args[1:])...)
+	os.Args = append(os.Args[:1], extractAnkiURLFlag(os.Args[1:])...)
+	os.Args = append(os.Args[:1], extractRetryFlags(os.Args[1:])...)
+	os.Args = append(os.Args[:1], extractBusyFlags(os.Args[1:])...)
+	os.Args = append(os.Args[:1], extractRunFlags(os.Args[1:])...)
+
+	// Subcommands are dispatched before the export flags are parsed.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "apply":
+			runApply(os.Args[2:])
+			return
+		case "upload":
+			runUpload(os.Args[2:])
+			return
+		case "memos":
+			runMemos(os.Args[2:])
+			return
+		case "opml":
+			runOPML(os.Args[2:])
+			return
+		case "site":
+			runSite(os.Args[2:])
+			return
+		case "runs":
+			runRuns(os.Args[2:])
+			return
+		case "doctor":
+			runDoctor(os.Args[2:])
+			return
+		case "link":
+			runLink(os.Args[2:])
+			return
+		case "verify-output":
+			runVerifyOutput(os.Args[2:])
+			return
+		case "skips":
+			runSkips(os.Args[2:])
+			return
+		case "batch":
+			runBatch(os.Args[2:])
+			return
+		case "rollback":
+			runRollback(os.Args[2:])
+			return
+		case "confusables":
+			runConfusables(os.Args[2:])
+			return
+		case "bury":
+			runBury(os.Args[2:])
+			return
+		case "schedule":
+			runSchedule(os.Args[2:])
+			return
+		case "pick":
+			runPick(os.Args[2:])
+			return
+		case "setup":
+			runSetup(os.Args[2:])
+			return
+		case "selftest":
+			runSelftest(os.Args[2:])
+			return
+		case "update":
+			runUpdate(os.Args[2:])
+			return
+		case "download":
+			runDownload(os.Args[2:])
+			return
+		case "audio":
+			runScript("audio_sourcer.py", os.Args[2:])
+			return
+		case "lesson":
+			runScript("concatenator.py", os.Args[2:])
+			return
+		}
+	}
+	runDownload(os.Args[1:])
+}
+
+// printWarnings prints the warnings of an export, if there are any.
+func printWarnings(warnings []string) {
+	if len(warnings) > 0 {
+		fmt.Printf("%d warnings:\n", len(warnings))
+		for _, w := range warnings {
+			fmt.Printf("  %s\n", w)
+		}
+	}
+}
+
+// runDownload implements the `download` command, which is also what runs without a command:
+// it queries Anki and writes the cards, and with --get_audio their audio.
+func runDownload(args []string) {
+	flag.CommandLine.Usage = usage
+	flag.CommandLine.Parse(args)
+	useWorkspace(flag.CommandLine, *workspaceRoot, map[string]string{
+		"csv_name":          "cards.csv",
+		"db_name":           "cards.db",
+		"epub_name":         "cards.epub",
+		"word_folder":       filepath.Join("audio", "words_anki"),
+		"definition_folder": filepath.Join("audio", "definitions"),
+		"image_folder":      "images",
+		"cache_dir":         "cache",
+		"history_file":      workspaceHistoryFile,
+		"buried_file":       filepath.Join("state", defaultBuriedFile),
+		"export_state_file": filepath.Join("state", defaultExportStateFile),
+	})
+	startRun("export", flag.CommandLine, *historyFile)
 
 	// Validate required flags
 	if *cardQuery == "" {
-		fmt.Println("error: must supply --card_query")
-		os.Exit(1)
+		fatalf("must supply --card_query")
+	}
+	query, err := dueQuery(*cardQuery, *dueOnly, *dueWithin)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	*cardQuery = query
+	// The first two of --fields are the word and definition unless they are named
+	if names := strings.Split(*fieldList, ","); len(names) >= 2 && *wordField == "" && *definitionField == "" {
+		*wordField, *definitionField = strings.TrimSpace(names[0]), strings.TrimSpace(names[1])
 	}
 	if *wordField == "" {
-		fmt.Println("error: must supply --word_field")
-		os.Exit(1)
+		fatalf("must supply --word_field")
 	}
 	if *definitionField == "" {
-		fmt.Println("error: must supply --definition_field")
-		os.Exit(1)
+		fatalf("must supply --definition_field")
+	}
+
+	columns, extraFields, err := fieldColumns(*fieldList)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	metadata, err := parseMetadataColumns(*metadataColumns)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	columns = append(columns, metadata...)
+	if *readingField != "" && !hasMetadataColumn(columns, "reading") {
+		columns = append(columns, metadataColumn{name: "reading", header: "Reading", value: func(c card) string { return c.reading }})
+	}
+	if !slices.Contains(clozeModes, *clozeMode) {
+		fatalf("unknown --cloze %q, must be one of %s", *clozeMode, strings.Join(clozeModes, ", "))
+	}
+	if *clozeMode == "both" {
+		columns = append(columns, metadataColumn{name: "answer", header: "Answer", value: func(c card) string { return c.answer }})
+	}
+	if err := checkColumnHeaders(columns); err != nil {
+		fatalf("%v", err)
+	}
+	switch *outputFormat {
+	case "csv", "sqlite", "epub":
+	case "json", "jsonl":
+		if *jsonName == "" {
+			*jsonName = filepath.Join(*workspaceRoot, "cards."+*outputFormat)
+		}
+	default:
+		fatalf("unknown --format %q, must be csv, json, jsonl, sqlite or epub", *outputFormat)
+	}
+	for _, f := range []string{"language", "default_language"} {
+		value := flag.Lookup(f).Value.String()
+		if value != "" && normalizeLanguage(value) == "" {
+			fatalf("invalid --%s %q, must be a language code such as ja or pt-BR", f, value)
+		}
+	}
+	if !validImagePolicy(*imagePolicy) {
+		fatalf("unknown --image_policy %q, must be one of %s", *imagePolicy, imagePolicyNames())
+	}
+	if *imagePolicy == "reference" && !*dryRun {
+		if err := os.MkdirAll(*imageFolder, 0755); err != nil {
+			fatalf("failed to create directory %s: %v", *imageFolder, err)
+		}
+	}
+	switch *duplicatePolicy {
+	case "keep", "merge", "both":
+	case "prefer":
+		if *preferDeck == "" {
+			fatalf("must supply --prefer_deck with --duplicates prefer")
+		}
+	default:
+		fatalf("unknown --duplicates policy %q, must be keep, merge, prefer or both", *duplicatePolicy)
+	}
+	switch *csvQuoting {
+	case "minimal", "all":
+	default:
+		fatalf("unknown --csv_quoting %q, must be minimal or all", *csvQuoting)
+	}
+	if !slices.Contains(multiValueModes, *multiValue) {
+		fatalf("unknown --multi_value %q, must be one of %s", *multiValue, strings.Join(multiValueModes, ", "))
+	}
+	if *multiValue == "join" && *multiValueSep == "" {
+		fatalf("--multi_value_separator must not be empty")
+	}
+	if *errorsCSV != "" && !*skipErrors {
+		fatalf("--errors_csv needs --skip_errors")
+	}
+	if *queryCacheTTL > 0 && *cacheDir == "" {
+		fatalf("--query_cache needs a --cache_dir to keep the cards in")
+	}
+	if *queryCacheTTL > 0 && *incremental {
+		fatalf("--query_cache can't be combined with --incremental, which asks Anki what changed")
+	}
+	if *incremental && (*outputFormat != "csv" || *duplicatePolicy != "keep" || *byNote) {
+		fatalf("--incremental needs --format csv and --duplicates keep, and no --by_note, which handle each card on its own")
+	}
+	orderer, found := ankiexport.LookupOrderer(*cardOrder)
+	if !found {
+		fatalf("unknown --order %q, must be one of %s", *cardOrder, strings.Join(ankiexport.OrdererNames(), ", "))
+	}
+	if *cardOrder == "frequency" {
+		orderer = ankiexport.FieldOrder{Field: *frequencyField}
+	}
+	if *incremental && *cardOrder != "anki" {
+		fatalf("--order can't be combined with --incremental, which adds new cards at the end to keep the clip numbers of the others")
+	}
+	enrichers, enrichesFrequency, err := parseEnrichers(*enrichList)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	regenerated := map[string]bool{}
+	for _, name := range strings.Split(*regenerate, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		known := false
+		for _, e := range enrichers {
+			known = known || fromSource(e.Name(), map[string]bool{name: true})
+		}
+		if !known {
+			fatalf("--regenerate %s is not one of the --enrich sources", name)
+		}
+		regenerated[name] = true
+	}
+	if len(regenerated) > 0 && !*incremental {
+		fatalf("--regenerate only applies to --incremental, other exports fill in every value again")
 	}
 
 	// If audio scraping is requested, validate related fields and ensure directory exists.
 	if *scrapeAudio {
 		if *wordAudioField == "" {
-			fmt.Println("error: must supply --word_audio_field when --get_audio is enabled")
-			os.Exit(1)
+			fatalf("must supply --word_audio_field when --get_audio is enabled")
 		}
 		if *wordFolder == "" {
-			fmt.Println("error: must supply valid --word_folder when --get_audio is enabled")
-			os.Exit(1)
+			fatalf("must supply valid --word_folder when --get_audio is enabled")
+		}
+		if *concurrency < 1 {
+			fatalf("--concurrency must be at least 1")
 		}
+		if err := checkSoundTags(*soundTags); err != nil {
+			fatalf("%v", err)
+		}
+	} else if *audioNameTemplate != "" {
+		fatalf("--audio_name_template names the clips of --get_audio")
+	}
+	namer, err := newAudioNamer(*audioNameTemplate, *audioNameASCII)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *scrapeAudio {
 
-		if _, err := os.Stat(*wordFolder); os.IsNotExist(err) {
+		if _, err := os.Stat(*wordFolder); os.IsNotExist(err) && !*dryRun {
 			err = os.Mkdir(*wordFolder, 0755)
 			if err != nil {
-				fmt.Printf("error: failed to create directory %s: %v\n", *wordFolder, err)
-				os.Exit(1)
+				fatalf("failed to create directory %s: %v", *wordFolder, err)
 			}
 		}
 	}
 
-	// Connect to Anki
-	client := ankiconnect.NewClient()
+	// Words without audio in Anki, and definitions, can be read by a TTS engine. Without its
+	// credentials or programs they aren't, and the rest is still exported.
+	var warnings []string
+	var wordTTS, definitionTTS ttsEngine
+	if transfers, err = newTransferLimits(*bwlimit, *transferHours); err != nil {
+		fatalf("%v", err)
+	}
+	limitClient(ttsHTTP, transfers)
+	if !slices.Contains(ttsWordModes, *ttsWords) {
+		fatalf("unknown --tts_words %q, must be one of %s", *ttsWords, strings.Join(ttsWordModes, ", "))
+	}
+	if *ttsEngineName != "" {
+		if !*scrapeAudio && !*ttsDefinitions {
+			fatalf("--tts_engine needs --get_audio to read the cards without audio, or --tts_definitions")
+		}
+		var keys map[string]string
+		if _, err := os.Stat(*apiKeyFile); err == nil {
+			if keys, err = loadAPIKeys(*apiKeyFile); err != nil {
+				fatalf("%v", err)
+			}
+		}
+		wordTTS, err = newTTSEngine(*ttsEngineName, *ttsVoice, keys)
+		if _, isMissing := err.(missingError); isMissing {
+			if *scrapeAudio {
+				warnings = append(warnings, skipFeature("reading the cards without audio", err))
+			}
+			if *ttsDefinitions {
+				warnings = append(warnings, skipFeature("reading the definitions", err))
+			}
+		} else if err != nil {
+			fatalf("%v", err)
+		}
+		if *ttsDefinitions && wordTTS != nil {
+			if normalizeLanguage(*ttsDefLanguage) == "" {
+				fatalf("invalid --tts_definition_language %q, must be a language code such as en", *ttsDefLanguage)
+			}
+			if definitionTTS, err = newTTSEngine(*ttsEngineName, *ttsDefVoice, keys); err != nil {
+				fatalf("%v", err)
+			}
+			if !*dryRun {
+				if err := os.MkdirAll(*definitionDir, 0755); err != nil {
+					fatalf("failed to create directory %s: %v", *definitionDir, err)
+				}
+			}
+		}
+	} else if *ttsDefinitions {
+		fatalf("--tts_definitions needs a --tts_engine to read with")
+	}
+	if *playlistName != "" && !*scrapeAudio && !*ttsDefinitions {
+		fatalf("--playlist needs --get_audio or --tts_definitions to download clips to play")
+	}
+
+	var cache *mediaCache
+	if (*scrapeAudio || *ttsDefinitions || *outputFormat == "epub" || *imagePolicy == "reference") && *cacheDir != "" && !*dryRun {
+		cache, err = openCache(*cacheDir)
+		if err != nil {
+			fmt.Printf("warning: %v, continuing without cache\n", err)
+		}
+	}
+
+	// Connect to Anki, or use the cards a batch build or the query cache already has
+	cachedQuery := snapshot == nil && *queryCacheTTL > 0 && loadQueryCache(*cacheDir, *cardQuery, *queryCacheTTL)
+	client := withSnapshot(newAnkiClient())
+
+	// Cards buried after an earlier day's lesson are due again. Unburying them changes
+	// Anki, so a dry run leaves them buried.
+	if !*dryRun {
+		if released, err := releaseBuried(client, *buriedFile, false); err != nil {
+			fmt.Printf("warning: %v\n", err)
+		} else if released > 0 {
+			recordCount("unburied", released)
+			fmt.Printf("Unburied %d cards buried after an earlier lesson\n", released)
+		}
+	}
+
+	exporter := &ankiexport.Exporter{
+		Client:          ankiSource{client: client, cache: cache},
+		Query:           *cardQuery,
+		WordField:       *wordField,
+		DefinitionField: *definitionField,
+		ReadingField:    *readingField,
+		Tags:            normalizeLanguage(*language) == "" || hasMetadataColumn(columns, "tags") || *outputFormat == "epub",
+		Due:             hasMetadataColumn(columns, "due"),
+		ByNote:          *byNote,
+		Enrichers:       enrichers,
+		FrequencyField:  *frequencyField,
+	}
+	if *scrapeAudio {
+		exporter.AudioField = *wordAudioField
+		exporter.RecordingField = *recordingAudioField
+	}
+	var fieldErrors []*ankiexport.FieldError
+	if *skipErrors {
+		exporter.SkipCard = func(err *ankiexport.FieldError) { fieldErrors = append(fieldErrors, err) }
+	}
+	recorded := &ankiSnapshot{}
+	if *queryCacheTTL > 0 && !cachedQuery {
+		exporter.Client = recordingSource{exporter.Client, recorded}
+	}
 
 	// Retrieve cards based on the provided query
-	cardsRes := must(client.Cards.Get(*cardQuery))
+	cardIDs := mustExport(exporter.Search())
+	namer.padTo(len(cardIDs))
 
-	if len(*cardsRes) == 0 {
-		fmt.Println("error: query returned no cards")
-		os.Exit(1)
+	if len(cardIDs) == 0 {
+		fatalf("query returned no cards")
 	}
 
-	cards := make([]card, len(*cardsRes))
+	// Guard against accidentally exporting a huge collection, e.g. deck:*
+	if *maxCards > 0 && len(cardIDs) > *maxCards && !*assumeYes {
+		question := fmt.Sprintf("Query matched %d cards, more than --max_cards %d. Continue?", len(cardIDs), *maxCards)
+		if !isTerminal(os.Stdin) {
+			fatalf("query matched %d cards, more than --max_cards %d. Use --yes to export anyway", len(cardIDs), *maxCards)
+		}
+		if !confirm(question) {
+			fatalf("aborted")
+		}
+	}
 
-	for i, c := range *cardsRes {
+	// Check the fields exist on every matched note type before fetching the cards
+	models := must(matchedModels(client, *cardQuery, len(cardIDs)))
+	required := map[string]string{"word_field": *wordField, "definition_field": *definitionField}
+	if *scrapeAudio {
+		required["word_audio_field"] = *wordAudioField
+	}
+	if *readingField != "" {
+		required["reading_field"] = *readingField
+	}
+	for _, name := range extraFields {
+		required["fields "+name] = name
+	}
+	if *cardOrder == "frequency" && !enrichesFrequency {
+		required["frequency_field"] = *frequencyField
+	}
+	if problems := missingFields(models, required); len(problems) > 0 && *skipErrors {
+		fmt.Printf("warning: fields missing from the note types matched by --card_query (--skip_errors):\n  %s\n", strings.Join(problems, "\n  "))
+	} else if len(problems) > 0 {
+		fatalf("fields missing from the note types matched by --card_query:\n  %s", strings.Join(problems, "\n  "))
+	}
 
-		// Validate that the required fields exist in the card
-		_, found := c.Fields[*wordField]
-		if !found{
-			fmt.Printf("error: card does not contain field %s\n", *wordField)
-			os.Exit(1)
+	// An incremental export only fetches the cards that are new or changed since the last one
+	fetchIDs := cardIDs
+	var (
+		state              *exportState
+		settings           string
+		cardMods, noteMods map[int64]int64
+	)
+	if *incremental {
+		settings = exportSettings(columns)
+		state = loadExportState(*exportStateFile, settings, *csvName)
+		fetchIDs, cardMods, noteMods = changedCards(client, state, cardIDs, regenerated)
+		if state != nil {
+			fmt.Printf("%d of %d cards are new or changed since the last export\n", len(fetchIDs), len(cardIDs))
 		}
-		_, found = c.Fields[*definitionField]
-		if !found{
-			fmt.Printf("error: card does not contain field %s\n", *definitionField)
-			os.Exit(1)
+	}
+
+	exported := mustExport(exporter.Cards(fetchIDs))
+	if *queryCacheTTL > 0 && !cachedQuery && !*dryRun {
+		if err := saveQueryCache(*cacheDir, *cardQuery, cardIDs, recorded); err != nil {
+			fmt.Printf("warning: failed to cache the cards of --card_query: %v\n", err)
 		}
+	}
+	if err := exporter.Enrich(exported); err != nil {
+		fatalf("%v", err)
+	}
+	exported = orderer.Order(exported)
 
-		cards[i].word = c.Fields[*wordField].Value
-		cards[i].definition = c.Fields[*definitionField].Value
+	cards := make([]card, len(exported))
+	audioCount := 0
+	replacer := &imageReplacer{policy: *imagePolicy, folder: *imageFolder, client: client, cache: cache, saved: map[string]string{}, dryRun: *dryRun}
+	skipped := map[int]bool{}
 
-		if *scrapeAudio {
+	for i, c := range exported {
+		cards[i].noteID = c.NoteID
+		cards[i].cardID = c.CardID
+		cards[i].deck = c.Deck
+		cards[i].template = c.Template
+		cards[i].interval = c.Interval
+		cards[i].reps = c.Reps
+		cards[i].lapses = c.Lapses
+		cards[i].cardType = c.Type
+		cards[i].due = c.Due
+		cards[i].tags = c.Tags
+		cards[i].language = resolveLanguage(*language, c.Tags, c.Fields, *languageField, c.Model, *defaultLanguage)
+		cards[i].word = c.Word
+		cards[i].definition = c.Definition
+		cards[i].audioFile, cards[i].extraAudio = pickSounds(c.AudioFiles, *soundTags)
+		for what, source := range c.Sources {
+			if cards[i].sources == nil {
+				cards[i].sources = map[string]string{}
+			}
+			cards[i].sources[string(what)] = source
+		}
+		// Without a --reading_field, only --enrich fills in readings
+		if c.Reading != "" {
+			// Readings are spoken, never shown, so they are always plain text
+			cards[i].reading, _ = htmlToText(c.Reading)
+			cards[i].reading = strings.TrimSpace(cards[i].reading)
+		}
+		if cards[i].image = firstImage(cards[i].word); cards[i].image == "" {
+			cards[i].image = firstImage(cards[i].definition)
+		}
 
-			_, found = c.Fields[*wordAudioField]
-			if !found{
-				fmt.Printf("error: card does not contain field %s\n", *definitionField)
-				os.Exit(1)
+		if *skipErrors {
+			for _, name := range extraFields {
+				if _, found := c.Fields[name]; !found {
+					fieldErrors = append(fieldErrors, &ankiexport.FieldError{NoteID: c.NoteID, CardID: c.CardID, Model: c.Model, Field: name})
+					skipped[i] = true
+					break
+				}
 			}
+			if skipped[i] {
+				continue
+			}
+		}
 
-			// Retrieve the audio file from Anki
-			filename := strings.TrimSuffix(strings.TrimPrefix(c.Fields[*wordAudioField].Value, "[sound:"), "]")
-			audioData := must(client.Media.RetrieveMediaFile(filename))
-			decodedData, decErr := base64.StdEncoding.DecodeString(*audioData)
-			if decErr != nil {
-				fmt.Printf("error: failed to decode audio data for %s: %v\n", filename, decErr)
-				os.Exit(1)
+		// Apply the image policy before any other processing of the text
+		if *imagePolicy == "skip" && (hasImage(cards[i].word) || hasImage(cards[i].definition)) {
+			warnings = append(warnings, fmt.Sprintf("note %d: skipped, it has an image (--image_policy skip)", c.NoteID))
+			skipped[i] = true
+			continue
+		}
+		clean := func(name, value string) string {
+			value, imageErr := replacer.replace(value)
+			if imageErr != nil {
+				warnings = append(warnings, fmt.Sprintf("note %d field %s: %v", c.NoteID, name, imageErr))
+			}
+			if *stripHTML {
+				var fieldWarnings []string
+				value, fieldWarnings = htmlToText(value)
+				for _, w := range fieldWarnings {
+					warnings = append(warnings, fmt.Sprintf("note %d field %s: %s", c.NoteID, name, w))
+				}
+			}
+			return value
+		}
+		// Cloze markup is rendered before the HTML is stripped, so the answer side's marked
+		// answers go with the rest of the HTML
+		cloze := func(value string) string {
+			return clozeField(value, c.Template, *clozeMode)
+		}
+		if *clozeMode == "both" {
+			// The text cloze note types ask is usually the word, but can be the definition
+			text := cards[i].word
+			if !hasCloze(text) && hasCloze(cards[i].definition) {
+				text = cards[i].definition
 			}
+			cards[i].answer = clean(*wordField, renderCloze(text, c.Template, "full"))
+		}
+		cards[i].word = clean(*wordField, cloze(cards[i].word))
+		cards[i].definition = clean(*definitionField, cloze(cards[i].definition))
+		if len(extraFields) > 0 {
+			cards[i].fields = map[string]string{}
+			for _, name := range extraFields {
+				cards[i].fields[name] = clean(name, cloze(c.Fields[name]))
+			}
+		}
+	}
 
-			// Write audio file to disk
-			outname := fmt.Sprintf("word_%04d.mp3", i)
-			outname = filepath.Join(*wordFolder, outname)
-			err := os.WriteFile(outname, decodedData, 0644)
-			if err != nil {
-				fmt.Printf("error: failed to write audio file %s: %v\n", outname, err)
-				os.Exit(1)
-			}	
-			fmt.Printf("downloaded %s\n", filename)
+	skippedNotes := map[int64]int64{}
+	for _, e := range fieldErrors {
+		skippedNotes[e.CardID] = e.NoteID
+	}
+	if len(skipped) > 0 {
+		kept := cards[:0]
+		for i, c := range cards {
+			if skipped[i] {
+				skippedNotes[exported[i].CardID] = exported[i].NoteID
+			} else {
+				kept = append(kept, c)
+			}
+		}
+		cards = kept
+	}
+	if !*incremental {
+		for i := range cards {
+			cards[i].number = i
+		}
+	} else {
+		cards = mergeExport(state, cardIDs, cards, skippedNotes, namer)
+		// Whether a card is due changes without the card changing
+		if state != nil && hasMetadataColumn(columns, "due") {
+			ids := make([]int64, len(cards))
+			for i, c := range cards {
+				ids[i] = c.cardID
+			}
+			for i, d := range must(cardsDue(client, ids)) {
+				cards[i].due = d
+			}
 		}
 	}
+	if len(cards) == 0 {
+		fatalf("every card was skipped, by --image_policy skip or --skip_errors")
+	}
 
-	// Create CSV file
-	file, err := os.Create(*csvName)
-	if err != nil {
-		fmt.Printf("error: failed to create CSV file %s: %v\n", *csvName, err)
-		os.Exit(1)
+	mismatched, mismatchWarnings := mismatchedCards(cards, *autoSwap)
+	warnings = append(warnings, mismatchWarnings...)
+	if *autoSwap && len(mismatched) > 0 {
+		recordCount("swapped", len(mismatched))
+	}
+
+	cards, duplicateWarnings := resolveDuplicates(cards, *duplicatePolicy, *preferDeck)
+	warnings = append(warnings, duplicateWarnings...)
+
+	if *dryRun {
+		printWarnings(warnings)
+		reportSkippedCards(fieldErrors, "")
+		output := *csvName
+		switch *outputFormat {
+		case "json", "jsonl":
+			output = *jsonName
+		case "sqlite":
+			output = *dbName
+		case "epub":
+			output = *epubName
+		}
+		problems := printDryRun(client, cards, dryRunOptions{
+			output:        output,
+			audio:         *scrapeAudio,
+			readings:      *readingField != "",
+			wordTTS:       wordTTS != nil && *ttsWords == "all",
+			missingTTS:    wordTTS != nil && *ttsWords != "none",
+			definitionTTS: definitionTTS != nil,
+		})
+		recordCount("cards", len(cards))
+		recordCount("missing_fields", problems)
+		recordCount("skipped_errors", len(fieldErrors))
+		recordCount("warnings", len(warnings))
+		finishRun("dry run")
+		return
 	}
-	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	ttsCount := 0
+	if *scrapeAudio {
+		names, err := namer.names(cards)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		readWords := wordTTS
+		if *ttsWords == "none" {
+			readWords = nil
+		}
+		if audioCount, ttsCount, err = downloadAudio(client, cache, cards, *wordFolder, names, *concurrency, readWords, *ttsWords == "all", &warnings); err != nil {
+			fatalf("%v", err)
+		}
+		// Clips named by an earlier export would be paired with the wrong cards
+		if namer != nil {
+			if stray := strayClips(*wordFolder, names); stray > 0 {
+				warnings = append(warnings, fmt.Sprintf("%d other clips in %s, e.g. from an export with other names, would be mixed into the lessons: remove them", stray, *wordFolder))
+			}
+		} else if err := removeStaleClips(*wordFolder, "word", names); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	definitionCount := 0
+	if definitionTTS != nil {
+		if definitionCount, err = synthesizeDefinitions(definitionTTS, cache, cards, *definitionDir, *ttsDefLanguage, *concurrency); err != nil {
+			fatalf("%v", err)
+		}
+		ttsCount += definitionCount
+	}
 
-	// Write CSV header
-	header := []string{"Word", "Definition"}
-	err = writer.Write(header)
+	// E-books include the first image of each card
+	var images map[string][]byte
+	if *outputFormat == "epub" {
+		images = fetchImages(client, cache, cards, &warnings)
+	}
+
+	printWarnings(warnings)
+	if err := reportSkippedCards(fieldErrors, *errorsCSV); err != nil {
+		fmt.Printf("warning: %v\n", err)
+	} else if *errorsCSV != "" && len(fieldErrors) > 0 {
+		recordOutput(*errorsCSV)
+	}
+
+	// Write the cards in the requested format
+	output := *csvName
+	switch *outputFormat {
+	case "csv":
+		err = writeCSV(*csvName, cards, columns, csvOptions{
+			safe:           *spreadsheetSafe,
+			quoteAll:       *csvQuoting == "all",
+			multiValue:     *multiValue,
+			valueSeparator: *multiValueSep,
+		})
+		if err == nil {
+			err = saveCSVExport(*csvName, csvExport{SpreadsheetSafe: *spreadsheetSafe, Transforms: exportTransforms()})
+		}
+	case "json", "jsonl":
+		output = *jsonName
+		err = writeJSON(*jsonName, cards, columns, *scrapeAudio, *outputFormat == "jsonl")
+	case "sqlite":
+		output = *dbName
+		err = writeSQLite(*dbName, cards, *cardQuery)
+	case "epub":
+		output = *epubName
+		title := *epubTitle
+		if title == "" {
+			title = *cardQuery
+		}
+		deckAttribution, deckLicense := tagCredits(cards)
+		if *attribution != "" {
+			deckAttribution = *attribution
+		}
+		if *license != "" {
+			deckLicense = *license
+		}
+		err = writeEPUB(*epubName, title, creditLine(deckAttribution, deckLicense), cards, images, *epubChapterSize)
+	}
 	if err != nil {
-		fmt.Printf("error: failed to write CSV header: %v\n", err)
-		os.Exit(1)
+		fatalf("%v", err)
+	}
+	if *incremental {
+		if err := saveExportState(*exportStateFile, newExportState(client, settings, cards, nextNumber(state, cards), skippedNotes, cardMods, noteMods)); err != nil {
+			os.Remove(*exportStateFile)
+			fmt.Printf("warning: failed to write %s, the next export fetches every card: %v\n", *exportStateFile, err)
+		}
+	} else if err := os.Remove(*exportStateFile); err != nil && !os.IsNotExist(err) {
+		// The state no longer describes the files this export wrote
+		fmt.Printf("warning: failed to remove %s: %v\n", *exportStateFile, err)
 	}
 
-	// Write card data
-	for _, c := range cards {
-		record := []string{c.word, c.definition}
-		err = writer.Write(record)
+	recordCount("cards", len(cards))
+	recordCount("audio_files", audioCount)
+	if ttsCount > 0 {
+		recordCount("tts_clips", ttsCount)
+	}
+	recordCount("warnings", len(warnings))
+	if len(fieldErrors) > 0 {
+		recordCount("skipped_errors", len(fieldErrors))
+	}
+	recordOutput(output)
+	if *outputFormat == "csv" {
+		recordOutput(csvExportName(*csvName))
+	}
+	if audioCount > 0 {
+		recordOutput(*wordFolder)
+	}
+	if definitionCount > 0 {
+		recordOutput(*definitionDir)
+	}
+	if *playlistName != "" {
+		entries, err := writePlaylist(*playlistName, cards, *definitionDir, *playlistPairs)
 		if err != nil {
-			fmt.Printf("error: failed to write record for word '%s': %v\n", c.word, err)
-			os.Exit(1)
+			fatalf("%v", err)
 		}
+		fmt.Printf("Wrote %d clips to playlist %s\n", entries, *playlistName)
+		recordOutput(*playlistName)
+	}
+	if *sqliteName != "" && (*outputFormat != "sqlite" || filepath.Clean(*sqliteName) != filepath.Clean(*dbName)) {
+		if err := writeSQLite(*sqliteName, cards, *cardQuery); err != nil {
+			fatalf("%v", err)
+		}
+		fmt.Printf("Wrote %d cards to database %s\n", len(cards), *sqliteName)
+		recordOutput(*sqliteName)
 	}
 
-	fmt.Printf("Successfully wrote %d cards to %s\n", len(cards), *csvName)
-	os.Exit(0)
+	fmt.Printf("Successfully wrote %d cards to %s\n", len(cards), output)
+	// Cards with warnings were still written, so the export is usable but not perfect
+	status := "ok"
+	if len(warnings) > 0 || len(fieldErrors) > 0 {
+		status = "partial"
+	}
+	finishRun(status)
+	os.Exit(exitCode(status))
 }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Michael-Manning/commuter-flashcards/pkg/ankiexport"
+	"github.com/atselvan/ankiconnect"
+	"github.com/privatesquare/bkst-go-utils/utils/errors"
+)
+
+// ankiURLs are the Anki-Connect addresses to use, set with --anki_url for an Anki-Connect on
+// another port or machine, or the fake one `selftest` runs. With several, separated by
+// commas, the first that answers is used, so a scheduled build can fall back from a desktop
+// that is switched off to a laptop or an always-on instance.
+var ankiURLs []string
+
+// ankiURL is the address picked from ankiURLs when the first client was created.
+var ankiURL string
+
+// ankiHealthTimeout is how long to wait for each address to answer before trying the next.
+const ankiHealthTimeout = 3 * time.Second
+
+// extractAnkiURLFlag removes --anki_url from args, so every command supports it.
+func extractAnkiURLFlag(args []string) []string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "anki_url" {
+			continue
+		}
+		rest := append([]string{}, args[:i]...)
+		if !hasValue {
+			if i+1 >= len(args) {
+				fatalf("--anki_url needs an address")
+			}
+			value = args[i+1]
+			i++
+		}
+		for _, u := range strings.Split(value, ",") {
+			if u = strings.TrimSpace(u); u == "" {
+				continue
+			}
+			if !strings.Contains(u, "://") {
+				u = "http://" + u
+			}
+			ankiURLs = append(ankiURLs, u)
+		}
+		return append(rest, args[i+1:]...)
+	}
+	return args
+}
+
+// pingAnki checks an Anki-Connect answers at url.
+func pingAnki(url string) error {
+	body, _ := json.Marshal(map[string]any{"action": "version", "version": minAnkiConnectVersion})
+	client := http.Client{Timeout: ankiHealthTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Result int `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.Result == 0 {
+		return fmt.Errorf("not an Anki-Connect")
+	}
+	return nil
+}
+
+// pickAnkiURL returns the first of urls that answers, or the first one if none do so the
+// command fails the usual way.
+func pickAnkiURL(urls []string) string {
+	if len(urls) == 1 {
+		return urls[0]
+	}
+	for i, url := range urls {
+		err := pingAnki(url)
+		if err == nil {
+			if i > 0 {
+				fmt.Printf("Using Anki-Connect at %s\n", url)
+			}
+			return url
+		}
+		fmt.Printf("warning: Anki-Connect at %s is not reachable: %v\n", url, err)
+	}
+	return urls[0]
+}
+
+// newAnkiClient returns an Anki-Connect client for ankiURL with the developer flags applied.
+func newAnkiClient() *ankiconnect.Client {
+	if ankiURL == "" && len(ankiURLs) > 0 {
+		ankiURL = pickAnkiURL(ankiURLs)
+	}
+	client := ankiconnect.NewClient()
+	if ankiURL != "" {
+		client.SetURL(ankiURL)
+	}
+	return withRetries(withChaos(client))
+}
+
+// ankiInvoke calls an AnkiConnect action that the ankiconnect package doesn't wrap.
+// Errors are reported the same way as the package's own calls so they work with must.
+func ankiInvoke[R any](client *ankiconnect.Client, action string, params any) (*R, *errors.RestErr) {
+	return withRetry(action, func() (*R, *errors.RestErr) {
+		if err := chaos.request(action); err != nil {
+			return nil, err
+		}
+		connect := &ankiexport.AnkiConnect{URL: client.Url, Version: client.Version, HTTPClient: ankiHTTPClient()}
+		res, err := ankiexport.Invoke[R](connect, action, params)
+		if err != nil {
+			return nil, restErr(err)
+		}
+		return &res, nil
+	})
+}
+
+// restErr turns an error from ankiexport into the errors the ankiconnect package returns.
+func restErr(err error) *errors.RestErr {
+	e, ok := err.(*ankiexport.Error)
+	switch {
+	case !ok:
+		return &errors.RestErr{Message: err.Error(), StatusCode: http.StatusBadRequest, Error: err.Error()}
+	case e.Unreachable:
+		return &errors.RestErr{Message: http.StatusText(http.StatusInternalServerError), StatusCode: http.StatusInternalServerError, Error: e.Message}
+	}
+	return &errors.RestErr{Message: e.Message, StatusCode: http.StatusBadRequest, Error: e.Message}
+}
+
+// cardsInfo fetches card details for the given IDs in batches.
+func cardsInfo(client *ankiconnect.Client, ids []int64) ([]ankiconnect.ResultCardsInfo, *errors.RestErr) {
+	const batchSize = 1000
+
+	if cards, found := snapshot.cardsInfo(ids); found {
+		return cards, nil
+	}
+	cards := make([]ankiconnect.ResultCardsInfo, 0, len(ids))
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+		res, err := ankiInvoke[[]ankiconnect.ResultCardsInfo](client, ankiconnect.ActionCardsInfo, ankiconnect.ParamsCardsInfo{Cards: &batch})
+		if err != nil {
+			return nil, failedFor(err, "cards", batch)
+		}
+		cards = append(cards, *res...)
+	}
+	return cards, nil
+}
+
+// cardsDue reports for each of the given cards if it is due for review in Anki today, in batches.
+func cardsDue(client *ankiconnect.Client, ids []int64) ([]bool, *errors.RestErr) {
+	const batchSize = 1000
+
+	due := make([]bool, 0, len(ids))
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+		res, err := ankiInvoke[[]bool](client, "areDue", map[string]any{"cards": batch})
+		if err != nil {
+			return nil, failedFor(err, "cards", batch)
+		}
+		due = append(due, *res...)
+	}
+	return due, nil
+}
+
+// notesInfo fetches note details, including tags, for the given note IDs in batches.
+func notesInfo(client *ankiconnect.Client, ids []int64) ([]ankiconnect.ResultNotesInfo, *errors.RestErr) {
+	const batchSize = 1000
+
+	if notes, found := snapshot.notesInfo(ids); found {
+		return notes, nil
+	}
+	notes := make([]ankiconnect.ResultNotesInfo, 0, len(ids))
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+		res, err := ankiInvoke[[]ankiconnect.ResultNotesInfo](client, ankiconnect.ActionNotesInfo, ankiconnect.ParamsNotesInfo{Notes: &batch})
+		if err != nil {
+			return nil, failedFor(err, "notes", batch)
+		}
+		notes = append(notes, *res...)
+	}
+	return notes, nil
+}
+
+// ankiSource is the ankiexport.Client exports use, going through the snapshot, the developer
+// flags and the media cache like every other Anki-Connect call here.
+type ankiSource struct {
+	client *ankiconnect.Client
+	cache  *mediaCache
+}
+
+// restError carries an Anki-Connect error through ankiexport, so mustExport can report it
+// like must.
+type restError struct{ *errors.RestErr }
+
+func (e restError) Error() string { return e.Message }
+
+// sourceResult returns v, or err as a restError.
+func sourceResult[T any](v T, err *errors.RestErr) (T, error) {
+	if err != nil {
+		return v, restError{err}
+	}
+	return v, nil
+}
+
+func (s ankiSource) FindCards(query string) ([]int64, error) {
+	ids, err := s.client.Cards.Search(query)
+	if err != nil {
+		return nil, restError{err}
+	}
+	return *ids, nil
+}
+
+func (s ankiSource) CardsInfo(ids []int64) ([]ankiconnect.ResultCardsInfo, error) {
+	return sourceResult(cardsInfo(s.client, ids))
+}
+
+func (s ankiSource) NotesInfo(ids []int64) ([]ankiconnect.ResultNotesInfo, error) {
+	return sourceResult(notesInfo(s.client, ids))
+}
+
+func (s ankiSource) AreDue(ids []int64) ([]bool, error) {
+	return sourceResult(cardsDue(s.client, ids))
+}
+
+func (s ankiSource) RetrieveMediaFile(filename string) ([]byte, error) {
+	return retrieveMedia(s.client, s.cache, filename)
+}
+
+// mustExport is must for the errors of an ankiexport.Exporter.
+func mustExport[T any](v T, err error) T {
+	if e, ok := err.(restError); ok {
+		return must(v, e.RestErr)
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+	return v
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// noteChange holds the field edits found for a single note.
+type noteChange struct {
+	noteID int64
+	before map[string]string
+	after  map[string]string
+}
+
+// runApply pushes edits made to an exported CSV back to the matching Anki notes.
+func runApply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	csvName := fs.String("csv_name", "cards.csv", "Edited CSV file to read word/definition pairs from")
+	wordField := fs.String("word_field", "", "Field name the Word column is written to")
+	definitionField := fs.String("definition_field", "", "Field name the Definition column is written to")
+	dryRun := fs.Bool("dry_run", false, "Print the changes without updating any notes")
+	yes := fs.Bool("yes", false, "Apply changes without asking for confirmation")
+	backupDir := fs.String("backup_dir", defaultBackupDir, "Directory to save the notes to before changing them, for rollback")
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{
+		"csv_name":     "cards.csv",
+		"backup_dir":   filepath.Join("state", defaultBackupDir),
+		"history_file": workspaceHistoryFile,
+	})
+	startRun("apply", fs, *historyFile)
+
+	if *wordField == "" {
+		fatalf("must supply --word_field")
+	}
+	if *definitionField == "" {
+		fatalf("must supply --definition_field")
+	}
+
+	export, err := loadCSVExport(*csvName)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if len(export.Transforms) > 0 {
+		fatalf("%s was exported with %s, which changed its Word and Definition cells from the note fields; applying it would write those changes to Anki. Export again without them to edit the fields", *csvName, strings.Join(export.Transforms, ", "))
+	}
+	rows, err := readNoteRows(*csvName)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if len(rows) == 0 {
+		fatalf("CSV contains no rows")
+	}
+
+	client := newAnkiClient()
+
+	ids := make([]int64, 0, len(rows))
+	for id := range rows {
+		ids = append(ids, id)
+	}
+	notes := fetchNotesByID(client, ids)
+
+	// Compare the CSV against the notes currently stored in Anki
+	var changes []noteChange
+	var affected []ankiconnect.ResultNotesInfo
+	for _, n := range notes {
+		row := rows[n.NoteId]
+		desired := map[string]string{
+			*wordField:       row.word,
+			*definitionField: row.definition,
+		}
+		change := noteChange{noteID: n.NoteId, before: map[string]string{}, after: map[string]string{}}
+		for field, value := range desired {
+			current, found := n.Fields[field]
+			if !found {
+				fatalf("note %d does not contain field %s", n.NoteId, field)
+			}
+			if current.Value != value {
+				change.before[field] = current.Value
+				change.after[field] = value
+			}
+		}
+		if len(change.after) > 0 {
+			changes = append(changes, change)
+			affected = append(affected, n)
+		}
+		delete(rows, n.NoteId)
+	}
+	for id := range rows {
+		fmt.Printf("warning: note %d not found in Anki, skipping\n", id)
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("No changes to apply")
+		finishRun("ok")
+		return
+	}
+
+	// Diff preview
+	for _, c := range changes {
+		fmt.Printf("note %d:\n", c.noteID)
+		for field, value := range c.after {
+			fmt.Printf("  %s: %q -> %q\n", field, c.before[field], value)
+		}
+	}
+
+	recordCount("notes_changed", len(changes))
+	if *dryRun {
+		fmt.Printf("dry run: %d notes would be updated\n", len(changes))
+		finishRun("dry run")
+		return
+	}
+	if !*yes && !confirm(fmt.Sprintf("Apply changes to %d notes?", len(changes))) {
+		fmt.Println("Aborted")
+		finishRun("aborted")
+		return
+	}
+
+	saved, err := backupNotes(*backupDir, "apply", affected)
+	if err != nil {
+		fatalf("failed to back up notes before updating them: %v", err)
+	}
+	fmt.Printf("Backed up the notes to %s (undo with: rollback)\n", saved)
+	recordOutput(saved)
+
+	for _, c := range changes {
+		err := client.Notes.Update(ankiconnect.UpdateNote{
+			Id:     c.noteID,
+			Fields: ankiconnect.Fields(c.after),
+		})
+		if err != nil {
+			fatalf("failed to update note %d: %v", c.noteID, err)
+		}
+	}
+	fmt.Printf("Successfully updated %d notes\n", len(changes))
+	finishRun("ok")
+}
+
+// readNoteRows reads an exported CSV keyed by its NoteID column. A note with several cards
+// has a row for each; they must agree on its fields, since there is only one to write.
+func readNoteRows(name string) (map[int64]card, error) {
+	list, err := readCardRows(name)
+	if err != nil {
+		return nil, err
+	}
+	rows := map[int64]card{}
+	for _, c := range list {
+		if prev, found := rows[c.noteID]; found && (prev.word != c.word || prev.definition != c.definition) {
+			return nil, fmt.Errorf("CSV file %s has rows for note %d with different fields (%q / %q and %q / %q); edit every card of the note the same way", name, c.noteID, prev.word, prev.definition, c.word, c.definition)
+		}
+		rows[c.noteID] = c
+	}
+	return rows, nil
+}
+
+// readCardRows reads the rows of an exported CSV in order. It must have a NoteID column.
+func readCardRows(name string) ([]card, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CSV file %s: %v", name, err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV file %s: %v", name, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("CSV file %s is empty", name)
+	}
+
+	index := map[string]int{}
+	for i, h := range records[0] {
+		index[strings.TrimSpace(h)] = i
+	}
+	for _, h := range []string{"NoteID", "Word", "Definition"} {
+		if _, found := index[h]; !found {
+			return nil, fmt.Errorf("CSV file %s has no %s column (export with --metadata_columns note_id)", name, h)
+		}
+	}
+
+	export, err := loadCSVExport(name)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]card, 0, len(records)-1)
+	for line, r := range records[1:] {
+		id, err := strconv.ParseInt(r[index["NoteID"]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid note ID on row %d: %v", line+1, err)
+		}
+		rows = append(rows, card{
+			noteID:     id,
+			word:       export.cell(r[index["Word"]]),
+			definition: export.cell(r[index["Definition"]]),
+		})
+	}
+	return rows, nil
+}
+
+// fetchNotesByID retrieves note info in batches to keep queries a reasonable size.
+func fetchNotesByID(client *ankiconnect.Client, ids []int64) []ankiconnect.ResultNotesInfo {
+	const batchSize = 500
+
+	var notes []ankiconnect.ResultNotesInfo
+	for start := 0; start < len(ids); start += batchSize {
+		end := min(start+batchSize, len(ids))
+		parts := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			parts = append(parts, strconv.FormatInt(id, 10))
+		}
+		res := must(client.Notes.Get("nid:" + strings.Join(parts, ",")))
+		notes = append(notes, *res...)
+	}
+	return notes
+}
+
+// isTerminal reports whether f is an interactive terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// stdin reads the answers to questions, shared so piped answers aren't lost to a buffer.
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm asks a yes/no question on stdin.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Every output file is written to a temporary file next to its final name and renamed into
+// place once complete, so a crash or full disk never leaves a half-written file behind for
+// downstream tools to read.
+
+// atomicFile is an output file that only appears under its name once committed.
+type atomicFile struct {
+	*os.File
+	name string
+	perm os.FileMode
+	done bool
+}
+
+// createAtomic starts writing name. Call commit when the contents are complete, and defer
+// abort to clean up after errors.
+func createAtomic(name string, perm os.FileMode) (*atomicFile, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: tmp, name: name, perm: perm}, nil
+}
+
+// commit flushes the file to disk and renames it into place.
+func (f *atomicFile) commit() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	defer os.Remove(f.File.Name())
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.File.Name(), f.perm); err != nil {
+		return err
+	}
+	return os.Rename(f.File.Name(), f.name)
+}
+
+// abort discards the file unless it was committed.
+func (f *atomicFile) abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.Close()
+	os.Remove(f.File.Name())
+}
+
+// writeFileAtomic writes data to a temporary file next to name and renames it into place.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := createAtomic(name, perm)
+	if err != nil {
+		return err
+	}
+	defer f.abort()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.commit()
+}
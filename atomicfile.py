@@ -0,0 +1,70 @@
+"""
+Atomic file output shared by audio_sourcer.py and concatenator.py.
+
+Every output is written to a temporary file next to its final name and renamed into place
+once complete, so a crash or full disk never leaves a half-written file behind.
+"""
+import os
+import tempfile
+from contextlib import contextmanager
+
+
+def _tempPath(filename):
+    directory = os.path.dirname(os.path.abspath(filename))
+    name, extension = os.path.splitext(os.path.basename(filename))
+    # Keep the extension so tools that pick a format from the file name still work
+    fd, tmp = tempfile.mkstemp(prefix='.' + name + '.tmp', suffix=extension, dir=directory)
+    os.close(fd)
+    return tmp
+
+
+def _commit(tmp, filename):
+    with open(tmp, 'rb+') as f:
+        os.fsync(f.fileno())
+    # mkstemp creates files readable only by the owner, give them the usual permissions
+    umask = os.umask(0)
+    os.umask(umask)
+    os.chmod(tmp, 0o666 & ~umask)
+    os.replace(tmp, filename)
+
+
+def writeFileAtomic(filename, data):
+    """
+    Writes bytes or text to a temporary file next to filename and renames it into place.
+    """
+    with atomicOutput(filename) as tmp:
+        mode = 'wb' if isinstance(data, (bytes, bytearray)) else 'w'
+        with open(tmp, mode, **({} if mode == 'wb' else {'encoding': 'utf-8'})) as f:
+            f.write(data)
+
+
+@contextmanager
+def atomicOutput(filename):
+    """
+    Yields a temporary path to write filename's contents to. The file is renamed into place
+    when the block completes and removed if it raises.
+    """
+    tmp = _tempPath(filename)
+    try:
+        yield tmp
+        _commit(tmp, filename)
+    finally:
+        if os.path.exists(tmp):
+            os.remove(tmp)
+
+
+def produceAtomic(filename, produce):
+    """
+    Calls produce(tmp) to write filename. A False result means nothing was produced, in which
+    case filename is left untouched and False is returned.
+    """
+    tmp = _tempPath(filename)
+    try:
+        result = produce(tmp)
+        if result is False:
+            return False
+        _commit(tmp, filename)
+        return result
+    finally:
+        if os.path.exists(tmp):
+            os.remove(tmp)
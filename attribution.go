@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+)
+
+// Decks shared by the community often ask to be credited, and under a license. With
+// --attribution and --license, or attribution:: and license:: tags on the notes such as
+// license::CC-BY-SA-4.0 or attribution::Refold_JP1K (underscores read as spaces), the credit
+// travels with what is exported: into the EPUB's metadata, and with the same flags of
+// concatenator.py and `site`, into lesson tags, the podcast feed and the player page.
+
+// tagCredits returns the attribution and license the tags of cards give, each value once in
+// the order they first appear.
+func tagCredits(cards []card) (attribution, license string) {
+	found := map[string][]string{}
+	seen := map[string]bool{}
+	for _, c := range cards {
+		for _, tag := range c.tags {
+			kind, value, ok := strings.Cut(tag, "::")
+			kind = strings.ToLower(kind)
+			if !ok || value == "" || kind != "attribution" && kind != "license" {
+				continue
+			}
+			value = strings.ReplaceAll(value, "_", " ")
+			if !seen[kind+"\x00"+value] {
+				seen[kind+"\x00"+value] = true
+				found[kind] = append(found[kind], value)
+			}
+		}
+	}
+	return strings.Join(found["attribution"], "; "), strings.Join(found["license"], "; ")
+}
+
+// creditLine returns the attribution and license as one line, e.g.
+// "JP1K by Refold. License: CC BY-SA 4.0", or "" without either.
+func creditLine(attribution, license string) string {
+	var parts []string
+	if attribution = strings.TrimSpace(attribution); attribution != "" {
+		parts = append(parts, strings.TrimSuffix(attribution, "."))
+	}
+	if license = strings.TrimSpace(license); license != "" {
+		parts = append(parts, "License: "+license)
+	}
+	return strings.Join(parts, ". ")
+}
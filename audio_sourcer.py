@@ -1,10 +1,16 @@
 import os
+import re
 import sys
 import csv
 import json
+import time
+import hashlib
 import argparse
+import html
 import requests
+import xml.etree.ElementTree as ET
 from enum import Enum
+from xml.sax.saxutils import escape, quoteattr
 
 from elevenlabs import save
 from elevenlabs.client import ElevenLabs
@@ -12,8 +18,234 @@ from elevenlabs.client import VoiceSettings
 
 import google.cloud.texttospeech as tts
 
+from atomicfile import writeFileAtomic, produceAtomic
+from workspace import RunWorkspace, saveDebug, safeName, addWorkspaceArgument, useWorkspace
+from tagphrases import loadTagPhrases, tagPhraseFor, tagPhraseFile
+from progressclips import progressWords, numberClipFile, wordClipFile
+from spokentemplates import templateTexts, templateClipFile
+from validation import ValidationReport, isSet, didYouMean
+from bandwidth import TransferLimits
+from spreadsheetcells import isSpreadsheetSafe, unescapeRow
 
-def downloadJapanesePronunciation_forvo(APIKey, word, filename):
+
+def defaultCacheDir():
+    """
+    Returns the per-user cache location shared with anki_downloader.
+    """
+    if sys.platform == 'win32':
+        base = os.environ.get('LOCALAPPDATA', os.path.expanduser('~'))
+    elif sys.platform == 'darwin':
+        base = os.path.expanduser('~/Library/Caches')
+    else:
+        base = os.environ.get('XDG_CACHE_HOME', os.path.expanduser('~/.cache'))
+    return os.path.join(base, 'commuter-flashcards')
+
+
+class MediaCache:
+    """
+    Content-addressed download cache, safe to share between concurrent runs.
+
+    Layout (shared with anki_downloader):
+    - objects/ab/abcdef...  file contents named by their sha256
+    - keys/0123...          object hash for a source key (named by sha256 of the key)
+    - locks/0123....lock    held while a key is being fetched
+
+    Keys name where a file came from, e.g. forvo:ja:入る, so they must name everything the file
+    depends on. anki_downloader's anki-media: keys name the Anki-Connect address and profile as
+    well as the file, since several collections can have files of the same name.
+    """
+    lock_timeout = 600
+    lock_stale = 1800
+
+    def __init__(self, root):
+        self.root = root
+        for sub in ('objects', 'keys', 'locks'):
+            os.makedirs(os.path.join(root, sub), exist_ok=True)
+
+    def _key_hash(self, key):
+        return hashlib.sha256(key.encode('utf-8')).hexdigest()
+
+    def _object_path(self, digest):
+        return os.path.join(self.root, 'objects', digest[:2], digest)
+
+    def get(self, key):
+        try:
+            with open(os.path.join(self.root, 'keys', self._key_hash(key)), 'r') as f:
+                digest = f.read().strip()
+            with open(self._object_path(digest), 'rb') as f:
+                data = f.read()
+        except OSError:
+            return None
+        if hashlib.sha256(data).hexdigest() != digest:
+            return None
+        return data
+
+    def put(self, key, data):
+        digest = hashlib.sha256(data).hexdigest()
+        obj = self._object_path(digest)
+        if not os.path.exists(obj):
+            os.makedirs(os.path.dirname(obj), exist_ok=True)
+            writeFileAtomic(obj, data)
+        writeFileAtomic(os.path.join(self.root, 'keys', self._key_hash(key)), digest.encode('ascii'))
+
+    def _lock(self, key):
+        path = os.path.join(self.root, 'locks', self._key_hash(key) + '.lock')
+        deadline = time.time() + self.lock_timeout
+        while True:
+            try:
+                fd = os.open(path, os.O_CREAT | os.O_EXCL | os.O_WRONLY)
+            except FileExistsError:
+                try:
+                    if time.time() - os.path.getmtime(path) > self.lock_stale:
+                        with open(path, 'rb') as f:
+                            self._remove_lock(path, f.read())
+                        continue
+                except OSError:
+                    continue
+                if time.time() > deadline:
+                    raise TimeoutError(f"timed out waiting for cache lock {path}")
+                time.sleep(0.1)
+                continue
+            # The nonce tells this lock from one taken after it was broken as stale
+            owner = f"{os.getpid()} {os.urandom(8).hex()}\n".encode('ascii')
+            try:
+                os.write(fd, owner)
+            finally:
+                os.close(fd)
+            return path, owner
+
+    @staticmethod
+    def _remove_lock(path, owner):
+        """
+        Removes the lock file at path if it still holds owner, the contents it was found or
+        written with. It's moved aside first, so of several runs breaking the same stale lock
+        only one does, and a lock another run took since is put back.
+        """
+        aside = f"{path}.{os.getpid()}.{time.time_ns()}"
+        try:
+            os.rename(path, aside)
+        except OSError:
+            return
+        try:
+            with open(aside, 'rb') as f:
+                taken = f.read() != owner
+            if taken:
+                # Fails if yet another run took the lock in the meantime, which then keeps it
+                os.link(aside, path)
+        except OSError:
+            pass
+        os.remove(aside)
+
+    def fetch(self, key, filename, download):
+        """
+        Copies the cached file for key to filename, or calls download(filename) and caches the result.
+        download returns False when nothing was found, which is not cached.
+        """
+        data = self.get(key)
+        if data is None:
+            lock, owner = self._lock(key)
+            try:
+                data = self.get(key)
+                if data is None:
+                    if produceAtomic(filename, download) is False:
+                        return False
+                    with open(filename, 'rb') as f:
+                        self.put(key, f.read())
+                    return True
+            finally:
+                # Our lock may have been broken as stale, leaving another run's in its place
+                self._remove_lock(lock, owner)
+        writeFileAtomic(filename, data)
+        return True
+
+
+# The --bwlimit and --transfer_window every download keeps to
+transferLimits = TransferLimits()
+
+
+def cachedDownload(cache, key, filename, download):
+    """
+    Runs download(filename) through the cache when one is configured, keeping to the
+    transferLimits. Cached files aren't downloaded, so they don't wait.
+    """
+    limited = lambda f: transferLimits.transfer(download, f)
+    if cache is None:
+        return produceAtomic(filename, limited)
+    return cache.fetch(key, filename, limited)
+
+
+class Lexicon:
+    """
+    User pronunciations for words TTS voices get wrong, e.g. names and jargon.
+
+    Entries either give a phoneme string (spoken with an SSML <phoneme> tag) or an alias
+    (text spoken instead of the word). Lexicons can be W3C PLS files or plain text files
+    with one "word=phoneme" per line, where "#" starts a comment.
+    """
+    def __init__(self):
+        self.entries = {}
+
+    def load(self, filename, alphabet='ipa'):
+        with open(filename, 'r', encoding='utf-8') as f:
+            content = f.read()
+        if content.lstrip().startswith('<'):
+            self._loadPLS(content)
+        else:
+            for number, line in enumerate(content.splitlines(), 1):
+                line = line.split('#', 1)[0].strip()
+                if not line:
+                    continue
+                if '=' not in line:
+                    raise ValueError(f"{filename}:{number}: expected word=phoneme")
+                word, phoneme = (part.strip() for part in line.split('=', 1))
+                self.entries[word.lower()] = ('phoneme', phoneme, alphabet)
+
+    def _loadPLS(self, content):
+        root = ET.fromstring(content)
+        ns = {'pls': 'http://www.w3.org/2005/01/pronunciation-lexicon'}
+        alphabet = root.get('alphabet', 'ipa')
+        for lexeme in root.findall('pls:lexeme', ns):
+            graphemes = [g.text.strip() for g in lexeme.findall('pls:grapheme', ns) if g.text]
+            phoneme = lexeme.find('pls:phoneme', ns)
+            alias = lexeme.find('pls:alias', ns)
+            if phoneme is not None and phoneme.text:
+                entry = ('phoneme', phoneme.text.strip(), phoneme.get('alphabet', alphabet))
+            elif alias is not None and alias.text:
+                entry = ('alias', alias.text.strip(), None)
+            else:
+                continue
+            for grapheme in graphemes:
+                self.entries[grapheme.lower()] = entry
+
+    def apply(self, text, xml=True):
+        """
+        Returns text as SSML with lexicon pronunciations applied, or None if no entry matched.
+        With xml=False the rest of the text is left unescaped, for ElevenLabs which only reads the tags.
+        """
+        if not self.entries:
+            return None
+        esc = escape if xml else (lambda t: t)
+        words = sorted(self.entries, key=len, reverse=True)
+        pattern = re.compile(r'(?<!\w)(' + '|'.join(re.escape(w) for w in words) + r')(?!\w)', re.IGNORECASE)
+        matched = False
+        out = []
+        last = 0
+        for m in pattern.finditer(text):
+            kind, value, alphabet = self.entries[m.group(1).lower()]
+            out.append(esc(text[last:m.start()]))
+            if kind == 'phoneme':
+                out.append(f'<phoneme alphabet={quoteattr(alphabet)} ph={quoteattr(value)}>{esc(m.group(1))}</phoneme>')
+            else:
+                out.append(esc(value))
+            last = m.end()
+            matched = True
+        if not matched:
+            return None
+        out.append(esc(text[last:]))
+        return ''.join(out)
+
+
+def downloadJapanesePronunciation_forvo(APIKey, word, filename, speaker_index=0, language='ja'):
     """
     Downloads a pronunciation recording from Forvo for a given Japanese word.
 
@@ -21,6 +253,8 @@ def downloadJapanesePronunciation_forvo(APIKey, word, filename):
     - APIKey (str): Forvo API key.
     - word (str): The Japanese word to download the pronunciation for.
     - filename (str): The file path to save the downloaded MP3.
+    - speaker_index (int): Which of the returned pronunciations to use (default 0).
+    - language (str): Forvo language code of the word (default 'ja').
 
     Returns:
     - True if the download was successful, False otherwise.
@@ -29,12 +263,13 @@ def downloadJapanesePronunciation_forvo(APIKey, word, filename):
     base_url = 'https://apifree.forvo.com/key/{key}/format/json/action/word-pronunciations/word/{word}/language/{language}'
 
     # Construct the request URL
-    url = base_url.format(key=APIKey, word=word, language='ja')
+    url = base_url.format(key=APIKey, word=word, language=language)
 
     # Make the API request
     response = requests.get(url)
     response.raise_for_status()
 
+    saveDebug(f"responses/forvo_{language}_{safeName(word)}.json", response.text)
     data = response.json()
 
     # Check for API errors
@@ -42,9 +277,8 @@ def downloadJapanesePronunciation_forvo(APIKey, word, filename):
         print(f"API error: {data['error']}")
         return False
 
-    if 'items' in data and len(data['items']) > 0:
-        # Get the first pronunciation URL
-        pronunciation_url = data['items'][0]['pathmp3']
+    if 'items' in data and len(data['items']) > speaker_index:
+        pronunciation_url = data['items'][speaker_index]['pathmp3']
 
         # Download the pronunciation file
         audio_response = requests.get(pronunciation_url)
@@ -56,18 +290,26 @@ def downloadJapanesePronunciation_forvo(APIKey, word, filename):
         print(f"Pronunciation saved to {filename}")
         return True
     else:
-        print(f"No pronunciations found for '{word}' in language 'ja'")
+        print(f"No pronunciation #{speaker_index + 1} found for '{word}' in language '{language}'")
         return False
     
 
-def downloadEnglish_elevenLabs(APIKey, definition, fileName):
+elevenLabsVoice = "Brian"
+elevenLabsModel = "eleven_turbo_v2"
+
+def downloadEnglish_elevenLabs(APIKey, definition, fileName, voice=elevenLabsVoice, model=elevenLabsModel,
+                               stability=1.0, similarity=0.0):
     """
     Downloads an english TTS generation from ElevenLabs
 
     Parameters:
     - APIKey (str): ElevenLabs API key.
-    - definition (str): The English definition text to synthesize.
+    - definition (str): The English definition text to synthesize. May contain SSML <phoneme> and <break> tags.
     - fileName (str): The file path to save the generated MP3.
+    - voice (str): Name or ID of the voice, e.g. a voice cloned from your own recordings (default "Brian").
+    - model (str): ElevenLabs model to synthesize with (default "eleven_turbo_v2").
+    - stability, similarity (float): Voice settings between 0 and 1. A cloned voice usually needs a
+      high similarity to sound like its recordings.
     """
     # short scentences sometimes causes elevelabs voices to add gibberish.
     # Adding a period and a pause seems to increase stability.
@@ -79,9 +321,9 @@ def downloadEnglish_elevenLabs(APIKey, definition, fileName):
 
     audio = client.generate(
         text=definition,
-        voice="Brian",
-        model="eleven_turbo_v2",
-        voice_settings=VoiceSettings(stability=1.0, similarity_boost=0.0)
+        voice=voice,
+        model=model,
+        voice_settings=VoiceSettings(stability=stability, similarity_boost=similarity)
     )
     save(audio, fileName)
 
@@ -91,7 +333,31 @@ googleTTS_ja_female = "ja-JP-Neural2-B"
 googleTTS_en_male   = "en-US-Neural2-A"
 googleTTS_en_female = "en-US-Neural2-C"
 
-def downloadVoice_GoogleTTS(voice_name, text, filename):
+# Default (female, male) GoogleTTS voices by language, for cards whose language
+# doesn't match --word_voice
+googleTTS_voices = {
+    'ja': (googleTTS_ja_female, googleTTS_ja_male),
+    'en': (googleTTS_en_female, googleTTS_en_male),
+    'ko': ("ko-KR-Neural2-A", "ko-KR-Neural2-C"),
+    'zh': ("cmn-CN-Wavenet-A", "cmn-CN-Wavenet-B"),
+    'es': ("es-ES-Neural2-A", "es-ES-Neural2-B"),
+    'fr': ("fr-FR-Neural2-A", "fr-FR-Neural2-B"),
+    'de': ("de-DE-Neural2-A", "de-DE-Neural2-B"),
+}
+
+def voiceForLanguage(language, voice, variant=False):
+    """
+    Returns voice if it speaks language, otherwise the default voice for language.
+    The language is the one resolved by anki_downloader for each note (the CSV "Language" column).
+    """
+    base = language.split('-')[0].lower()
+    if voice.split('-')[0].lower() == base:
+        return voice
+    if base not in googleTTS_voices:
+        raise ValueError(f"no GoogleTTS voice known for language '{language}'. Set --word_voice to a voice for it")
+    return googleTTS_voices[base][1 if variant else 0]
+
+def downloadVoice_GoogleTTS(voice_name, text, filename, ssml=False):
     """
     Downloads a TTS generation from the Google Cloud Text-to-Speech API
 
@@ -99,10 +365,14 @@ def downloadVoice_GoogleTTS(voice_name, text, filename):
     - voice_name (str): The specific TTS voice name to use.
     - text (str): The text to synthesize into speech.
     - filename (str): The file path to save the generated MP3.
+    - ssml (bool): Whether text is an SSML fragment, e.g. with lexicon <phoneme> tags (default False).
     """
 
     language_code = "-".join(voice_name.split("-")[:2])
-    text_input = tts.SynthesisInput(text=text)
+    if ssml:
+        text_input = tts.SynthesisInput(ssml=f"<speak>{text}</speak>")
+    else:
+        text_input = tts.SynthesisInput(text=text)
     voice_params = tts.VoiceSelectionParams(
         language_code=language_code, name=voice_name
     )
@@ -119,26 +389,209 @@ def downloadVoice_GoogleTTS(voice_name, text, filename):
     with open(filename, "wb") as out:
         out.write(response.audio_content)
 
+def downloadVoice_Stub(text, filename):
+    """
+    Writes a quiet tone about as long as reading text would take, standing in for a voice so
+    the pipeline can run without API keys or a network connection ("anki_downloader selftest").
+    """
+    from pydub.generators import Sine
+    duration = min(300 + 60 * len(text), 4000)
+    Sine(440).to_audio_segment(duration=duration, volume=-30.0).export(filename, format="mp3")
+
+# Sense numbering such as "1. to enter 2. to join", "(1) ...", "1) ..." or "① ... ②"
+_senseMarker = re.compile(r'(?:^|(?<=\s))(?:\(\d{1,2}\)|\d{1,2}[.)](?!\d))\s*|[\u2460-\u2473]\s*')
+_numberWords = ["one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten"]
+
+def splitSenses(definition):
+    """
+    Splits a definition with numbered senses into a list of senses.
+    Definitions without numbering are a single sense.
+    """
+    markers = list(_senseMarker.finditer(definition))
+    if len(markers) < 2:
+        return [definition]
+    senses = []
+    for m, next_m in zip(markers, markers[1:] + [None]):
+        sense = definition[m.end():next_m.start() if next_m else len(definition)].strip(" \t;,")
+        if sense:
+            senses.append(sense)
+    return senses or [definition]
+
+def parseSenseSpec(spec):
+    """
+    Parses a sense reading spec: a count or "all", optionally followed by ":announce"
+    or ":quiet", e.g. "1", "all:announce". Returns (count or None for all, announce or None).
+    """
+    count, _, announce = spec.partition(':')
+    if count.strip().lower() == 'all':
+        limit = None
+    else:
+        limit = int(count)
+        if limit < 1:
+            raise ValueError(f"sense count must be at least 1 in \"{spec}\"")
+    if announce not in ('', 'announce', 'quiet'):
+        raise ValueError(f"expected \"announce\" or \"quiet\" in \"{spec}\"")
+    return limit, {'announce': True, 'quiet': False}.get(announce)
+
+def senseSpecForCard(card, default, tag_specs):
+    """
+    Returns the (count, announce) to read a card with. The first --tag_senses entry that
+    matches one of the card's tags, or a parent tag (e.g. "medical" for "medical::cardio"),
+    overrides the global --senses spec. Settings the override leaves out are inherited.
+    """
+    limit, announce = default
+    for tag, (tag_limit, tag_announce) in tag_specs:
+        if any(t.lower() == tag or t.lower().startswith(tag + '::') for t in card.tags):
+            limit = tag_limit
+            if tag_announce is not None:
+                announce = tag_announce
+            break
+    return limit, bool(announce)
+
+def definitionReading(definition, limit, announce):
+    """
+    Returns the text to read for a definition with the chosen senses.
+    """
+    senses = splitSenses(definition)
+    if len(senses) == 1:
+        return definition
+    if limit is not None:
+        senses = senses[:limit]
+    if announce and len(senses) > 1:
+        senses = [f"{_numberWords[i] if i < len(_numberWords) else i + 1}: {sense}" for i, sense in enumerate(senses)]
+    return ". ".join(sense.rstrip('.') for sense in senses)
+
+# Images left in a field, as HTML or as anki_downloader's --image_policy markers
+_imageMarker = re.compile(r'<img\b[^>]*>|\[image(?::[^\]]*)?\]', re.IGNORECASE)
+
+# HTML left in fields exported without --strip_html: elements that end a line, scripts and
+# styles whose content isn't text, and any other tag
+_htmlBlock = re.compile(r'<(?:br|div|p|li|tr|h[1-6])\b[^>]*>', re.IGNORECASE)
+_htmlHidden = re.compile(r'<(script|style)\b.*?</\1\s*>|<!--.*?-->', re.IGNORECASE | re.DOTALL)
+_htmlTag = re.compile(r'</?[a-zA-Z][^<>]*>')
+
+def spokenText(text):
+    """
+    Removes images and HTML markup from text to be spoken, so TTS never reads out tags,
+    entities or file paths. Line breaks stay line breaks.
+    """
+    text = _htmlHidden.sub('', _imageMarker.sub('', text))
+    text = html.unescape(_htmlTag.sub('', _htmlBlock.sub('\n', text)))
+    text = re.sub(r'[ \t\u00a0]+', ' ', text)
+    return re.sub(r'\s*\n\s*', '\n', text).strip()
+
+# How each language's words are synthesized: from the Reading column "always", only when the
+# word is written with kanji/hanzi ("kanji"), or "never", e.g. "ja=kanji,zh=always,*=never"
+readingModes = ('always', 'kanji', 'never')
+
+_furigana = re.compile(r'\s?([^\s\[\]]+)\[([^\]]*)\]')
+_han = re.compile(r'[\u3400-\u4dbf\u4e00-\u9fff\uf900-\ufaff々]')
+
+def readingText(reading):
+    """
+    Returns the kana of a reading, which may be written as Anki furigana, e.g. 日本[にほん]語[ご].
+    """
+    return re.sub(r'\s{2,}', ' ', _furigana.sub(lambda m: m.group(2), reading)).strip()
+
+def parseReadingRules(spec):
+    """
+    Parses --reading_rules into {language: mode}, "*" standing for every other language.
+    """
+    rules = {}
+    for rule in spec.split(','):
+        if not rule.strip():
+            continue
+        language, sep, mode = rule.partition('=')
+        language, mode = language.strip().lower(), mode.strip().lower()
+        if not sep or not language:
+            raise ValueError(f"reading rule \"{rule.strip()}\" must be LANGUAGE=MODE, e.g. ja=kanji")
+        if mode not in readingModes:
+            raise ValueError(f"unknown reading mode \"{mode}\" for {language}, expected one of {', '.join(readingModes)}")
+        rules[language.split('-')[0]] = mode
+    return rules
+
+def wordSpeech(card, language, rules):
+    """
+    Returns the text TTS reads for a card's word: its reading where the rules for its
+    language say so, since kanji alone are often ambiguous, otherwise the word as written.
+    """
+    mode = rules.get(language.split('-')[0].lower(), rules.get('*', 'never'))
+    if not card.reading or mode == 'never' or (mode == 'kanji' and not _han.search(card.word)):
+        return card.word
+    return card.reading
+
+# Pauses card authors write into fields, e.g. "to give {{pause:2s}} or hand over" or 500ms
+_pauseToken = re.compile(r'\{\{\s*pause\s*:\s*(\d+(?:\.\d+)?)\s*(ms|s)?\s*\}\}', re.IGNORECASE)
+_ellipsis = re.compile(r'\s*(?:…|\.\.\.)\s*')
+
+# The longest break each voice will read, in milliseconds
+maxPause = {'GoogleTTS': 10000, 'ElevenLabs': 3000}
+
+def splitPauses(text, ellipsisPause=0):
+    """
+    Splits text into ('text', text) and ('pause', milliseconds) parts at {{pause:...}}
+    markers, and at ellipses when ellipsisPause is set.
+    """
+    parts = []
+    last = 0
+    for m in _pauseToken.finditer(text):
+        parts.append(('text', text[last:m.start()]))
+        parts.append(('pause', int(float(m.group(1)) * (1 if (m.group(2) or 's').lower() == 'ms' else 1000))))
+        last = m.end()
+    parts.append(('text', text[last:]))
+    if ellipsisPause:
+        split = []
+        for kind, value in parts:
+            if kind == 'text':
+                pieces = _ellipsis.split(value)
+                for i, piece in enumerate(pieces):
+                    if i > 0:
+                        split.append(('pause', ellipsisPause))
+                    split.append(('text', piece))
+            else:
+                split.append((kind, value))
+        parts = split
+    return [(kind, value) for kind, value in parts if kind == 'pause' or value.strip()]
+
+def malformedPauses(text):
+    """
+    Returns the pause markers in text that aren't understood and would be read out.
+    """
+    return [m for m in re.findall(r'\{\{\s*pause\b[^}]*\}\}', text, re.IGNORECASE) if not _pauseToken.fullmatch(m)]
+
 def loadCards(cardsFile):
     cards = []
+    safe = isSpreadsheetSafe(cardsFile)
     with open(cardsFile, 'r', encoding='utf-8', errors='replace') as csvfile:
         reader = csv.DictReader(csvfile)
         for row in reader:
-            card = Card(word=row['Word'], definition=row['Definition'])
+            row = unescapeRow(row, safe)
+            card = Card(word=spokenText(row['Word']), definition=spokenText(row['Definition']), language=row.get('Language') or None,
+                        tags=(row.get('Tags') or '').split(), reading=readingText(spokenText(row.get('Reading') or '')) or None)
+            # Anki_downloader keeps a card's number from export to export, so its clips keep their names
+            number = (row.get('Number') or '').strip()
+            card.number = int(number) if number.isdigit() else None
             cards.append(card)
     return cards
 
 class Card:
-    def __init__(self, word, definition):
+    def __init__(self, word, definition, language=None, tags=None, reading=None):
         self.word = word
         self.definition = definition
+        self.language = language
+        self.tags = tags or []
+        self.reading = reading
+        self.number = None
 
 class WordVoiceSource(Enum):
     Forvo = 1
     GoogleTTS = 2
+    Stub = 3
+
 class DefinitionVoiceSource(Enum):
     ElevenLabs = 1
     GoogleTTS = 2
+    Stub = 3
 
 if __name__ == '__main__':
 
@@ -156,139 +609,495 @@ if __name__ == '__main__':
     parser.add_argument('--download_definitions', action='store_true',
       help='Download definitions found in the csv (default False)')
     parser.add_argument('--word_source', type=str, default="Forvo",
-        help='Source for word pronunciations [Forvo, GoogleTTS] (default "Forvo")')
+        help='Source for word pronunciations [Forvo, GoogleTTS, Stub] (default "Forvo"). Stub writes tones, for testing')
     parser.add_argument('--definition_source', type=str, default="ElevenLabs",
-        help='Source for definition readings [ElevenLabs, GoogleTTS] (default "ElevenLabs")') 
+        help='Source for definition readings [ElevenLabs, GoogleTTS, Stub] (default "ElevenLabs"). Stub writes tones, for testing') 
+    parser.add_argument('--definition_voice', type=str, default=None,
+        help=f'Voice for definitions: an ElevenLabs voice name or the ID of a voice cloned in your ElevenLabs account (default "{elevenLabsVoice}"), or a GoogleTTS voice name (default "{googleTTS_en_male}")')
+    parser.add_argument('--voice_model', type=str, default=elevenLabsModel,
+        help=f'ElevenLabs model for definitions, e.g. "eleven_multilingual_v2" which reproduces cloned voices more closely (default "{elevenLabsModel}")')
+    parser.add_argument('--voice_stability', type=float, default=1.0,
+        help='ElevenLabs voice stability between 0 and 1, lower is more expressive (default 1.0)')
+    parser.add_argument('--voice_similarity', type=float, default=0.0,
+        help='ElevenLabs similarity boost between 0 and 1, how closely to match the voice\'s recordings. Use about 0.75 for a cloned voice (default 0.0)')
     parser.add_argument('--word_folder', type=str, default='words',
         help='Output directory for word audio files (default "words")')
     parser.add_argument('--definition_folder', type=str, default='definitions',
         help='Output directory for definition audio files (default "definitions")')
+    parser.add_argument('--word_voice', type=str, default=googleTTS_ja_female,
+        help=f'GoogleTTS voice used for words (default "{googleTTS_ja_female}")')
+    parser.add_argument('--word_variant_source', type=str, default=None,
+        help='Also download a second pronunciation of each word [Forvo, GoogleTTS] (optional)')
+    parser.add_argument('--word_variant_voice', type=str, default=googleTTS_ja_male,
+        help=f'GoogleTTS voice used for the word variant (default "{googleTTS_ja_male}")')
+    parser.add_argument('--word_variant_speaker', type=int, default=1,
+        help='Which Forvo pronunciation to use for the word variant, 0 being the first (default 1)')
+    parser.add_argument('--word_variant_folder', type=str, default='words_b',
+        help='Output directory for word variant audio files (default "words_b")')
+    parser.add_argument('--default_language', type=str, default='ja',
+        help='Language of words for CSV rows without a "Language" column value (default "ja")')
+    parser.add_argument('--reading_rules', type=str, default='ja=kanji',
+        help='When TTS reads a word from the CSV\'s Reading column (anki_downloader --reading_field) instead of as written, per language: "always", "kanji" when the word has kanji, or "never", with "*" for other languages (default "ja=kanji")')
+    parser.add_argument('--senses', type=str, default='all',
+        help='Which senses of numbered definitions to read: a count or "all", optionally with ":announce" to say the sense numbers, e.g. "1" or "all:announce" (default "all")')
+    parser.add_argument('--tag_senses', type=str, action='append', default=[],
+        help='Override --senses for cards with a tag, as TAG=SPEC, e.g. "medical=all:announce". Needs a CSV exported with --metadata_columns tags. May be given several times (optional)')
+    parser.add_argument('--lexicon', type=str, action='append', default=[],
+        help='Pronunciation lexicon for GoogleTTS and ElevenLabs, a PLS file or "word=phoneme" lines. May be given several times (optional)')
+    parser.add_argument('--ellipsis_pause', type=int, default=0,
+        help='Milliseconds of silence to read "..." and "…" in definitions as, 0 to leave them to the voice (default 0)')
+    parser.add_argument('--lexicon_alphabet', type=str, default='ipa',
+        help='Phonetic alphabet of "word=phoneme" lexicons, e.g. "ipa" or "cmu-arpabet" (default "ipa")')
+    parser.add_argument('--tag_phrases', type=str, default=None,
+        help='JSON file mapping tags to phrases announced before their cards, e.g. {"chemistry": "chemistry:"}. Needs a CSV exported with --metadata_columns tags (optional)')
+    parser.add_argument('--tag_folder', type=str, default='tags',
+        help='Output directory for tag phrase audio files (default "tags")')
+    parser.add_argument('--tag_voice', type=str, default=googleTTS_en_female,
+        help=f'GoogleTTS voice used for tag phrases (default "{googleTTS_en_female}")')
+    parser.add_argument('--download_numbers', type=int, default=0,
+        help='Synthesize the numbers 1 to N, and "of" and "percent", for concatenator.py progress announcements (optional)')
+    parser.add_argument('--number_folder', type=str, default='numbers',
+        help='Output directory for number audio files (default "numbers")')
+    parser.add_argument('--number_voice', type=str, default=googleTTS_en_female,
+        help=f'GoogleTTS voice used for numbers (default "{googleTTS_en_female}")')
+    parser.add_argument('--word_template', type=str, default=None,
+        help='Sentence to frame each word in, e.g. "What is ... {word}?". Synthesizes the text around the placeholders')
+    parser.add_argument('--definition_template', type=str, default=None,
+        help='Sentence to frame each definition in, e.g. "{word} means: {definition}"')
+    parser.add_argument('--confidence_prompt', type=str, default=None,
+        help='Question concatenator.py asks after each answer, e.g. "got it?". Synthesized with the template text')
+    parser.add_argument('--template_folder', type=str, default='templates',
+        help='Output folder for the template clips (default: templates)')
+    parser.add_argument('--template_voice', type=str, default=googleTTS_en_female,
+        help='GoogleTTS voice for the template text')
+    parser.add_argument('--temp_dir', type=str, default=None,
+        help='Where to create the per-run temp workspace for SSML payloads and raw API responses (default: system temp directory)')
+    parser.add_argument('--keep_temp', action='store_true',
+        help='Keep the temp workspace after a successful run, for debugging bad audio (default False)')
+    parser.add_argument('--cache_dir', type=str, default=defaultCacheDir(),
+        help='Shared cache directory for downloaded audio, empty string to disable (default: user cache directory)')
+    parser.add_argument('--bwlimit', type=str, default=None,
+        help='Most bytes per second to download on average, e.g. 500K or 2M (default: no limit)')
+    parser.add_argument('--transfer_window', type=str, default=None,
+        help='Time of day to download in, e.g. 02:00-06:00, waiting until it opens (default: any time)')
+    addWorkspaceArgument(parser)
     opt = parser.parse_args()
+    useWorkspace(parser, opt, {
+        'card_file': 'cards.csv',
+        'word_folder': os.path.join('audio', 'words'),
+        'definition_folder': os.path.join('audio', 'definitions'),
+        'word_variant_folder': os.path.join('audio', 'words_b'),
+        'tag_folder': os.path.join('audio', 'tags'),
+        'number_folder': os.path.join('audio', 'numbers'),
+        'template_folder': os.path.join('audio', 'templates'),
+        'cache_dir': 'cache',
+    })
+
+    # Check every setting before doing any work, reporting all problems at once
+    report = ValidationReport()
+    templatePieces = []
+    try:
+        templatePieces = templateTexts(opt.word_template, opt.definition_template)
+    except ValueError as e:
+        report.error(str(e))
+    if opt.confidence_prompt and opt.confidence_prompt.strip() not in templatePieces:
+        templatePieces.append(opt.confidence_prompt.strip())
 
-    if opt.download_words == False and opt.download_definitions == False:
-        print(f"nothing to do. Use --download_words and/or --download_definitions")
+    if opt.download_words == False and opt.download_definitions == False and not opt.tag_phrases and opt.download_numbers <= 0 and not templatePieces:
+        report.finish()
+        print(f"nothing to do. Use --download_words, --download_definitions, --tag_phrases, --download_numbers, --word_template/--definition_template and/or --confidence_prompt")
         sys.exit(0)
 
-      # Validate card file
+    # Validate card file
+    cards = []
     if os.path.exists(opt.card_file) == False:
-        print(f"error: {opt.card_file} not found")
-        sys.exit(1)
-
-    cards = loadCards(opt.card_file)
+        report.error(f"{opt.card_file} not found")
+    else:
+        cards = loadCards(opt.card_file)
+        if(opt.end_index == -1):
+            opt.end_index = len(cards)
+        if(opt.start_index < 0 or opt.start_index >= opt.end_index ):
+            report.error(f"start_index {opt.start_index} is out of range")
+        elif(opt.end_index <= 0 or opt.end_index > len(cards)):
+            report.error(f"end_index {opt.end_index} is out of range. CSV has {len(cards)} rows.")
+    rangeCards = cards[max(opt.start_index, 0):opt.end_index] if cards else []
 
-    if(opt.end_index == -1):
-        opt.end_index = len(cards)
+    # Determine word, word variant and definition sources
+    wordSources = {"forvo": WordVoiceSource.Forvo, "googletts": WordVoiceSource.GoogleTTS, "stub": WordVoiceSource.Stub}
+    wordSource = None
+    variantSource = None
+    if opt.download_words:
+        wordSource = wordSources.get(opt.word_source.lower())
+        if wordSource is None:
+            report.error(f"unknown word source \"{opt.word_source}\". must be \"Forvo\", \"GoogleTTS\" or \"Stub\"", opt.word_source, ["Forvo", "GoogleTTS", "Stub"])
+        if opt.word_variant_source:
+            variantSource = wordSources.get(opt.word_variant_source.lower())
+            if variantSource is None:
+                report.error(f"unknown word variant source \"{opt.word_variant_source}\". must be \"Forvo\", \"GoogleTTS\" or \"Stub\"", opt.word_variant_source, ["Forvo", "GoogleTTS", "Stub"])
+    definitionSource = None
+    if opt.download_definitions:
+        definitionSource = {"elevenlabs": DefinitionVoiceSource.ElevenLabs, "googletts": DefinitionVoiceSource.GoogleTTS,
+                            "stub": DefinitionVoiceSource.Stub}.get(opt.definition_source.lower())
+        if definitionSource is None:
+            report.error(f"unknown definition source \"{opt.definition_source}\". must be \"ElevenLabs\", \"GoogleTTS\" or \"Stub\"", opt.definition_source, ["ElevenLabs", "GoogleTTS", "Stub"])
 
-    if(opt.start_index < 0 or opt.start_index >= opt.end_index ):
-        print(f"error: start_index {opt.start_index} is out of range")
-        sys.exit(1)
+    # Voices must speak a language the cards use, and every language needs a voice
+    languages = {}
+    for card in rangeCards:
+        base = (card.language or opt.default_language).split('-')[0].lower()
+        languages[base] = languages.get(base, 0) + 1
+    for name, used in (('word_voice', wordSource == WordVoiceSource.GoogleTTS), ('word_variant_voice', variantSource == WordVoiceSource.GoogleTTS)):
+        voice = getattr(opt, name)
+        base = voice.split('-')[0].lower()
+        if used and isSet(parser, opt, name) and languages and base not in languages:
+            defaults = [googleTTS_voices[l][0] for l in languages if l in googleTTS_voices]
+            report.warning(f"--{name} {voice} speaks '{base}' but no card in the range does (cards are in {', '.join(sorted(languages))}), so it is never used",
+                           voice, defaults)
+    missingVoices = set()
+    for name, used in (('word_voice', wordSource == WordVoiceSource.GoogleTTS), ('word_variant_voice', variantSource == WordVoiceSource.GoogleTTS)):
+        for language, count in sorted(languages.items()):
+            if used and language not in googleTTS_voices and language != getattr(opt, name).split('-')[0].lower() and language not in missingVoices:
+                missingVoices.add(language)
+                report.error(f"no GoogleTTS voice known for language '{language}' used by {count} cards. Set --{name} to a voice for it",
+                             language, googleTTS_voices)
 
-    if(opt.end_index <= 0 or opt.end_index > len(cards)):
-        print(f"error: end_index {opt.start_index} is out of range. CSV has {len(cards)} rows.")
-        sys.exit(1)
+    # Readings stand in for words written with ambiguous characters
+    readingRules = {}
+    try:
+        readingRules = parseReadingRules(opt.reading_rules)
+    except ValueError as e:
+        report.error(f"--reading_rules: {e}")
+    ttsWords = wordSource in (WordVoiceSource.GoogleTTS, WordVoiceSource.Stub) or variantSource in (WordVoiceSource.GoogleTTS, WordVoiceSource.Stub)
+    if ttsWords and isSet(parser, opt, 'reading_rules') and rangeCards and not any(card.reading for card in rangeCards):
+        report.warning(f"--reading_rules has no effect, no card in the range has a reading. Export the CSV with --reading_field")
 
-    # Determine word source
-    wordSource = WordVoiceSource.Forvo
-    if opt.download_words:
-        if opt.word_source.lower() == "forvo":
-            wordSource = WordVoiceSource.Forvo
-        elif opt.word_source.lower() == "googletts":
-            wordSource = WordVoiceSource.GoogleTTS
-        else:
-            print(f"error: unkown word source \"{opt.word_source}\". must be \"Forvo\" or \"GoogleTTS\"")
-            sys.exit(1)
-    else:
-        wordSource = None  # Not used
+    try:
+        transferLimits = TransferLimits(opt.bwlimit, opt.transfer_window)
+    except ValueError as e:
+        report.error(str(e))
 
-    # Determine definition source
-    definitionSource = DefinitionVoiceSource.ElevenLabs
+    # Pause markers the voices can't read as written
+    if opt.ellipsis_pause < 0:
+        report.error("--ellipsis_pause cannot be negative")
     if opt.download_definitions:
-        if opt.definition_source.lower() == "elevenlabs":
-            definitionSource = DefinitionVoiceSource.ElevenLabs
-        elif opt.definition_source.lower() == "googletts":
-            definitionSource = DefinitionVoiceSource.GoogleTTS
-        else:
-            print(f"error: unkown word source \"{opt.definition_source}\". must be \"ElevenLabs\" or \"GoogleTTS\"")
-            sys.exit(1)
-    else:
-        definitionSource = None  # Not used
+        for card in rangeCards:
+            for marker in malformedPauses(card.definition):
+                report.warning(f"'{card.word}' has a pause marker {marker} that will be read out, write it like {{{{pause:2s}}}} or {{{{pause:500ms}}}}")
+            longest = max([value for kind, value in splitPauses(card.definition, opt.ellipsis_pause) if kind == 'pause'], default=0)
+            source = definitionSource.name if definitionSource else None
+            if source in maxPause and longest > maxPause[source]:
+                report.warning(f"'{card.word}' has a {longest / 1000:g}s pause, longer than the {maxPause[source] / 1000:g}s {source} can read, so it is shortened")
 
-    api_keys = None
-    if not os.path.exists(opt.API_key_file):
-        print(f"API key file {opt.API_key_file} not found.")
-        sys.exit(1)
-    with open(opt.API_key_file, 'r') as file:
-        api_keys = json.load(file)
+    # Settings that only matter together with another one
+    if not opt.word_variant_source:
+        for name in ('word_variant_voice', 'word_variant_speaker'):
+            report.unused(parser, opt, name, "--word_variant_source")
+    if wordSource != WordVoiceSource.GoogleTTS:
+        report.unused(parser, opt, 'word_voice', "--word_source GoogleTTS")
+    if not ttsWords:
+        report.unused(parser, opt, 'reading_rules', "--word_source or --word_variant_source GoogleTTS")
+    if not opt.download_definitions:
+        for name in ('definition_source', 'definition_voice', 'senses', 'tag_senses', 'ellipsis_pause'):
+            report.unused(parser, opt, name, "--download_definitions")
+    if definitionSource != DefinitionVoiceSource.ElevenLabs:
+        for name in ('voice_model', 'voice_stability', 'voice_similarity'):
+            report.unused(parser, opt, name, "--definition_source ElevenLabs")
+    if definitionSource == DefinitionVoiceSource.Stub:
+        report.unused(parser, opt, 'definition_voice', "--definition_source ElevenLabs or GoogleTTS")
+    for name in ('voice_stability', 'voice_similarity'):
+        if not 0 <= getattr(opt, name) <= 1:
+            report.error(f"--{name} must be between 0 and 1")
+    if definitionSource == DefinitionVoiceSource.GoogleTTS and opt.definition_voice and not re.match(r'^[a-z]{2,3}-[A-Za-z]{2,4}-', opt.definition_voice):
+        report.error(f"--definition_voice \"{opt.definition_voice}\" is not a GoogleTTS voice name such as {googleTTS_en_male}")
+    if not opt.tag_phrases:
+        report.unused(parser, opt, 'tag_voice', "--tag_phrases")
+    if opt.download_numbers <= 0:
+        report.unused(parser, opt, 'number_voice', "--download_numbers")
+    if not templatePieces:
+        report.unused(parser, opt, 'template_voice', "--word_template, --definition_template or --confidence_prompt")
+    if not opt.lexicon:
+        report.unused(parser, opt, 'lexicon_alphabet', "--lexicon")
+
+    # Clips whose service has no key are skipped with a warning, the others are still made
+    api_keys = {}
+    if os.path.exists(opt.API_key_file):
+        with open(opt.API_key_file, 'r') as file:
+            api_keys = json.load(file)
+
+    def missingKey(key):
+        """
+        Returns why the key of a service can't be used, or None if it can.
+        """
+        if key == "googleTTS" and 'GOOGLE_APPLICATION_CREDENTIALS' in os.environ:
+            return None
+        if not os.path.exists(opt.API_key_file):
+            return f"API key file {opt.API_key_file} not found"
+        if key not in api_keys:
+            return f"{opt.API_key_file} has no \"{key}\" key" + didYouMean(key, api_keys)
+        return None
+
+    keySources = {WordVoiceSource.Forvo: "Forvo", WordVoiceSource.GoogleTTS: "googleTTS",
+                  DefinitionVoiceSource.ElevenLabs: "ElevenLabs", DefinitionVoiceSource.GoogleTTS: "googleTTS"}
+    requested = opt.download_words or opt.download_definitions or opt.tag_phrases or opt.download_numbers > 0 or templatePieces
+    reason = missingKey(keySources.get(wordSource)) if wordSource in keySources else None
+    if opt.download_words and reason:
+        report.skip("word audio", reason)
+        opt.download_words, wordSource, variantSource = False, None, None
+    reason = missingKey(keySources.get(variantSource)) if variantSource in keySources else None
+    if reason:
+        report.skip("word variant audio", reason)
+        variantSource = None
+    reason = missingKey(keySources.get(definitionSource)) if definitionSource in keySources else None
+    if opt.download_definitions and reason:
+        report.skip("definition audio", reason)
+        opt.download_definitions, definitionSource = False, None
+    reason = missingKey("googleTTS")
+    if reason:
+        if opt.tag_phrases:
+            report.skip("tag phrases", reason)
+            opt.tag_phrases = None
+        if opt.download_numbers > 0:
+            report.skip("numbers", reason)
+            opt.download_numbers = 0
+        if templatePieces:
+            report.skip("template texts", reason)
+            templatePieces = []
+    if requested and report.skipped and not (opt.download_words or opt.download_definitions or opt.tag_phrases or
+                                             opt.download_numbers > 0 or templatePieces):
+        report.error("nothing left to do without the missing API keys")
+
+    # Tag phrases to announce, limited to the ones cards in the range use
+    tagPhrases = []
+    if opt.tag_phrases:
+        try:
+            tagPhrases = loadTagPhrases(opt.tag_phrases)
+        except (OSError, ValueError) as e:
+            report.error(f"failed to load tag phrases {opt.tag_phrases}: {e}")
+        used = {tagPhraseFor(card.tags, tagPhrases) for card in rangeCards}
+        tagPhrases = [phrase for _, phrase in tagPhrases if phrase in used]
+        tagPhrases = list(dict.fromkeys(tagPhrases))
+        if not tagPhrases and rangeCards:
+            report.warning(f"no cards in the range have a tag from {opt.tag_phrases}")
+
+    senseSpec = (None, None)
+    tagSenseSpecs = []
+    try:
+        senseSpec = parseSenseSpec(opt.senses)
+        for entry in opt.tag_senses:
+            tag, sep, spec = entry.partition('=')
+            if not sep or not tag:
+                raise ValueError(f"expected TAG=SPEC in \"{entry}\"")
+            tagSenseSpecs.append((tag.strip().lower(), parseSenseSpec(spec.strip())))
+    except ValueError as e:
+        report.error(f"invalid sense spec: {e}")
+    cardTags = {t.lower() for card in cards for t in card.tags}
+    for tag, _ in tagSenseSpecs:
+        if cards and not any(t == tag or t.startswith(tag + '::') for t in cardTags):
+            report.warning(f"tag \"{tag}\" in --tag_senses is not used by any card", tag, cardTags)
+
+    lexicon = Lexicon()
+    for lexicon_file in opt.lexicon:
+        try:
+            lexicon.load(lexicon_file, opt.lexicon_alphabet)
+        except (OSError, ValueError, ET.ParseError) as e:
+            report.error(f"failed to load lexicon {lexicon_file}: {e}")
+    report.finish()
 
     # Authenticate Google API if needed
-    if ((opt.download_words and wordSource == WordVoiceSource.GoogleTTS) or 
-        (opt.download_definitions and definitionSource == DefinitionVoiceSource.GoogleTTS)):
+    if ((opt.download_words and WordVoiceSource.GoogleTTS in (wordSource, variantSource)) or 
+        (opt.download_definitions and definitionSource == DefinitionVoiceSource.GoogleTTS) or tagPhrases or
+        opt.download_numbers > 0 or templatePieces):
         # Check if Google credintials are already set
         if 'GOOGLE_APPLICATION_CREDENTIALS' not in os.environ:
             os.environ['GOOGLE_APPLICATION_CREDENTIALS'] = api_keys["googleTTS"]
 
+    def speechMarkup(text, voiceSource, xml=True):
+        """
+        Returns text as SSML with lexicon pronunciations applied and the pauses written into it
+        as breaks, or None if it needs no markup.
+        """
+        parts = splitPauses(text, opt.ellipsis_pause)
+        if all(kind == 'text' for kind, _ in parts):
+            return lexicon.apply(text, xml)
+        esc = escape if xml else (lambda t: t)
+        out = []
+        for kind, value in parts:
+            if kind == 'pause':
+                out.append(f'<break time="{min(value, maxPause[voiceSource]) / 1000:g}s"/>')
+            else:
+                out.append(lexicon.apply(value, xml) or esc(value))
+        return ' '.join(out)
+
+    def googleTTS(voice, text, filename):
+        """
+        Synthesizes text with GoogleTTS through the cache, applying the lexicon and pauses.
+        """
+        ssml = speechMarkup(text, 'GoogleTTS')
+        saveDebug(f"payloads/{os.path.basename(filename)}.{'ssml' if ssml else 'txt'}", ssml or text)
+        if ssml is None:
+            return cachedDownload(cache, f"googletts:{voice}:{text}", filename,
+                lambda f: downloadVoice_GoogleTTS(voice, text, f))
+        return cachedDownload(cache, f"googletts:{voice}:ssml:{ssml}", filename,
+            lambda f: downloadVoice_GoogleTTS(voice, ssml, f, ssml=True))
+
+    cache = None
+    if opt.cache_dir:
+        try:
+            cache = MediaCache(opt.cache_dir)
+        except OSError as e:
+            print(f"warning: failed to open cache {opt.cache_dir}: {e}, continuing without cache")
+
     # Ensure output directories exist
     if opt.download_words:
         os.makedirs(opt.word_folder, exist_ok=True)
+    if variantSource is not None:
+        os.makedirs(opt.word_variant_folder, exist_ok=True)
     if opt.download_definitions:
         os.makedirs(opt.definition_folder, exist_ok=True)
+    if tagPhrases:
+        os.makedirs(opt.tag_folder, exist_ok=True)
+    if opt.download_numbers > 0:
+        os.makedirs(opt.number_folder, exist_ok=True)
+    if templatePieces:
+        os.makedirs(opt.template_folder, exist_ok=True)
 
-    # Process each card in the specified index range
-    for idx in range(opt.start_index, opt.end_index):
-        card = cards[idx]
-        padded_idx = str(idx).zfill(5)
-
-        # Download word pronunciation if requested
-        if opt.download_words:
-            word_file_name =  f"word_{padded_idx}.mp3"  
-            word_file_path = os.path.join(opt.word_folder, word_file_name)        
-
-            print(f"Downloading word audio for '{card.word}' to '{word_file_name}'")
+    # Definitions can be read in a voice of your own, e.g. one cloned from a teacher's recordings
+    if definitionSource == DefinitionVoiceSource.GoogleTTS:
+        definitionVoice = opt.definition_voice or googleTTS_en_male
+    else:
+        definitionVoice = opt.definition_voice or elevenLabsVoice
+    # Clips made with other voice settings are different clips
+    elevenLabsKey = f"{definitionVoice}:{opt.voice_model}"
+    if (opt.voice_stability, opt.voice_similarity) != (1.0, 0.0):
+        elevenLabsKey += f":{opt.voice_stability:g}:{opt.voice_similarity:g}"
 
-            if wordSource == WordVoiceSource.Forvo:
+    # Intermediates of this run are kept in a temp workspace
+    with RunWorkspace('audio_sourcer', opt.temp_dir, opt.keep_temp):
+        # Numbers and joining words for progress announcements
+        if opt.download_numbers > 0:
+            print(f"Downloading numbers 1 to {opt.download_numbers} to '{opt.number_folder}'")
+            clips = [(word, wordClipFile(word)) for word in progressWords]
+            clips += [(str(n), numberClipFile(n)) for n in range(1, opt.download_numbers + 1)]
+            for text, name in clips:
                 try:
-                     # Attempt to download from Forvo
-                    found = downloadJapanesePronunciation_forvo(api_keys["Forvo"], card.word, word_file_path)
-                    if not found:
-                        # Have not implemented a solution for this scenario yet.
-                        print(f"Error: No pronunciation found for '{card.word}'. Consider removing this row from the CSV.")
-                        sys.exit(1)     
+                    googleTTS(opt.number_voice, text, os.path.join(opt.number_folder, name))
                 except Exception as e:
-                    print(f"error downloading word audio for '{card.word}' at index {idx}: {e}")
+                    print(f"error downloading number audio for '{text}': {e}")
                     sys.exit(1)
 
-            elif wordSource == WordVoiceSource.GoogleTTS:
-                try:
-                    downloadVoice_GoogleTTS(googleTTS_ja_female, card.word, word_file_path)
-                except Exception as e:
-                    print(f"error downloading word audio for '{card.word}' at index {idx}: {e}")
-                    sys.exit(1)
+        # Synthesize each tag phrase once, cards share them
+        for phrase in tagPhrases:
+            tag_file_path = os.path.join(opt.tag_folder, tagPhraseFile(phrase))
+            print(f"Downloading tag phrase '{phrase}' to '{tag_file_path}'")
+            try:
+                googleTTS(opt.tag_voice, phrase, tag_file_path)
+            except Exception as e:
+                print(f"error downloading tag phrase '{phrase}': {e}")
+                sys.exit(1)
+
+        # The text of the templates is the same for every card
+        for text in templatePieces:
+            template_file_path = os.path.join(opt.template_folder, templateClipFile(text))
+            print(f"Downloading template text '{text}' to '{template_file_path}'")
+            try:
+                googleTTS(opt.template_voice, text, template_file_path)
+            except Exception as e:
+                print(f"error downloading template text '{text}': {e}")
+                sys.exit(1)
+
+        # Process each card in the specified index range
+        for idx in range(opt.start_index, opt.end_index):
+            card = cards[idx]
+            padded_idx = str(card.number if card.number is not None else idx).zfill(5)
+            language = card.language or opt.default_language
+            forvoLanguage = language.split('-')[0]
+            spokenWord = wordSpeech(card, language, readingRules)
+
+            # Download word pronunciation if requested
+            if opt.download_words:
+                word_file_name =  f"word_{padded_idx}.mp3"  
+                word_file_path = os.path.join(opt.word_folder, word_file_name)        
+
+                reading = f" (read as '{spokenWord}')" if spokenWord != card.word and wordSource != WordVoiceSource.Forvo else ""
+                print(f"Downloading word audio for '{card.word}'{reading} to '{word_file_name}'")
+
+                if wordSource == WordVoiceSource.Forvo:
+                    try:
+                         # Attempt to download from Forvo
+                        found = cachedDownload(cache, f"forvo:{forvoLanguage}:{card.word}", word_file_path,
+                            lambda f: downloadJapanesePronunciation_forvo(api_keys["Forvo"], card.word, f, language=forvoLanguage))
+                        if not found:
+                            # Have not implemented a solution for this scenario yet.
+                            print(f"Error: No pronunciation found for '{card.word}'. Consider removing this row from the CSV.")
+                            sys.exit(1)     
+                    except Exception as e:
+                        print(f"error downloading word audio for '{card.word}' at index {idx}: {e}")
+                        sys.exit(1)
+
+                elif wordSource == WordVoiceSource.GoogleTTS:
+                    try:
+                        googleTTS(voiceForLanguage(language, opt.word_voice), spokenWord, word_file_path)
+                    except Exception as e:
+                        print(f"error downloading word audio for '{card.word}' at index {idx}: {e}")
+                        sys.exit(1)
+
+                elif wordSource == WordVoiceSource.Stub:
+                    produceAtomic(word_file_path, lambda f: downloadVoice_Stub(spokenWord, f))
+
+                # Download the second pronunciation if requested
+                if variantSource is not None:
+                    variant_file_path = os.path.join(opt.word_variant_folder, word_file_name)
+                    print(f"Downloading word variant audio for '{card.word}' to '{variant_file_path}'")
+                    try:
+                        if variantSource == WordVoiceSource.Forvo:
+                            speaker = opt.word_variant_speaker
+                            found = cachedDownload(cache, f"forvo:{forvoLanguage}:{card.word}:{speaker}", variant_file_path,
+                                lambda f: downloadJapanesePronunciation_forvo(api_keys["Forvo"], card.word, f, speaker, forvoLanguage))
+                            if not found:
+                                print(f"Error: No second pronunciation found for '{card.word}'. Choose another --word_variant_source.")
+                                sys.exit(1)
+                        elif variantSource == WordVoiceSource.Stub:
+                            produceAtomic(variant_file_path, lambda f: downloadVoice_Stub(spokenWord, f))
+                        else:
+                            googleTTS(voiceForLanguage(language, opt.word_variant_voice, variant=True), spokenWord, variant_file_path)
+                    except Exception as e:
+                        print(f"error downloading word variant audio for '{card.word}' at index {idx}: {e}")
+                        sys.exit(1)
                     
-        # Download definition audio if requested
-        if opt.download_definitions:
+            # Download definition audio if requested
+            if opt.download_definitions:
 
-            definition_file_name = f"definition_{padded_idx}.mp3"
-            definition_file_path = os.path.join(opt.definition_folder, definition_file_name)
+                definition_file_name = f"definition_{padded_idx}.mp3"
+                definition_file_path = os.path.join(opt.definition_folder, definition_file_name)
 
-            print(f"Downloading definition audio for '{card.word}' to '{definition_file_name}'")
+                print(f"Downloading definition audio for '{card.word}' to '{definition_file_name}'")
+                definition = definitionReading(card.definition, *senseSpecForCard(card, senseSpec, tagSenseSpecs))
 
-            if definitionSource == DefinitionVoiceSource.ElevenLabs:
-                downloadAttempts = 4
-                while True:
+                if definitionSource == DefinitionVoiceSource.ElevenLabs:
+                    downloadAttempts = 4
+                    while True:
+                        try:
+                            # Make multiple attempts at this in case of "heavy traffic"
+                            text = speechMarkup(definition, 'ElevenLabs', xml=False) or definition
+                            saveDebug(f"payloads/{definition_file_name}.txt", text)
+                            cachedDownload(cache, f"elevenlabs:{elevenLabsKey}:{text}", definition_file_path,
+                                lambda f: downloadEnglish_elevenLabs(api_keys["ElevenLabs"], text, f, definitionVoice,
+                                                                     opt.voice_model, opt.voice_stability, opt.voice_similarity))
+                            break
+                        except Exception as e:
+                            downloadAttempts -= 1
+                            if downloadAttempts <= 0:
+                                print(f"error downloading definition audio for '{card.word}' at index {idx}: {e}")
+                                sys.exit(1)
+                elif definitionSource == DefinitionVoiceSource.GoogleTTS:
                     try:
-                        # Make multiple attempts at this in case of "heavy traffic"
-                        downloadEnglish_elevenLabs(api_keys["ElevenLabs"], card.definition, definition_file_path)
-                        break
+                        googleTTS(definitionVoice, definition, definition_file_path)
                     except Exception as e:
-                        downloadAttempts -= 1
-                        if downloadAttempts <= 0:
-                            print(f"error downloading definition audio for '{card.word}' at index {idx}: {e}")
-                            sys.exit(1)
-            elif definitionSource == DefinitionVoiceSource.GoogleTTS:
-                try:
-                    downloadVoice_GoogleTTS(googleTTS_en_male, card.definition, definition_file_path)
-                except Exception as e:
-                    print(f"error downloading definition audio for '{card.word}' at index {idx}: {e}")
-                    sys.exit(1)
+                        print(f"error downloading definition audio for '{card.word}' at index {idx}: {e}")
+                        sys.exit(1)
+                elif definitionSource == DefinitionVoiceSource.Stub:
+                    produceAtomic(definition_file_path, lambda f: downloadVoice_Stub(
+                        ' '.join(value for kind, value in splitPauses(definition) if kind == 'text'), f))
 
-    print(f"Audio sourcing complete! downloaded aduio for {(opt.end_index - opt.start_index)} rows")
\ No newline at end of file
+    print(f"Audio sourcing complete! downloaded aduio for {(opt.end_index - opt.start_index)} rows")
+    report.summary()
\ No newline at end of file
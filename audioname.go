@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/Michael-Manning/commuter-flashcards/pkg/ankiexport"
+)
+
+// audioNameData is what an --audio_name_template can use. The text fields are slugs, safe
+// in file names on every filesystem.
+type audioNameData struct {
+	// Index is the card's number, zero padded so the names sort in card order
+	Index   string
+	Word    string
+	Reading string
+	Deck    string
+	NoteID  int64
+}
+
+var doubleUnderscores = regexp.MustCompile(`__+`)
+
+// maxSlugLength is the most runes a field is shortened to in a file name, so long words or
+// sentences don't run into filesystem limits.
+const maxSlugLength = 40
+
+// audioNamer names the downloaded word clips. A nil audioNamer names them like
+// ankiexport.AudioFileName.
+type audioNamer struct {
+	tmpl  *template.Template
+	ascii bool
+	// width is how many digits Index is padded to
+	width int
+}
+
+// newAudioNamer parses an --audio_name_template, or returns nil for an empty one.
+func newAudioNamer(text string, ascii bool) (*audioNamer, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("audio_name_template").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --audio_name_template: %v", err)
+	}
+	n := &audioNamer{tmpl: tmpl, ascii: ascii, width: 4}
+	// Misspelled fields only show up when the template is run
+	if err := tmpl.Execute(new(strings.Builder), audioNameData{}); err != nil {
+		return nil, fmt.Errorf("invalid --audio_name_template: %v", err)
+	}
+	return n, nil
+}
+
+// padTo pads the index to sort in order up to count cards.
+func (n *audioNamer) padTo(count int) {
+	if n != nil {
+		n.width = max(len(fmt.Sprint(count-1)), 4)
+	}
+}
+
+// name returns the file name of the clip of c, by its number, before collisions are
+// resolved.
+func (n *audioNamer) name(c card) string {
+	i := c.number
+	if n == nil {
+		return ankiexport.AudioFileName(i)
+	}
+	word, _ := htmlToText(c.word)
+	var b strings.Builder
+	n.tmpl.Execute(&b, audioNameData{
+		Index:   fmt.Sprintf("%0*d", n.width, i),
+		Word:    slugify(word, c.language, n.ascii),
+		Reading: slugify(c.reading, c.language, n.ascii),
+		Deck:    slugify(strings.ReplaceAll(c.deck, "::", " "), "", n.ascii),
+		NoteID:  c.noteID,
+	})
+	// Fields without a slug, e.g. a Japanese word with ascii, would leave their separator
+	name := strings.Trim(doubleUnderscores.ReplaceAllString(sanitizeFileName(b.String()), "_"), "_")
+	if name == "" {
+		name = fmt.Sprintf("%0*d", n.width, i)
+	}
+	return name + ".mp3"
+}
+
+// names returns the file names of the clips of cards. Names that would be the same, also on
+// filesystems that ignore case, get a number. concatenator.py pairs the word clips with the
+// definitions in the order their names sort in, so they must sort in card order.
+func (n *audioNamer) names(cards []card) ([]string, error) {
+	names := make([]string, len(cards))
+	taken := map[string]bool{}
+	for i, c := range cards {
+		name := n.name(c)
+		base := strings.TrimSuffix(name, ".mp3")
+		for k := 2; taken[strings.ToLower(name)]; k++ {
+			name = fmt.Sprintf("%s_%d.mp3", base, k)
+		}
+		taken[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i] < names[i-1] {
+			return nil, fmt.Errorf("--audio_name_template names card %d %s, which sorts before card %d's %s. Start the template with {{.Index}} so the names sort in card order", i, names[i], i-1, names[i-1])
+		}
+	}
+	return names, nil
+}
+
+// slugify turns text into a part of a file name: case, width and accents folded, and
+// everything but letters and digits turned into single underscores. With ascii only ASCII
+// letters and digits are kept, for players that can't show other scripts.
+func slugify(text, language string, ascii bool) string {
+	var b strings.Builder
+	gap := false
+	for _, r := range normalizeWord(text, language) {
+		keep := unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-'
+		if ascii && r > unicode.MaxASCII {
+			keep = false
+		}
+		if !keep {
+			gap = b.Len() > 0
+			continue
+		}
+		if gap {
+			b.WriteRune('_')
+			gap = false
+		}
+		b.WriteRune(r)
+	}
+	slug := []rune(b.String())
+	if len(slug) > maxSlugLength {
+		slug = slug[:maxSlugLength]
+	}
+	return strings.TrimRight(string(slug), "_")
+}
+
+// sanitizeFileName replaces the characters Windows, macOS, Android or FAT32 SD cards don't
+// allow in file names, such as / from the template itself.
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	// Windows drops trailing dots and spaces
+	return strings.TrimRight(strings.TrimSpace(name), ".")
+}
+
+// strayClips returns how many .mp3 files in folder aren't one of names, left behind by
+// exports that named their clips differently.
+func strayClips(folder string, names []string) int {
+	want := map[string]bool{}
+	for _, name := range names {
+		want[name] = true
+	}
+	files, _ := filepath.Glob(filepath.Join(folder, "*.mp3"))
+	stray := 0
+	for _, f := range files {
+		if !want[filepath.Base(f)] {
+			stray++
+		}
+	}
+	return stray
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// Before a command writes to Anki it saves the current fields and tags of the notes it is
+// about to change to a backup file, and `rollback` restores them. Backups are named
+// <time>-<command>.json, and that name without .json is the backup's ID.
+const defaultBackupDir = "backups"
+
+type noteBackup struct {
+	NoteID int64             `json:"note_id"`
+	Model  string            `json:"model"`
+	Fields map[string]string `json:"fields"`
+	Tags   []string          `json:"tags"`
+}
+
+type backupFile struct {
+	Created string       `json:"created"`
+	Command string       `json:"command"`
+	Notes   []noteBackup `json:"notes"`
+}
+
+// backupNotes saves the current state of notes before command changes them and returns
+// the backup file name.
+func backupNotes(dir, command string, notes []ankiconnect.ResultNotesInfo) (string, error) {
+	backup := backupFile{Created: time.Now().Format(time.RFC3339), Command: command}
+	for _, n := range notes {
+		fields := make(map[string]string, len(n.Fields))
+		for name, f := range n.Fields {
+			fields[name] = f.Value
+		}
+		backup.Notes = append(backup.Notes, noteBackup{NoteID: n.NoteId, Model: n.ModelName, Fields: fields, Tags: n.Tags})
+	}
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(backup); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, time.Now().Format("20060102-150405.000")+"-"+strings.ReplaceAll(command, " ", "-")+".json")
+	if err := writeFileAtomic(name, data.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// listBackups returns the backup file names in dir, oldest first.
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func loadBackup(name string) (backupFile, error) {
+	var backup backupFile
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return backup, fmt.Errorf("failed to read backup: %v", err)
+	}
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return backup, fmt.Errorf("failed to read backup %s: %v", name, err)
+	}
+	return backup, nil
+}
+
+// runRollback restores notes to the state saved in a backup, the latest one by default.
+func runRollback(args []string) {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	backupDir := fs.String("backup_dir", defaultBackupDir, "Directory holding the note backups")
+	list := fs.Bool("list", false, "List the backups instead of restoring one")
+	dryRun := fs.Bool("dry_run", false, "Print the changes without updating any notes")
+	yes := fs.Bool("yes", false, "Restore without asking for confirmation")
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{
+		"backup_dir":   filepath.Join("state", defaultBackupDir),
+		"history_file": workspaceHistoryFile,
+	})
+
+	backups, err := listBackups(*backupDir)
+	if err != nil {
+		fatalf("failed to read backups: %v", err)
+	}
+	if *list {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCOMMAND\tNOTES")
+		for _, name := range backups {
+			b, err := loadBackup(name)
+			if err != nil {
+				fmt.Printf("warning: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\n", strings.TrimSuffix(filepath.Base(name), ".json"), b.Command, len(b.Notes))
+		}
+		w.Flush()
+		return
+	}
+	startRun("rollback", fs, *historyFile)
+
+	// Pick the backup: an ID, a file, or the latest
+	var name string
+	switch {
+	case fs.NArg() > 1:
+		fatalf("usage: rollback [backup ID or file]")
+	case fs.NArg() == 1:
+		name = fs.Arg(0)
+		if _, err := os.Stat(name); err != nil {
+			name = filepath.Join(*backupDir, fs.Arg(0)+".json")
+		}
+	case len(backups) == 0:
+		fatalf("no backups in %s", *backupDir)
+	default:
+		name = backups[len(backups)-1]
+	}
+	backup, err := loadBackup(name)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Printf("Restoring %s (%s, %s)\n", name, backup.Command, backup.Created)
+
+	client := newAnkiClient()
+	ids := make([]int64, 0, len(backup.Notes))
+	for _, n := range backup.Notes {
+		ids = append(ids, n.NoteID)
+	}
+	current := map[int64]ankiconnect.ResultNotesInfo{}
+	for _, n := range fetchNotesByID(client, ids) {
+		current[n.NoteId] = n
+	}
+
+	// Compare the backup with the notes as they are now
+	var changes []noteChange
+	tagChanges := map[int64][]string{}
+	var affected []ankiconnect.ResultNotesInfo
+	for _, saved := range backup.Notes {
+		n, found := current[saved.NoteID]
+		if !found {
+			fmt.Printf("warning: note %d no longer exists, skipping\n", saved.NoteID)
+			continue
+		}
+		change := noteChange{noteID: n.NoteId, before: map[string]string{}, after: map[string]string{}}
+		for field, value := range saved.Fields {
+			f, found := n.Fields[field]
+			if !found {
+				fmt.Printf("warning: note %d no longer has field %s, skipping it\n", n.NoteId, field)
+				continue
+			}
+			if f.Value != value {
+				change.before[field] = f.Value
+				change.after[field] = value
+			}
+		}
+		tagsChanged := !slices.Equal(sortedTags(n.Tags), sortedTags(saved.Tags))
+		if tagsChanged {
+			tagChanges[n.NoteId] = saved.Tags
+		}
+		if len(change.after) > 0 || tagsChanged {
+			changes = append(changes, change)
+			affected = append(affected, n)
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Println("Notes already match the backup")
+		finishRun("ok")
+		return
+	}
+
+	for _, c := range changes {
+		fmt.Printf("note %d:\n", c.noteID)
+		for field, value := range c.after {
+			fmt.Printf("  %s: %q -> %q\n", field, c.before[field], value)
+		}
+		if tags, found := tagChanges[c.noteID]; found {
+			fmt.Printf("  tags: %q -> %q\n", strings.Join(current[c.noteID].Tags, " "), strings.Join(tags, " "))
+		}
+	}
+	recordCount("notes_changed", len(changes))
+	if *dryRun {
+		fmt.Printf("dry run: %d notes would be restored\n", len(changes))
+		finishRun("dry run")
+		return
+	}
+	if !*yes && !confirm(fmt.Sprintf("Restore %d notes?", len(changes))) {
+		fmt.Println("Aborted")
+		finishRun("aborted")
+		return
+	}
+
+	// The rollback is a write-back too, so it can be undone the same way
+	saved, err := backupNotes(*backupDir, "rollback", affected)
+	if err != nil {
+		fatalf("failed to back up notes before restoring: %v", err)
+	}
+	fmt.Printf("Backed up the current notes to %s\n", saved)
+	recordOutput(saved)
+
+	for _, c := range changes {
+		if len(c.after) > 0 {
+			if err := client.Notes.Update(ankiconnect.UpdateNote{Id: c.noteID, Fields: ankiconnect.Fields(c.after)}); err != nil {
+				fatalf("failed to restore note %d: %s", c.noteID, err.Message)
+			}
+		}
+		if tags, found := tagChanges[c.noteID]; found {
+			if _, err := ankiInvoke[any](client, "updateNoteTags", map[string]any{"note": c.noteID, "tags": tags}); err != nil {
+				fatalf("failed to restore tags of note %d: %s", c.noteID, err.Message)
+			}
+		}
+	}
+	fmt.Printf("Successfully restored %d notes\n", len(changes))
+	finishRun("ok")
+}
+
+func sortedTags(tags []string) []string {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Downloads from TTS services and site uploads can be kept off a metered or shared
+// connection's busy hours: --bwlimit caps how fast they transfer, all of them together, and
+// --transfer_window, e.g. 02:00-06:00, holds every transfer until the window opens. A
+// transfer already started when the window closes finishes; the next one waits for the
+// next day's window. Anki is local, so its media isn't limited.
+
+// byteUnits are the suffixes a --bwlimit can have.
+var byteUnits = map[string]int64{"": 1, "B": 1, "K": 1 << 10, "KB": 1 << 10, "M": 1 << 20, "MB": 1 << 20, "G": 1 << 30, "GB": 1 << 30}
+
+// parseByteRate parses a --bwlimit in bytes per second, e.g. 500K or 1.5M, with K, M and G
+// counting 1024s like rsync's. An empty limit is 0, no limit.
+func parseByteRate(limit string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(limit)), "/S")
+	if s == "" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, known := byteUnits[s[i:]]
+	if err != nil || !known || n <= 0 {
+		return 0, fmt.Errorf("--bwlimit must be bytes per second like 500K or 2M, got %q", limit)
+	}
+	return max(int64(n*float64(unit)), 1), nil
+}
+
+// transferWindow is the time of day transfers may start in, from start up to end in
+// minutes after midnight. A window ending before it starts runs past midnight.
+type transferWindow struct {
+	text       string
+	start, end int
+}
+
+// parseTransferWindow parses a --transfer_window like 02:00-06:00, or returns nil for none.
+func parseTransferWindow(window string) (*transferWindow, error) {
+	if strings.TrimSpace(window) == "" {
+		return nil, nil
+	}
+	from, to, found := strings.Cut(window, "-")
+	start, err1 := time.Parse("15:04", strings.TrimSpace(from))
+	end, err2 := time.Parse("15:04", strings.TrimSpace(to))
+	if !found || err1 != nil || err2 != nil || start.Equal(end) {
+		return nil, fmt.Errorf("--transfer_window must be a start and end time like 02:00-06:00, got %q", window)
+	}
+	return &transferWindow{
+		text:  window,
+		start: start.Hour()*60 + start.Minute(),
+		end:   end.Hour()*60 + end.Minute(),
+	}, nil
+}
+
+// until returns how long it is from now until the window next opens, 0 while it is open.
+func (w *transferWindow) until(now time.Time) time.Duration {
+	minute := now.Hour()*60 + now.Minute()
+	open := minute >= w.start && minute < w.end
+	if w.end < w.start {
+		open = minute >= w.start || minute < w.end
+	}
+	if open {
+		return 0
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	next := midnight.Add(time.Duration(w.start) * time.Minute)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next.Sub(now)
+}
+
+// transfers are the limits of the download flags, which the TTS engines keep to.
+var transfers = &transferLimits{}
+
+// transferLimits holds the --bwlimit and --transfer_window transfers keep to. The zero
+// value limits nothing.
+type transferLimits struct {
+	rate   int64
+	window *transferWindow
+
+	mu sync.Mutex
+	// next is when the bytes taken so far have been sent at rate
+	next time.Time
+	// waiting is set while a transfer waits for the window, so the wait is printed once
+	waiting bool
+}
+
+// newTransferLimits parses --bwlimit and --transfer_window values.
+func newTransferLimits(bwlimit, window string) (*transferLimits, error) {
+	rate, err := parseByteRate(bwlimit)
+	if err != nil {
+		return nil, err
+	}
+	w, err := parseTransferWindow(window)
+	if err != nil {
+		return nil, err
+	}
+	return &transferLimits{rate: rate, window: w}, nil
+}
+
+// waitForWindow returns once the transfer window is open.
+func (l *transferLimits) waitForWindow() {
+	if l.window == nil {
+		return
+	}
+	for {
+		wait := l.window.until(time.Now())
+		l.mu.Lock()
+		if wait > 0 && !l.waiting {
+			fmt.Printf("Waiting %s until the transfer window %s opens\n", wait.Round(time.Minute), l.window.text)
+		}
+		l.waiting = wait > 0
+		l.mu.Unlock()
+		if wait == 0 {
+			return
+		}
+		// Sleeping in steps keeps to the clock if the computer sleeps meanwhile
+		time.Sleep(min(wait, time.Minute))
+	}
+}
+
+// take waits until n more bytes can be transferred at rate.
+func (l *transferLimits) take(n int) {
+	if l.rate == 0 || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// limitedReader reads from r no faster than its limits allow.
+type limitedReader struct {
+	r      io.Reader
+	limits *transferLimits
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	// Small reads spread the waits out instead of bursting a large buffer at once
+	if chunk := int(max(r.limits.rate/10, 1024)); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+	r.limits.take(n)
+	return n, err
+}
+
+type limitedReadCloser struct {
+	limitedReader
+	io.Closer
+}
+
+// limitedTransport sends requests through base at the limits' rate, both their bodies and
+// the bodies of the responses. Waiting for the window is up to the caller, before the
+// client's timeout starts.
+type limitedTransport struct {
+	base   http.RoundTripper
+	limits *transferLimits
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req = req.Clone(req.Context())
+		req.Body = limitedReadCloser{limitedReader{req.Body, t.limits}, req.Body}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		resp.Body = limitedReadCloser{limitedReader{resp.Body, t.limits}, resp.Body}
+	}
+	return resp, err
+}
+
+// limitClient makes client's transfers keep to the limits' rate.
+func limitClient(client *http.Client, limits *transferLimits) {
+	if limits.rate == 0 {
+		return
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &limitedTransport{base: base, limits: limits}
+}
@@ -0,0 +1,102 @@
+"""
+Bandwidth limits for the downloads of audio_sourcer.py and the uploads of concatenator.py,
+for metered or shared connections.
+
+--bwlimit takes bytes per second like anki_downloader's, e.g. 500K or 2M, with K, M and G
+counting 1024s. The TTS services answer with whole clips and uploads are run by another
+tool, so the limit is kept on average: after each file the run pauses until the file would
+have been transferred at the limit. --transfer_window, e.g. 02:00-06:00, holds every
+transfer until the window opens. A window ending before it starts runs past midnight.
+"""
+import datetime
+import os
+import re
+import time
+
+_units = {'': 1, 'B': 1, 'K': 1 << 10, 'KB': 1 << 10, 'M': 1 << 20, 'MB': 1 << 20, 'G': 1 << 30, 'GB': 1 << 30}
+
+
+def parseByteRate(limit):
+    """
+    Returns a --bwlimit in bytes per second, 0 for none.
+    """
+    text = (limit or '').strip().upper()
+    if text.endswith('/S'):
+        text = text[:-2]
+    if not text:
+        return 0
+    match = re.fullmatch(r'([0-9]*\.?[0-9]+)([A-Z]*)', text)
+    if match is None or match.group(2) not in _units or float(match.group(1)) <= 0:
+        raise ValueError(f"--bwlimit must be bytes per second like 500K or 2M, got \"{limit}\"")
+    return max(int(float(match.group(1)) * _units[match.group(2)]), 1)
+
+
+def parseTransferWindow(window):
+    """
+    Returns a --transfer_window as its start and end in minutes after midnight, None for none.
+    """
+    if not (window or '').strip():
+        return None
+    match = re.fullmatch(r'\s*([0-9]{1,2}):([0-9]{2})\s*-\s*([0-9]{1,2}):([0-9]{2})\s*', window)
+    if match is not None:
+        startHour, startMinute, endHour, endMinute = (int(g) for g in match.groups())
+        start, end = startHour * 60 + startMinute, endHour * 60 + endMinute
+        if startHour < 24 and endHour < 24 and startMinute < 60 and endMinute < 60 and start != end:
+            return start, end
+    raise ValueError(f"--transfer_window must be a start and end time like 02:00-06:00, got \"{window}\"")
+
+
+class TransferLimits:
+    """
+    Keeps transfers to a --bwlimit and --transfer_window. With neither, nothing waits.
+    """
+    def __init__(self, bwlimit=None, window=None):
+        self.rate = parseByteRate(bwlimit)
+        # As given, for tools with a limit of their own, e.g. rclone --bwlimit 500K
+        self.rateText = bwlimit.strip() if self.rate else '0'
+        self.windowText = window
+        self.window = parseTransferWindow(window)
+        # When the bytes downloaded so far have been received at the rate
+        self.next = 0.0
+
+    def _untilOpen(self, now):
+        start, end = self.window
+        minute = now.hour * 60 + now.minute
+        isOpen = start <= minute < end if start < end else (minute >= start or minute < end)
+        if isOpen:
+            return 0
+        opens = now.replace(hour=start // 60, minute=start % 60, second=0, microsecond=0)
+        if opens <= now:
+            opens += datetime.timedelta(days=1)
+        return (opens - now).total_seconds()
+
+    def waitForWindow(self):
+        """
+        Returns once the transfer window is open.
+        """
+        if self.window is None:
+            return
+        printed = False
+        while True:
+            wait = self._untilOpen(datetime.datetime.now())
+            if wait <= 0:
+                return
+            if not printed:
+                print(f"Waiting {round(wait / 60)} minutes until the transfer window {self.windowText} opens")
+                printed = True
+            # Sleeping in steps keeps to the clock if the computer sleeps meanwhile
+            time.sleep(min(wait, 60))
+
+    def transfer(self, transfer, filename):
+        """
+        Calls transfer(filename) once the window is open and returns its result, then pauses
+        until the file would have been transferred at the rate. A False result transferred
+        nothing.
+        """
+        self.waitForWindow()
+        started = time.monotonic()
+        result = transfer(filename)
+        if self.rate > 0 and result is not False and os.path.exists(filename):
+            self.next = max(self.next, started) + os.path.getsize(filename) / self.rate
+            time.sleep(max(self.next - time.monotonic(), 0))
+        return result
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+	"github.com/privatesquare/bkst-go-utils/utils/errors"
+)
+
+// Batch builds export several profiles, e.g. one per person or deck, in one run. The cards
+// and notes of every profile's query are fetched from Anki once and handed to the profile
+// exports, which run in parallel and share one media cache. A profiles file lists the
+// export flags of each profile:
+//
+//	{"profiles": [
+//	  {"name": "alice", "flags": {"card_query": "deck:JP1K", "word_field": "Word", "definition_field": "Meaning"}},
+//	  {"name": "bob", "flags": {"card_query": "deck:JP1K tag:n5", "word_field": "Word", "definition_field": "Meaning", "get_audio": true}}
+//	]}
+type batchProfile struct {
+	Name  string         `json:"name"`
+	Flags map[string]any `json:"flags"`
+}
+
+type batchFile struct {
+	Profiles []batchProfile `json:"profiles"`
+}
+
+// ankiSnapshot is the Anki data fetched for a batch, passed to each profile export with
+// the hidden --snapshot flag.
+type ankiSnapshot struct {
+	Queries map[string][]int64            `json:"queries"`
+	Cards   []ankiconnect.ResultCardsInfo `json:"cards"`
+	Notes   []ankiconnect.ResultNotesInfo `json:"notes"`
+
+	cardsByID map[int64]ankiconnect.ResultCardsInfo
+	notesByID map[int64]ankiconnect.ResultNotesInfo
+}
+
+// snapshot is the prefetched Anki data of a batch build, nil outside one.
+var snapshot *ankiSnapshot
+
+// extractSnapshotFlag removes --snapshot from args and loads the snapshot it names.
+func extractSnapshotFlag(args []string) []string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "snapshot" {
+			continue
+		}
+		rest := append([]string{}, args[:i]...)
+		if !hasValue {
+			if i+1 >= len(args) {
+				fatalf("--snapshot needs a file")
+			}
+			value = args[i+1]
+			i++
+		}
+		rest = append(rest, args[i+1:]...)
+
+		data, err := os.ReadFile(value)
+		if err != nil {
+			fatalf("failed to read snapshot: %v", err)
+		}
+		snapshot = &ankiSnapshot{}
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			fatalf("failed to read snapshot %s: %v", value, err)
+		}
+		snapshot.index()
+		return rest
+	}
+	return args
+}
+
+func (s *ankiSnapshot) index() {
+	s.cardsByID = map[int64]ankiconnect.ResultCardsInfo{}
+	for _, c := range s.Cards {
+		s.cardsByID[c.CardId] = c
+	}
+	s.notesByID = map[int64]ankiconnect.ResultNotesInfo{}
+	for _, n := range s.Notes {
+		s.notesByID[n.NoteId] = n
+	}
+}
+
+// cardsInfo returns the cards with ids from the snapshot, or false if any are missing.
+func (s *ankiSnapshot) cardsInfo(ids []int64) ([]ankiconnect.ResultCardsInfo, bool) {
+	if s == nil {
+		return nil, false
+	}
+	cards := make([]ankiconnect.ResultCardsInfo, 0, len(ids))
+	for _, id := range ids {
+		c, found := s.cardsByID[id]
+		if !found {
+			return nil, false
+		}
+		cards = append(cards, c)
+	}
+	return cards, true
+}
+
+// notesInfo returns the notes with ids from the snapshot, or false if any are missing.
+func (s *ankiSnapshot) notesInfo(ids []int64) ([]ankiconnect.ResultNotesInfo, bool) {
+	if s == nil {
+		return nil, false
+	}
+	notes := make([]ankiconnect.ResultNotesInfo, 0, len(ids))
+	for _, id := range ids {
+		n, found := s.notesByID[id]
+		if !found {
+			return nil, false
+		}
+		notes = append(notes, n)
+	}
+	return notes, true
+}
+
+// withSnapshot answers card searches from the snapshot when there is one.
+func withSnapshot(client *ankiconnect.Client) *ankiconnect.Client {
+	if snapshot != nil {
+		client.Cards = snapshotCards{client.Cards}
+	}
+	return client
+}
+
+type snapshotCards struct{ ankiconnect.CardsManager }
+
+func (m snapshotCards) Search(query string) (*[]int64, *errors.RestErr) {
+	if ids, found := snapshot.Queries[query]; found {
+		return &ids, nil
+	}
+	return m.CardsManager.Search(query)
+}
+
+// flagArgs turns a profile's flags into command line arguments, in a stable order.
+func flagArgs(flags map[string]any) []string {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, name := range names {
+		var value string
+		switch v := flags[name].(type) {
+		case string:
+			value = v
+		case bool:
+			value = strconv.FormatBool(v)
+		case float64:
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			fatalf("flag %s must be a string, number or boolean", name)
+		}
+		args = append(args, "--"+name+"="+value)
+	}
+	return args
+}
+
+// runBatch exports every profile in a profiles file.
+func runBatch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	profilesFile := fs.String("profiles", "profiles.json", "JSON file listing the profiles to build and their export flags")
+	jobs := fs.Int("jobs", 4, "Number of profiles to build at the same time")
+	only := fs.String("only", "", "Comma separated names of the profiles to build (default: all)")
+	cacheDir := fs.String("cache_dir", defaultCacheDir(), "Media cache shared by every profile (empty to disable)")
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{"cache_dir": "cache", "history_file": workspaceHistoryFile})
+	startRun("batch", fs, *historyFile)
+
+	data, err := os.ReadFile(*profilesFile)
+	if err != nil {
+		fatalf("failed to read profiles: %v", err)
+	}
+	var file batchFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		fatalf("failed to read profiles %s: %v", *profilesFile, err)
+	}
+	selected := map[string]bool{}
+	for _, name := range strings.Split(*only, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected[name] = true
+		}
+	}
+	var profiles []batchProfile
+	seen := map[string]bool{}
+	for _, p := range file.Profiles {
+		if p.Name == "" {
+			fatalf("every profile in %s needs a name", *profilesFile)
+		}
+		if seen[p.Name] {
+			fatalf("profile %s is listed twice in %s", p.Name, *profilesFile)
+		}
+		seen[p.Name] = true
+		if _, found := p.Flags["card_query"].(string); !found {
+			fatalf("profile %s has no card_query", p.Name)
+		}
+		if len(selected) == 0 || selected[p.Name] {
+			profiles = append(profiles, p)
+		}
+	}
+	if len(profiles) == 0 {
+		fatalf("no profiles to build")
+	}
+
+	// Fetch every card and note once, however many profiles include it
+	client := newAnkiClient()
+	snap := ankiSnapshot{Queries: map[string][]int64{}}
+	var cardIDs, noteIDs []int64
+	seenCards, seenNotes := map[int64]bool{}, map[int64]bool{}
+	for _, p := range profiles {
+		query := p.Flags["card_query"].(string)
+		if _, found := snap.Queries[query]; found {
+			continue
+		}
+		ids := must(client.Cards.Search(query))
+		snap.Queries[query] = *ids
+
+		// Fail before the fetch if a profile names fields its note types don't have
+		models := must(matchedModels(client, query, len(*ids)))
+		for _, q := range profiles {
+			if q.Flags["card_query"] != query {
+				continue
+			}
+			required := map[string]string{}
+			for _, f := range []string{"word_field", "definition_field", "word_audio_field"} {
+				if name, found := q.Flags[f].(string); found {
+					required[f] = name
+				}
+			}
+			if q.Flags["get_audio"] != true {
+				delete(required, "word_audio_field")
+			}
+			if problems := missingFields(models, required); len(problems) > 0 {
+				fatalf("profile %s: fields missing from the note types matched by its card_query:\n  %s", q.Name, strings.Join(problems, "\n  "))
+			}
+		}
+		for _, id := range *ids {
+			if !seenCards[id] {
+				seenCards[id] = true
+				cardIDs = append(cardIDs, id)
+			}
+		}
+	}
+	snap.Cards = must(cardsInfo(client, cardIDs))
+	for _, c := range snap.Cards {
+		if !seenNotes[c.Note] {
+			seenNotes[c.Note] = true
+			noteIDs = append(noteIDs, c.Note)
+		}
+	}
+	snap.Notes = must(notesInfo(client, noteIDs))
+	fmt.Printf("Fetched %d cards and %d notes for %d profiles\n", len(snap.Cards), len(snap.Notes), len(profiles))
+	recordCount("profiles", len(profiles))
+	recordCount("cards", len(snap.Cards))
+
+	tmp, err := os.CreateTemp("", "anki-snapshot-*.json")
+	if err != nil {
+		fatalf("failed to create snapshot: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := json.NewEncoder(tmp).Encode(snap); err != nil {
+		fatalf("failed to write snapshot: %v", err)
+	}
+	tmp.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		fatalf("batch: %v", err)
+	}
+
+	// Build the profiles in parallel, printing each one's output once it finishes
+	type result struct {
+		err     error
+		elapsed time.Duration
+	}
+	results := make([]result, len(profiles))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(*jobs, 1))
+	for i, p := range profiles {
+		cmdArgs := flagArgs(p.Flags)
+		if _, found := p.Flags["workspace"]; !found {
+			root := p.Name
+			if *workspace != "" {
+				root = filepath.Join(*workspace, "profiles", p.Name)
+			}
+			cmdArgs = append(cmdArgs, "--workspace="+root)
+		}
+		if _, found := p.Flags["cache_dir"]; !found {
+			cmdArgs = append(cmdArgs, "--cache_dir="+*cacheDir)
+		}
+		// Profiles are exported with their own flags only, not the config file's
+		cmdArgs = append(cmdArgs, "--snapshot="+tmp.Name(), "--config=")
+		if ankiURL != "" {
+			cmdArgs = append(cmdArgs, "--anki_url="+ankiURL)
+		}
+		if partialExitCode != 0 {
+			cmdArgs = append(cmdArgs, "--partial_exit_code="+strconv.Itoa(partialExitCode))
+		}
+		cmdArgs = append(cmdArgs, retryArgs()...)
+		cmdArgs = append(cmdArgs, busyArgs()...)
+
+		wg.Add(1)
+		go func(i int, name string, cmdArgs []string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			var out bytes.Buffer
+			cmd := exec.Command(exe, cmdArgs...)
+			cmd.Stdout = &out
+			cmd.Stderr = &out
+			start := time.Now()
+			err := cmd.Run()
+			results[i] = result{err, time.Since(start)}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+				fmt.Printf("[%s] %s\n", name, line)
+			}
+		}(i, p.Name, cmdArgs)
+	}
+	wg.Wait()
+
+	// A profile that exits with --partial_exit_code finished with warnings
+	failed, partial := 0, 0
+	fmt.Println()
+	for i, p := range profiles {
+		elapsed := results[i].elapsed.Round(time.Millisecond)
+		exitErr, exited := results[i].err.(*exec.ExitError)
+		switch {
+		case results[i].err == nil:
+			fmt.Printf("%s: ok in %v\n", p.Name, elapsed)
+		case partialExitCode != 0 && exited && exitErr.ExitCode() == partialExitCode:
+			partial++
+			fmt.Printf("%s: finished with warnings in %v\n", p.Name, elapsed)
+		default:
+			failed++
+			fmt.Printf("%s: failed in %v\n", p.Name, elapsed)
+			if currentRun != nil {
+				currentRun.Errors = append(currentRun.Errors, fmt.Sprintf("%s: %v", p.Name, results[i].err))
+			}
+		}
+	}
+	recordCount("failed", failed)
+	recordCount("partial", partial)
+
+	// The profiles that did build are usable, unless every one of them failed
+	switch {
+	case failed == len(profiles):
+		finishRun("failed")
+		os.Exit(1)
+	case failed > 0 || partial > 0:
+		finishRun("partial")
+		// Without --partial_exit_code, a failed profile fails the batch as it always has
+		if partialExitCode == 0 && failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(exitCode("partial"))
+	}
+	finishRun("ok")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// Cards heard in a lesson don't need reviewing on screen the same day. `bury` takes them out
+// of Anki's queue until the next day: AnkiConnect can't bury cards, so they are suspended
+// instead and recorded in a state file, and the next run on a later day (`bury` itself or an
+// export) unsuspends exactly those cards again. Cards that were already suspended are left
+// alone, so releasing never unsuspends anything the lesson didn't.
+const defaultBuriedFile = "buried.json"
+
+type buriedCards struct {
+	// Date is the day the cards were buried, in YYYY-MM-DD local time
+	Date  string  `json:"date"`
+	Cards []int64 `json:"cards"`
+}
+
+func loadBuriedCards(name string) (buriedCards, error) {
+	var buried buriedCards
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return buried, nil
+	}
+	if err != nil {
+		return buried, err
+	}
+	if err := json.Unmarshal(data, &buried); err != nil {
+		return buried, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	return buried, nil
+}
+
+func saveBuriedCards(name string, buried buriedCards) error {
+	if len(buried.Cards) == 0 {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(buried, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(name, append(data, '\n'), 0644)
+}
+
+// releaseBuried unsuspends the cards buried on an earlier day, or on any day with force, and
+// returns how many were released.
+func releaseBuried(client *ankiconnect.Client, name string, force bool) (int, error) {
+	buried, err := loadBuriedCards(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(buried.Cards) == 0 || !force && buried.Date == time.Now().Format(time.DateOnly) {
+		return 0, nil
+	}
+	if _, restErr := ankiInvoke[bool](client, "unsuspend", map[string]any{"cards": buried.Cards}); restErr != nil {
+		return 0, fmt.Errorf("failed to unbury cards: %v", restErr.Message)
+	}
+	if err := saveBuriedCards(name, buriedCards{}); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return len(buried.Cards), nil
+}
+
+// lessonTimelineName returns the timeline of a lesson given as its audio file, its name in
+// sessionsDir or the timeline itself.
+func lessonTimelineName(lesson, sessionsDir string) string {
+	name := lesson
+	if !strings.HasSuffix(name, ".timeline.json") {
+		name += ".timeline.json"
+	}
+	if _, err := os.Stat(name); err != nil {
+		name = filepath.Join(sessionsDir, filepath.Base(name))
+	}
+	return name
+}
+
+// runBury implements the `bury` command, burying the cards of lessons for the day.
+func runBury(args []string) {
+	fs := flag.NewFlagSet("bury", flag.ExitOnError)
+	sessionsDir := fs.String("sessions_dir", "output", "Directory containing the lessons and their .timeline.json files")
+	buriedFile := fs.String("buried_file", defaultBuriedFile, "File recording the buried cards, so they can be unburied")
+	release := fs.Bool("release", false, "Unbury the cards now instead of burying any")
+	dryRun := fs.Bool("dry_run", false, "Print what would be buried without changing Anki")
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{
+		"sessions_dir": "sessions",
+		"buried_file":  filepath.Join("state", defaultBuriedFile),
+		"history_file": workspaceHistoryFile,
+	})
+	if !*release && fs.NArg() == 0 {
+		fatalf("usage: bury <lesson>... | bury --release")
+	}
+	startRun("bury", fs, *historyFile)
+	client := newAnkiClient()
+
+	// Cards buried on an earlier day are due again, and --release frees them today too
+	released, err := releaseBuried(client, *buriedFile, *release)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	recordCount("unburied", released)
+	if released > 0 {
+		fmt.Printf("Unburied %d cards\n", released)
+	}
+	if *release {
+		if released == 0 {
+			fmt.Println("No buried cards")
+		}
+		finishRun("ok")
+		return
+	}
+
+	// The timelines list the cards each lesson played, by note ID when the CSV has one
+	var noteIDs []int64
+	seen := map[int64]bool{}
+	withoutID := 0
+	for _, lesson := range fs.Args() {
+		t, err := loadTimeline(lessonTimelineName(lesson, *sessionsDir))
+		if err != nil {
+			fatalf("%v", err)
+		}
+		for _, c := range t.Cards {
+			id, err := strconv.ParseInt(c.Key, 10, 64)
+			if err != nil {
+				withoutID++
+				continue
+			}
+			if !seen[id] {
+				seen[id] = true
+				noteIDs = append(noteIDs, id)
+			}
+		}
+	}
+	if withoutID > 0 {
+		fmt.Printf("warning: %d plays have no note ID and were skipped. Export with --metadata_columns note_id to bury them\n", withoutID)
+	}
+	if len(noteIDs) == 0 {
+		fatalf("no cards with a note ID in the lessons")
+	}
+
+	var cardIDs []int64
+	const batchSize = 500
+	for start := 0; start < len(noteIDs); start += batchSize {
+		parts := make([]string, 0, batchSize)
+		for _, id := range noteIDs[start:min(start+batchSize, len(noteIDs))] {
+			parts = append(parts, strconv.FormatInt(id, 10))
+		}
+		cardIDs = append(cardIDs, *must(client.Cards.Search("nid:" + strings.Join(parts, ",")))...)
+	}
+
+	// Leave cards that are suspended already out, so unburying can't unsuspend them
+	suspended := must(ankiInvoke[[]bool](client, "areSuspended", map[string]any{"cards": cardIDs}))
+	buried, err := loadBuriedCards(*buriedFile)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	already := map[int64]bool{}
+	for _, id := range buried.Cards {
+		already[id] = true
+	}
+	var toBury []int64
+	for i, id := range cardIDs {
+		if i < len(*suspended) && !(*suspended)[i] && !already[id] {
+			toBury = append(toBury, id)
+		}
+	}
+	recordCount("buried", len(toBury))
+	if len(toBury) == 0 {
+		fmt.Println("Cards are already buried or suspended")
+		finishRun("ok")
+		return
+	}
+	if *dryRun {
+		fmt.Printf("dry run: %d cards of %d notes would be buried\n", len(toBury), len(noteIDs))
+		finishRun("dry run")
+		return
+	}
+
+	// Record the cards before suspending them, so an interrupted run can still be undone
+	buried.Date = time.Now().Format(time.DateOnly)
+	buried.Cards = append(buried.Cards, toBury...)
+	if err := saveBuriedCards(*buriedFile, buried); err != nil {
+		fatalf("failed to write %s: %v", *buriedFile, err)
+	}
+	recordOutput(*buriedFile)
+	must(ankiInvoke[bool](client, "suspend", map[string]any{"cards": toBury}))
+	fmt.Printf("Buried %d cards until tomorrow (unbury now with: bury --release)\n", len(toBury))
+	finishRun("ok")
+}
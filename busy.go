@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Michael-Manning/commuter-flashcards/pkg/ankiexport"
+)
+
+// Notes changed while Anki syncs, or while its reviewer has them open, can conflict with
+// AnkiWeb's copy, and the next sync then asks which side to throw away. Before a command
+// writes to Anki it checks that Anki is idle, and checks again every few seconds during a
+// long write-back, so a sync started halfway pauses the rest. Every command supports:
+//
+//	--anki_busy wait     wait for Anki to be idle, up to --anki_busy_wait (default)
+//	--anki_busy abort    stop at once if Anki is busy
+//	--anki_busy ignore   write without checking
+//	--anki_busy_wait 2m  how long to wait
+//
+// Commands that only read from Anki never wait.
+var (
+	ankiBusyPolicy = "wait"
+	ankiBusyWait   = 2 * time.Minute
+)
+
+var busyFlagNames = map[string]bool{"anki_busy": true, "anki_busy_wait": true}
+
+// ankiWriteActions are the Anki-Connect actions that change the collection.
+var ankiWriteActions = map[string]bool{
+	"updateNoteFields": true, "updateNoteTags": true, "addNote": true, "createDeck": true,
+	"storeMediaFile": true, "suspend": true, "unsuspend": true,
+}
+
+// busyCheckInterval is how long Anki is trusted to stay idle after a check, and how often a
+// busy Anki is asked again.
+const busyCheckInterval = 5 * time.Second
+
+// busyCheckTimeout is how long a check waits for an answer. A sync holds the collection, so
+// Anki-Connect answers slowly or not at all while it runs.
+const busyCheckTimeout = 5 * time.Second
+
+var (
+	busyMu   sync.Mutex
+	lastIdle time.Time
+)
+
+// extractBusyFlags removes the busy flags from args, so every command supports them.
+func extractBusyFlags(args []string) []string {
+	fs := flag.NewFlagSet("busy", flag.ExitOnError)
+	fs.StringVar(&ankiBusyPolicy, "anki_busy", ankiBusyPolicy, "")
+	fs.DurationVar(&ankiBusyWait, "anki_busy_wait", ankiBusyWait, "")
+
+	var rest, busy []string
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || !busyFlagNames[name] {
+			rest = append(rest, args[i])
+			continue
+		}
+		busy = append(busy, args[i])
+		if !hasValue && i+1 < len(args) {
+			i++
+			busy = append(busy, args[i])
+		}
+	}
+	if len(busy) == 0 {
+		return args
+	}
+	fs.Parse(busy)
+	switch ankiBusyPolicy {
+	case "wait", "abort", "ignore":
+	default:
+		fatalf("invalid --anki_busy %q, must be wait, abort or ignore", ankiBusyPolicy)
+	}
+	if ankiBusyWait < 0 {
+		fatalf("--anki_busy_wait cannot be negative")
+	}
+	return rest
+}
+
+// busyArgs returns the busy flags as arguments for another run of this program.
+func busyArgs() []string {
+	return []string{"--anki_busy=" + ankiBusyPolicy, "--anki_busy_wait=" + ankiBusyWait.String()}
+}
+
+// ankiBusy returns why Anki shouldn't be written to right now, or "" if it is idle. An
+// Anki-Connect too old for one of the checks counts as idle for it.
+func ankiBusy(url string) string {
+	connect := &ankiexport.AnkiConnect{URL: url, Version: ankiexport.Version, HTTPClient: &http.Client{Timeout: busyCheckTimeout}}
+	unsupported := func(err error) bool { return strings.Contains(err.Error(), "unsupported action") }
+
+	if _, err := ankiexport.Invoke[string](connect, "getActiveProfile", nil); err != nil && !unsupported(err) {
+		if e, ok := err.(*ankiexport.Error); ok && e.Unreachable {
+			return "Anki isn't answering, it may be syncing"
+		}
+		return "no profile is open, Anki may be syncing or switching profiles"
+	}
+	if _, err := ankiexport.Invoke[int](connect, "getNumCardsReviewedToday", nil); err != nil && !unsupported(err) {
+		return "the collection isn't available, Anki may be syncing"
+	}
+	if card, err := ankiexport.Invoke[json.RawMessage](connect, "guiCurrentCard", nil); err == nil && len(card) > 0 && string(card) != "null" {
+		return "a review is in progress, finish it or go back to the deck list"
+	}
+	return ""
+}
+
+// waitForAnkiIdle returns once Anki at url may be written to with action, following
+// --anki_busy, and stops the run if it can't be.
+func waitForAnkiIdle(url, action string) {
+	if ankiBusyPolicy == "ignore" || !ankiWriteActions[action] {
+		return
+	}
+	if url == "" {
+		url = ankiexport.DefaultURL
+	}
+	busyMu.Lock()
+	defer busyMu.Unlock()
+	if time.Since(lastIdle) < busyCheckInterval {
+		return
+	}
+	deadline := time.Now().Add(ankiBusyWait)
+	waitingFor := ""
+	for {
+		reason := ankiBusy(url)
+		if reason == "" {
+			lastIdle = time.Now()
+			return
+		}
+		if ankiBusyPolicy == "abort" {
+			fatalf("not writing to Anki: %s. Run again once it's done, or pass --anki_busy wait", reason)
+		}
+		if time.Now().After(deadline) {
+			fatalf("not writing to Anki: %s, still after waiting %v. Run again once it's done, or raise --anki_busy_wait", reason, ankiBusyWait)
+		}
+		if reason != waitingFor {
+			fmt.Printf("Waiting for Anki before %s: %s\n", action, reason)
+			waitingFor = reason
+		}
+		time.Sleep(busyCheckInterval)
+	}
+}
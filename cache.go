@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The cache layout is shared with audio_sourcer.py so several tools and runs can
+// reuse each other's downloads:
+//
+//	objects/ab/abcdef...  file contents, named by the sha256 of the contents
+//	keys/0123...          the object hash for a source key (named by sha256 of the key)
+//	locks/0123....lock    held while a key is being fetched
+const (
+	cacheLockTimeout = 10 * time.Minute
+	cacheLockStale   = 30 * time.Minute
+	cacheLockPoll    = 100 * time.Millisecond
+)
+
+// mediaCache is a content-addressed store safe to use from concurrent processes.
+type mediaCache struct {
+	root string
+}
+
+// defaultCacheDir returns the per-user cache location shared by all profiles.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "commuter-flashcards")
+}
+
+// openCache creates the cache directories under root if needed.
+func openCache(root string) (*mediaCache, error) {
+	for _, sub := range []string{"objects", "keys", "locks"} {
+		if err := os.MkdirAll(filepath.Join(root, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory %s: %v", root, err)
+		}
+	}
+	return &mediaCache{root: root}, nil
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *mediaCache) keyPath(key string) string {
+	return filepath.Join(c.root, "keys", hashHex([]byte(key)))
+}
+
+func (c *mediaCache) objectPath(hash string) string {
+	return filepath.Join(c.root, "objects", hash[:2], hash)
+}
+
+// get returns the cached contents for key, if present and intact, and cached no longer
+// than maxAge ago unless maxAge is 0.
+func (c *mediaCache) get(key string, maxAge time.Duration) ([]byte, bool) {
+	if maxAge > 0 {
+		if info, err := os.Stat(c.keyPath(key)); err != nil || time.Since(info.ModTime()) > maxAge {
+			return nil, false
+		}
+	}
+	ref, err := os.ReadFile(c.keyPath(key))
+	if err != nil {
+		return nil, false
+	}
+	hash := strings.TrimSpace(string(ref))
+	if len(hash) != sha256.Size*2 {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.objectPath(hash))
+	if err != nil || hashHex(data) != hash {
+		return nil, false
+	}
+	return data, true
+}
+
+// put stores data under key. Objects are immutable so an existing object is reused.
+func (c *mediaCache) put(key string, data []byte) error {
+	hash := hashHex(data)
+	obj := c.objectPath(hash)
+	if _, err := os.Stat(obj); err != nil {
+		if err := os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(obj, data, 0644); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(c.keyPath(key), []byte(hash), 0644)
+}
+
+// fetch returns the cached value for key or calls download and caches its result.
+// The key is locked while downloading so concurrent runs don't fetch the same file twice.
+func (c *mediaCache) fetch(key string, download func() ([]byte, error)) ([]byte, error) {
+	return c.fetchFresh(key, 0, download)
+}
+
+// fetchFresh is fetch for values that can change under the same key, which are downloaded
+// again once they were cached more than maxAge ago.
+func (c *mediaCache) fetchFresh(key string, maxAge time.Duration, download func() ([]byte, error)) ([]byte, error) {
+	if data, ok := c.get(key, maxAge); ok {
+		return data, nil
+	}
+
+	unlock, err := c.lock(key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Another process may have filled the cache while we waited for the lock.
+	if data, ok := c.get(key, maxAge); ok {
+		return data, nil
+	}
+
+	data, err := download()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.put(key, data); err != nil {
+		fmt.Printf("warning: failed to cache %s: %v\n", key, err)
+	}
+	return data, nil
+}
+
+// lock takes an exclusive lock file for key, breaking locks left behind by crashed runs.
+func (c *mediaCache) lock(key string) (func(), error) {
+	path := filepath.Join(c.root, "locks", hashHex([]byte(key))+".lock")
+	deadline := time.Now().Add(cacheLockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			// The nonce tells this lock from one taken after it was broken as stale
+			nonce := make([]byte, 8)
+			rand.Read(nonce)
+			owner := fmt.Sprintf("%d %x\n", os.Getpid(), nonce)
+			_, err := f.WriteString(owner)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("failed to lock cache key %s: %v", key, err)
+			}
+			return func() { removeLock(path, owner) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to lock cache key %s: %v", key, err)
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > cacheLockStale {
+			if owner, err := os.ReadFile(path); err == nil {
+				removeLock(path, string(owner))
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for cache lock %s", path)
+		}
+		time.Sleep(cacheLockPoll)
+	}
+}
+
+// removeLock removes the lock file at path if it still holds owner, the contents it was
+// found or written with. It's moved aside first, so of several runs breaking the same stale
+// lock only one does, and a lock another run took since is put back.
+func removeLock(path, owner string) {
+	aside := fmt.Sprintf("%s.%d.%d", path, os.Getpid(), time.Now().UnixNano())
+	if os.Rename(path, aside) != nil {
+		return
+	}
+	if got, err := os.ReadFile(aside); err == nil && string(got) != owner {
+		// Fails if yet another run took the lock in the meantime, which then keeps it
+		os.Link(aside, path)
+	}
+	os.Remove(aside)
+}
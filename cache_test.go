@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T) *mediaCache {
+	t.Helper()
+	cache, err := openCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestCachePutGet(t *testing.T) {
+	cache := newTestCache(t)
+	if _, ok := cache.get("tts:a", 0); ok {
+		t.Fatal("get of a missing key found something")
+	}
+	if err := cache.put("tts:a", []byte("clip")); err != nil {
+		t.Fatal(err)
+	}
+	// Keys with the same contents share one object
+	if err := cache.put("tts:b", []byte("clip")); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tts:a", "tts:b"} {
+		if data, ok := cache.get(key, 0); !ok || string(data) != "clip" {
+			t.Errorf("get(%q) = %q, %v, want clip", key, data, ok)
+		}
+	}
+	objects, _ := filepath.Glob(filepath.Join(cache.root, "objects", "*", "*"))
+	if len(objects) != 1 {
+		t.Errorf("%d objects for two keys with the same contents, want 1", len(objects))
+	}
+}
+
+func TestCacheGetCorrupt(t *testing.T) {
+	cache := newTestCache(t)
+	if err := cache.put("k", []byte("clip")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cache.objectPath(hashHex([]byte("clip"))), []byte("clap"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get("k", 0); ok {
+		t.Error("get returned an object that doesn't match its hash")
+	}
+	if err := os.WriteFile(cache.keyPath("k"), []byte("not a hash"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get("k", 0); ok {
+		t.Error("get followed a key that doesn't hold a hash")
+	}
+}
+
+func TestCacheFetch(t *testing.T) {
+	cache := newTestCache(t)
+	calls := 0
+	download := func() ([]byte, error) {
+		calls++
+		return []byte("clip"), nil
+	}
+	for i := 0; i < 2; i++ {
+		data, err := cache.fetch("k", download)
+		if err != nil || string(data) != "clip" {
+			t.Fatalf("fetch = %q, %v, want clip", data, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("downloaded %d times, want once", calls)
+	}
+
+	failed := errors.New("offline")
+	if _, err := cache.fetch("other", func() ([]byte, error) { return nil, failed }); !errors.Is(err, failed) {
+		t.Errorf("fetch error = %v, want %v", err, failed)
+	}
+	if _, ok := cache.get("other", 0); ok {
+		t.Error("a failed download was cached")
+	}
+}
+
+func TestCacheFetchConcurrent(t *testing.T) {
+	cache := newTestCache(t)
+	var calls atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := cache.fetch("k", func() ([]byte, error) {
+				calls.Add(1)
+				time.Sleep(20 * time.Millisecond)
+				return []byte("clip"), nil
+			})
+			if err != nil || !bytes.Equal(data, []byte("clip")) {
+				t.Errorf("fetch = %q, %v", data, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("downloaded %d times, want once", n)
+	}
+}
+
+func TestCacheLock(t *testing.T) {
+	cache := newTestCache(t)
+	unlock, err := cache.lock("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := cache.lock("k")
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("a second lock was taken while the first was held")
+	case <-time.After(3 * cacheLockPoll):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the second lock wasn't taken after the first was released")
+	}
+}
+
+func TestCacheLockStale(t *testing.T) {
+	cache := newTestCache(t)
+	path := filepath.Join(cache.root, "locks", hashHex([]byte("k"))+".lock")
+	if err := os.WriteFile(path, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-cacheLockStale - time.Minute)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := cache.lock("k")
+	if err != nil {
+		t.Fatalf("lock of a key with a stale lock: %v", err)
+	}
+	unlock()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the lock file is left after unlocking: %v", err)
+	}
+}
+
+func TestCacheUnlockBroken(t *testing.T) {
+	cache := newTestCache(t)
+	path := filepath.Join(cache.root, "locks", hashHex([]byte("k"))+".lock")
+	unlock, err := cache.lock("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A run that takes too long has its lock broken and taken by another
+	old := time.Now().Add(-cacheLockStale - time.Minute)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	unlockNew, err := cache.lock("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("unlocking a broken lock removed the one taken after it: %v", err)
+	}
+	unlockNew()
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("files left in the lock folder: %v", entries)
+	}
+}
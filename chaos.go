@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+	"github.com/privatesquare/bkst-go-utils/utils/errors"
+)
+
+// Developer flags for exercising error handling. They are parsed separately from the
+// normal flags so they never show up in --help:
+//
+//	--chaos_fail_rate 0.1     fail this fraction of Anki-Connect requests
+//	--chaos_latency 2s        delay each Anki-Connect request by up to this long
+//	--chaos_corrupt_rate 0.1  corrupt this fraction of media files retrieved from Anki
+//	--chaos_seed 42           seed for reproducible failures (default: time based)
+//	--stress 20               run the command this many times and summarize the results
+type chaosConfig struct {
+	failRate    float64
+	latency     time.Duration
+	corruptRate float64
+
+	// mu guards rng, which downloads running in parallel share
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// chaos is the active failure injection, nil when disabled.
+var chaos *chaosConfig
+
+const chaosFlagPrefix = "chaos_"
+
+// extractDevFlags removes the chaos and stress flags from args, configuring failure
+// injection or running the stress test as requested, and returns the remaining args.
+func extractDevFlags(args []string) []string {
+	fs := flag.NewFlagSet("chaos", flag.ExitOnError)
+	failRate := fs.Float64("chaos_fail_rate", 0, "")
+	latency := fs.Duration("chaos_latency", 0, "")
+	corruptRate := fs.Float64("chaos_corrupt_rate", 0, "")
+	seed := fs.Int64("chaos_seed", 0, "")
+	stress := fs.Int("stress", 0, "")
+
+	var rest, dev []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if !strings.HasPrefix(args[i], "-") || !(strings.HasPrefix(name, chaosFlagPrefix) || name == "stress" || strings.HasPrefix(name, "stress=")) {
+			rest = append(rest, args[i])
+			continue
+		}
+		dev = append(dev, args[i])
+		if !strings.Contains(name, "=") && i+1 < len(args) {
+			i++
+			dev = append(dev, args[i])
+		}
+	}
+	if len(dev) == 0 {
+		return args
+	}
+	fs.Parse(dev)
+
+	if *stress > 0 {
+		runStress(*stress, rest, dev, *seed)
+	}
+
+	if *failRate > 0 || *latency > 0 || *corruptRate > 0 {
+		if *seed == 0 {
+			*seed = time.Now().UnixNano()
+		}
+		chaos = &chaosConfig{failRate: *failRate, latency: *latency, corruptRate: *corruptRate, rng: rand.New(rand.NewSource(*seed))}
+		fmt.Printf("chaos: fail rate %.2f, latency up to %v, corrupt rate %.2f, seed %d\n", *failRate, *latency, *corruptRate, *seed)
+	}
+	return rest
+}
+
+// request is called before every Anki-Connect request and may delay or fail it.
+func (c *chaosConfig) request(action string) *errors.RestErr {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	var delay time.Duration
+	if c.latency > 0 {
+		delay = time.Duration(c.rng.Int63n(int64(c.latency)))
+	}
+	fail := c.rng.Float64() < c.failRate
+	c.mu.Unlock()
+	time.Sleep(delay)
+	if fail {
+		msg := fmt.Sprintf("chaos: injected failure for %s", action)
+		return &errors.RestErr{Message: msg, StatusCode: http.StatusInternalServerError, Error: msg}
+	}
+	return nil
+}
+
+// media may corrupt the base64 contents of a media file by truncating it, flipping bytes
+// or breaking the encoding.
+func (c *chaosConfig) media(data *string) *string {
+	if c == nil || data == nil {
+		return data
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rng.Float64() >= c.corruptRate {
+		return data
+	}
+	raw, err := base64.StdEncoding.DecodeString(*data)
+	if err != nil || len(raw) == 0 {
+		return data
+	}
+	var corrupted string
+	switch c.rng.Intn(3) {
+	case 0:
+		corrupted = base64.StdEncoding.EncodeToString(raw[:len(raw)/2])
+	case 1:
+		for i := 0; i < max(len(raw)/100, 1); i++ {
+			raw[c.rng.Intn(len(raw))] ^= 0xff
+		}
+		corrupted = base64.StdEncoding.EncodeToString(raw)
+	default:
+		corrupted = (*data)[:len(*data)/2] + "!!"
+	}
+	return &corrupted
+}
+
+// withChaos installs failure injection on an Anki-Connect client when enabled.
+func withChaos(client *ankiconnect.Client) *ankiconnect.Client {
+	if chaos == nil {
+		return client
+	}
+	client.Cards = chaosCards{client.Cards}
+	client.Notes = chaosNotes{client.Notes}
+	return client
+}
+
+type chaosCards struct{ ankiconnect.CardsManager }
+
+func (m chaosCards) Search(query string) (*[]int64, *errors.RestErr) {
+	if err := chaos.request("findCards"); err != nil {
+		return nil, err
+	}
+	return m.CardsManager.Search(query)
+}
+
+func (m chaosCards) Get(query string) (*[]ankiconnect.ResultCardsInfo, *errors.RestErr) {
+	if err := chaos.request("cardsInfo"); err != nil {
+		return nil, err
+	}
+	return m.CardsManager.Get(query)
+}
+
+type chaosNotes struct{ ankiconnect.NotesManager }
+
+func (m chaosNotes) Search(query string) (*[]int64, *errors.RestErr) {
+	if err := chaos.request("findNotes"); err != nil {
+		return nil, err
+	}
+	return m.NotesManager.Search(query)
+}
+
+func (m chaosNotes) Get(query string) (*[]ankiconnect.ResultNotesInfo, *errors.RestErr) {
+	if err := chaos.request("notesInfo"); err != nil {
+		return nil, err
+	}
+	return m.NotesManager.Get(query)
+}
+
+func (m chaosNotes) Update(note ankiconnect.UpdateNote) *errors.RestErr {
+	if err := chaos.request("updateNoteFields"); err != nil {
+		return err
+	}
+	return m.NotesManager.Update(note)
+}
+
+// runStress runs this program n times with args, passing on the chaos flags with a
+// different seed per run, then prints a summary and exits.
+func runStress(n int, args, dev []string, seed int64) {
+	exe, err := os.Executable()
+	if err != nil {
+		fatalf("stress: %v", err)
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	// Drop --stress and --chaos_seed, every run gets its own seed
+	var chaosArgs []string
+	for i := 0; i < len(dev); i++ {
+		name := strings.TrimLeft(dev[i], "-")
+		valueNext := !strings.Contains(name, "=") && i+1 < len(dev)
+		if strings.HasPrefix(name, "stress") || strings.HasPrefix(name, "chaos_seed") {
+			if valueNext {
+				i++
+			}
+			continue
+		}
+		chaosArgs = append(chaosArgs, dev[i])
+		if valueNext {
+			i++
+			chaosArgs = append(chaosArgs, dev[i])
+		}
+	}
+
+	failures := map[string]int{}
+	ok := 0
+	var total time.Duration
+	for i := 0; i < n; i++ {
+		runSeed := seed + int64(i)
+		cmdArgs := append(append([]string{}, args...), chaosArgs...)
+		// The config file's settings are already in args
+		cmdArgs = append(cmdArgs, fmt.Sprintf("--chaos_seed=%d", runSeed), "--config=")
+
+		var out bytes.Buffer
+		cmd := exec.Command(exe, cmdArgs...)
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		start := time.Now()
+		err := cmd.Run()
+		elapsed := time.Since(start)
+		total += elapsed
+
+		if err == nil {
+			ok++
+			fmt.Printf("run %d/%d (seed %d): ok in %v\n", i+1, n, runSeed, elapsed.Round(time.Millisecond))
+			continue
+		}
+		reason := lastErrorLine(out.String())
+		failures[reason]++
+		fmt.Printf("run %d/%d (seed %d): failed in %v: %s\n", i+1, n, runSeed, elapsed.Round(time.Millisecond), reason)
+	}
+
+	fmt.Printf("\n%d runs: %d ok, %d failed, average %v\n", n, ok, n-ok, (total / time.Duration(n)).Round(time.Millisecond))
+	reasons := make([]string, 0, len(failures))
+	for reason := range failures {
+		reasons = append(reasons, reason)
+	}
+	sort.SliceStable(reasons, func(i, j int) bool { return failures[reasons[i]] > failures[reasons[j]] })
+	for _, reason := range reasons {
+		fmt.Printf("  %4d  %s\n", failures[reason], reason)
+	}
+	if ok < n {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// lastErrorLine picks the most useful line from a failed run's output.
+func lastErrorLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	for _, prefix := range []string{"error: ", "REST error details: ", "panic: "} {
+		for i := len(lines) - 1; i >= 0; i-- {
+			if strings.HasPrefix(lines[i], prefix) {
+				return strings.TrimSpace(lines[i])
+			}
+		}
+	}
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Cloze note types keep their text with the deletions marked, e.g. "{{c1::入る::verb}} the
+// room", and Anki renders a card of them by its number: card 1 asks c1, card 2 c2. --cloze
+// renders the marked up fields of each card instead of exporting the markup:
+//
+//	keep      the markup as it is in Anki
+//	strip     the markup removed, leaving the answers
+//	full      the answer side: every answer, the card's own marked like Anki does
+//	question  the question side: the card's deletions blanked as [...], or [hint] with a hint
+//	both      the question side, with the answer side in an Answer column
+var clozeModes = []string{"keep", "strip", "full", "question", "both"}
+
+// clozeNode is a run of text, or a deletion holding more nodes when numbers is set.
+type clozeNode struct {
+	text    string
+	numbers []int
+	content []clozeNode
+	hint    string
+}
+
+// parseCloze splits text into its deletions, which can be nested. Markup that isn't closed is
+// kept as text.
+func parseCloze(text string) []clozeNode {
+	nodes, rest := parseClozeNodes(text, false)
+	if rest != "" {
+		nodes = append(nodes, clozeNode{text: rest})
+	}
+	return nodes
+}
+
+// parseClozeNodes parses text up to the }} closing the deletion it is in with inside, and
+// returns the rest after it. The :: starting a hint is left in the rest too.
+func parseClozeNodes(text string, inside bool) ([]clozeNode, string) {
+	var nodes []clozeNode
+	var plain strings.Builder
+	flush := func() {
+		if plain.Len() > 0 {
+			nodes = append(nodes, clozeNode{text: plain.String()})
+			plain.Reset()
+		}
+	}
+	for text != "" {
+		if inside && (strings.HasPrefix(text, "}}") || strings.HasPrefix(text, "::")) {
+			flush()
+			return nodes, text
+		}
+		if numbers, body, found := clozeStart(text); found {
+			content, rest := parseClozeNodes(body, true)
+			hint := ""
+			if strings.HasPrefix(rest, "::") {
+				end := strings.Index(rest, "}}")
+				if end < 0 {
+					plain.WriteString(text[:2])
+					text = text[2:]
+					continue
+				}
+				hint, rest = rest[2:end], rest[end:]
+			}
+			if strings.HasPrefix(rest, "}}") {
+				flush()
+				nodes = append(nodes, clozeNode{numbers: numbers, content: content, hint: hint})
+				text = rest[2:]
+				continue
+			}
+		}
+		_, size := utf8.DecodeRuneInString(text)
+		plain.WriteString(text[:size])
+		text = text[size:]
+	}
+	flush()
+	return nodes, ""
+}
+
+// clozeStart returns the numbers of the deletion text starts with, e.g. 1 and 2 for
+// {{c1,2::, and what follows its ::.
+func clozeStart(text string) ([]int, string, bool) {
+	if !strings.HasPrefix(text, "{{c") {
+		return nil, "", false
+	}
+	spec, body, found := strings.Cut(text[3:], "::")
+	if !found {
+		return nil, "", false
+	}
+	var numbers []int
+	for _, n := range strings.Split(spec, ",") {
+		number, err := strconv.Atoi(n)
+		if err != nil || number < 1 {
+			return nil, "", false
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, body, true
+}
+
+// hasCloze reports whether text has deletions.
+func hasCloze(text string) bool {
+	for _, n := range parseCloze(text) {
+		if n.numbers != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// clozeField renders a field of the card with template ordinal ord like --cloze mode says.
+// Both modes' Answer column is rendered with the full mode.
+func clozeField(value string, ord int64, mode string) string {
+	switch mode {
+	case "keep":
+		return value
+	case "both":
+		return renderCloze(value, ord, "question")
+	}
+	return renderCloze(value, ord, mode)
+}
+
+// renderCloze renders text for the card of the note with template ordinal ord, the
+// question side or the answer side, or with only the answers for neither.
+func renderCloze(text string, ord int64, mode string) string {
+	var b strings.Builder
+	var render func(nodes []clozeNode)
+	render = func(nodes []clozeNode) {
+		for _, n := range nodes {
+			asked := false
+			for _, number := range n.numbers {
+				asked = asked || int64(number) == ord+1
+			}
+			switch {
+			case n.numbers == nil:
+				b.WriteString(n.text)
+			case asked && mode == "question" && n.hint != "":
+				b.WriteString("[" + n.hint + "]")
+			case asked && mode == "question":
+				b.WriteString("[...]")
+			case asked && mode == "full":
+				b.WriteString(`<span class="cloze">`)
+				render(n.content)
+				b.WriteString("</span>")
+			default:
+				render(n.content)
+			}
+		}
+	}
+	render(parseCloze(text))
+	return b.String()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCloze(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []clozeNode
+	}{
+		{"plain", "入る", []clozeNode{{text: "入る"}}},
+		{"deletion", "{{c1::入る}}に", []clozeNode{
+			{numbers: []int{1}, content: []clozeNode{{text: "入る"}}},
+			{text: "に"},
+		}},
+		{"hint", "{{c1::入る::verb}}", []clozeNode{
+			{numbers: []int{1}, content: []clozeNode{{text: "入る"}}, hint: "verb"},
+		}},
+		{"several numbers", "{{c1,2::部屋}}", []clozeNode{
+			{numbers: []int{1, 2}, content: []clozeNode{{text: "部屋"}}},
+		}},
+		{"nested", "{{c1::a {{c2::b}} c}}", []clozeNode{
+			{numbers: []int{1}, content: []clozeNode{
+				{text: "a "},
+				{numbers: []int{2}, content: []clozeNode{{text: "b"}}},
+				{text: " c"},
+			}},
+		}},
+		{"nested with hint", "{{c1::{{c2::b::inner}}::outer}}", []clozeNode{
+			{numbers: []int{1}, content: []clozeNode{
+				{numbers: []int{2}, content: []clozeNode{{text: "b"}}, hint: "inner"},
+			}, hint: "outer"},
+		}},
+		{"unclosed", "{{c1::入る", []clozeNode{{text: "{{c1::入る"}}},
+		{"unclosed hint", "{{c1::入る::verb", []clozeNode{{text: "{{c1::入る::verb"}}},
+		{"unclosed after a deletion", "{{c1::a}} {{c2::b", []clozeNode{
+			{numbers: []int{1}, content: []clozeNode{{text: "a"}}},
+			{text: " {{c2::b"},
+		}},
+		{"no number", "{{c::a}}", []clozeNode{{text: "{{c::a}}"}}},
+		{"number 0", "{{c0::a}}", []clozeNode{{text: "{{c0::a}}"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseCloze(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCloze(%q) = %+v, want %+v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClozeField(t *testing.T) {
+	const (
+		hinted   = "{{c1::入る::verb}}、<b>{{c2::部屋}}</b>に"
+		nested   = "{{c1::a {{c2::b}} c}}"
+		multi    = "{{c1,2::x}} y"
+		unclosed = "{{c1::open"
+	)
+	tests := []struct {
+		text, mode string
+		ord0, ord1 string
+	}{
+		{hinted, "keep", hinted, hinted},
+		{hinted, "strip", "入る、<b>部屋</b>に", "入る、<b>部屋</b>に"},
+		{hinted, "full", `<span class="cloze">入る</span>、<b>部屋</b>に`, `入る、<b><span class="cloze">部屋</span></b>に`},
+		{hinted, "question", "[verb]、<b>部屋</b>に", "入る、<b>[...]</b>に"},
+		{hinted, "both", "[verb]、<b>部屋</b>に", "入る、<b>[...]</b>に"},
+
+		{nested, "keep", nested, nested},
+		{nested, "strip", "a b c", "a b c"},
+		{nested, "full", `<span class="cloze">a b c</span>`, `a <span class="cloze">b</span> c`},
+		{nested, "question", "[...]", "a [...] c"},
+		{nested, "both", "[...]", "a [...] c"},
+
+		{multi, "keep", multi, multi},
+		{multi, "strip", "x y", "x y"},
+		{multi, "full", `<span class="cloze">x</span> y`, `<span class="cloze">x</span> y`},
+		{multi, "question", "[...] y", "[...] y"},
+		{multi, "both", "[...] y", "[...] y"},
+
+		{unclosed, "keep", unclosed, unclosed},
+		{unclosed, "strip", unclosed, unclosed},
+		{unclosed, "full", unclosed, unclosed},
+		{unclosed, "question", unclosed, unclosed},
+		{unclosed, "both", unclosed, unclosed},
+	}
+	for _, tt := range tests {
+		for ord, want := range []string{tt.ord0, tt.ord1} {
+			if got := clozeField(tt.text, int64(ord), tt.mode); got != want {
+				t.Errorf("clozeField(%q, %d, %s) = %q, want %q", tt.text, ord, tt.mode, got, want)
+			}
+		}
+	}
+}
+
+func TestHasCloze(t *testing.T) {
+	for text, want := range map[string]bool{
+		"{{c1::入る}}":  true,
+		"a {{c2::b}}": true,
+		"入る":          false,
+		"{{c1::入る":    false,
+	} {
+		if got := hasCloze(text); got != want {
+			t.Errorf("hasCloze(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
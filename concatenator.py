@@ -1,9 +1,38 @@
 import os
+import csv
+import re
+import json
+import time
+import datetime
+import hashlib
 import argparse
 import random
 import sys  
+import math
+import queue
+import shlex
+import shutil
+import posixpath
+import threading
+import tempfile
+import subprocess
+import email.utils
+import urllib.parse
+import xml.etree.ElementTree as ET
 
 from pydub import AudioSegment, effects
+from pydub.generators import Sine
+
+from atomicfile import atomicOutput, writeFileAtomic
+import workspace
+from workspace import RunWorkspace, addWorkspaceArgument, useWorkspace, safeName
+from tagphrases import loadTagPhrases, tagPhraseFor, tagPhraseFile, tagMatches
+from tagpatterns import loadTagPatterns, tagPatternFor
+from progressclips import progressPhrase, progressClipFiles
+from spokentemplates import parseTemplate, templateClipFile
+from validation import ValidationReport
+from bandwidth import TransferLimits
+from spreadsheetcells import isSpreadsheetSafe, unescapeRow
 
 def remove_trailing_silence(sound, silence_threshold=-50.0, chunk_size=10):
     """
@@ -33,92 +62,1163 @@ def remove_trailing_silence(sound, silence_threshold=-50.0, chunk_size=10):
     trimmed_sound = sound[:end_trim]
     return trimmed_sound
 
-def combine_words_and_definitions(words_folder, definitions_folder, output_file, startIndex, endIndex, repeatCount, wordPause, definitionPause, normalize): 
-    combined_audio = AudioSegment.empty()
+# compression settings:
+_threshold = -20
+_ratio = 3
+_attack = 10
+_release = 75
+
+# Sample rate and channels every clip is converted to, so clips from different sources join
+# cleanly. Chosen from the clips of the lesson before building it
+clip_format = None
+
+# Loudness of every clip a session has loaded, by folder and file name, kept in the session
+# state so it can be looked at when choosing thresholds. Set up by main from the last
+# session's: the measurements, and with --normalize the normalized clip saved in
+# normalized_folder, are reused for clips whose file hasn't changed
+clip_manifest = None
+normalized_folder = None
+
+# Sample rates by MPEG version bits of an MP3 frame header
+_mpeg_sample_rates = {3: (44100, 48000, 32000), 2: (22050, 24000, 16000), 0: (11025, 12000, 8000)}
+
+def mp3_format(filename):
+    """
+    Returns (sample rate, channels) from the first frame header of an MP3 file without
+    decoding it, or None if it has no MP3 frames.
+    """
+    with open(filename, 'rb') as f:
+        data = f.read(10)
+        # Skip an ID3v2 tag, whose size is stored in 7 bit bytes
+        if len(data) == 10 and data[:3] == b'ID3':
+            f.seek(10 + (data[6] << 21 | data[7] << 14 | data[8] << 7 | data[9]) + (10 if data[5] & 0x10 else 0))
+            data = b''
+        data += f.read(65536)
+    for i in range(len(data) - 3):
+        if data[i] != 0xFF or data[i + 1] & 0xE0 != 0xE0:
+            continue
+        version, layer = data[i + 1] >> 3 & 3, data[i + 1] >> 1 & 3
+        bitrate, rate = data[i + 2] >> 4, data[i + 2] >> 2 & 3
+        if version == 1 or layer == 0 or bitrate in (0, 15) or rate == 3:
+            continue
+        return _mpeg_sample_rates[version][rate], 1 if data[i + 3] >> 6 == 3 else 2
+    return None
+
+# Bitrates in kbit/s by the bitrate bits of a layer III frame header, for MPEG 1 and MPEG 2 or 2.5
+_mp3_bitrates = {3: (0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320),
+                 2: (0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160)}
+
+def mp3_duration_ms(filename):
+    """
+    Estimates how long an MP3 file plays without decoding it: from the frame count of its Xing
+    or Info header, which VBR encoders write, or else from its size at the bitrate of its first
+    frame. Returns None if it has no layer III frames.
+    """
+    size = os.path.getsize(filename)
+    with open(filename, 'rb') as f:
+        start = 0
+        data = f.read(10)
+        if len(data) == 10 and data[:3] == b'ID3':
+            start = 10 + (data[6] << 21 | data[7] << 14 | data[8] << 7 | data[9]) + (10 if data[5] & 0x10 else 0)
+            f.seek(start)
+            data = b''
+        data += f.read(65536)
+    for i in range(len(data) - 3):
+        if data[i] != 0xFF or data[i + 1] & 0xE0 != 0xE0:
+            continue
+        version, layer = data[i + 1] >> 3 & 3, data[i + 1] >> 1 & 3
+        bitrate, rate = data[i + 2] >> 4, data[i + 2] >> 2 & 3
+        if version == 1 or layer != 1 or bitrate in (0, 15) or rate == 3:
+            continue
+        mono = data[i + 3] >> 6 == 3
+        rate = _mpeg_sample_rates[version][rate]
+        samples = 1152 if version == 3 else 576
+        side_info = (17 if mono else 32) if version == 3 else (9 if mono else 17)
+        xing = i + 4 + side_info
+        if data[xing:xing + 4] in (b'Xing', b'Info') and len(data) >= xing + 12 and data[xing + 7] & 1:
+            frames = int.from_bytes(data[xing + 8:xing + 12], 'big')
+            return frames * samples * 1000 // rate
+        kbps = _mp3_bitrates[3 if version == 3 else 2][bitrate]
+        return (size - start - i) * 8 // kbps
+    return None
+
+# Speaking rate for estimating the length of clips that can't be measured, about what TTS
+# engines read at
+speech_ms_per_char = 70
+speech_lead_ms = 300
+
+def speech_ms(text):
+    """Estimates how long text takes a TTS engine to read, from its length without HTML."""
+    text = re.sub(r'<[^>]*>|\[sound:[^\]]*\]', '', text or '').strip()
+    return speech_lead_ms + speech_ms_per_char * len(text)
+
+def clip_ms(filename, text):
+    """Estimates how long a clip plays, from its MP3 header, or from the text it reads."""
+    try:
+        ms = mp3_duration_ms(filename)
+    except OSError:
+        ms = None
+    return speech_ms(text) if ms is None else ms
+
+def estimate_card_ms(word_ms, definition_ms, pattern, opt):
+    """
+    Estimates how long one repeat of a card plays with its pattern, like
+    combine_words_and_definitions builds it, leaving out topic announcements and prompts.
+    """
+    word_pause = pattern.get('pause_after_word', opt.pause_after_word)
+    definition_pause = pattern.get('pause_after_definition', opt.pause_after_definition)
+    if pattern.get('mode', opt.mode) != 'shadowing':
+        return word_ms + word_pause + definition_ms + definition_pause
+    shadow_pause = pattern.get('shadow_pause', opt.shadow_pause)
+    if shadow_pause is None:
+        shadow_pause = int(definition_ms * pattern.get('shadow_pause_factor', opt.shadow_pause_factor)) + 500
+    ms = definition_ms + shadow_pause + word_ms
+    if pattern.get('shadow_repeat', opt.shadow_repeat):
+        ms += word_pause + definition_ms + shadow_pause
+    return ms + definition_pause
+
+def describe_format(fmt):
+    rate, channels = fmt
+    return f"{rate} Hz {'mono' if channels == 1 else 'stereo'}"
+
+def load_clip(filename, normalize):
+    """
+    Loads an audio clip, converts it to clip_format, removes trailing silence and optionally
+    normalizes it.
+    """
+    entry = manifest_entry(filename)
+    cached = normalized_clip(entry) if normalize else None
+    if cached is not None:
+        audio = AudioSegment.from_wav(cached)
+    else:
+        audio = process_clip(filename, normalize, entry)
+
+    # Keep the processed clip when debugging with --keep_temp
+    ws = workspace.currentWorkspace
+    if ws is not None and ws.keep:
+        kept = ws.path('clips', os.path.basename(os.path.dirname(filename)), os.path.basename(filename))
+        if not os.path.exists(kept):
+            audio.export(kept, format="mp3")
+    return audio
+
+def process_clip(filename, normalize, entry):
+    """
+    Does the work of load_clip, measuring the clip into its clip_manifest entry if it has one.
+    """
+    audio = AudioSegment.from_mp3(filename)
+    if clip_format is not None:
+        rate, channels = clip_format
+        if audio.frame_rate != rate:
+            audio = audio.set_frame_rate(rate)
+        if audio.channels != channels:
+            audio = audio.set_channels(channels)
+    audio = remove_trailing_silence(audio)
+    if entry is not None and 'loudness' not in entry:
+        entry['loudness'], entry['peak'] = measure_loudness(audio)
+
+    if normalize:
+        audio = effects.normalize(audio)
+        audio = effects.compress_dynamic_range(
+            audio,
+            threshold = _threshold,
+            ratio = _ratio,
+            attack = _attack,
+            release = _release
+        )
+        audio = effects.normalize(audio)
+        if entry is not None:
+            loudness, peak = measure_loudness(audio)
+            name = entry['digest'][:16] + '.wav'
+            os.makedirs(normalized_folder, exist_ok=True)
+            audio.export(os.path.join(normalized_folder, name), format='wav')
+            entry['normalized'] = {'file': name, 'format': list(clip_format or []), 'loudness': loudness, 'peak': peak}
+    return audio
+
+def normalized_clip(entry):
+    """
+    Returns the file of the normalized clip saved for a clip_manifest entry, or None if there
+    is none for the current clip_format.
+    """
+    normalized = (entry or {}).get('normalized')
+    if normalized is None or normalized.get('format') != list(clip_format or []):
+        return None
+    path = os.path.join(normalized_folder, normalized['file'])
+    return path if os.path.exists(path) else None
+
+def manifest_entry(filename):
+    """
+    Returns the clip_manifest entry of a clip file, a new one if the file changed since it
+    was measured, or None without a manifest.
+    """
+    if clip_manifest is None:
+        return None
+    name = os.path.basename(os.path.dirname(filename)) + '/' + os.path.basename(filename)
+    digest = file_digest(filename)
+    entry = clip_manifest.get(name)
+    if entry is None or entry.get('digest') != digest:
+        entry = clip_manifest[name] = {'digest': digest}
+    return entry
+
+def prune_normalized_clips():
+    """
+    Removes the normalized clips of files that changed since they were normalized. They are
+    named by content, so clips with the same audio share one.
+    """
+    used = {entry['normalized']['file'] for entry in clip_manifest.values() if 'normalized' in entry}
+    if os.path.isdir(normalized_folder):
+        for name in os.listdir(normalized_folder):
+            if name not in used:
+                os.remove(os.path.join(normalized_folder, name))
+
+def measure_loudness(audio):
+    """
+    Measures the integrated loudness of audio, gated like EBU R 128 but without its
+    K-weighting filter, and its sample peak. Returns both in dB relative to full scale, rounded
+    to a tenth, with None for silence.
+    """
+    if len(audio) == 0 or audio.rms == 0:
+        return None, None
+    full_scale = audio.max_possible_amplitude
+    # Mean square of 400 ms blocks overlapping by 75%, summed over the channels
+    blocks = [(audio[start:start + 400].rms / full_scale) ** 2 * audio.channels
+              for start in range(0, max(len(audio) - 400, 0) + 1, 100)]
+    def loudness(powers):
+        return -0.691 + 10 * math.log10(sum(powers) / len(powers))
+    gated = [p for p in blocks if p > 0 and loudness([p]) > -70]
+    if gated:
+        relative = loudness(gated) - 10
+        gated = [p for p in gated if loudness([p]) > relative]
+    if not gated:
+        return None, round(audio.max_dBFS, 1)
+    return round(loudness(gated), 1), round(audio.max_dBFS, 1)
 
-    word_files = [f for f in os.listdir(words_folder) if f.endswith('.mp3')]
-    definition_files = [f for f in os.listdir(definitions_folder) if f.endswith('.mp3')]
+def change_speed(audio, speed, name):
+    """
+    Plays audio at speed times its speed without changing its pitch, with ffmpeg's atempo
+    filter. name identifies the clip for the intermediate file.
+    """
+    ws = workspace.currentWorkspace
+    folder = ws.path('slow', '') if ws else tempfile.mkdtemp()
+    stretched = os.path.join(folder, f"{speed:g}x_{os.path.splitext(name)[0]}.wav")
+    audio.export(stretched, format="wav", parameters=["-filter:a", f"atempo={speed:g}"])
+    result = AudioSegment.from_file(stretched, format="wav")
+    if ws is None:
+        shutil.rmtree(folder, ignore_errors=True)
+    return result
+
+def list_clips(folder):
+    # Sort alphabetically so that indexes map consistently to words/definitions
+    files = [f for f in os.listdir(folder) if f.endswith('.mp3')]
+    files.sort()
+    return files
+
+def load_card_rows(card_file):
+    """
+    Loads the rows of the card CSV so clip indexes can be matched to card metadata.
+    """
+    safe = isSpreadsheetSafe(card_file)
+    with open(card_file, 'r', encoding='utf-8', errors='replace') as csvfile:
+        return [unescapeRow(row, safe) for row in csv.DictReader(csvfile)]
 
-     # Sort alphabetically so that indexes map consistently to words/definitions
-    word_files.sort()
-    definition_files.sort()
+def parse_template_tests(value):
+    """
+    Parses --template_tests, e.g. "0=definition,1=word", into the field each template ordinal
+    tests, keyed by the ordinal as the CSV's Template column writes it.
+    """
+    tests = {}
+    for entry in value.split(','):
+        ordinal, _, field = entry.partition('=')
+        ordinal, field = ordinal.strip(), field.strip().lower()
+        if not ordinal.isdigit() or field not in ('word', 'definition'):
+            raise ValueError(f"\"{entry.strip()}\" must be a template ordinal and the field it tests, e.g. 1=word")
+        tests[str(int(ordinal))] = field
+    return tests
 
-    # compression settings:
-    _threshold = -20
-    _ratio = 3
-    _attack = 10
-    _release = 75
+def card_difficulty(row):
+    """
+    Estimates how hard a card is from its Anki scheduling columns, from 0 (mature) to 1 (new).
+    Requires a CSV exported with --metadata_columns interval,reps,lapses,card_type.
+    """
+    reps = int(row.get('Reps') or 0)
+    if reps == 0 or row.get('CardType') == 'new':
+        return 1.0
+    interval = int(row.get('Interval') or 0)
+    lapses = int(row.get('Lapses') or 0)
+    maturity = 1.0 / (1.0 + max(interval, 0) / 21.0)
+    lapse_rate = min(lapses / reps, 1.0)
+    return 0.7 * maturity + 0.3 * lapse_rate
+
+def ramp_order(indexes, difficulties, shape, warmup, jitter):
+    """
+    Orders indexes from easy to hard.
+
+    Shapes:
+    - linear: every card sorted by difficulty, with some jitter so the order still varies between repeats.
+    - warmup: only the easiest `warmup` cards are played first, the rest are shuffled.
+    """
+    ranked = sorted(indexes, key=lambda i: difficulties[i])
+    if shape == 'warmup':
+        head = ranked[:warmup]
+        tail = ranked[warmup:]
+        random.shuffle(tail)
+        return head + tail
+
+    spread = jitter * len(ranked)
+    keyed = [(pos + random.uniform(-spread, spread), idx) for pos, idx in enumerate(ranked)]
+    keyed.sort()
+    return [idx for _, idx in keyed]
+
+def shadowing_segment(word_audio, definition_audio, wordPause, definitionPause, shadow_pause, shadow_pause_factor, shadow_repeat):
+    """
+    Builds one card for shadowing practice: the definition/sentence plays first, followed by
+    a pause long enough to repeat it aloud, then the word.
+
+    The repeat pause is shadow_pause milliseconds when given, otherwise it is sized from the
+    length of the definition clip.
+    """
+    if shadow_pause is None:
+        shadow_pause = int(len(definition_audio) * shadow_pause_factor) + 500
+
+    segment = definition_audio
+    segment += AudioSegment.silent(duration=shadow_pause)
+    segment += word_audio
+    if shadow_repeat:
+        segment += AudioSegment.silent(duration=wordPause)
+        segment += definition_audio
+        segment += AudioSegment.silent(duration=shadow_pause)
+    segment += AudioSegment.silent(duration=definitionPause)
+    return segment
+
+def group_sections(indexes, sections):
+    """
+    Splits indexes into (title, indexes) chapters in the order each section first appears.
+    Without sections everything is one untitled group.
+    """
+    if sections is None:
+        return [(None, indexes)]
+    groups = {}
+    for idx in indexes:
+        groups.setdefault(sections[idx] or "Other", []).append(idx)
+    return list(groups.items())
 
-    # Create a list of indexes within the specified range
-    indexes = list(range(startIndex, endIndex))
+def cue_time(ms):
+    # Cue sheets count in minutes, seconds and frames of 1/75 second
+    frames = ms * 75 // 1000
+    return f"{frames // (75 * 60):02d}:{(frames // 75) % 60:02d}:{frames % 75:02d}"
+
+def write_cue_sheet(audio_file, chapters):
+    """
+    Writes a .cue sheet next to an MP3 with one track per chapter.
+    """
+    cue_file = os.path.splitext(audio_file)[0] + ".cue"
+    name = os.path.basename(audio_file)
+    lines = [f'TITLE "{os.path.splitext(name)[0]}"', f'FILE "{name}" MP3']
+    for number, (title, start) in enumerate(chapters, 1):
+        lines.append(f'  TRACK {number:02d} AUDIO')
+        lines.append(f'    TITLE "{title.replace(chr(34), chr(39))}"')
+        lines.append(f'    INDEX 01 {cue_time(start)}')
+    writeFileAtomic(cue_file, '\n'.join(lines) + '\n')
+    print(f"Cue sheet created: {cue_file}")
+
+def export_with_chapters(audio, output_file, chapters, chapter_format, tags=None):
+    """
+    Exports audio as M4B or MKA with embedded chapter markers, and tags such as a comment.
+    """
+    def escape(text):
+        for c in '\\=;#\n':
+            text = text.replace(c, '\\' + c)
+        return text
+
+    ws = workspace.currentWorkspace
+    meta_file = ws.path(os.path.basename(output_file) + ".ffmeta") if ws else output_file + ".ffmeta"
+    with open(meta_file, 'w', encoding='utf-8') as f:
+        f.write(";FFMETADATA1\n")
+        for key, value in (tags or {}).items():
+            f.write(f"{key}={escape(value)}\n")
+        ends = [start for _, start in chapters[1:]] + [len(audio)]
+        for (title, start), end in zip(chapters, ends):
+            f.write(f"[CHAPTER]\nTIMEBASE=1/1000\nSTART={start}\nEND={end}\ntitle={escape(title)}\n")
+
+    container, codec = ("ipod", "aac") if chapter_format == 'm4b' else ("matroska", "libmp3lame")
+    try:
+        with atomicOutput(output_file) as tmp:
+            audio.export(tmp, format=container, codec=codec,
+                         parameters=["-i", meta_file, "-map", "0:a", "-map_metadata", "1", "-map_chapters", "1"])
+    finally:
+        if ws is None:
+            os.remove(meta_file)
+
+# ffmpeg container and codec of each --audio_format
+_lesson_formats = {'mp3': ('mp3', None), 'm4a': ('ipod', 'aac')}
+
+def export_lesson(audio, output_file, audio_format, tags=None):
+    """
+    Exports a lesson, or a part of one, as audio_format with tags such as a comment.
+    """
+    container, codec = _lesson_formats[audio_format]
+    audio.export(output_file, format=container, codec=codec, tags=tags or None)
+
+def lesson_credits(attribution, license, rows):
+    """
+    Returns the credit line of a lesson of rows, e.g. "JP1K by Refold. License: CC BY-SA 4.0",
+    and its license. Without attribution or license, they come from the cards' attribution::
+    and license:: tags, e.g. license::CC-BY-SA-4.0, with underscores read as spaces, the same
+    as anki_downloader's.
+    """
+    found = {'attribution': [], 'license': []}
+    for row in rows:
+        for tag in (row.get('Tags') or '').split():
+            kind, sep, value = tag.partition('::')
+            kind = kind.lower()
+            value = value.replace('_', ' ')
+            if sep and value and kind in found and value not in found[kind]:
+                found[kind].append(value)
+    attribution = (attribution or '; '.join(found['attribution'])).strip()
+    license = (license or '; '.join(found['license'])).strip()
+    parts = ([attribution.rstrip('.')] if attribution else []) + ([f"License: {license}"] if license else [])
+    return '. '.join(parts), license
+
+def credit_tags(credits, license):
+    """
+    Returns the tags that credit the deck in a lesson file: an ID3 or MP4 comment and copyright.
+    """
+    tags = {}
+    if credits:
+        tags['comment'] = credits
+    if license:
+        tags['copyright'] = license
+    return tags
+
+# DTMF (row, column) frequencies for each key
+_dtmf_keys = {
+    '1': (697, 1209), '2': (697, 1336), '3': (697, 1477),
+    '4': (770, 1209), '5': (770, 1336), '6': (770, 1477),
+    '7': (852, 1209), '8': (852, 1336), '9': (852, 1477),
+    '*': (941, 1209), '0': (941, 1336), '#': (941, 1477),
+}
+
+def bookmark_tones(index, volume, tone_length=40, tone_gap=40):
+    """
+    Builds a quiet DTMF sequence "*<index>#" that a decoder can use to find the current card.
+    Each key is tone_length milliseconds long and followed by tone_gap milliseconds of silence.
+    """
+    sequence = AudioSegment.empty()
+    for key in f"*{index}#":
+        low, high = _dtmf_keys[key]
+        # Each sine is 6 dB below the target so the sum peaks at the requested volume
+        tone = Sine(low).to_audio_segment(duration=tone_length, volume=volume - 6)
+        tone = tone.overlay(Sine(high).to_audio_segment(duration=tone_length, volume=volume - 6))
+        sequence += tone.fade_in(5).fade_out(5)
+        sequence += AudioSegment.silent(duration=tone_gap)
+    return sequence
+
+def file_digest(filename):
+    with open(filename, 'rb') as f:
+        return hashlib.sha256(f.read()).hexdigest()
+
+def write_checksum(output_file):
+    """
+    Writes the SHA-256 of a lesson file to <file>.sha256 next to it, in the format of
+    sha256sum, so a copy on a phone or SD card can be checked with "anki_downloader
+    verify-output" or sha256sum -c.
+    """
+    writeFileAtomic(output_file + ".sha256", f"{file_digest(output_file)}  {os.path.basename(output_file)}\n")
+
+def session_fingerprint(folders, indexes, names, settings):
+    """
+    Fingerprints the content of a session: the audio of every card plus the settings that
+    change how it sounds. Shuffle order is ignored so identical material compares equal.
+
+    Returns the overall digest and a digest per card, keyed by the card's word when known.
+    """
+    clips = [(folder, list_clips(folder)) for folder in folders]
+    cards = {}
+    for idx in indexes:
+        h = hashlib.sha256()
+        for folder, files in clips:
+            h.update(file_digest(os.path.join(folder, files[idx])).encode('ascii'))
+        cards[names.get(idx) or f"#{idx}"] = h.hexdigest()
+    overall = hashlib.sha256(json.dumps({'cards': cards, 'settings': settings}, sort_keys=True).encode('utf-8'))
+    return overall.hexdigest(), cards
+
+def compare_sessions(previous, cards):
+    """
+    Returns the numbers of new, changed and removed cards since the previous session.
+    """
+    old = previous.get('cards', {})
+    new = sum(1 for k in cards if k not in old)
+    changed = sum(1 for k in cards if k in old and old[k] != cards[k])
+    removed = sum(1 for k in old if k not in cards)
+    return new, changed, removed
+
+# Held while the session state is rewritten, since uploads record themselves in it from their thread
+_session_state_lock = threading.Lock()
+
+def load_session_state(state_file):
+    try:
+        with open(state_file, 'r', encoding='utf-8') as f:
+            return json.load(f)
+    except (OSError, ValueError):
+        return None
+
+def save_session_state(state_file, fingerprint, cards, settings, published, clips):
+    """
+    Records the session just built. The files it published are listed by name, and the
+    uploads recorded by record_upload are kept.
+    """
+    with _session_state_lock:
+        uploads = (load_session_state(state_file) or {}).get('uploads', {})
+        writeFileAtomic(state_file, json.dumps({'fingerprint': fingerprint, 'built': time.strftime('%Y-%m-%dT%H:%M:%S'),
+                                                'output': os.path.basename(published[0]), 'settings': settings, 'cards': cards,
+                                                'clips': clips, 'published': [os.path.basename(f) for f in published],
+                                                'uploads': uploads},
+                                               ensure_ascii=False, indent=2))
+
+def record_upload(state_file, name, digest):
+    """
+    Records in the session state that the file called name was uploaded with the given
+    digest, or with digest None that its uploaded copy was deleted.
+    """
+    with _session_state_lock:
+        state = load_session_state(state_file) or {}
+        uploads = state.setdefault('uploads', {})
+        if digest is None:
+            uploads.pop(name, None)
+        else:
+            uploads[name] = digest
+        writeFileAtomic(state_file, json.dumps(state, ensure_ascii=False, indent=2))
+
+def load_play_history(history_file):
+    """
+    Loads the cross-session play history: {"sessions": count, "cards": {key: {"first": n, "appearances": [n, ...],
+    "last_played": "YYYY-MM-DD"}}}.
+    """
+    try:
+        with open(history_file, 'r', encoding='utf-8') as f:
+            return json.load(f)
+    except FileNotFoundError:
+        return {'sessions': 0, 'cards': {}}
+
+def save_play_history(history_file, history):
+    writeFileAtomic(history_file, json.dumps(history, ensure_ascii=False, indent=2))
+
+def card_key(row, idx):
+    """
+    Identifies a card across sessions by its note ID or word, falling back to its index.
+    """
+    if row:
+        return row.get('NoteID') or row.get('Word') or f"#{idx}"
+    return f"#{idx}"
+
+def load_exclusions(exclude_file):
+    """
+    Loads the keys (see card_key) of known cards to leave out of sessions, one per line.
+    anki_downloader's "skips confirm" command adds cards skipped during playback.
+    """
+    try:
+        with open(exclude_file, 'r', encoding='utf-8') as f:
+            lines = [line.split('#', 1)[0].strip() for line in f]
+    except FileNotFoundError:
+        return set()
+    return {line for line in lines if line}
+
+def load_curriculum(filename):
+    """
+    Loads a curriculum: tags in teaching order, one per line or separated by commas, with
+    # comments.
+    """
+    with open(filename, 'r', encoding='utf-8') as f:
+        lines = [line.split('#', 1)[0] for line in f]
+    tags = [tag.strip().lower() for line in lines for tag in line.split(',') if tag.strip()]
+    if not tags:
+        raise ValueError(f"{filename} lists no tags")
+    for tag in tags:
+        if tags.count(tag) > 1:
+            raise ValueError(f"tag \"{tag}\" is listed twice")
+    return tags
+
+def curriculum_units(indexes, rows, curriculum):
+    """
+    Returns the position in the curriculum of the unit each card belongs to, the first tag
+    of the curriculum the card has, or None for cards in no unit.
+    """
+    units = {}
+    for idx in indexes:
+        tags = ((rows[idx] if idx < len(rows) else {}).get('Tags') or '').split()
+        units[idx] = next((unit for unit, tag in enumerate(curriculum) if tagMatches(tags, tag)), None)
+    return units
+
+def curriculum_session(indexes, rows, units, threshold):
+    """
+    Picks the cards of a curriculum session: the units in order, moving on to the next one
+    only while fewer than threshold of the cards in the units so far are due in Anki.
+    Returns the cards and the position of the last unit included.
+    """
+    chosen = []
+    due = 0
+    last = None
+    for unit in sorted({u for u in units.values() if u is not None}):
+        if chosen and due / len(chosen) >= threshold:
+            break
+        cards = [idx for idx in indexes if units[idx] == unit]
+        chosen += cards
+        due += sum(1 for idx in cards if is_anki_due(rows[idx] if idx < len(rows) else None))
+        last = unit
+    return chosen, last
+
+def write_timeline(output_file, timeline, keys, rows):
+    """
+    Writes where each card plays in the lesson next to it, so playback logs can be matched
+    back to cards ("anki_downloader skips import").
+    """
+    cards = []
+    for idx, start, end, response in timeline:
+        row = rows[idx] if idx < len(rows) else {}
+        card = {'index': idx, 'key': keys.get(idx, card_key(row, idx)), 'word': row.get('Word', ''),
+                'start_ms': start, 'end_ms': end}
+        # The confidence prompt and the gap after it, where a tap grades this card
+        if response is not None:
+            card['response_start_ms'], card['response_end_ms'] = response
+        cards.append(card)
+    writeFileAtomic(output_file + ".timeline.json", json.dumps({'output': os.path.basename(output_file),
+                    'built': time.strftime('%Y-%m-%dT%H:%M:%S'), 'cards': cards}, ensure_ascii=False, indent=2))
+
+_itunes_ns = 'http://www.itunes.com/dtds/podcast-1.0.dtd'
+_atom_ns = 'http://www.w3.org/2005/Atom'
+_episode_types = {'.mp3': 'audio/mpeg', '.m4a': 'audio/mp4', '.m4b': 'audio/x-m4b', '.mka': 'audio/x-matroska'}
+
+def update_feed(feed_file, output_file, episode_title, feed_title, base_url, duration_ms, keep_episodes, credits='', description=''):
+    """
+    Adds the lesson just built as the newest episode of a podcast feed, keeping the episodes
+    already in it. With keep_episodes, only that many of the newest episodes stay in the feed
+    and the files of older ones are deleted from the output folder. Returns the deleted files.
+    credits, if any, becomes the feed's copyright and goes at the end of the episode's
+    description.
+    """
+    ET.register_namespace('itunes', _itunes_ns)
+    ET.register_namespace('atom', _atom_ns)
+    base_url = base_url.rstrip('/')
+    root = channel = None
+    if os.path.exists(feed_file):
+        try:
+            root = ET.parse(feed_file).getroot()
+        except ET.ParseError as e:
+            print(f"error: failed to read feed {feed_file}: {e}")
+            sys.exit(1)
+        channel = root.find('channel')
+    if channel is None:
+        root = ET.Element('rss', {'version': '2.0'})
+        channel = ET.SubElement(root, 'channel')
+        ET.SubElement(channel, 'title').text = feed_title
+        ET.SubElement(channel, 'link').text = base_url
+        ET.SubElement(channel, 'description').text = feed_title
+        ET.SubElement(channel, f'{{{_atom_ns}}}link', {'rel': 'self', 'type': 'application/rss+xml',
+                      'href': f"{base_url}/{urllib.parse.quote(os.path.basename(feed_file))}"})
+
+    name = os.path.basename(output_file)
+    item = ET.Element('item')
+    ET.SubElement(item, 'title').text = episode_title
+    ET.SubElement(item, 'enclosure', {'url': f"{base_url}/{urllib.parse.quote(name)}", 'length': str(os.path.getsize(output_file)),
+                  'type': _episode_types.get(os.path.splitext(name)[1], 'audio/mpeg')})
+    ET.SubElement(item, 'guid', {'isPermaLink': 'false'}).text = name
+    ET.SubElement(item, 'pubDate').text = email.utils.formatdate(localtime=True)
+    ET.SubElement(item, f'{{{_itunes_ns}}}duration').text = str(duration_ms // 1000)
+    if description or credits:
+        ET.SubElement(item, 'description').text = '\n\n'.join(text for text in (description, credits) if text)
+    if credits:
+        copyright = channel.find('copyright')
+        if copyright is None:
+            copyright = ET.SubElement(channel, 'copyright')
+        copyright.text = credits
+
+    # The newest episode goes first, replacing an older build of the same file
+    items = [i for i in channel.findall('item') if i.findtext('guid') != name]
+    for i in channel.findall('item'):
+        channel.remove(i)
+    items.insert(0, item)
+
+    deleted = []
+    if keep_episodes > 0:
+        items, expired = items[:keep_episodes], items[keep_episodes:]
+        folder = os.path.dirname(output_file)
+        for old in expired:
+            enclosure = old.find('enclosure')
+            if enclosure is None:
+                continue
+            old_name = os.path.basename(urllib.parse.unquote(urllib.parse.urlparse(enclosure.get('url', '')).path))
+            if not old_name:
+                continue
+            for f in (old_name, old_name + ".timeline.json", old_name + ".sha256", os.path.splitext(old_name)[0] + ".cue"):
+                path = os.path.join(folder, f)
+                if os.path.isfile(path):
+                    os.remove(path)
+                    deleted.append(path)
+    channel.extend(items)
+
+    build_date = channel.find('lastBuildDate')
+    if build_date is None:
+        build_date = ET.SubElement(channel, 'lastBuildDate')
+    build_date.text = email.utils.formatdate(localtime=True)
+    ET.indent(root)
+    writeFileAtomic(feed_file, ET.tostring(root, encoding='utf-8', xml_declaration=True))
+    return deleted
+
+class PartUploader:
+    """
+    Runs an upload command on each finished file in a background thread, in the order they
+    were queued, so the parts of a long lesson upload while later parts are still rendering.
+    {file} in the command is replaced with the local path and {name} with the file name;
+    without either the path is added at the end. Failed uploads are retried with backoff.
+
+    limits is the TransferLimits every upload waits for and keeps to. {bwlimit} in the
+    command is replaced with its rate as given to --bwlimit, or 0 without one, for tools that
+    keep to a limit of their own, like rclone.
+
+    With a state file, each finished upload is recorded in the session state with the file's
+    digest, and a file already uploaded as it is now is skipped, so a run picks up where an
+    interrupted one stopped. The delete command, if any, removes the uploaded copy of a file
+    by its {name}, run in the same order so an episode is only deleted after the feed that
+    drops it has gone up.
+    """
+    def __init__(self, command, retries, limits, delete_command=None, state_file=None):
+        self.command = shlex.split(command)
+        if not any('{file}' in a or '{name}' in a for a in self.command):
+            self.command.append('{file}')
+        self.delete_command = shlex.split(delete_command) if delete_command else None
+        if self.delete_command and not any('{name}' in a for a in self.delete_command):
+            self.delete_command.append('{name}')
+        self.retries = retries
+        self.limits = limits
+        self.state_file = state_file
+        self.uploaded = (load_session_state(state_file) or {}).get('uploads', {}) if state_file else {}
+        self.failed = []
+        self.queue = queue.Queue()
+        self.thread = threading.Thread(target=self._run, daemon=True)
+        self.thread.start()
+
+    def upload(self, *files):
+        for f in files:
+            self.queue.put(('upload', f))
+
+    def delete(self, *names):
+        """Queues the uploaded copies of files, by name, to be deleted with the delete command."""
+        if self.delete_command:
+            for name in names:
+                self.queue.put(('delete', name))
+
+    def finish(self):
+        """Waits for the queued uploads and returns the files that failed to upload."""
+        self.queue.put(None)
+        self.thread.join()
+        return self.failed
+
+    def _run(self):
+        while True:
+            item = self.queue.get()
+            if item is None:
+                return
+            action, path = item
+            if action == 'delete':
+                self._delete(path)
+                continue
+            args = [a.replace('{file}', path).replace('{name}', os.path.basename(path)).replace('{bwlimit}', self.limits.rateText)
+                    for a in self.command]
+            name = os.path.basename(path)
+            digest = file_digest(path) if os.path.exists(path) else None
+            if digest is not None and self.uploaded.get(name) == digest:
+                print(f"Skipping upload of {path}, already uploaded")
+                continue
+            for attempt in range(self.retries + 1):
+                if not os.path.exists(path):
+                    # Pruned by --keep_episodes before it was uploaded
+                    print(f"Skipping upload of deleted file {path}")
+                    break
+                try:
+                    ok = self.limits.transfer(lambda f: subprocess.run(args).returncode == 0, path)
+                except OSError as e:
+                    print(f"warning: failed to run upload command: {e}")
+                    ok = False
+                if ok:
+                    print(f"Uploaded {path}")
+                    self._record(name, digest)
+                    break
+                if attempt < self.retries:
+                    time.sleep(2 ** attempt)
+            else:
+                print(f"warning: upload of {path} failed after {self.retries + 1} attempts")
+                self.failed.append(path)
+
+    def _delete(self, name):
+        """Runs the delete command for name, retrying it like an upload. A failure is only a warning."""
+        args = [a.replace('{name}', name) for a in self.delete_command]
+        for attempt in range(self.retries + 1):
+            try:
+                if subprocess.run(args).returncode == 0:
+                    print(f"Deleted uploaded copy of {name}")
+                    self._record(name, None)
+                    return
+            except OSError as e:
+                print(f"warning: failed to run delete command: {e}")
+            if attempt < self.retries:
+                time.sleep(2 ** attempt)
+        print(f"warning: failed to delete the uploaded copy of {name}, remove it by hand")
+
+    def _record(self, name, digest):
+        """Notes a finished upload or delete, so a later run doesn't upload the same file again."""
+        if digest is None:
+            self.uploaded.pop(name, None)
+        else:
+            self.uploaded[name] = digest
+        if self.state_file:
+            record_upload(self.state_file, name, digest)
+
+def finish_uploads(uploader):
+    """Waits for the uploads to finish, exiting with an error if any failed."""
+    print("Waiting for uploads to finish")
+    failed = uploader.finish()
+    if failed:
+        print(f"error: {len(failed)} uploads failed: {', '.join(failed)}")
+        sys.exit(1)
+
+def adb_command(serial, *args):
+    return ['adb'] + (['-s', serial] if serial else []) + list(args)
+
+def run_adb(serial, *args):
+    """Runs an adb command and returns (ok, output)."""
+    try:
+        result = subprocess.run(adb_command(serial, *args), capture_output=True, text=True)
+    except OSError as e:
+        return False, f"failed to run adb: {e}"
+    return result.returncode == 0, (result.stdout.strip() or result.stderr.strip())
+
+def check_adb_device(serial):
+    """Returns why no Android device is ready for adb, or None if one is."""
+    ok, output = run_adb(serial, 'get-state')
+    if ok and output == 'device':
+        return None
+    return output.splitlines()[0] if output else "no device connected"
+
+def push_to_adb(local, device_folder, serial):
+    """
+    Pushes a file to a folder on an Android device and checks that it arrived intact, by
+    size and, where the device has md5sum, by checksum. Returns an error message or None.
+    """
+    remote = posixpath.join(device_folder, os.path.basename(local))
+    ok, output = run_adb(serial, 'shell', 'mkdir', '-p', shlex.quote(device_folder))
+    if not ok:
+        return f"failed to create {device_folder} on the device: {output}"
+    ok, output = run_adb(serial, 'push', local, remote)
+    if not ok:
+        return f"failed to push {local}: {output}"
+    ok, output = run_adb(serial, 'shell', 'stat', '-c', '%s', shlex.quote(remote))
+    if not ok or output != str(os.path.getsize(local)):
+        return f"{remote} on the device has size {output}, expected {os.path.getsize(local)}"
+    ok, output = run_adb(serial, 'shell', 'md5sum', shlex.quote(remote))
+    if ok and output.split():
+        with open(local, 'rb') as f:
+            expected = hashlib.md5(f.read()).hexdigest()
+        if output.split()[0] != expected:
+            return f"{remote} on the device has checksum {output.split()[0]}, expected {expected}"
+    return None
+
+def copy_to_folder(local, folder):
+    """
+    Copies a file into a folder, e.g. a phone mounted over MTP, and checks the copy matches.
+    Returns an error message or None.
+    """
+    try:
+        os.makedirs(folder, exist_ok=True)
+        copy = os.path.join(folder, os.path.basename(local))
+        shutil.copyfile(local, copy)
+        if file_digest(copy) != file_digest(local):
+            os.remove(copy)
+            return f"copy of {local} in {folder} doesn't match the original"
+    except OSError as e:
+        return f"failed to copy {local} to {folder}: {e}"
+    return None
+
+def part_file_name(output_file, part):
+    base, extension = os.path.splitext(output_file)
+    return f"{base}_part{part:02d}{extension}"
+
+name_fields = ('date', 'time', 'profile', 'start', 'end', 'seq', 'firstword')
+
+def lesson_file_name(template, profile, start, end, seq, firstword):
+    """
+    Fills in a --name_template, e.g. "{date}_{profile}_{seq:02d}_{firstword}". seq is the part
+    number, 1 for a lesson in one file, and firstword the first word played in the file.
+    """
+    return template.format(date=time.strftime('%Y-%m-%d'), time=time.strftime('%H%M%S'), profile=safeName(profile),
+                           start=start, end=end, seq=seq, firstword=safeName(re.sub(r'<[^>]*>', '', firstword).strip(), 20))
+
+episode_fields = ('date', 'start', 'end', 'part', 'cards', 'words', 'firstword', 'minutes', 'profile')
+
+def episode_text(template, profile, start, end, part, duration_ms, words):
+    """
+    Fills in an --episode_title or --episode_description, e.g. "{date}: {cards} cards from
+    {firstword}". words are the words of the cards played in the episode, in order, and part
+    its part number, 1 for a lesson in one file.
+    """
+    words = [re.sub(r'<[^>]*>', '', w).strip() for w in words]
+    return template.format(date=time.strftime('%Y-%m-%d'), start=start, end=end, part=part, cards=len(words),
+                           words=', '.join(w for w in words if w), firstword=words[0] if words else '',
+                           minutes=round(duration_ms / 60000), profile=profile)
+
+def framed_segment(parts, clips, gap, normalize):
+    """
+    Joins a parsed template's pieces: the card's own clips for placeholders and the template
+    clips for the text between them.
+    """
+    segment = AudioSegment.empty()
+    for i, (kind, value) in enumerate(parts):
+        if i > 0:
+            segment += AudioSegment.silent(duration=gap)
+        segment += clips[value] if kind == 'field' else load_clip(value, normalize)
+    return segment
+
+def progress_announcement(parts, number_folder, normalize, gap=80):
+    """
+    Joins the number and word clips of a progress announcement, e.g. "twenty of eighty".
+    """
+    audio = AudioSegment.empty()
+    for i, name in enumerate(progressClipFiles(parts)):
+        if i > 0:
+            audio += AudioSegment.silent(duration=gap)
+        audio += load_clip(os.path.join(number_folder, name), normalize)
+    return audio
+
+def missing_progress_clips(total, every, milestones, number_folder):
+    """
+    Returns the clips the progress announcements of a lesson need that aren't in the number folder.
+    """
+    needed = set()
+    for played in range(1, total):
+        parts = progressPhrase(played, total, every, milestones)
+        if parts:
+            needed.update(progressClipFiles(parts))
+    return sorted(name for name in needed if not os.path.exists(os.path.join(number_folder, name)))
+
+def is_due(entry, session):
+    """
+    Exponential schedule: a card plays in its 1st, 2nd, 4th, 8th... session counting from the
+    one it was introduced in. Cards that have never played are always due.
+    """
+    if entry is None:
+        return True
+    age = session - entry['first'] + 1
+    return age & (age - 1) == 0
+
+def played_recently(entry, today, days):
+    """
+    Reports whether a card last played in a lesson less than days days before today.
+    """
+    if not entry or not entry.get('last_played') or days <= 0:
+        return False
+    last = datetime.date.fromisoformat(entry['last_played'])
+    return (today - last).days < days
+
+def is_anki_due(row):
+    """
+    Reports whether the card's Due column (--metadata_columns due) says it is due in Anki.
+    """
+    return bool(row) and (row.get('Due') or '').strip().lower() in ('yes', 'true', '1')
+
+def combine_words_and_definitions(words_folder, definitions_folder, output_file, startIndex, endIndex, repeatCount, wordPause, definitionPause, normalize,
+                                  variant_folder=None, variant_mode='alternate', variant_gap=500,
+                                  difficulties=None, ramp_shape='linear', ramp_warmup=5, ramp_jitter=0.1,
+                                  mode='recall', shadow_pause=None, shadow_pause_factor=1.2, shadow_repeat=False,
+                                  sections=None, chapter_format='cue', bookmark_volume=None, indexes=None,
+                                  tag_clips=None, tag_pause=300, timeline=None, progress=None, part_ms=None, on_part=None,
+                                  templates=None, pinned=None, confidence=None, file_namer=None, card_patterns=None,
+                                  units=None, word_speeds=None, audio_format='mp3', tags=None):
+    combined_audio = AudioSegment.empty()
+    part = 1
+    part_start = 0
+    part_first = None
+
+    def file_name(part):
+        # Names the lesson, or one of its parts, once its first card is known
+        if file_namer is not None:
+            return file_namer(part, part_first)
+        return output_file if part is None else part_file_name(output_file, part)
+
+    word_files = list_clips(words_folder)
+    definition_files = list_clips(definitions_folder)
+    variant_files = list_clips(variant_folder) if variant_folder else None
+    slowed = {}
+
+    # Create a list of indexes within the specified range, split into chapters if requested
+    if indexes is None:
+        indexes = list(range(startIndex, endIndex))
+    groups = [(title, group, False) for title, group in group_sections(list(indexes), sections)]
+    if units is not None:
+        # Curriculum units play one after another, each with all its repeats
+        order = sorted({units[idx] for idx in indexes})
+        groups = [(title, group, False) for unit in order
+                  for title, group in group_sections([idx for idx in indexes if units[idx] == unit], sections)]
+    if pinned:
+        # Pinned cards open the session, as a chapter of their own when there are chapters
+        groups.insert(0, ("Pinned" if sections is not None else None, list(pinned), True))
+    chapters = []
     last_index_played = None
+    play_counts = {}
+    played = 0
+    total = (len(indexes) + len(pinned or [])) * repeatCount
 
-    for repeat in range(repeatCount):
-        print(f"Repeat {repeat + 1} of {repeatCount}")
+    for title, indexes, is_pinned in groups:
+        if title is not None:
+            print(f"Chapter \"{title}\"")
+            chapters.append((title, len(combined_audio)))
 
-        # Shuffle indexes to get a new study order each time
-        random.shuffle(indexes)
+        for repeat in range(repeatCount):
+            print(f"Repeat {repeat + 1} of {repeatCount}")
 
-        # If possible, avoid starting a new round with the same word as the last one played previously
-        if last_index_played is not None and len(indexes) > 1:
-            if indexes[0] == last_index_played:
-                indexes[0], indexes[1] = indexes[1], indexes[0] 
+            # Shuffle indexes to get a new study order each time, or ramp from easy to hard cards
+            if difficulties is None or is_pinned:
+                random.shuffle(indexes)
+            else:
+                indexes = ramp_order(indexes, difficulties, ramp_shape, ramp_warmup, ramp_jitter)
+
+            # If possible, avoid starting a new round with the same word as the last one played previously
+            if last_index_played is not None and len(indexes) > 1:
+                if indexes[0] == last_index_played:
+                    indexes[0], indexes[1] = indexes[1], indexes[0] 
             
-        for idx in indexes:
-            word_file = os.path.join(words_folder, word_files[idx])
-            definition_file = os.path.join(definitions_folder, definition_files[idx])
+            for idx in indexes:
+                word_file = os.path.join(words_folder, word_files[idx])
+                definition_file = os.path.join(definitions_folder, definition_files[idx])
 
-            try:
-                # Load the word audio and remove trailing silence
-                word_audio = AudioSegment.from_mp3(word_file)
-                word_audio = remove_trailing_silence(word_audio)
-
-                if normalize:
-                    word_audio = effects.normalize(word_audio)
-                    word_audio = effects.compress_dynamic_range(
-                        word_audio,
-                        threshold = _threshold,
-                        ratio = _ratio,
-                        attack = _attack,
-                        release = _release
-                    )
-                    word_audio = effects.normalize(word_audio)
-
-                combined_audio += word_audio
-
-                # Add pause after word
-                combined_audio += AudioSegment.silent(duration=wordPause)
-
-                # Load the definition audio and remove trailing silence
-                definition_audio = AudioSegment.from_mp3(definition_file)
-                definition_audio = remove_trailing_silence(definition_audio)
-
-                if normalize:
-                    definition_audio = effects.normalize(definition_audio)
-                    definition_audio = effects.compress_dynamic_range(
-                        definition_audio,
-                        threshold = _threshold,
-                        ratio = _ratio,
-                        attack = _attack,
-                        release = _release
-                    )
-                    definition_audio = effects.normalize(definition_audio)
-
-                combined_audio += definition_audio
-
-                # Add pause after definition
-                combined_audio += AudioSegment.silent(duration=definitionPause)
-
-                print(f"Added word and definition for index {idx}")
-                last_index_played = idx
+                try:
+                    response = None
+
+                    # Pick the pronunciation variant(s) for this play of the card
+                    word_clip = 'word'
+                    if variant_files is None:
+                        word_audio = load_clip(word_file, normalize)
+                    else:
+                        variant_file = os.path.join(variant_folder, variant_files[idx])
+                        if variant_mode == 'both':
+                            word_audio = load_clip(word_file, normalize)
+                            word_audio += AudioSegment.silent(duration=variant_gap)
+                            word_audio += load_clip(variant_file, normalize)
+                            word_clip = 'both'
+                        elif play_counts.get(idx, 0) % 2 == 0:
+                            word_audio = load_clip(word_file, normalize)
+                        else:
+                            word_audio = load_clip(variant_file, normalize)
+                            word_clip = 'variant'
+                    play_counts[idx] = play_counts.get(idx, 0) + 1
+
+                    # New words are pronounced slower, stretched once for all their repeats
+                    if word_speeds and idx in word_speeds:
+                        key = f"{idx}_{word_clip}"
+                        if key not in slowed:
+                            slowed[key] = change_speed(word_audio, word_speeds[idx], key)
+                        word_audio = slowed[key]
+
+                    definition_audio = load_clip(definition_file, normalize)
+
+                    # Frame the word and definition in their template sentences
+                    if templates:
+                        clips = {'word': word_audio, 'definition': definition_audio}
+                        if templates.get('word'):
+                            word_audio = framed_segment(templates['word'], clips, templates['gap'], normalize)
+                        if templates.get('definition'):
+                            definition_audio = framed_segment(templates['definition'], clips, templates['gap'], normalize)
+
+                    # A tag can give the card a pattern of its own instead of the session's
+                    pattern = (card_patterns or {}).get(idx, {})
+                    card_word_pause = pattern.get('pause_after_word', wordPause)
+                    card_definition_pause = pattern.get('pause_after_definition', definitionPause)
+                    if pattern.get('mode', mode) == 'shadowing':
+                        segment = shadowing_segment(word_audio, definition_audio, card_word_pause, card_definition_pause,
+                                                    pattern.get('shadow_pause', shadow_pause),
+                                                    pattern.get('shadow_pause_factor', shadow_pause_factor),
+                                                    pattern.get('shadow_repeat', shadow_repeat))
+                    else:
+                        # A card testing the word gives its definition as the prompt
+                        prompt, answer = word_audio, definition_audio
+                        if pattern.get('tests') == 'word':
+                            prompt, answer = definition_audio, word_audio
+                        segment = prompt
+
+                        # Add pause after the prompt, to think of the answer
+                        segment += AudioSegment.silent(duration=card_word_pause)
+
+                        segment += answer
+
+                        # Ask whether the answer was right and leave time to tap a response
+                        if confidence is not None:
+                            response_start = len(segment)
+                            segment += load_clip(confidence['clip'], normalize)
+                            segment += AudioSegment.silent(duration=confidence['gap'])
+                            response = (response_start, len(segment))
+
+                        # Add pause after definition
+                        segment += AudioSegment.silent(duration=card_definition_pause)
+
+                    # Announce the card's topic before it
+                    if tag_clips and idx in tag_clips:
+                        intro = load_clip(tag_clips[idx], normalize) + AudioSegment.silent(duration=tag_pause)
+                        segment = intro + segment
+                        if response is not None:
+                            response = (response[0] + len(intro), response[1] + len(intro))
+
+                    # Mark the start of the card without shifting its timing
+                    if bookmark_volume is not None:
+                        segment = segment.overlay(bookmark_tones(idx, bookmark_volume))
+                    if timeline is not None:
+                        start = len(combined_audio)
+                        timeline.append((idx, start, start + len(segment),
+                                         (start + response[0], start + response[1]) if response else None))
+                    combined_audio += segment
+                    played += 1
+                    if part_first is None:
+                        part_first = idx
+
+                    # Say how far through the lesson we are
+                    if progress is not None:
+                        parts = progressPhrase(played, total, progress['every'], progress['milestones'])
+                        if parts:
+                            combined_audio += progress_announcement(parts, progress['folder'], normalize)
+                            combined_audio += AudioSegment.silent(duration=progress['pause'])
+
+                    # Publish a finished part while the rest of the lesson renders
+                    if part_ms and len(combined_audio) >= part_ms and played < total:
+                        part_file = file_name(part)
+                        with atomicOutput(part_file) as tmp:
+                            export_lesson(combined_audio, tmp, audio_format, tags)
+                        print(f"Part {part} created: {part_file}")
+                        on_part(part_file, part, len(combined_audio), timeline[part_start:] if timeline is not None else [])
+                        part += 1
+                        combined_audio = AudioSegment.empty()
+                        part_start = len(timeline) if timeline is not None else 0
+                        part_first = None
+
+                    print(f"Added word and definition for index {idx}")
+                    last_index_played = idx
                 
-            except Exception as e:
-                print(f"Error processing index {idx}: {e}")
-                sys.exit(1)
+                except Exception as e:
+                    print(f"Error processing index {idx}: {e}")
+                    sys.exit(1)
 
-    # Export the combined audio as an MP3 file
-    combined_audio.export(output_file, format="mp3")
+    if part_ms:
+        part_file = file_name(part)
+        with atomicOutput(part_file) as tmp:
+            export_lesson(combined_audio, tmp, audio_format, tags)
+        print(f"Part {part} created: {part_file}")
+        on_part(part_file, part, len(combined_audio), timeline[part_start:] if timeline is not None else [])
+        return part_file
+    output_file = file_name(None)
+    if chapters and chapter_format in ('m4b', 'mka'):
+        export_with_chapters(combined_audio, output_file, chapters, chapter_format, tags)
+    else:
+        with atomicOutput(output_file) as tmp:
+            export_lesson(combined_audio, tmp, audio_format, tags)
+        if chapters:
+            write_cue_sheet(output_file, chapters)
     print(f"Combined audio file created: {output_file}")
+    return output_file
 
 if __name__ == '__main__':
 
@@ -135,63 +1235,803 @@ if __name__ == '__main__':
         help='Directory containing definition audio files (default "definitions")')
     parser.add_argument('--output_folder', type=str, default='output',
         help='Directory to store results (default: "output")')
+    parser.add_argument('--name_template', type=str, default=None,
+        help='File name of lessons and their parts, from {date}, {time}, {profile}, {start}, {end}, {seq} (the part number) and {firstword}, e.g. "{date}_{profile}_{seq:02d}_{firstword}" (default "cards_<start>-<end>")')
+    parser.add_argument('--profile', type=str, default=None,
+        help='Name for {profile} in --name_template (default: the name of the workspace folder)')
     parser.add_argument('--pause_after_word', type=int, default=3000,
         help='Milliseconds of silence after word before the definition (default 3000)')
     parser.add_argument('--pause_after_definition', type=int, default=1000,
         help='Milliseconds of silence after definition before next word (default 1000)')
     parser.add_argument('--normalize', action='store_true',
       help='Normalize and compress all audio clips to the same volume (default False)')
+    parser.add_argument('--word_variant_folder', type=str, default=None,
+        help='Directory containing a second pronunciation of each word, e.g. "words_b" (optional)')
+    parser.add_argument('--variant_mode', type=str, default='alternate', choices=['alternate', 'both'],
+        help='Alternate between pronunciations on each repeat or play both back-to-back (default "alternate")')
+    parser.add_argument('--variant_gap', type=int, default=500,
+        help='Milliseconds of silence between pronunciations in "both" mode (default 500)')
+    parser.add_argument('--card_file', type=str, default='cards.csv',
+        help='CSV the clips were generated from, used for card metadata (default "cards.csv")')
+    parser.add_argument('--order', type=str, default='shuffle', choices=['shuffle', 'ramp'],
+        help='Shuffle cards, or ramp from easy/mature cards to hard/new ones (default "shuffle")')
+    parser.add_argument('--ramp_shape', type=str, default='linear', choices=['linear', 'warmup'],
+        help='"linear" sorts the whole lesson by difficulty, "warmup" only plays the easiest cards first (default "linear")')
+    parser.add_argument('--ramp_warmup', type=int, default=5,
+        help='Number of easy cards to start with in "warmup" shape (default 5)')
+    parser.add_argument('--ramp_jitter', type=float, default=0.1,
+        help='How far, as a fraction of the lesson, cards may stray from strict difficulty order in "linear" shape (default 0.1)')
+    parser.add_argument('--mode', type=str, default='recall', choices=['recall', 'shadowing'],
+        help='"recall" plays the word then the definition, "shadowing" plays the definition, a pause to repeat it aloud, then the word (default "recall")')
+    parser.add_argument('--shadow_pause', type=int, default=None,
+        help='Milliseconds of silence to repeat the definition aloud in shadowing mode (default: sized from the clip)')
+    parser.add_argument('--shadow_pause_factor', type=float, default=1.2,
+        help='Repeat pause as a multiple of the definition length when --shadow_pause is not set (default 1.2)')
+    parser.add_argument('--shadow_repeat', action='store_true',
+        help='Play the definition once more after the word in shadowing mode (default False)')
+    parser.add_argument('--tag_patterns', type=str, default=None,
+        help='JSON file mapping tags to the mode and pauses of their cards, e.g. {"pattern::sentence-first": "shadowing"}. Needs a CSV exported with --metadata_columns tags (optional)')
+    parser.add_argument('--template_tests', type=str, default=None,
+        help='Comma separated card template ordinals and the field their cards test, e.g. 0=definition,1=word. Cards testing the word play their definition first and the word after the pause. Needs a CSV exported with --metadata_columns template (optional)')
+    parser.add_argument('--curriculum', type=str, default=None,
+        help='File listing tags in teaching order, e.g. unit01, unit02. Sessions play their units in order and only move on to the next one once few of the earlier cards are due. Needs a CSV exported with --metadata_columns tags,due (optional)')
+    parser.add_argument('--curriculum_due', type=float, default=0.2,
+        help='Move on to the next curriculum unit once fewer than this fraction of the cards so far are due in Anki (default 0.2)')
+    parser.add_argument('--chapters_by', type=str, default=None,
+        help='CSV column to group cards into chapters by, e.g. "Deck" (optional)')
+    parser.add_argument('--attribution', type=str, default=None,
+        help='Credit for the deck, e.g. "JP1K deck by Refold", written into the lesson files and podcast feed (default: the cards\' attribution:: tags)')
+    parser.add_argument('--license', type=str, default=None,
+        help='License of the deck, e.g. "CC BY-SA 4.0", written with --attribution (default: the cards\' license:: tags)')
+    parser.add_argument('--audio_format', type=str, default='mp3', choices=sorted(_lesson_formats),
+        help='Format of the lesson files: mp3, or m4a (AAC), which many car stereos and phones also play (default "mp3")')
+    parser.add_argument('--chapter_format', type=str, default='cue', choices=['cue', 'm4b', 'mka'],
+        help='Write chapters as a .cue sheet next to the MP3, or embed them in an M4B or MKA file (default "cue")')
+    parser.add_argument('--skip_if_unchanged', action='store_true',
+        help='Don\'t build a new session when its cards, audio and settings match the last one built, so a feed only gets new episodes when something changed (default False)')
+    parser.add_argument('--session_state', type=str, default=None,
+        help='File recording the last built session for --skip_if_unchanged, and the files --upload_command has uploaded (default: "last_session.json" in the output folder)')
+    parser.add_argument('--schedule', type=str, default='all', choices=['all', 'exponential'],
+        help='"all" plays every card in the range, "exponential" only plays cards due in their 1st, 2nd, 4th, 8th... session (default "all")')
+    parser.add_argument('--play_history', type=str, default='play_history.json',
+        help='File tracking which cards played in past sessions for --schedule exponential and --min_days_between (default "play_history.json")')
+    parser.add_argument('--min_days_between', type=int, default=0,
+        help='Leave out cards that played in a lesson less than this many days ago, unless the CSV\'s Due column says they are due in Anki (default 0, off)')
+    parser.add_argument('--new_card_speed', type=float, default=1.0,
+        help='Speed to pronounce the words of new cards at, e.g. 0.85, without changing their pitch. Needs ffmpeg (default 1.0, off)')
+    parser.add_argument('--new_card_sessions', type=int, default=2,
+        help='How many sessions a card is new for with --new_card_speed, counted in --play_history (default 2)')
+    parser.add_argument('--tag_phrases', type=str, default=None,
+        help='JSON file mapping tags to phrases to announce before their cards, the same file given to audio_sourcer.py (optional)')
+    parser.add_argument('--tag_folder', type=str, default='tags',
+        help='Directory containing tag phrase audio files (default "tags")')
+    parser.add_argument('--tag_pause', type=int, default=300,
+        help='Milliseconds of silence between a tag phrase and its card (default 300)')
+    parser.add_argument('--exclude_file', type=str, default='excluded.txt',
+        help='File listing known cards to leave out, one note ID or word per line, empty to disable (default "excluded.txt")')
+    parser.add_argument('--pin_file', type=str, default='pinned.txt',
+        help='Cards to play at the start of every session, one note ID, word or "tag:<tag>" per line (default pinned.txt)')
+    parser.add_argument('--pin_tag', type=str, default='commuter::pin',
+        help='Cards with this tag are pinned too. Needs the Tags column (default commuter::pin)')
+    parser.add_argument('--podcast', action='store_true',
+        help='Add each lesson built as a new episode of a podcast feed in the output folder (default False)')
+    parser.add_argument('--base_url', type=str, default=None,
+        help='URL the output folder is served from, required with --podcast')
+    parser.add_argument('--feed_file', type=str, default=None,
+        help='Podcast feed to update (default: "feed.xml" in the output folder)')
+    parser.add_argument('--feed_title', type=str, default='Commuter Flashcards',
+        help='Title of a new podcast feed (default "Commuter Flashcards")')
+    parser.add_argument('--episode_title', type=str, default=None,
+        help='Title of each episode, from {date}, {start}, {end}, {part}, {cards}, {words}, {firstword}, {minutes} and {profile}, e.g. "{date}: {cards} cards from {firstword}" (default "Cards <start>-<end> (<date>)", and " part <part>" for parts)')
+    parser.add_argument('--episode_description', type=str, default=None,
+        help='Description of each episode, from the same fields as --episode_title, e.g. "Today: {words}". Credits from --attribution are added after it (default: just the credits)')
+    parser.add_argument('--keep_episodes', type=int, default=0,
+        help='Keep only the newest N episodes in the feed and delete the audio of older ones, 0 to keep all (default 0)')
+    parser.add_argument('--word_template', type=str, default=None,
+        help='Sentence to frame each word in, e.g. "What is ... {word}?". Needs the clips from audio_sourcer.py --word_template')
+    parser.add_argument('--definition_template', type=str, default=None,
+        help='Sentence to frame each definition in, e.g. "{word} means: {definition}"')
+    parser.add_argument('--template_folder', type=str, default='templates',
+        help='Folder of the template clips (default: templates)')
+    parser.add_argument('--template_gap', type=int, default=150,
+        help='Pause between the pieces of a template in ms (default 150)')
+    parser.add_argument('--confidence_prompt', type=str, default=None,
+        help='Short question to ask after each answer in recall mode, e.g. "got it?". Needs the clip from audio_sourcer.py --confidence_prompt')
+    parser.add_argument('--confidence_gap', type=int, default=1000,
+        help='Milliseconds of silence after the confidence prompt to tap a response in (default 1000)')
+    parser.add_argument('--sample_rate', type=int, default=0,
+        help='Sample rate to convert every clip to, 0 for the one most clips have (default 0)')
+    parser.add_argument('--channels', type=int, default=0, choices=[0, 1, 2],
+        help='1 for mono or 2 for stereo to convert every clip to, 0 for what most clips have (default 0)')
+    parser.add_argument('--minutes', type=float, default=0,
+        help='Only play the cards of the range that fit in about N minutes, by the length of their clips and pauses, leaving the rest for the next session (default 0, every card)')
+    parser.add_argument('--part_minutes', type=int, default=0,
+        help='Write the lesson as parts of about N minutes, each published (timeline, feed entry, upload) as soon as it is rendered (default 0, one file)')
+    parser.add_argument('--upload_command', type=str, default=None,
+        help="Command to upload each finished file with, run in the background, e.g. 'rclone copyto {file} remote:jp1k/{name}'. Finished uploads are recorded in --session_state and files already uploaded as they are skipped, so the next run picks up after an interrupted one")
+    parser.add_argument('--delete_command', type=str, default=None,
+        help="Command to delete the uploaded copy of each episode file pruned by --keep_episodes with, by its {name}, e.g. 'rclone deletefile remote:jp1k/{name}'. Without it the uploaded copies are left in place (default: none)")
+    parser.add_argument('--upload_retries', type=int, default=3,
+        help='Times to retry a failed upload (default 3)')
+    parser.add_argument('--bwlimit', type=str, default=None,
+        help="Most bytes per second to upload with --upload_command on average, e.g. 500K or 2M, also passed to the command as {bwlimit} (default: no limit)")
+    parser.add_argument('--transfer_window', type=str, default=None,
+        help='Time of day to upload in, e.g. 02:00-06:00, holding uploads until it opens (default: any time)')
+    parser.add_argument('--device_folder', type=str, default=None,
+        help='Also copy each finished lesson into this folder, e.g. a phone mounted over MTP')
+    parser.add_argument('--adb_folder', type=str, default=None,
+        help='Also push each finished lesson to this folder on an Android device over adb, e.g. /sdcard/Podcasts/Commuter')
+    parser.add_argument('--adb_serial', type=str, default=None,
+        help='Serial of the device to push to when several are connected (see "adb devices")')
+    parser.add_argument('--progress_every', type=int, default=0,
+        help='Announce progress every N cards, e.g. "twenty of eighty" (optional)')
+    parser.add_argument('--progress_milestones', type=str, default='',
+        help='Comma separated percentages to announce, e.g. "25,50,75" (optional)')
+    parser.add_argument('--number_folder', type=str, default='numbers',
+        help='Directory containing the number clips from audio_sourcer.py --download_numbers (default "numbers")')
+    parser.add_argument('--progress_pause', type=int, default=500,
+        help='Milliseconds of silence after a progress announcement (default 500)')
+    parser.add_argument('--temp_dir', type=str, default=None,
+        help='Where to create the per-run temp workspace for intermediate files (default: system temp directory)')
+    parser.add_argument('--keep_temp', action='store_true',
+        help='Keep the temp workspace, including every processed clip, after a successful run for debugging bad audio (default False)')
+    parser.add_argument('--bookmark_tones', action='store_true',
+        help='Overlay a quiet DTMF tone sequence encoding the card index at the start of each card (default False)')
+    parser.add_argument('--bookmark_volume', type=float, default=-35.0,
+        help='Volume of the bookmark tones in dBFS (default -35)')
+    addWorkspaceArgument(parser)
     opt = parser.parse_args()
+    useWorkspace(parser, opt, {
+        'card_file': 'cards.csv',
+        'word_folder': os.path.join('audio', 'words'),
+        'definition_folder': os.path.join('audio', 'definitions'),
+        'tag_folder': os.path.join('audio', 'tags'),
+        'number_folder': os.path.join('audio', 'numbers'),
+        'template_folder': os.path.join('audio', 'templates'),
+        'output_folder': 'sessions',
+        'session_state': os.path.join('state', 'last_session.json'),
+        'play_history': os.path.join('state', 'play_history.json'),
+        'exclude_file': os.path.join('state', 'excluded.txt'),
+        'pin_file': os.path.join('state', 'pinned.txt'),
+    })
 
-    # Validate existence of audio source folders. 
-    if not (os.path.exists(opt.word_folder) and os.path.isdir(opt.word_folder)):
-        print(f"error: word folder '{opt.word_folder}' not found")
-        sys.exit(1)
-    if not (os.path.exists(opt.definition_folder) and os.path.isdir(opt.definition_folder)):
-        print(f"error: definition folder '{opt.definition_folder}' not found")
-        sys.exit(1)
-
-    # Count available word and definition files
-    word_files = [f for f in os.listdir(opt.word_folder) if f.endswith('.mp3')]
-    definition_files = [f for f in os.listdir(opt.definition_folder) if f.endswith('.mp3')]
-    wordCount = len(word_files)
-    definitionCount = len(definition_files)
+    # Check every setting before doing any work, reporting all problems at once
+    report = ValidationReport()
+    if not (shutil.which('ffmpeg') or shutil.which('avconv')):
+        # Nothing can be built without it, unlike the optional tools skipped further down
+        report.error("ffmpeg not found on the PATH, it is needed to read and write clips. Install it from https://ffmpeg.org/download.html")
+    folders_found = True
+    for name, folder in (('word', opt.word_folder), ('definition', opt.definition_folder), ('word variant', opt.word_variant_folder)):
+        if folder and not os.path.isdir(folder):
+            parent = os.path.dirname(folder) or '.'
+            siblings = [os.path.join(os.path.dirname(folder), d) for d in os.listdir(parent)
+                        if os.path.isdir(os.path.join(parent, d))] if os.path.isdir(parent) else []
+            report.error(f"{name} folder '{folder}' not found", folder, siblings)
+            folders_found = False
 
     # Validate index range
     if(opt.start_index < 0 or opt.start_index >= opt.end_index ):
-        print(f"error: start_index {opt.start_index} must be >=0 and < end_index {opt.end_index}")
-        sys.exit(1)
-    if opt.end_index > wordCount:
-        print(f"error: end_index {opt.end_index} exceeds available word count {wordCount}")
-        sys.exit(1)
+        report.error(f"start_index {opt.start_index} must be >=0 and < end_index {opt.end_index}")
+    if folders_found:
+        wordCount = len(list_clips(opt.word_folder))
+        definitionCount = len(list_clips(opt.definition_folder))
+        if opt.end_index > wordCount:
+            report.error(f"end_index {opt.end_index} exceeds available word count {wordCount}")
+        if opt.end_index > definitionCount:
+            report.error(f"end_index {opt.end_index} exceeds available definition count {definitionCount}")
+        if opt.word_variant_folder and opt.end_index > len(list_clips(opt.word_variant_folder)):
+            report.error(f"end_index {opt.end_index} exceeds available word variant count")
 
-    if opt.end_index > definitionCount:
-        print(f"error: end_index {opt.end_index} exceeds available definition count {definitionCount}")
-        sys.exit(1)
+    # Counts and pauses must be non-negative
+    for name in ('pause_after_word', 'pause_after_definition', 'shadow_pause', 'keep_episodes', 'part_minutes',
+                 'upload_retries', 'tag_pause', 'progress_every', 'progress_pause', 'template_gap', 'variant_gap',
+                 'confidence_gap', 'sample_rate', 'min_days_between', 'minutes'):
+        if getattr(opt, name) is not None and getattr(opt, name) < 0:
+            report.error(f"{name} cannot be negative")
 
-    # Pause arguments must be non-negative
-    if opt.pause_after_word < 0:
-        print(f"error: pause_after_word cannot be negative")
-        sys.exit(1)
-    if opt.pause_after_definition < 0:
-        print(f"error: pause_after_definition cannot be negative")
-        sys.exit(1)
+    if opt.podcast and not opt.base_url:
+        report.error(f"--podcast requires --base_url, the URL the output folder is served from")
+    if opt.name_template:
+        try:
+            lesson_file_name(opt.name_template, 'profile', 0, 1, 1, 'word')
+            if opt.part_minutes and '{seq' not in opt.name_template:
+                report.warning("--name_template has no {seq}, so parts are told apart by a _partNN suffix")
+            if opt.podcast and '{time' not in opt.name_template:
+                report.warning("--name_template has no {time}, so a second episode built the same day replaces the first")
+        except KeyError as e:
+            report.error(f"unknown field {{{e.args[0]}}} in --name_template, expected one of "
+                         + ", ".join('{' + f + '}' for f in name_fields), e.args[0], name_fields)
+        except (ValueError, IndexError) as e:
+            report.error(f"invalid --name_template \"{opt.name_template}\": {e}")
+    elif not (opt.episode_title or opt.episode_description):
+        report.unused(parser, opt, 'profile', "--name_template, --episode_title or --episode_description")
+    for name in ('episode_title', 'episode_description'):
+        template = getattr(opt, name)
+        if not template:
+            continue
+        try:
+            episode_text(template, 'profile', 0, 1, 1, 60000, ['word'])
+        except KeyError as e:
+            report.error(f"unknown field {{{e.args[0]}}} in --{name}, expected one of "
+                         + ", ".join('{' + f + '}' for f in episode_fields), e.args[0], episode_fields)
+        except (ValueError, IndexError) as e:
+            report.error(f"invalid --{name} \"{template}\": {e}")
+    if opt.part_minutes and opt.chapters_by:
+        report.error(f"--part_minutes cannot be combined with --chapters_by")
+
+    # Settings that only matter together with another one
+    if not opt.word_variant_folder:
+        for name in ('variant_mode', 'variant_gap'):
+            report.unused(parser, opt, name, "--word_variant_folder")
+    if opt.mode != 'shadowing':
+        for name in ('shadow_pause', 'shadow_pause_factor', 'shadow_repeat'):
+            if not opt.tag_patterns:
+                report.unused(parser, opt, name, "--mode shadowing")
+    if opt.order != 'ramp':
+        for name in ('ramp_shape', 'ramp_warmup', 'ramp_jitter'):
+            report.unused(parser, opt, name, "--order ramp")
+    if not opt.chapters_by:
+        report.unused(parser, opt, 'chapter_format', "--chapters_by")
+    elif opt.chapter_format != 'cue' and opt.audio_format != 'mp3':
+        report.warning(f"--audio_format has no effect with --chapter_format {opt.chapter_format}, which is its own format")
+    if not opt.curriculum:
+        report.unused(parser, opt, 'curriculum_due', "--curriculum")
+    elif not 0 < opt.curriculum_due <= 1:
+        report.error(f"--curriculum_due must be a fraction between 0 and 1")
+    if not opt.podcast:
+        for name in ('base_url', 'feed_file', 'feed_title', 'keep_episodes', 'episode_title', 'episode_description'):
+            report.unused(parser, opt, name, "--podcast")
+    if not opt.tag_phrases:
+        report.unused(parser, opt, 'tag_pause', "--tag_phrases")
+    if not (opt.progress_every or opt.progress_milestones):
+        report.unused(parser, opt, 'progress_pause', "--progress_every or --progress_milestones")
+    if not (opt.word_template or opt.definition_template):
+        report.unused(parser, opt, 'template_gap', "--word_template or --definition_template")
+    if not opt.confidence_prompt:
+        report.unused(parser, opt, 'confidence_gap', "--confidence_prompt")
+    elif opt.mode == 'shadowing':
+        report.warning("--confidence_prompt has no effect with --mode shadowing, which has no answer to grade")
+    if not opt.upload_command:
+        report.unused(parser, opt, 'upload_retries', "--upload_command")
+        report.unused(parser, opt, 'bwlimit', "--upload_command")
+        report.unused(parser, opt, 'transfer_window', "--upload_command")
+        report.unused(parser, opt, 'delete_command', "--upload_command")
+    elif not opt.keep_episodes:
+        report.unused(parser, opt, 'delete_command', "--keep_episodes")
+    transferLimits = TransferLimits()
+    try:
+        transferLimits = TransferLimits(opt.bwlimit, opt.transfer_window)
+    except ValueError as e:
+        report.error(str(e))
+    if not opt.adb_folder:
+        report.unused(parser, opt, 'adb_serial', "--adb_folder")
+    if not opt.bookmark_tones:
+        report.unused(parser, opt, 'bookmark_volume', "--bookmark_tones")
+    if opt.new_card_speed == 1.0:
+        report.unused(parser, opt, 'new_card_sessions', "--new_card_speed")
+    elif not 0.5 <= opt.new_card_speed <= 2.0:
+        report.error(f"--new_card_speed must be between 0.5 and 2.0")
+    elif not shutil.which('ffmpeg'):
+        # pydub can read clips with avconv too, but only ffmpeg changes their speed
+        report.skip("slowing down new cards", "--new_card_speed needs ffmpeg to change the speed of clips")
+        opt.new_card_speed = 1.0
+    if opt.new_card_sessions < 1:
+        report.error(f"--new_card_sessions must be at least 1")
+
+    # Check the phone is reachable before spending time on the build
+    if opt.device_folder and not os.path.isdir(opt.device_folder):
+        report.error(f"device folder '{opt.device_folder}' not found. Is the phone connected and mounted?")
+    if opt.adb_folder and not shutil.which('adb'):
+        report.skip("pushing lessons to the Android device", "adb not found on the PATH")
+        opt.adb_folder = None
+    if opt.adb_folder:
+        problem = check_adb_device(opt.adb_serial)
+        if problem:
+            report.error(f"no Android device ready for adb: {problem}")
+
+    # Card CSV columns needed by ordering, chapters and tag announcements
+    card_rows = load_card_rows(opt.card_file) if os.path.exists(opt.card_file) else None
+    columns = list(card_rows[0].keys()) if card_rows else []
+    needs_rows = [flag for flag, used in (('--order ramp', opt.order == 'ramp'), ('--chapters_by', opt.chapters_by),
+                                          ('--tag_phrases', opt.tag_phrases), ('--tag_patterns', opt.tag_patterns),
+                                          ('--template_tests', opt.template_tests), ('--curriculum', opt.curriculum)) if used]
+    if needs_rows and card_rows is None:
+        report.error(f"{', '.join(needs_rows)} requires card file '{opt.card_file}'")
+    elif needs_rows and len(card_rows) < opt.end_index:
+        report.error(f"end_index {opt.end_index} exceeds card count {len(card_rows)} in {opt.card_file}")
+        card_rows = None
+    elif needs_rows:
+        if opt.order == 'ramp' and 'Reps' not in columns:
+            report.error(f"{opt.card_file} has no scheduling columns. Export it with --metadata_columns interval,reps,lapses,card_type")
+        if opt.chapters_by and opt.chapters_by not in columns:
+            report.error(f"{opt.card_file} has no \"{opt.chapters_by}\" column", opt.chapters_by, columns)
+        if (opt.tag_phrases or opt.tag_patterns) and 'Tags' not in columns:
+            report.error(f"{opt.card_file} has no Tags column. Export it with --metadata_columns tags")
+        if opt.template_tests and 'Template' not in columns:
+            report.error(f"{opt.card_file} has no Template column. Export it with --metadata_columns template")
+        if opt.curriculum and not ('Tags' in columns and 'Due' in columns):
+            report.error(f"{opt.card_file} needs Tags and Due columns for --curriculum. Export it with --metadata_columns tags,due")
+    else:
+        card_rows = None
+
+    # Tag announcements need the synthesized phrases
+    tag_phrases = None
+    if opt.tag_phrases:
+        try:
+            tag_phrases = loadTagPhrases(opt.tag_phrases)
+        except (OSError, ValueError) as e:
+            report.error(f"failed to load tag phrases {opt.tag_phrases}: {e}")
+    tag_clips = None
+    if tag_phrases is not None and card_rows is not None and 'Tags' in columns:
+        tag_clips = {}
+        card_tags = {t.lower() for row in card_rows for t in (row.get('Tags') or '').split()}
+        for tag, _ in tag_phrases:
+            if not any(t == tag or t.startswith(tag + '::') for t in card_tags):
+                report.warning(f"tag \"{tag}\" in {opt.tag_phrases} is not used by any card", tag, card_tags)
+        for i in range(opt.start_index, opt.end_index):
+            phrase = tagPhraseFor((card_rows[i].get('Tags') or '').split(), tag_phrases)
+            if phrase is None:
+                continue
+            tag_file = os.path.join(opt.tag_folder, tagPhraseFile(phrase))
+            if not os.path.exists(tag_file):
+                report.error(f"no audio for tag phrase '{phrase}' in '{opt.tag_folder}'. Run audio_sourcer.py with --tag_phrases {opt.tag_phrases}")
+                break
+            tag_clips[i] = os.path.abspath(tag_file)
+
+    # Cards whose tags give them a pattern of their own
+    tag_patterns = None
+    if opt.tag_patterns:
+        try:
+            tag_patterns = loadTagPatterns(opt.tag_patterns)
+        except (OSError, ValueError) as e:
+            report.error(f"failed to load tag patterns {opt.tag_patterns}: {e}")
+    card_patterns = None
+    if tag_patterns is not None and card_rows is not None and 'Tags' in columns:
+        card_tags = {t.lower() for row in card_rows for t in (row.get('Tags') or '').split()}
+        for tag, _ in tag_patterns:
+            if not tagMatches(card_tags, tag):
+                report.warning(f"tag \"{tag}\" in {opt.tag_patterns} is not used by any card", tag, card_tags)
+        card_patterns = {}
+        for i in range(opt.start_index, opt.end_index):
+            pattern = tagPatternFor((card_rows[i].get('Tags') or '').split(), tag_patterns)
+            if pattern is not None:
+                card_patterns[i] = pattern
+
+    # Cards of a template that tests the word are asked the other way around
+    if opt.template_tests:
+        try:
+            template_tests = parse_template_tests(opt.template_tests)
+        except ValueError as e:
+            report.error(f"invalid --template_tests: {e}")
+            template_tests = {}
+        if card_rows is not None and 'Template' in columns:
+            templates_used = {row.get('Template') for row in card_rows}
+            for ordinal in template_tests:
+                if ordinal not in templates_used:
+                    report.warning(f"template {ordinal} in --template_tests is not used by any card in {opt.card_file}")
+            if card_patterns is None:
+                card_patterns = {}
+            for i in range(opt.start_index, opt.end_index):
+                if template_tests.get(card_rows[i].get('Template')) == 'word':
+                    card_patterns[i] = dict(card_patterns.get(i, {}), tests='word')
+
+    # The curriculum's units, in teaching order
+    curriculum = None
+    if opt.curriculum:
+        try:
+            curriculum = load_curriculum(opt.curriculum)
+        except (OSError, ValueError) as e:
+            report.error(f"failed to load curriculum {opt.curriculum}: {e}")
+    if curriculum is not None and card_rows is not None and 'Tags' in columns:
+        card_tags = {t.lower() for row in card_rows for t in (row.get('Tags') or '').split()}
+        for tag in curriculum:
+            if not tagMatches(card_tags, tag):
+                report.warning(f"tag \"{tag}\" in {opt.curriculum} is not used by any card", tag, card_tags)
+
+    # Templates are built from text clips synthesized by audio_sourcer.py
+    templates = None
+    if opt.word_template or opt.definition_template:
+        templates = {'gap': opt.template_gap}
+        for segment, template in (('word', opt.word_template), ('definition', opt.definition_template)):
+            if not template:
+                continue
+            try:
+                parts = parseTemplate(template)
+            except ValueError as e:
+                report.error(f"invalid --{segment}_template: {e}")
+                continue
+            resolved = []
+            for kind, value in parts:
+                if kind == 'text':
+                    clip = os.path.join(opt.template_folder, templateClipFile(value))
+                    if not os.path.exists(clip):
+                        report.error(f"no audio for template text '{value}' in '{opt.template_folder}'. Run audio_sourcer.py with the same --{segment}_template")
+                    value = os.path.abspath(clip)
+                resolved.append((kind, value))
+            templates[segment] = resolved
+
+    # The confidence prompt is a clip synthesized with the template text
+    confidence = None
+    if opt.confidence_prompt and opt.mode != 'shadowing':
+        clip = os.path.join(opt.template_folder, templateClipFile(opt.confidence_prompt.strip()))
+        if not os.path.exists(clip):
+            report.error(f"no audio for the confidence prompt '{opt.confidence_prompt}' in '{opt.template_folder}'. Run audio_sourcer.py with the same --confidence_prompt")
+        confidence = {'clip': os.path.abspath(clip), 'gap': opt.confidence_gap}
+
+    # Progress milestones are percentages
+    milestones = []
+    try:
+        milestones = sorted({int(m) for m in opt.progress_milestones.split(',') if m.strip()})
+    except ValueError:
+        report.error(f"--progress_milestones must be comma separated percentages, e.g. 25,50,75")
+    if any(m <= 0 or m >= 100 for m in milestones):
+        report.error(f"progress milestones must be between 0 and 100")
+
+    # Clips from different sources can differ in sample rate and channels, e.g. 22.05 kHz mono
+    # TTS and 48 kHz stereo recordings. Read their formats from the MP3 headers and convert
+    # the odd ones out to the format most clips have
+    clip_files = []
+    if folders_found:
+        for folder in (opt.word_folder, opt.definition_folder, opt.word_variant_folder):
+            if folder:
+                files = list_clips(folder)
+                clip_files += [os.path.join(folder, f) for f in files[opt.start_index:opt.end_index]]
+    clip_files += list((tag_clips or {}).values())
+    for segment in ('word', 'definition'):
+        clip_files += [value for kind, value in (templates or {}).get(segment, []) if kind == 'text']
+    if confidence is not None:
+        clip_files.append(confidence['clip'])
+    formats = {}
+    unreadable = []
+    for clip in dict.fromkeys(clip_files):
+        if not os.path.exists(clip):
+            continue
+        fmt = mp3_format(clip)
+        if fmt is None:
+            unreadable.append(clip)
+        else:
+            formats.setdefault(fmt, []).append(clip)
+    if unreadable:
+        report.warning(f"{len(unreadable)} clips have no MP3 frame header to check the format of, e.g. '{unreadable[0]}'")
+    if formats:
+        rate, channels = max(formats, key=lambda f: len(formats[f]))
+        clip_format = (opt.sample_rate or rate, opt.channels or channels)
+        odd = {fmt: clips for fmt, clips in formats.items() if fmt != clip_format}
+        if odd:
+            print(f"Converting clips in other formats to {describe_format(clip_format)}: "
+                  + ", ".join(f"{len(clips)} in {describe_format(fmt)} (e.g. '{clips[0]}')"
+                              for fmt, clips in sorted(odd.items(), key=lambda item: -len(item[1]))))
+    report.finish()
+
+    # Difficulty ordering needs scheduling data from the card CSV
+    difficulties = None
+    if opt.order == 'ramp':
+        difficulties = {i: card_difficulty(card_rows[i]) for i in range(opt.start_index, opt.end_index)}
+
+    # Chapters need the section column from the card CSV
+    sections = None
+    if opt.chapters_by:
+        sections = {i: card_rows[i][opt.chapters_by] for i in range(opt.start_index, opt.end_index)}
 
     # Ensure output directory exists
     if not os.path.exists(opt.output_folder):
         os.makedirs(opt.output_folder)
 
     # Execute the combination process
-    output_file = "cards_" + str(opt.start_index) + "-" + str(opt.end_index) + ".mp3"
+    extension = "." + opt.audio_format
+    if opt.chapters_by and opt.chapter_format != 'cue':
+        extension = "." + opt.chapter_format
+    output_file = "cards_" + str(opt.start_index) + "-" + str(opt.end_index)
+    if opt.podcast:
+        # Every episode needs its own file
+        output_file += "_" + time.strftime('%Y%m%d-%H%M%S')
+    output_file += extension
     output_file = os.path.join(opt.output_folder, output_file)
-    combine_words_and_definitions(
-        os.path.abspath(opt.word_folder), 
-        os.path.abspath(opt.definition_folder), 
-        output_file, 
-        opt.start_index, 
-        opt.end_index, 
-        opt.repeat_count, 
-        opt.pause_after_word, 
-        opt.pause_after_definition,
-        opt.normalize
-    )
+
+    # Pick the cards due this session, leaving out cards marked as known
+    indexes = list(range(opt.start_index, opt.end_index))
+    rows = load_card_rows(opt.card_file) if os.path.exists(opt.card_file) else []
+    keys = {i: card_key(rows[i] if i < len(rows) else None, i) for i in indexes}
+    credits, license = lesson_credits(opt.attribution, opt.license, [rows[i] for i in indexes if i < len(rows)])
+
+    # Pinned cards play at the start of every session, whatever the range, schedule or exclusions
+    pins = load_exclusions(opt.pin_file) if opt.pin_file else set()
+    pin_tags = {p[len('tag:'):].lower() for p in pins if p.startswith('tag:')}
+    if opt.pin_tag:
+        pin_tags.add(opt.pin_tag.lower())
+    if pin_tags - {opt.pin_tag.lower()} and rows and 'Tags' not in rows[0]:
+        print(f"warning: {opt.card_file} has no Tags column, so tags in {opt.pin_file} can't match. Export it with --metadata_columns tags")
+    pinned = []
+    matched = set()
+    available = min(len(list_clips(opt.word_folder)), len(list_clips(opt.definition_folder)))
+    for i in range(available):
+        row = rows[i] if i < len(rows) else None
+        ids = {card_key(row, i)} | ({row.get('NoteID'), row.get('Word')} if row else set())
+        tags = [t.lower() for t in ((row or {}).get('Tags') or '').split()]
+        hits = (ids & pins) | {'tag:' + p for p in pin_tags if any(t == p or t.startswith(p + '::') for t in tags)}
+        if hits:
+            pinned.append(i)
+            keys[i] = card_key(row, i)
+            matched |= hits
+    for pin in sorted(pins - matched):
+        print(f"warning: pinned card \"{pin}\" in {opt.pin_file} not found in {opt.card_file}")
+    if pinned:
+        print(f"Playing {len(pinned)} pinned cards first")
+        indexes = [i for i in indexes if i not in set(pinned)]
+
+    excluded = load_exclusions(opt.exclude_file) if opt.exclude_file else set()
+    if excluded:
+        count = len(indexes)
+        indexes = [i for i in indexes if keys[i] not in excluded]
+        print(f"Leaving out {count - len(indexes)} known cards listed in {opt.exclude_file}")
+        if not indexes and not pinned:
+            print("No cards left to play")
+            sys.exit(0)
+    units = None
+    if curriculum is not None:
+        # Only the units up to the one being learned play, in curriculum order
+        units = curriculum_units(indexes, rows, curriculum)
+        count = len(indexes)
+        indexes, last = curriculum_session(indexes, rows, units, opt.curriculum_due)
+        if last is None:
+            print(f"No cards in the range have a tag of {opt.curriculum}")
+            if not pinned:
+                sys.exit(0)
+        else:
+            unit_cards = [idx for idx in indexes if units[idx] == last]
+            unit_due = sum(1 for idx in unit_cards if is_anki_due(rows[idx] if idx < len(rows) else None))
+            print(f"Curriculum: up to unit \"{curriculum[last]}\" ({last + 1} of {len(curriculum)}), "
+                  f"{unit_due} of its {len(unit_cards)} cards due")
+        if count > len(indexes):
+            print(f"Leaving out {count - len(indexes)} cards of later units or in no unit")
+    history = None
+    if opt.schedule == 'exponential' or opt.min_days_between > 0 or opt.new_card_speed != 1.0:
+        history = load_play_history(opt.play_history)
+        session = history['sessions'] + 1
+    if opt.schedule == 'exponential':
+        indexes = [i for i in indexes if is_due(history['cards'].get(keys[i]), session)]
+        print(f"Session {session}: {len(indexes)} of {opt.end_index - opt.start_index} cards due")
+        if not indexes and not pinned:
+            # Still count the session so the schedule moves on
+            history['sessions'] = session
+            save_play_history(opt.play_history, history)
+            print("No cards due this session")
+            sys.exit(0)
+    today = datetime.date.today()
+    if opt.min_days_between > 0:
+        # Cards heard in the last few days wait, unless Anki wants them reviewed anyway
+        if rows and 'Due' not in rows[0]:
+            print(f"warning: {opt.card_file} has no Due column, so cards due in Anki wait too. Export it with --metadata_columns due")
+        count = len(indexes)
+        indexes = [i for i in indexes
+                   if not played_recently(history['cards'].get(keys[i]), today, opt.min_days_between)
+                   or is_anki_due(rows[i] if i < len(rows) else None)]
+        if count > len(indexes):
+            print(f"Leaving out {count - len(indexes)} cards played in the last {opt.min_days_between} days")
+        if not indexes and not pinned:
+            print("No cards left to play")
+            sys.exit(0)
+
+    # Only the cards that fit in --minutes play, by how long their clips and pauses are, so
+    # sessions of long sentences have fewer cards than sessions of short words
+    if opt.minutes > 0:
+        word_files, definition_files = list_clips(opt.word_folder), list_clips(opt.definition_folder)
+        def card_ms(i):
+            row = rows[i] if i < len(rows) else {}
+            word_ms = clip_ms(os.path.join(opt.word_folder, word_files[i]), row.get('Word'))
+            definition_ms = clip_ms(os.path.join(opt.definition_folder, definition_files[i]), row.get('Definition'))
+            return estimate_card_ms(word_ms, definition_ms, (card_patterns or {}).get(i, {}), opt) * opt.repeat_count
+        budget = opt.minutes * 60000
+        planned = sum(card_ms(i) for i in pinned)
+        if planned > budget:
+            print(f"warning: the {len(pinned)} pinned cards alone play for about {planned / 60000:.1f} minutes, more than --minutes {opt.minutes:g}")
+        count = len(indexes)
+        for n, i in enumerate(indexes):
+            ms = card_ms(i)
+            if planned + ms > budget:
+                indexes = indexes[:n]
+                break
+            planned += ms
+        if count > len(indexes):
+            print(f"Playing {len(indexes)} of {count} cards, about {planned / 60000:.1f} minutes (--minutes {opt.minutes:g}), the rest wait for the next session")
+        else:
+            print(f"All {count} cards fit in --minutes {opt.minutes:g}, about {planned / 60000:.1f} minutes")
+        if not indexes and not pinned:
+            print("No cards fit in --minutes")
+            sys.exit(0)
+
+    # Cards heard in fewer than --new_card_sessions earlier sessions are new
+    word_speeds = None
+    if opt.new_card_speed != 1.0:
+        word_speeds = {i: opt.new_card_speed for i in pinned + indexes
+                       if len((history['cards'].get(keys[i]) or {}).get('appearances', [])) < opt.new_card_sessions}
+        if word_speeds:
+            print(f"Pronouncing {len(word_speeds)} new cards at {opt.new_card_speed:g}x speed")
+
+    # Progress announcements are built from number clips
+    progress = None
+    if opt.progress_every > 0 or opt.progress_milestones:
+        total = (len(indexes) + len(pinned)) * opt.repeat_count
+        missing = missing_progress_clips(total, opt.progress_every, milestones, opt.number_folder)
+        if missing:
+            print(f"error: {len(missing)} number clips missing from '{opt.number_folder}', e.g. {missing[0]}. Run audio_sourcer.py --download_numbers {total}")
+            sys.exit(1)
+        progress = {'every': opt.progress_every, 'milestones': milestones,
+                    'folder': os.path.abspath(opt.number_folder), 'pause': opt.progress_pause}
+
+    # Compare the material of this session with the last one built
+    state_file = opt.session_state or os.path.join(opt.output_folder, "last_session.json")
+    folders = [opt.word_folder, opt.definition_folder] + ([opt.word_variant_folder] if opt.word_variant_folder else [])
+    names = {}
+    if os.path.exists(opt.card_file):
+        rows = load_card_rows(opt.card_file)
+        names = {i: rows[i].get('Word') for i in pinned + list(range(opt.start_index, min(opt.end_index, len(rows))))
+                 if i < len(rows)}
+    ignored = ('output_folder', 'session_state', 'skip_if_unchanged', 'play_history', 'exclude_file', 'podcast', 'base_url', 'feed_file', 'feed_title', 'keep_episodes', 'episode_title', 'episode_description', 'temp_dir', 'keep_temp', 'upload_command', 'delete_command', 'upload_retries', 'bwlimit', 'transfer_window', 'device_folder', 'adb_folder', 'adb_serial', 'workspace', 'word_folder', 'definition_folder', 'word_variant_folder', 'card_file', 'tag_folder', 'number_folder', 'template_folder', 'pin_file')
+    settings = {k: v for k, v in vars(opt).items() if k not in ignored}
+    if tag_phrases is not None:
+        # Compare the phrases rather than the file they came from
+        settings['tag_phrases'] = [list(p) for p in tag_phrases]
+    if tag_patterns is not None:
+        settings['tag_patterns'] = [list(p) for p in tag_patterns]
+    if curriculum is not None:
+        settings['curriculum'] = curriculum
+    if word_speeds is not None:
+        # Cards stop being new without the material changing
+        settings['new_cards'] = sorted(keys[i] for i in word_speeds)
+    fingerprint, card_digests = session_fingerprint(folders, pinned + indexes, names, settings)
+    previous = load_session_state(state_file)
+    clip_manifest = dict((previous or {}).get('clips') or {})
+    normalized_folder = os.path.join(os.path.dirname(state_file), 'normalized_clips')
+    feed_file = opt.feed_file or os.path.join(opt.output_folder, "feed.xml")
+    uploader = PartUploader(opt.upload_command, opt.upload_retries, transferLimits, opt.delete_command, state_file) if opt.upload_command else None
+    # A state holding only the uploads of a run that stopped before it finished building is no session
+    if previous is not None and 'fingerprint' in previous:
+        new, changed, removed = compare_sessions(previous, card_digests)
+        if previous.get('fingerprint') == fingerprint:
+            print(f"Session unchanged since {previous.get('built')} ({previous.get('output')})")
+            if opt.skip_if_unchanged:
+                print("Skipping build (--skip_if_unchanged)")
+                if uploader:
+                    # Finish the uploads of the last build that didn't go through
+                    for name in previous.get('published', []):
+                        path = os.path.join(opt.output_folder, name)
+                        if os.path.exists(path):
+                            uploader.upload(path, path + ".sha256")
+                    if opt.podcast and os.path.exists(feed_file):
+                        uploader.upload(feed_file)
+                    finish_uploads(uploader)
+                sys.exit(0)
+        else:
+            print(f"Session differs from {previous.get('built')}: {new} new, {changed} changed, {removed} removed cards"
+                  + (", settings changed" if previous.get('settings') != settings else ""))
+    profile = opt.profile or os.path.basename(os.path.abspath(opt.workspace or '.'))
+    published = []
+    device_failures = []
+
+    def sync_device(copy, remove):
+        """Copies files to the phone and removes expired episodes from it."""
+        for path in copy:
+            if opt.device_folder:
+                problem = copy_to_folder(path, opt.device_folder)
+                if problem:
+                    print(f"warning: {problem}")
+                    device_failures.append(path)
+                else:
+                    print(f"Copied {path} to {opt.device_folder}")
+            if opt.adb_folder:
+                problem = push_to_adb(path, opt.adb_folder, opt.adb_serial)
+                if problem:
+                    print(f"warning: {problem}")
+                    device_failures.append(path)
+                else:
+                    print(f"Pushed {path} to {opt.adb_folder} on the device")
+        for name in remove:
+            if opt.device_folder and os.path.isfile(os.path.join(opt.device_folder, name)):
+                os.remove(os.path.join(opt.device_folder, name))
+            if opt.adb_folder:
+                run_adb(opt.adb_serial, 'shell', 'rm', '-f', shlex.quote(posixpath.join(opt.adb_folder, name)))
+
+    def publish(file, part, duration, part_timeline):
+        """Makes a finished lesson file, or part of one, available: feed entry, upload and phone."""
+        published.append(file)
+        write_timeline(file, part_timeline, keys, rows)
+        write_checksum(file)
+        deleted = []
+        if opt.podcast:
+            played = list(dict.fromkeys(idx for idx, *_ in part_timeline))
+            words = [rows[idx].get('Word', '') for idx in played if idx < len(rows)]
+            if opt.episode_title:
+                title = episode_text(opt.episode_title, profile, opt.start_index, opt.end_index, part or 1, duration, words)
+            else:
+                title = f"Cards {opt.start_index}-{opt.end_index} ({time.strftime('%Y-%m-%d')})"
+                if part is not None:
+                    title += f" part {part}"
+            description = ''
+            if opt.episode_description:
+                description = episode_text(opt.episode_description, profile, opt.start_index, opt.end_index, part or 1, duration, words)
+            deleted = update_feed(feed_file, file, title, opt.feed_title, opt.base_url, duration, opt.keep_episodes, credits, description)
+            print(f"Feed updated: {feed_file}")
+            for path in deleted:
+                print(f"Deleted expired episode file {path}")
+        if uploader:
+            # The feed goes up after the episode so it never links to a missing file
+            uploader.upload(file, file + ".sha256", *([feed_file] if opt.podcast else []))
+            # Timelines and cue sheets are only kept locally
+            uploader.delete(*[os.path.basename(path) for path in deleted if not path.endswith((".timeline.json", ".cue"))])
+        if opt.device_folder or opt.adb_folder:
+            cue_file = os.path.splitext(file)[0] + ".cue"
+            sync_device([file, file + ".sha256"] + ([cue_file] if os.path.exists(cue_file) else []),
+                        [os.path.basename(path) for path in deleted if not path.endswith(".timeline.json")])
+
+    file_namer = None
+    if opt.name_template:
+        def file_namer(part, first):
+            """Names the lesson, or its part-th part, from the template and the first card in it."""
+            word = rows[first].get('Word', '') if first is not None and first < len(rows) else ''
+            name = lesson_file_name(opt.name_template, profile, opt.start_index, opt.end_index, part or 1, word)
+            if part is not None and '{seq' not in opt.name_template:
+                return part_file_name(os.path.join(opt.output_folder, name + extension), part)
+            return os.path.join(opt.output_folder, name + extension)
+
+    timeline = []
+    with RunWorkspace('concatenator', opt.temp_dir, opt.keep_temp):
+        output_file = combine_words_and_definitions(
+            os.path.abspath(opt.word_folder), 
+            os.path.abspath(opt.definition_folder), 
+            output_file, 
+            opt.start_index, 
+            opt.end_index, 
+            opt.repeat_count, 
+            opt.pause_after_word, 
+            opt.pause_after_definition,
+            opt.normalize,
+            variant_folder=os.path.abspath(opt.word_variant_folder) if opt.word_variant_folder else None,
+            variant_mode=opt.variant_mode,
+            variant_gap=opt.variant_gap,
+            difficulties=difficulties,
+            ramp_shape=opt.ramp_shape,
+            ramp_warmup=opt.ramp_warmup,
+            ramp_jitter=opt.ramp_jitter,
+            mode=opt.mode,
+            shadow_pause=opt.shadow_pause,
+            shadow_pause_factor=opt.shadow_pause_factor,
+            shadow_repeat=opt.shadow_repeat,
+            sections=sections,
+            chapter_format=opt.chapter_format,
+            bookmark_volume=opt.bookmark_volume if opt.bookmark_tones else None,
+            indexes=indexes,
+            tag_clips=tag_clips,
+            tag_pause=opt.tag_pause,
+            timeline=timeline,
+            progress=progress,
+            part_ms=opt.part_minutes * 60000 or None,
+            on_part=publish,
+            templates=templates,
+            confidence=confidence,
+            pinned=pinned,
+            file_namer=file_namer,
+            card_patterns=card_patterns,
+            units=units,
+            word_speeds=word_speeds,
+            audio_format=opt.audio_format,
+            tags=credit_tags(credits, license)
+        )
+        if not opt.part_minutes:
+            publish(output_file, None, timeline[-1][2] if timeline else 0, timeline)
+    if history is not None:
+        for i in pinned + indexes:
+            entry = history['cards'].setdefault(keys[i], {'first': session, 'appearances': []})
+            entry['appearances'].append(session)
+            entry['last_played'] = today.isoformat()
+        history['sessions'] = session
+        save_play_history(opt.play_history, history)
+    save_session_state(state_file, fingerprint, card_digests, settings, published, clip_manifest)
+    prune_normalized_clips()
+    report.summary()
+
+    if device_failures:
+        print(f"error: {len(device_failures)} files failed to reach the phone: {', '.join(device_failures)}")
+        sys.exit(1)
+    if uploader:
+        finish_uploads(uploader)
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings can be kept in a YAML config file, ~/.commuter-flashcards.yaml or the file given
+// with --config, instead of being typed every time. Each command's flags go under its name,
+// and `download` is also used when no command is given:
+//
+//	anki_url: desktop.local:8765
+//	download:
+//	  card_query: "deck:JP1K is:due"
+//	  word_field: Word
+//	  definition_field: Meaning
+//	  metadata_columns: [note_id, tags]
+//	lesson:
+//	  repeat_count: 5
+//
+// Only the flags every command has, such as anki_url and notify_url, can be at the top.
+// The values are passed before the command line's, so flags given on the command line win.
+// Lists are joined with commas, or passed once per item to audio and lesson.
+//
+// Decks that need other settings, e.g. another voice or other pauses, can override them
+// under decks, by deck name or a pattern of them with * for any characters. A deck's
+// section looks like the file itself:
+//
+//	decks:
+//	  "Japanese::*":
+//	    audio:
+//	      word_voice: ja-JP-Neural2-C
+//	    lesson:
+//	      pause_after_word: 3000
+//
+// The deck of a run is the one its card_query searches, from the command line, the
+// command's section or the download section, or the one given with --config_deck. The
+// settings of every matching section apply, a more specific one winning over a less
+// specific one: a deck name over a pattern, and a longer pattern over a shorter one. They
+// win over the settings outside of decks, and the command line wins over all of them.
+const configName = ".commuter-flashcards.yaml"
+
+// configFile is the config file the settings are read from, empty with --config "".
+var configFile string
+
+// globalConfigFlags are the settings allowed outside of a command's section.
+var globalConfigFlags = map[string]bool{"anki_url": true, "notify_url": true, "partial_exit_code": true,
+	"anki_retries": true, "anki_backoff": true, "anki_timeout": true, "anki_busy": true, "anki_busy_wait": true}
+
+// scriptCommands are the commands that run a Python step, whose flags are passed the way
+// argparse expects them.
+var scriptCommands = map[string]bool{"audio": true, "lesson": true}
+
+// extractConfigFlag removes --config from args and returns them with the settings of the
+// config file for the command inserted before the command line's flags.
+func extractConfigFlag(args []string) []string {
+	name := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		name = filepath.Join(home, configName)
+	}
+	explicit := false
+	deck := ""
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		flagName, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || (flagName != "config" && flagName != "config_deck") {
+			rest = append(rest, args[i])
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				fatalf("--%s needs a value", flagName)
+			}
+			i++
+			value = args[i]
+		}
+		if flagName == "config_deck" {
+			deck = value
+			continue
+		}
+		name, explicit = value, true
+	}
+	configFile = name
+	if name == "" {
+		return rest
+	}
+
+	command, flags := "download", rest
+	if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		command, flags = rest[0], rest[1:]
+	}
+	data, err := os.ReadFile(name)
+	// pick and setup create the file
+	if os.IsNotExist(err) && (!explicit || command == "pick" || command == "setup") {
+		return rest
+	}
+	if err != nil {
+		fatalf("failed to read config %s: %v", name, err)
+	}
+	var config map[string]any
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		fatalf("failed to read config %s: %v", name, err)
+	}
+
+	// The settings of the top level and of the command's section by flag, the ones of the
+	// matching deck sections replacing them
+	globals, settings := map[string]any{}, map[string]any{}
+	apply := func(config map[string]any, where string) {
+		for _, key := range sortedKeys(config) {
+			if _, isSection := config[key].(map[string]any); isSection || (where == "" && key == "decks") {
+				continue
+			}
+			flagName := configKey(name, "", key)
+			if !globalConfigFlags[flagName] {
+				fatalf("config %s: %s%s must be under a command, e.g. download:", name, where, key)
+			}
+			globals[flagName] = config[key]
+		}
+		if section, found := config[command].(map[string]any); found {
+			for _, key := range sortedKeys(section) {
+				settings[configKey(name, command, key)] = section[key]
+			}
+		}
+	}
+	apply(config, "")
+	if deck == "" {
+		deck = configDeck(flags, config, command)
+	}
+	if decks, found := config["decks"]; found {
+		sections, isSection := decks.(map[string]any)
+		if !isSection {
+			fatalf("config %s: decks must map deck names or patterns to their settings", name)
+		}
+		patterns := matchingDecks(sections, deck)
+		for _, pattern := range patterns {
+			section, isSection := sections[pattern].(map[string]any)
+			if !isSection {
+				fatalf("config %s: decks: %s must be a section of settings", name, pattern)
+			}
+			apply(section, "decks: "+pattern+": ")
+		}
+		if len(patterns) > 0 {
+			fmt.Printf("Using the config settings for deck %s from decks %s\n", deck, strings.Join(patterns, ", "))
+		}
+	}
+
+	var configured []string
+	for _, key := range sortedKeys(globals) {
+		values, err := configArgs(key, globals[key], false)
+		if err != nil {
+			fatalf("config %s: %v", name, err)
+		}
+		configured = append(configured, values...)
+	}
+	for _, key := range sortedKeys(settings) {
+		values, err := configArgs(key, settings[key], scriptCommands[command])
+		if err != nil {
+			fatalf("config %s: %s: %v", name, command, err)
+		}
+		configured = append(configured, values...)
+	}
+	if len(configured) == 0 {
+		return rest
+	}
+	if len(flags) < len(rest) {
+		return append(append([]string{command}, configured...), flags...)
+	}
+	return append(configured, flags...)
+}
+
+// queryDeckTerm matches the deck a search names, as deck:Name, "deck:Some Name" or
+// deck:"Some Name". Negated ones don't match, being preceded by a -.
+var queryDeckTerm = regexp.MustCompile(`(?:^|[\s(])(?:"deck:((?:[^"\\]|\\.)*)"|deck:"((?:[^"\\]|\\.)*)"|deck:([^\s")]+))`)
+
+var searchUnescaper = regexp.MustCompile(`\\(.)`)
+
+// queryDeck returns the first deck an Anki search searches, or "" for none.
+func queryDeck(query string) string {
+	m := queryDeckTerm.FindStringSubmatch(query)
+	if m == nil {
+		return ""
+	}
+	return searchUnescaper.ReplaceAllString(m[1]+m[2]+m[3], "$1")
+}
+
+// configDeck returns the deck the card_query of a run searches: the command line's, the
+// command's section's or the download section's.
+func configDeck(flags []string, config map[string]any, command string) string {
+	for i, arg := range flags {
+		flagName, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || flagName != "card_query" {
+			continue
+		}
+		if !hasValue && i+1 < len(flags) {
+			value = flags[i+1]
+		}
+		return queryDeck(value)
+	}
+	for _, section := range []string{command, "download"} {
+		if settings, found := config[section].(map[string]any); found {
+			if query, isString := settings["card_query"].(string); isString {
+				return queryDeck(query)
+			}
+		}
+	}
+	return ""
+}
+
+// matchingDecks returns the deck names and patterns of decks that deck matches, least
+// specific first: patterns before names, and shorter patterns before longer ones. Names are
+// matched like Anki does, whatever their case.
+func matchingDecks(decks map[string]any, deck string) []string {
+	if deck == "" {
+		return nil
+	}
+	var matched []string
+	for pattern := range decks {
+		expr := "(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if regexp.MustCompile(expr).MatchString(deck) {
+			matched = append(matched, pattern)
+		}
+	}
+	// specificity orders names after patterns, and patterns by their length without the *s
+	specificity := func(pattern string) int {
+		if !strings.Contains(pattern, "*") {
+			return math.MaxInt
+		}
+		return len(strings.ReplaceAll(pattern, "*", ""))
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if a, b := specificity(matched[i]), specificity(matched[j]); a != b {
+			return a < b
+		}
+		return matched[i] < matched[j]
+	})
+	return matched
+}
+
+// configKey returns the flag a key of the config file sets, warning if it was renamed.
+func configKey(name, command, key string) string {
+	newName, found := renamedFlag(command, key)
+	if !found {
+		return key
+	}
+	fmt.Printf("warning: config %s: %s was renamed to %s, update the config with: config migrate\n", name, key, newName)
+	return newName
+}
+
+// configArgs returns the command line arguments setting flag name to value.
+func configArgs(name string, value any, script bool) ([]string, error) {
+	switch v := value.(type) {
+	case bool:
+		// argparse switches take no value and can't be turned off
+		if script {
+			if v {
+				return []string{"--" + name}, nil
+			}
+			return nil, nil
+		}
+		return []string{"--" + name + "=" + strconv.FormatBool(v)}, nil
+	case []any:
+		var items []string
+		for _, item := range v {
+			s, err := configValue(name, item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, s)
+		}
+		if !script {
+			return []string{"--" + name + "=" + strings.Join(items, ",")}, nil
+		}
+		var args []string
+		for _, item := range items {
+			args = append(args, "--"+name+"="+item)
+		}
+		return args, nil
+	}
+	s, err := configValue(name, value)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"--" + name + "=" + s}, nil
+}
+
+// configValue formats a single value of flag name.
+func configValue(name string, value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("%s must be a string, number, true/false or a list of them", name)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A configSetting is a key of the config file and the value to give it.
+type configSetting struct {
+	key   string
+	value any
+}
+
+// A configSection is the settings of a command's section of the config file.
+type configSection struct {
+	name     string
+	settings []configSetting
+}
+
+// saveConfig sets keys of commands' sections of the config file name, creating the file or
+// the sections if needed. The rest of the file is kept as it was, comments included, and an
+// existing file is backed up to <name>.bak first.
+func saveConfig(name string, sections ...configSection) error {
+	data, err := os.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to read config %s: %v", name, err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("config %s is not a mapping of settings", name)
+	}
+	// mappingValue returns the value of key in mapping, adding it as an empty node of kind
+	mappingValue := func(mapping *yaml.Node, key string, kind yaml.Kind) *yaml.Node {
+		for i := 0; i+1 < len(mapping.Content); i += 2 {
+			if mapping.Content[i].Value == key {
+				return mapping.Content[i+1]
+			}
+		}
+		value := &yaml.Node{Kind: kind}
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+		return value
+	}
+	for _, section := range sections {
+		commands := mappingValue(root, section.name, yaml.MappingNode)
+		if commands.Kind != yaml.MappingNode {
+			return fmt.Errorf("config %s: %s is not a section of settings", name, section.name)
+		}
+		for _, s := range section.settings {
+			value := mappingValue(commands, s.key, yaml.ScalarNode)
+			comment := value.LineComment
+			if err := value.Encode(s.value); err != nil {
+				return err
+			}
+			value.LineComment = comment
+		}
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	if data != nil {
+		if err := writeFileAtomic(name+".bak", data, 0644); err != nil {
+			return fmt.Errorf("failed to back up config %s: %v", name, err)
+		}
+	}
+	return writeFileAtomic(name, out.Bytes(), 0644)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Renamed flags keep working under their old name, with a warning, so cron jobs, batch
+// profiles and config files written for an older release don't break on upgrade. `config
+// migrate` rewrites a config file to the new names. Old names are dropped a few releases
+// after they were renamed.
+type flagRename struct {
+	// command is the command with the flag, or "" for a flag every command has
+	command  string
+	old, new string
+}
+
+var renamedFlags = []flagRename{
+	// Named like concatenator's --session_state, it was easy to mix the two up
+	{command: "download", old: "state_file", new: "export_state_file"},
+}
+
+// renamedFlag returns the new name of flag name of command, if it was renamed. An empty
+// command only has the flags every command has.
+func renamedFlag(command, name string) (string, bool) {
+	for _, r := range renamedFlags {
+		if r.old == name && (r.command == "" || r.command == command) {
+			return r.new, true
+		}
+	}
+	return "", false
+}
+
+// commandOf returns the command args run and the args after it.
+func commandOf(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+	return "download", args
+}
+
+// renameFlags returns args with renamed flags given their new name, warning about each.
+func renameFlags(args []string) []string {
+	command, flags := commandOf(args)
+	renamed := make([]string, 0, len(args))
+	renamed = append(renamed, args[:len(args)-len(flags)]...)
+	for _, arg := range flags {
+		if arg == "--" {
+			break
+		}
+		dashes := arg[:len(arg)-len(strings.TrimLeft(arg, "-"))]
+		name, value, hasValue := strings.Cut(arg[len(dashes):], "=")
+		if dashes == "" || dashes == arg {
+			renamed = append(renamed, arg)
+			continue
+		}
+		if newName, found := renamedFlag(command, name); found {
+			fmt.Printf("warning: --%s was renamed to --%s, the old name will stop working in a future release\n", name, newName)
+			arg = dashes + newName
+			if hasValue {
+				arg += "=" + value
+			}
+		}
+		renamed = append(renamed, arg)
+	}
+	return append(renamed, args[len(renamed):]...)
+}
+
+// runConfig implements the config command. `config migrate` renames the renamed flags of
+// a config file, keeping the old file as <name>.bak.
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "migrate" {
+		fatalf("usage: config migrate [--config file] [--dry_run]")
+	}
+	fs := flag.NewFlagSet("config migrate", flag.ExitOnError)
+	defaultName := configName
+	if home, err := os.UserHomeDir(); err == nil {
+		defaultName = filepath.Join(home, configName)
+	}
+	name := fs.String("config", defaultName, "Config file to migrate")
+	dryRun := fs.Bool("dry_run", false, "Print the migrated config without writing it")
+	fs.Parse(args[1:])
+
+	data, err := os.ReadFile(*name)
+	if err != nil {
+		fatalf("failed to read config %s: %v", *name, err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		fatalf("failed to read config %s: %v", *name, err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		fatalf("config %s has no settings to migrate", *name)
+	}
+
+	changes := migrateConfig(doc.Content[0], "")
+	if len(changes) == 0 {
+		fmt.Printf("%s is up to date\n", *name)
+		return
+	}
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		fatalf("failed to encode config: %v", err)
+	}
+	if *dryRun {
+		fmt.Printf("dry run: %s would be:\n%s", *name, out.String())
+		return
+	}
+	if err := writeFileAtomic(*name+".bak", data, 0644); err != nil {
+		fatalf("failed to back up config %s: %v", *name, err)
+	}
+	if err := writeFileAtomic(*name, out.Bytes(), 0644); err != nil {
+		fatalf("failed to write config %s: %v", *name, err)
+	}
+	fmt.Printf("Migrated %s, the old config is in %s.bak\n", *name, *name)
+}
+
+// migrateConfig renames the renamed flags of a config mapping, the top level if section is
+// empty or a command's, and returns what it changed.
+func migrateConfig(mapping *yaml.Node, section string) []string {
+	var changes []string
+	keys := map[string]bool{}
+	for i := 0; i < len(mapping.Content); i += 2 {
+		keys[mapping.Content[i].Value] = true
+	}
+	where := "top level"
+	if section != "" {
+		where = section
+	}
+	for i := 0; i < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		if section == "" && key.Value == "decks" && value.Kind == yaml.MappingNode {
+			// Each deck's section looks like the file itself
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				for _, change := range migrateConfig(value.Content[j+1], "") {
+					changes = append(changes, fmt.Sprintf("decks: %s: %s", value.Content[j].Value, change))
+				}
+			}
+			continue
+		}
+		if section == "" && value.Kind == yaml.MappingNode {
+			changes = append(changes, migrateConfig(value, key.Value)...)
+			continue
+		}
+		newName, found := renamedFlag(section, key.Value)
+		if !found {
+			continue
+		}
+		if keys[newName] {
+			// Both names are set, keep the new one
+			changes = append(changes, fmt.Sprintf("%s: removed %s, %s is already set", where, key.Value, newName))
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			i -= 2
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: renamed %s to %s", where, key.Value, newName))
+		keys[newName] = true
+		key.Value = newName
+	}
+	return changes
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+const minAnkiConnectVersion = 6
+
+// checkResult is the outcome of one doctor check.
+type checkResult struct {
+	status string // PASS, WARN or FAIL
+	detail string
+	fix    string
+}
+
+func pass(detail string) checkResult {
+	return checkResult{status: "PASS", detail: detail}
+}
+
+func warn(detail, fix string) checkResult {
+	return checkResult{status: "WARN", detail: detail, fix: fix}
+}
+
+func fail(detail, fix string) checkResult {
+	return checkResult{status: "FAIL", detail: detail, fix: fix}
+}
+
+// runDoctor checks everything a scheduled run depends on and prints pass/fail with fixes.
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	cardQuery := fs.String("card_query", "", "Anki search query to check fields against (optional)")
+	wordField := fs.String("word_field", "", "Field name where words are stored on cards")
+	definitionField := fs.String("definition_field", "", "Field name where word definitions are stored on cards")
+	wordAudioField := fs.String("word_audio_field", "", "Field name where word pronunciation audio files are stored on cards")
+	apiKeyFile := fs.String("API_key_file", "API_keys.json", "File containing TTS API keys")
+	outputDir := fs.String("output_dir", ".", "Directory output files will be written to")
+	offline := fs.Bool("offline", false, "Skip checks that contact TTS services")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{"output_dir": ""})
+
+	client := newAnkiClient()
+	failed := 0
+	report := func(name string, r checkResult) {
+		fmt.Printf("[%s] %s: %s\n", r.status, name, r.detail)
+		if r.fix != "" {
+			fmt.Printf("       fix: %s\n", r.fix)
+		}
+		if r.status == "FAIL" {
+			failed++
+		}
+	}
+
+	ankiOK := false
+	version, restErr := ankiInvoke[int](client, "version", nil)
+	switch {
+	case restErr != nil:
+		report("Anki", fail(restErr.Error, "start Anki and make sure the Anki-Connect add-on is installed and enabled"))
+	case *version < minAnkiConnectVersion:
+		report("Anki", pass("reachable at "+client.Url))
+		report("Anki-Connect version", fail(fmt.Sprintf("version %d, need %d or newer", *version, minAnkiConnectVersion),
+			"update the Anki-Connect add-on from Tools > Add-ons"))
+	default:
+		ankiOK = true
+		report("Anki", pass("reachable at "+client.Url))
+		report("Anki-Connect version", pass(fmt.Sprint(*version)))
+	}
+
+	if *cardQuery != "" && ankiOK {
+		report("Card fields", checkFields(client, *cardQuery, map[string]string{
+			"word_field": *wordField, "definition_field": *definitionField, "word_audio_field": *wordAudioField,
+		}))
+	}
+
+	if path, err := exec.LookPath("ffmpeg"); err == nil {
+		report("ffmpeg", pass(path))
+	} else {
+		report("ffmpeg", fail("not found on PATH", "install ffmpeg (https://ffmpeg.org/download.html) and add it to your PATH"))
+	}
+
+	report("Python dependencies", checkPython())
+
+	keys, err := loadAPIKeys(*apiKeyFile)
+	if err != nil {
+		report("API keys", warn(err.Error(), "create "+*apiKeyFile+" as described in the README if you use TTS"))
+	} else {
+		report("Forvo key", checkForvo(keys["Forvo"], *offline))
+		report("ElevenLabs key", checkElevenLabs(keys["ElevenLabs"], *offline))
+		report("Google TTS credentials", checkGoogleCredentials(keys["googleTTS"]))
+	}
+
+	report("Output directory", checkWritable(*outputDir))
+
+	if failed > 0 {
+		fmt.Printf("%d checks failed\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("All checks passed")
+}
+
+// checkFields verifies that every note type matched by query has the configured fields.
+func checkFields(client *ankiconnect.Client, query string, fields map[string]string) checkResult {
+	ids, restErr := client.Cards.Search(query)
+	if restErr != nil {
+		return fail(restErr.Message, "check the --card_query syntax")
+	}
+	if len(*ids) == 0 {
+		return fail("query matched no cards", "check the --card_query deck name, quoting deck names with spaces")
+	}
+	models, restErr := matchedModels(client, query, len(*ids))
+	if restErr != nil {
+		return fail(restErr.Message, "")
+	}
+	if problems := missingFields(models, fields); len(problems) > 0 {
+		return fail(strings.Join(problems, "; "), "use the field names listed, or narrow --card_query to note types that have the fields")
+	}
+	return pass(fmt.Sprintf("%d cards matched in %d note types, fields present", len(*ids), len(models)))
+}
+
+// pythonPath returns the Python interpreter on PATH that runs the audio tools.
+func pythonPath() (string, error) {
+	for _, name := range []string{"python3", "python"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("python not found on PATH")
+}
+
+// checkPython verifies the audio tools' Python dependencies are importable.
+func checkPython() checkResult {
+	path, err := pythonPath()
+	if err != nil {
+		return fail(err.Error(), "install Python 3 from https://www.python.org")
+	}
+	out, err := exec.Command(path, "-c", "import pydub, requests, elevenlabs, google.cloud.texttospeech").CombinedOutput()
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		return fail(lines[len(lines)-1], "run: pip install -r requirements.txt")
+	}
+	return pass(path)
+}
+
+// loadAPIKeys reads the API key file shared with audio_sourcer.py.
+func loadAPIKeys(name string) (map[string]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	keys := map[string]string{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %s: %v", name, err)
+	}
+	return keys, nil
+}
+
+var doctorHTTP = &http.Client{Timeout: 15 * time.Second}
+
+func checkForvo(key string, offline bool) checkResult {
+	if key == "" {
+		return warn("not configured", "add a \"Forvo\" key to the API key file to use Forvo pronunciations")
+	}
+	if offline {
+		return pass("configured (not verified)")
+	}
+	u := fmt.Sprintf("https://apifree.forvo.com/key/%s/format/json/action/language-list/min-pronunciations/1000000", url.PathEscape(key))
+	resp, err := doctorHTTP.Get(u)
+	if err != nil {
+		return fail(err.Error(), "check your internet connection")
+	}
+	defer resp.Body.Close()
+	var body map[string]any
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusOK || body["error"] != nil {
+		return fail(fmt.Sprintf("Forvo rejected the key (%s)", resp.Status), "check the key at https://api.forvo.com/account/")
+	}
+	return pass("key accepted")
+}
+
+func checkElevenLabs(key string, offline bool) checkResult {
+	if key == "" {
+		return warn("not configured", "add an \"ElevenLabs\" key to the API key file to use ElevenLabs voices")
+	}
+	if offline {
+		return pass("configured (not verified)")
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://api.elevenlabs.io/v1/user", nil)
+	req.Header.Set("xi-api-key", key)
+	resp, err := doctorHTTP.Do(req)
+	if err != nil {
+		return fail(err.Error(), "check your internet connection")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fail("ElevenLabs rejected the key ("+resp.Status+")", "create a new key at https://elevenlabs.io/app/settings/api-keys")
+	}
+	return pass("key accepted")
+}
+
+func checkGoogleCredentials(path string) checkResult {
+	if env := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); env != "" {
+		path = env
+	}
+	if path == "" {
+		return warn("not configured", "set \"googleTTS\" in the API key file to the path of a service account JSON file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fail(err.Error(), "download a service account key from the Google Cloud console")
+	}
+	var creds struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil || creds.Type != "service_account" || creds.PrivateKey == "" {
+		return fail(path+" is not a service account key file", "download a JSON key for a service account with Text-to-Speech access")
+	}
+	return pass(creds.ClientEmail)
+}
+
+func checkWritable(dir string) checkResult {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fail(err.Error(), "choose a different output directory")
+	}
+	f, err := os.CreateTemp(dir, ".doctor*")
+	if err != nil {
+		return fail(err.Error(), "check the permissions of "+dir)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	abs, _ := filepath.Abs(dir)
+	return pass(abs + " is writable")
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/Michael-Manning/commuter-flashcards/pkg/ankiexport"
+	"github.com/atselvan/ankiconnect"
+)
+
+// forEachCard calls fn for each of n cards with up to workers calls at a time. fn is only
+// called for the cards todo accepts. The first failure stops the calls that haven't started,
+// and is returned.
+func forEachCard(n, workers int, todo func(i int) bool, fn func(i int) error) error {
+	jobs := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	for w := 0; w < max(workers, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if failed() {
+			break
+		}
+		if todo(i) {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return firstErr
+}
+
+// downloadAudio retrieves the audio file of every card from Anki into folder with up to
+// workers downloads at a time, and returns how many were written and how many of them tts
+// read because Anki had no audio for the card: the file its audio field names is missing,
+// or with readEmpty the field is empty. tts may be nil, and cards without audio are then
+// left without it with a warning. Files are named by the card's position, so the output
+// is the same however the downloads interleave. Cards with an audioPath already have their
+// audio.
+func downloadAudio(client *ankiconnect.Client, cache *mediaCache, cards []card, folder string, names []string, workers int, tts ttsEngine, readEmpty bool, warnings *[]string) (int, int, error) {
+	var (
+		mu                    sync.Mutex
+		downloaded, generated int
+	)
+	err := forEachCard(len(cards), workers, func(i int) bool { return cards[i].audioPath == "" }, func(i int) error {
+		filename := cards[i].audioFile
+		var data []byte
+		err := ankiexport.ErrMediaNotFound
+		if filename != "" {
+			data, err = retrieveMedia(client, cache, filename)
+		}
+		synthesized := false
+		if errors.Is(err, ankiexport.ErrMediaNotFound) && tts != nil && (filename != "" || readEmpty) {
+			text := spokenText(cards[i])
+			if data, err = synthesizeClip(tts, cache, text, spokenLanguage(cards[i])); err != nil {
+				return fmt.Errorf("failed to synthesize audio for %q: %v", text, err)
+			}
+			synthesized = true
+		} else if errors.Is(err, ankiexport.ErrMediaNotFound) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case filename == "" && tts != nil:
+				*warnings = append(*warnings, fmt.Sprintf("note %d: %q has no audio, which --tts_words missing leaves it without", cards[i].noteID, cards[i].word))
+			case filename == "":
+				*warnings = append(*warnings, fmt.Sprintf("note %d: %q has no audio, and no TTS engine to read it", cards[i].noteID, cards[i].word))
+			default:
+				*warnings = append(*warnings, fmt.Sprintf("note %d: audio file %s of %q %v, and no TTS engine to read it", cards[i].noteID, filename, cards[i].word, err))
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to retrieve audio file %s of note %d: %v", filename, cards[i].noteID, err)
+		}
+		if !synthesized && len(cards[i].extraAudio) > 0 {
+			if data, err = appendSounds(client, cache, cards[i], data, warnings, &mu); err != nil {
+				return err
+			}
+		}
+		outname := filepath.Join(folder, names[i])
+		if err := writeFileAtomic(outname, data, 0644); err != nil {
+			return fmt.Errorf("failed to write audio file %s: %v", outname, err)
+		}
+		// Each worker only touches the cards it was given
+		cards[i].audioPath = outname
+		cards[i].audioHash = hashHex(data)
+		cards[i].audioSize = len(data)
+
+		mu.Lock()
+		defer mu.Unlock()
+		downloaded++
+		if synthesized {
+			generated++
+			if cards[i].sources == nil {
+				cards[i].sources = map[string]string{}
+			}
+			cards[i].sources["audio"] = "tts:" + tts.voice(spokenLanguage(cards[i]))
+			fmt.Printf("synthesized %s\n", cards[i].word)
+		} else {
+			delete(cards[i].sources, "audio")
+			fmt.Printf("downloaded %s\n", filename)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return downloaded, generated, nil
+}
+
+// audioSource returns where a card's clip came from for the audio_source column: anki, the
+// TTS voice that read it, e.g. tts:google:ja-JP-Neural2-B, or nothing for a card without one.
+func audioSource(c card) string {
+	switch {
+	case c.audioPath == "":
+		return ""
+	case c.sources["audio"] != "":
+		return c.sources["audio"]
+	}
+	return "anki"
+}
+
+// appendSounds returns data with the card's extraAudio played after it. Files that aren't in
+// Anki are left out with a warning, and only MP3s can be joined, so with other files the
+// clip stays the first one.
+func appendSounds(client *ankiconnect.Client, cache *mediaCache, c card, data []byte, warnings *[]string, mu *sync.Mutex) ([]byte, error) {
+	warn := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		*warnings = append(*warnings, fmt.Sprintf("note %d: ", c.noteID)+fmt.Sprintf(format, args...))
+	}
+	for _, name := range append([]string{c.audioFile}, c.extraAudio...) {
+		if !isMP3(name) {
+			warn("only MP3 sound tags can be played together, %q plays only %s", c.word, c.audioFile)
+			return data, nil
+		}
+	}
+	clips := [][]byte{data}
+	for _, name := range c.extraAudio {
+		extra, err := retrieveMedia(client, cache, name)
+		if errors.Is(err, ankiexport.ErrMediaNotFound) {
+			warn("audio file %s of %q %v, leaving it out", name, c.word, err)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to retrieve audio file %s of note %d: %v", name, c.noteID, err)
+		}
+		clips = append(clips, extra)
+	}
+	return joinMP3(clips), nil
+}
+
+// definitionFileName is the name of the definition clip of the card numbered i, as
+// audio_sourcer.py names them.
+func definitionFileName(i int) string {
+	return fmt.Sprintf("definition_%05d.mp3", i)
+}
+
+// numberedClip matches the names clips are numbered with, e.g. word_0012.mp3.
+var numberedClip = regexp.MustCompile(`^[a-z]+_[0-9]+\.mp3$`)
+
+// removeStaleClips removes the clips in folder numbered like prefix_0012.mp3 that aren't one
+// of names, left by cards an earlier export had. concatenator.py pairs the clips in the
+// order their names sort in, so a gap in the numbers must not hold an old card's clip.
+func removeStaleClips(folder, prefix string, names []string) error {
+	want := map[string]bool{}
+	for _, name := range names {
+		want[name] = true
+	}
+	files, _ := filepath.Glob(filepath.Join(folder, prefix+"_*.mp3"))
+	removed := 0
+	for _, f := range files {
+		name := filepath.Base(f)
+		if !numberedClip.MatchString(name) || want[name] {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			return fmt.Errorf("failed to remove the clip of a card no longer exported: %v", err)
+		}
+		removed++
+	}
+	if removed > 0 {
+		fmt.Printf("Removed %d clips of cards no longer exported from %s\n", removed, folder)
+	}
+	return nil
+}
+
+// synthesizeDefinitions reads the definition of every card in language into folder with up
+// to workers at a time, and returns how many were written.
+func synthesizeDefinitions(tts ttsEngine, cache *mediaCache, cards []card, folder, language string, workers int) (int, error) {
+	err := forEachCard(len(cards), workers, func(int) bool { return true }, func(i int) error {
+		text, _ := htmlToText(cards[i].definition)
+		data, err := synthesizeClip(tts, cache, text, language)
+		if err != nil {
+			return fmt.Errorf("failed to synthesize the definition of %q: %v", cards[i].word, err)
+		}
+		name := filepath.Join(folder, definitionFileName(cards[i].number))
+		if err := writeFileAtomic(name, data, 0644); err != nil {
+			return fmt.Errorf("failed to write audio file %s: %v", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	names := make([]string, len(cards))
+	for i, c := range cards {
+		names[i] = definitionFileName(c.number)
+	}
+	if err := removeStaleClips(folder, "definition", names); err != nil {
+		return 0, err
+	}
+	return len(cards), nil
+}
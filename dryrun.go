@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Michael-Manning/commuter-flashcards/pkg/ankiexport"
+	"github.com/atselvan/ankiconnect"
+)
+
+// dryRunSamples is how many audio files a dry run downloads to estimate the size of all of
+// them. They are only measured, not written.
+const dryRunSamples = 5
+
+// dryRunOptions is what a dry run checks the cards against.
+type dryRunOptions struct {
+	output   string
+	audio    bool
+	readings bool
+	// wordTTS is set when the cards with an empty audio field are read, and missingTTS when
+	// the ones whose audio file Anki doesn't have are
+	wordTTS       bool
+	missingTTS    bool
+	definitionTTS bool
+}
+
+// cardProblems returns what is missing from a card that an export needs.
+func cardProblems(c card, opts dryRunOptions) []string {
+	var problems []string
+	if strings.TrimSpace(c.word) == "" {
+		problems = append(problems, "empty word")
+	}
+	if strings.TrimSpace(c.definition) == "" {
+		problems = append(problems, "empty definition")
+	}
+	if opts.readings && c.reading == "" {
+		problems = append(problems, "empty reading")
+	}
+	if opts.audio && c.audioFile == "" && !opts.wordTTS {
+		problems = append(problems, "no audio")
+	}
+	return problems
+}
+
+// printDryRun prints what an export of cards would do, checking every card and estimating
+// the size of its audio from a few of the files, and returns how many cards have problems.
+func printDryRun(client *ankiconnect.Client, cards []card, opts dryRunOptions) int {
+	var missing, audioFiles []string
+	seen := map[string]bool{}
+	withoutAudio := 0
+	for _, c := range cards {
+		if problems := cardProblems(c, opts); len(problems) > 0 {
+			missing = append(missing, fmt.Sprintf("note %d %q: %s", c.noteID, c.word, strings.Join(problems, ", ")))
+		}
+		if c.audioFile == "" {
+			withoutAudio++
+			continue
+		}
+		for _, name := range append([]string{c.audioFile}, c.extraAudio...) {
+			if !seen[name] {
+				seen[name] = true
+				audioFiles = append(audioFiles, name)
+			}
+		}
+	}
+
+	fmt.Printf("dry run: %d cards would be written to %s\n", len(cards), opts.output)
+	if len(missing) > 0 {
+		fmt.Printf("%d cards have missing fields:\n", len(missing))
+		for _, m := range missing {
+			fmt.Printf("  %s\n", m)
+		}
+	} else {
+		fmt.Println("Every card has the fields an export needs")
+	}
+	if !opts.audio && !opts.definitionTTS {
+		return len(missing)
+	}
+
+	var total int64
+	if opts.audio {
+		fmt.Printf("%d audio files would be fetched from Anki\n", len(audioFiles))
+		switch {
+		case withoutAudio > 0 && opts.wordTTS:
+			fmt.Printf("%d cards without audio would be read by the TTS engine\n", withoutAudio)
+		case withoutAudio > 0:
+			fmt.Printf("%d cards have no audio, and no TTS engine to read them\n", withoutAudio)
+		}
+		size, sampled, notFound := sampleMediaSize(client, audioFiles)
+		switch {
+		case notFound > 0 && opts.missingTTS:
+			fmt.Printf("%d of %d sampled audio files are missing from Anki's media folder, the TTS engine would read their cards\n", notFound, notFound+sampled)
+		case notFound > 0:
+			fmt.Printf("warning: %d of %d sampled audio files are missing from Anki's media folder\n", notFound, notFound+sampled)
+		}
+		if sampled > 0 {
+			total = size / int64(sampled) * int64(len(audioFiles))
+		}
+	}
+	if opts.definitionTTS {
+		fmt.Printf("%d definitions would be read by the TTS engine\n", len(cards))
+	}
+	if total > 0 {
+		estimate := "Estimated audio size: " + formatSize(total)
+		if opts.wordTTS && withoutAudio > 0 || opts.definitionTTS {
+			estimate += ", not counting the TTS clips"
+		}
+		fmt.Println(estimate)
+	}
+	return len(missing)
+}
+
+// sampleMediaSize downloads up to dryRunSamples of files, spread across them, and returns
+// their total size, how many were downloaded and how many Anki doesn't have.
+func sampleMediaSize(client *ankiconnect.Client, files []string) (int64, int, int) {
+	var size int64
+	sampled, missing := 0, 0
+	step := max(len(files)/dryRunSamples, 1)
+	for i := 0; i < len(files) && sampled+missing < dryRunSamples; i += step {
+		// Without the cache, so a dry run leaves it alone too
+		data, err := retrieveMedia(client, nil, files[i])
+		if errors.Is(err, ankiexport.ErrMediaNotFound) {
+			missing++
+			continue
+		} else if err != nil {
+			fmt.Printf("warning: failed to retrieve audio file %s: %v\n", files[i], err)
+			continue
+		}
+		size += int64(len(data))
+		sampled++
+	}
+	return size, sampled, missing
+}
+
+// formatSize formats a number of bytes for people, e.g. 1.5 MB.
+func formatSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, prefix := float64(n)/unit, "k"
+	for _, p := range []string{"M", "G", "T"} {
+		if value < unit {
+			break
+		}
+		value, prefix = value/unit, p
+	}
+	return fmt.Sprintf("%.1f %sB", value, prefix)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// dueQuery returns query narrowed to the cards Anki would show for review: with dueOnly the
+// ones due today, learning cards included, and with within the ones due in the next that many
+// days too. Suspended and buried cards are left out, as Anki leaves them out of reviews.
+func dueQuery(query string, dueOnly bool, within string) (string, error) {
+	if !dueOnly && within == "" {
+		return query, nil
+	}
+	filter := "is:due"
+	if within != "" {
+		days, err := parseDays(within)
+		if err != nil {
+			return "", fmt.Errorf("invalid --due_within %q: %v", within, err)
+		}
+		// prop:due counts review cards' days from today, overdue ones are negative
+		filter = fmt.Sprintf("(is:due OR prop:due<=%d)", days)
+	}
+	return fmt.Sprintf("(%s) %s -is:suspended -is:buried", query, filter), nil
+}
+
+// parseDays parses a number of days, written like 2d or 2.
+func parseDays(s string) (int, error) {
+	days, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(s), "d"))
+	if err != nil {
+		return 0, fmt.Errorf("must be a number of days such as 2d")
+	}
+	if days < 0 {
+		return 0, fmt.Errorf("cannot be negative")
+	}
+	return days, nil
+}
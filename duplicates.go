@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Base letters for precomposed Latin characters with diacritics.
+var diacriticBase = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'ç': "c", 'ć': "c", 'ĉ': "c", 'ċ': "c", 'č': "c",
+	'ď': "d", 'đ': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ĕ': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ĝ': "g", 'ğ': "g", 'ġ': "g", 'ģ': "g",
+	'ĥ': "h", 'ħ': "h",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ĩ': "i", 'ī': "i", 'ĭ': "i", 'į': "i", 'ı': "i",
+	'ĵ': "j", 'ķ': "k",
+	'ĺ': "l", 'ļ': "l", 'ľ': "l", 'ŀ': "l", 'ł': "l",
+	'ñ': "n", 'ń': "n", 'ņ': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ŏ': "o", 'ő': "o",
+	'ŕ': "r", 'ŗ': "r", 'ř': "r",
+	'ś': "s", 'ŝ': "s", 'ş': "s", 'š': "s", 'ß': "ss",
+	'ţ': "t", 'ť': "t", 'ŧ': "t",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ũ': "u", 'ū': "u", 'ŭ': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ŵ': "w", 'ý': "y", 'ÿ': "y", 'ŷ': "y",
+	'ź': "z", 'ż': "z", 'ž': "z",
+	'æ': "ae", 'œ': "oe",
+}
+
+// normalizeWord folds case, width and diacritics so spelling variants of a word compare equal.
+// Case folding follows the rules of language where they differ, e.g. the Turkish dotted I.
+func normalizeWord(s, language string) string {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	switch baseLanguage(language) {
+	case "tr", "az":
+		lower = strings.ToLowerSpecial(unicode.TurkishCase, strings.TrimSpace(s))
+	}
+	var b strings.Builder
+	for _, r := range lower {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// Combining marks, e.g. from decomposed input
+			continue
+		case r >= '！' && r <= '～':
+			// Full-width ASCII
+			r = unicode.ToLower(r - '！' + '!')
+		case r == '　':
+			r = ' '
+		}
+		if base, found := diacriticBase[r]; found {
+			b.WriteString(base)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// ordinalMeanings are the spoken markers added to extra definitions with --duplicates both.
+var ordinalMeanings = []string{"second", "third", "fourth", "fifth"}
+
+// resolveDuplicates finds words that appear in more than one deck with different definitions
+// and handles them according to policy:
+//
+//	keep    leave every card as is and only warn
+//	merge   keep the first card with all definitions joined
+//	prefer  keep the card from preferDeck
+//	both    keep every card, marking later definitions as "second meaning: ..."
+func resolveDuplicates(cards []card, policy, preferDeck string) ([]card, []string) {
+	groups := map[string][]int{}
+	var order []string
+	for i, c := range cards {
+		// The same spelling in two languages is not a duplicate
+		key := c.language + "\x00" + normalizeWord(c.word, c.language)
+		if _, found := groups[key]; !found {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	var warnings []string
+	drop := map[int]bool{}
+	for _, key := range order {
+		idx := groups[key]
+		if !isCrossDeckConflict(cards, idx) {
+			continue
+		}
+
+		decks := make([]string, len(idx))
+		for j, i := range idx {
+			decks[j] = cards[i].deck
+		}
+		warnings = append(warnings, fmt.Sprintf("word %q has different definitions in decks %s (--duplicates %s)",
+			cards[idx[0]].word, strings.Join(decks, ", "), policy))
+
+		switch policy {
+		case "merge":
+			var defs []string
+			seen := map[string]bool{}
+			for _, i := range idx {
+				d := strings.TrimSpace(cards[i].definition)
+				if !seen[d] {
+					seen[d] = true
+					defs = append(defs, d)
+				}
+			}
+			cards[idx[0]].definition = strings.Join(defs, "; ")
+			for _, i := range idx[1:] {
+				drop[i] = true
+			}
+		case "prefer":
+			keep := idx[0]
+			for _, i := range idx {
+				if cards[i].deck == preferDeck {
+					keep = i
+					break
+				}
+			}
+			for _, i := range idx {
+				if i != keep {
+					drop[i] = true
+				}
+			}
+		case "both":
+			for n, i := range idx[1:] {
+				ordinal := "another"
+				if n < len(ordinalMeanings) {
+					ordinal = ordinalMeanings[n]
+				}
+				cards[i].definition = ordinal + " meaning: " + cards[i].definition
+			}
+		}
+	}
+
+	if len(drop) == 0 {
+		return cards, warnings
+	}
+	kept := make([]card, 0, len(cards)-len(drop))
+	for i, c := range cards {
+		if !drop[i] {
+			kept = append(kept, c)
+		}
+	}
+	return kept, warnings
+}
+
+// isCrossDeckConflict reports whether the cards span several decks with differing definitions.
+func isCrossDeckConflict(cards []card, idx []int) bool {
+	if len(idx) < 2 {
+		return false
+	}
+	decks := map[string]bool{}
+	defs := map[string]bool{}
+	for _, i := range idx {
+		decks[cards[i].deck] = true
+		defs[normalizeWord(cards[i].definition, "")] = true
+	}
+	return len(decks) > 1 && len(defs) > 1
+}
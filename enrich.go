@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Michael-Manning/commuter-flashcards/pkg/ankiexport"
+)
+
+// Empty definitions, readings and frequency ranks can be filled in from local files with
+// --enrich, a comma separated list of sources in priority order, the first with a value
+// winning:
+//
+//	dictionary:FILE  lines of a word, its definition and optionally its reading, separated
+//	                 by tabs, e.g. an export of JMdict
+//	frequency:FILE   a word per line, most frequent first, or a word and its rank separated
+//	                 by a tab
+//
+// Which source filled each value is kept in the sources metadata column and the export
+// state, so --incremental --regenerate can fill in the values of one source again.
+var enricherKinds = []string{"dictionary", "frequency"}
+
+// enrichKey is what a word is looked up by: its plain text, case and accents folded.
+func enrichKey(word string) string {
+	text, _ := htmlToText(word)
+	return normalizeWord(text, "")
+}
+
+// readEnrichFile calls line with the tab separated columns of every line of name, skipping
+// empty lines and # comments, numbered from 1.
+func readEnrichFile(name string, line func(n int, columns []string) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if n == 1 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := line(n, strings.Split(text, "\t")); err != nil {
+			return fmt.Errorf("%s line %d: %v", name, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// dictionaryEnricher fills in definitions and readings from a dictionary file. A word listed
+// more than once keeps its first entry.
+type dictionaryEnricher struct {
+	name    string
+	entries map[string][2]string
+}
+
+func loadDictionary(spec, name string) (*dictionaryEnricher, error) {
+	d := &dictionaryEnricher{name: spec, entries: map[string][2]string{}}
+	err := readEnrichFile(name, func(n int, columns []string) error {
+		if len(columns) < 2 {
+			return fmt.Errorf("want a word and a definition separated by a tab")
+		}
+		key := enrichKey(columns[0])
+		if _, found := d.entries[key]; found || key == "" {
+			return nil
+		}
+		entry := [2]string{strings.TrimSpace(columns[1])}
+		if len(columns) > 2 {
+			entry[1] = strings.TrimSpace(columns[2])
+		}
+		d.entries[key] = entry
+		return nil
+	})
+	return d, err
+}
+
+func (d *dictionaryEnricher) Name() string { return d.name }
+
+func (d *dictionaryEnricher) Enrich(c ankiexport.Card, what ankiexport.Enrichable) (string, bool, error) {
+	entry := d.entries[enrichKey(c.Word)]
+	switch what {
+	case ankiexport.EnrichDefinition:
+		return entry[0], entry[0] != "", nil
+	case ankiexport.EnrichReading:
+		return entry[1], entry[1] != "", nil
+	}
+	return "", false, nil
+}
+
+// frequencyEnricher fills in frequency ranks from a frequency list.
+type frequencyEnricher struct {
+	name  string
+	ranks map[string]int
+}
+
+func loadFrequencyList(spec, name string) (*frequencyEnricher, error) {
+	f := &frequencyEnricher{name: spec, ranks: map[string]int{}}
+	rank := 0
+	err := readEnrichFile(name, func(n int, columns []string) error {
+		rank++
+		if len(columns) > 1 {
+			r, err := strconv.Atoi(strings.TrimSpace(columns[1]))
+			if err != nil {
+				return fmt.Errorf("rank %q is not a number", columns[1])
+			}
+			rank = r
+		}
+		if key := enrichKey(columns[0]); key != "" {
+			if _, found := f.ranks[key]; !found {
+				f.ranks[key] = rank
+			}
+		}
+		return nil
+	})
+	return f, err
+}
+
+func (f *frequencyEnricher) Name() string { return f.name }
+
+func (f *frequencyEnricher) Enrich(c ankiexport.Card, what ankiexport.Enrichable) (string, bool, error) {
+	rank, found := f.ranks[enrichKey(c.Word)]
+	if what != ankiexport.EnrichFrequency || !found {
+		return "", false, nil
+	}
+	return strconv.Itoa(rank), true, nil
+}
+
+// parseEnrichers loads the sources of an --enrich list, and returns whether one of them
+// fills in frequency ranks.
+func parseEnrichers(list string) ([]ankiexport.Enricher, bool, error) {
+	var enrichers []ankiexport.Enricher
+	frequency := false
+	seen := map[string]bool{}
+	for _, spec := range strings.Split(list, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if seen[spec] {
+			return nil, false, fmt.Errorf("%s is listed twice in --enrich", spec)
+		}
+		seen[spec] = true
+		kind, name, _ := strings.Cut(spec, ":")
+		if name == "" {
+			return nil, false, fmt.Errorf("--enrich %s needs a file, e.g. %s:words.tsv", spec, kind)
+		}
+		var (
+			enricher ankiexport.Enricher
+			err      error
+		)
+		switch kind {
+		case "dictionary":
+			enricher, err = loadDictionary(spec, name)
+		case "frequency":
+			enricher, err = loadFrequencyList(spec, name)
+			frequency = true
+		default:
+			return nil, false, fmt.Errorf("unknown --enrich source %q, must be one of %s", kind, strings.Join(enricherKinds, ", "))
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read --enrich %s: %v", spec, err)
+		}
+		enrichers = append(enrichers, enricher)
+	}
+	return enrichers, frequency, nil
+}
+
+// cardSources returns the sources of a card's values as name=source, sorted, for the
+// sources column.
+func cardSources(c card) []string {
+	var sources []string
+	for what, source := range c.sources {
+		sources = append(sources, what+"="+source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// fromSource reports whether source is one of names, or of a kind in names, e.g. dictionary
+// for dictionary:jmdict.tsv.
+func fromSource(source string, names map[string]bool) bool {
+	kind, _, _ := strings.Cut(source, ":")
+	return names[source] || names[kind]
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"html"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+var imageSrcPattern = regexp.MustCompile(`(?i)<img[^>]*\ssrc\s*=\s*["']?([^"'\s>]+)`)
+
+// firstImage returns the file name of the first image in an Anki field, if any.
+func firstImage(field string) string {
+	if m := imageSrcPattern.FindStringSubmatch(field); m != nil {
+		return html.UnescapeString(m[1])
+	}
+	return ""
+}
+
+var epubMediaTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".svg":  "image/svg+xml",
+	".webp": "image/webp",
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const epubStyle = `body { font-family: serif; }
+.card { margin-bottom: 2em; page-break-inside: avoid; }
+.card h2 { font-size: 1.6em; margin-bottom: 0.3em; }
+.card .number { color: #888; font-size: 0.6em; font-weight: normal; }
+.card img { max-width: 100%; }
+.credits { color: #888; font-size: 0.8em; }
+`
+
+// fetchImages retrieves the images of cards from Anki's media folder. Images that can't be
+// retrieved, or that e-readers don't support, are left out with a warning.
+func fetchImages(client *ankiconnect.Client, cache *mediaCache, cards []card, warnings *[]string) map[string][]byte {
+	images := map[string][]byte{}
+	for _, c := range cards {
+		if c.image == "" {
+			continue
+		}
+		if _, found := images[c.image]; found {
+			continue
+		}
+		if _, supported := epubMediaTypes[strings.ToLower(path.Ext(c.image))]; !supported {
+			*warnings = append(*warnings, fmt.Sprintf("note %d: image %s is not a supported e-book image type", c.noteID, c.image))
+			continue
+		}
+		filename := c.image
+		data, err := retrieveMedia(client, cache, filename)
+		if err != nil || len(data) == 0 {
+			*warnings = append(*warnings, fmt.Sprintf("note %d: failed to retrieve image %s: %v", c.noteID, filename, err))
+			continue
+		}
+		images[filename] = data
+	}
+	return images
+}
+
+// xhtmlText converts a field to escaped XHTML text, keeping line breaks.
+func xhtmlText(field string) string {
+	text, _ := htmlToText(field)
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	for i, line := range lines {
+		lines[i] = html.EscapeString(line)
+	}
+	return strings.Join(lines, "<br/>")
+}
+
+// writeEPUB writes a simple e-book with one entry per card, in the same order and numbering
+// as the audio clips. Cards are split into chapters of chapterSize, matching lessons built
+// with the same index ranges. images holds the contents of card images by file name.
+// credits, if any, are the rights of the book, shown under its contents.
+func writeEPUB(name, title, credits string, cards []card, images map[string][]byte, chapterSize int) error {
+	file, err := createAtomic(name, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create EPUB file %s: %v", name, err)
+	}
+	defer file.abort()
+	zw := zip.NewWriter(file)
+
+	add := func(name string, data string, method uint16) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte(data))
+		return err
+	}
+
+	// The mimetype entry must come first and be stored uncompressed
+	if err := add("mimetype", "application/epub+zip", zip.Store); err != nil {
+		return fmt.Errorf("failed to write EPUB file %s: %v", name, err)
+	}
+	files := map[string]string{
+		"META-INF/container.xml": epubContainer,
+		"OEBPS/style.css":        epubStyle,
+	}
+
+	if chapterSize <= 0 {
+		chapterSize = max(len(cards), 1)
+	}
+	var manifest, spine, nav strings.Builder
+	imageIDs := map[string]string{}
+	var imageFiles []string
+	for start := 0; start < len(cards); start += chapterSize {
+		end := min(start+chapterSize, len(cards))
+		chapterTitle := fmt.Sprintf("Cards %d-%d", start, end-1)
+		chapterFile := fmt.Sprintf("chapter_%04d.xhtml", start)
+
+		var body strings.Builder
+		fmt.Fprintf(&body, "<h1>%s</h1>\n", html.EscapeString(chapterTitle))
+		for i := start; i < end; i++ {
+			c := cards[i]
+			fmt.Fprintf(&body, "<div class=\"card\" id=\"card_%04d\">\n<h2>%s <span class=\"number\">#%d</span></h2>\n", i, xhtmlText(c.word), i)
+			if data, found := images[c.image]; found && c.image != "" {
+				id, seen := imageIDs[c.image]
+				if !seen {
+					id = fmt.Sprintf("img%04d", len(imageIDs))
+					imageIDs[c.image] = id
+					href := "images/" + id + strings.ToLower(path.Ext(c.image))
+					files["OEBPS/"+href] = string(data)
+					imageFiles = append(imageFiles, "OEBPS/"+href)
+					fmt.Fprintf(&manifest, "    <item id=\"%s\" href=\"%s\" media-type=\"%s\"/>\n", id, href, epubMediaTypes[strings.ToLower(path.Ext(c.image))])
+				}
+				fmt.Fprintf(&body, "<p><img src=\"images/%s%s\" alt=\"\"/></p>\n", id, strings.ToLower(path.Ext(c.image)))
+			}
+			fmt.Fprintf(&body, "<p>%s</p>\n</div>\n", xhtmlText(c.definition))
+		}
+
+		files["OEBPS/"+chapterFile] = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title><link rel="stylesheet" type="text/css" href="style.css"/></head>
+<body>
+%s</body>
+</html>
+`, html.EscapeString(chapterTitle), body.String())
+		id := strings.TrimSuffix(chapterFile, ".xhtml")
+		fmt.Fprintf(&manifest, "    <item id=\"%s\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", id, chapterFile)
+		fmt.Fprintf(&spine, "    <itemref idref=\"%s\"/>\n", id)
+		fmt.Fprintf(&nav, "      <li><a href=\"%s\">%s</a></li>\n", chapterFile, html.EscapeString(chapterTitle))
+	}
+
+	escapedTitle := html.EscapeString(title)
+	var rights, colophon string
+	if credits != "" {
+		rights = fmt.Sprintf("    <dc:rights>%s</dc:rights>\n", html.EscapeString(credits))
+		colophon = fmt.Sprintf("  <p class=\"credits\">%s</p>\n", html.EscapeString(credits))
+	}
+	files["OEBPS/nav.xhtml"] = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title></head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <h1>%s</h1>
+    <ol>
+%s    </ol>
+  </nav>
+%s</body>
+</html>
+`, escapedTitle, escapedTitle, nav.String(), colophon)
+	files["OEBPS/content.opf"] = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="bookid">urn:commuter-flashcards:%s</dc:identifier>
+    <dc:title>%s</dc:title>
+    <dc:language>%s</dc:language>
+%s    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+%s  </manifest>
+  <spine>
+%s  </spine>
+</package>
+`, hashHex([]byte(title))[:16], escapedTitle, epubLanguage(cards), rights, time.Now().UTC().Format("2006-01-02T15:04:05Z"), manifest.String(), spine.String())
+
+	// Write in a fixed order so the same cards produce the same book
+	order := []string{"META-INF/container.xml", "OEBPS/content.opf", "OEBPS/nav.xhtml", "OEBPS/style.css"}
+	for start := 0; start < len(cards); start += chapterSize {
+		order = append(order, fmt.Sprintf("OEBPS/chapter_%04d.xhtml", start))
+	}
+	order = append(order, imageFiles...)
+	for _, f := range order {
+		if err := add(f, files[f], zip.Deflate); err != nil {
+			return fmt.Errorf("failed to write EPUB file %s: %v", name, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write EPUB file %s: %v", name, err)
+	}
+	if err := file.commit(); err != nil {
+		return fmt.Errorf("failed to write EPUB file %s: %v", name, err)
+	}
+	return nil
+}
+
+// epubLanguage returns the language of the first card that has one, as the book language.
+func epubLanguage(cards []card) string {
+	for _, c := range cards {
+		if c.language != "" {
+			return c.language
+		}
+	}
+	return "und"
+}
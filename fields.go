@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fieldColumns returns the CSV columns for the note fields of list, a comma separated list
+// of field names in the order they are written, e.g. "Front,Back,Example". The word and
+// definition fields are written as the Word and Definition columns the other tools read,
+// first if list leaves them out, and a listed reading field as the Reading column. Every
+// other field is a column named after it, and is returned too, to be fetched with the cards.
+// Without a list, the columns are Word and Definition.
+func fieldColumns(list string) ([]metadataColumn, []string, error) {
+	word := metadataColumn{name: "word", header: "Word", value: func(c card) string { return c.word }}
+	definition := metadataColumn{name: "definition", header: "Definition", value: func(c card) string { return c.definition }}
+	reading := metadataColumn{name: "reading", header: "Reading", value: func(c card) string { return c.reading }}
+
+	var columns []metadataColumn
+	var extra []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, nil, fmt.Errorf("field %q is listed twice in --fields", name)
+		}
+		seen[name] = true
+		switch name {
+		case *wordField:
+			columns = append(columns, word)
+		case *definitionField:
+			columns = append(columns, definition)
+		case *readingField:
+			columns = append(columns, reading)
+		default:
+			columns = append(columns, metadataColumn{name: "field:" + name, header: name, value: func(c card) string { return c.fields[name] }})
+			extra = append(extra, name)
+		}
+	}
+	if !seen[*definitionField] {
+		columns = append([]metadataColumn{definition}, columns...)
+	}
+	if !seen[*wordField] {
+		columns = append([]metadataColumn{word}, columns...)
+	}
+	return columns, extra, nil
+}
+
+// checkColumnHeaders returns an error if two CSV columns would have the same header, e.g. a
+// note field named Tags and --metadata_columns tags.
+func checkColumnHeaders(columns []metadataColumn) error {
+	seen := map[string]bool{}
+	for _, col := range columns {
+		header := strings.ToLower(col.header)
+		if seen[header] {
+			return fmt.Errorf("two CSV columns would be named %s, leave one out of --fields or --metadata_columns", col.header)
+		}
+		seen[header] = true
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultHistoryFile = "run_history.jsonl"
+
+// runRecord is one line of the run history file.
+type runRecord struct {
+	ID       string            `json:"id"`
+	Command  string            `json:"command"`
+	Started  time.Time         `json:"started"`
+	Duration float64           `json:"duration_seconds"`
+	Status   string            `json:"status"`
+	Settings map[string]string `json:"settings"`
+	Counts   map[string]int    `json:"counts,omitempty"`
+	Outputs  []string          `json:"outputs,omitempty"`
+	Errors   []string          `json:"errors,omitempty"`
+	Skipped  []string          `json:"skipped,omitempty"`
+}
+
+// The run being recorded by this process, if any.
+var (
+	currentRun  *runRecord
+	historyPath string
+)
+
+// startRun begins recording a run. Settings are taken from every flag in fs.
+func startRun(command string, fs *flag.FlagSet, historyFile string) {
+	now := time.Now()
+	currentRun = &runRecord{
+		// Milliseconds and the pid keep runs started in the same second, e.g. by batch, apart
+		ID:       fmt.Sprintf("%s-%d", now.Format("20060102-150405.000"), os.Getpid()),
+		Command:  command,
+		Started:  now,
+		Settings: map[string]string{},
+		Counts:   map[string]int{},
+	}
+	historyPath = historyFile
+	fs.VisitAll(func(f *flag.Flag) {
+		currentRun.Settings[f.Name] = f.Value.String()
+	})
+}
+
+// recordCount sets a named counter on the current run.
+func recordCount(name string, n int) {
+	if currentRun != nil {
+		currentRun.Counts[name] = n
+	}
+}
+
+// recordOutput notes a file written by the current run.
+func recordOutput(name string) {
+	if currentRun != nil {
+		currentRun.Outputs = append(currentRun.Outputs, name)
+	}
+}
+
+// skipFeature notes a part of the current run left out because a tool or credential it needs
+// is missing, and returns the warning saying so.
+func skipFeature(feature string, err error) string {
+	if currentRun != nil {
+		currentRun.Skipped = append(currentRun.Skipped, feature)
+	}
+	warning := fmt.Sprintf("skipped %s: %v", feature, err)
+	fmt.Printf("warning: %s\n", warning)
+	return warning
+}
+
+// finishRun appends the current run to the history file and sends its notification.
+func finishRun(status string) {
+	if currentRun == nil {
+		return
+	}
+	run := currentRun
+	currentRun = nil
+
+	run.Status = status
+	run.Duration = time.Since(run.Started).Round(time.Millisecond).Seconds()
+	notifyRun(run)
+	if historyPath == "" {
+		return
+	}
+
+	line, err := json.Marshal(run)
+	if err != nil {
+		fmt.Printf("warning: failed to encode run history: %v\n", err)
+		return
+	}
+	f, err := os.OpenFile(historyPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Printf("warning: failed to open run history %s: %v\n", historyPath, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		fmt.Printf("warning: failed to write run history %s: %v\n", historyPath, err)
+	}
+}
+
+// fatalf prints an error, records it in the run history and exits.
+func fatalf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Printf("error: %s\n", msg)
+	if currentRun != nil {
+		currentRun.Errors = append(currentRun.Errors, msg)
+	}
+	finishRun("failed")
+	os.Exit(1)
+}
+
+// loadHistory reads all runs from the history file, oldest first.
+func loadHistory(name string) ([]runRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []runRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var r runRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("corrupt run history %s: %v", name, err)
+		}
+		runs = append(runs, r)
+	}
+	return runs, scanner.Err()
+}
+
+// runRuns implements the `runs list`, `runs show` and `runs diff` commands.
+func runRuns(args []string) {
+	if len(args) == 0 {
+		fatalf("usage: runs list | runs show <id> | runs diff <id> <id>")
+	}
+	fs := flag.NewFlagSet("runs", flag.ExitOnError)
+	historyFile := fs.String("history_file", defaultHistoryFile, "Run history file")
+	limit := fs.Int("limit", 20, "Number of most recent runs to list")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args[1:])
+	useWorkspace(fs, *workspace, map[string]string{"history_file": workspaceHistoryFile})
+
+	runs, err := loadHistory(*historyFile)
+	if err != nil {
+		fatalf("failed to read run history: %v", err)
+	}
+
+	// find fails on an id several runs have, as older histories have for runs started in
+	// the same second
+	find := func(id string) runRecord {
+		var found []runRecord
+		for _, r := range runs {
+			if r.ID == id {
+				found = append(found, r)
+			}
+		}
+		switch len(found) {
+		case 0:
+			fatalf("no run with id %s", id)
+		case 1:
+			return found[0]
+		}
+		var started []string
+		for _, r := range found {
+			started = append(started, fmt.Sprintf("%s %s", r.Command, r.Started.Format(time.RFC3339Nano)))
+		}
+		fatalf("%d runs have id %s, which is ambiguous: %s", len(found), id, strings.Join(started, "; "))
+		return runRecord{}
+	}
+
+	switch args[0] {
+	case "list":
+		start := max(len(runs)-*limit, 0)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCOMMAND\tSTARTED\tDURATION\tSTATUS\tCARDS\tERRORS")
+		for _, r := range runs[start:] {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%.1fs\t%s\t%d\t%d\n", r.ID, r.Command, r.Started.Format("Mon 2006-01-02 15:04"),
+				r.Duration, r.Status, r.Counts["cards"], len(r.Errors))
+		}
+		w.Flush()
+	case "show":
+		if fs.NArg() != 1 {
+			fatalf("usage: runs show <id>")
+		}
+		data, _ := json.MarshalIndent(find(fs.Arg(0)), "", "  ")
+		fmt.Println(string(data))
+	case "diff":
+		if fs.NArg() != 2 {
+			fatalf("usage: runs diff <id> <id>")
+		}
+		printRunDiff(find(fs.Arg(0)), find(fs.Arg(1)))
+	default:
+		fatalf("unknown runs command %q", args[0])
+	}
+}
+
+// printRunDiff prints the settings and counts that differ between two runs.
+func printRunDiff(a, b runRecord) {
+	fmt.Printf("--- %s (%s)\n+++ %s (%s)\n", a.ID, a.Started.Format(time.RFC1123), b.ID, b.Started.Format(time.RFC1123))
+	diff := func(section string, x, y map[string]string) {
+		keys := map[string]bool{}
+		for k := range x {
+			keys[k] = true
+		}
+		for k := range y {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			if x[k] != y[k] {
+				fmt.Printf("%s %s: %q -> %q\n", section, k, x[k], y[k])
+			}
+		}
+	}
+	counts := func(m map[string]int) map[string]string {
+		out := map[string]string{}
+		for k, v := range m {
+			out[k] = fmt.Sprint(v)
+		}
+		return out
+	}
+	diff("setting", a.Settings, b.Settings)
+	diff("count", counts(a.Counts), counts(b.Counts))
+	if a.Status != b.Status {
+		fmt.Printf("status: %q -> %q\n", a.Status, b.Status)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	// A tag that was never closed with '>', e.g. `foo <div class="x`.
+	truncatedTagPattern = regexp.MustCompile(`<[a-zA-Z/][^<>]*$`)
+	// An entity left over after decoding, meaning the text was encoded twice.
+	entityPattern = regexp.MustCompile(`&(#[0-9]+|#[xX][0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`)
+	// Markup that appears once encoded entities are decoded.
+	tagPattern = regexp.MustCompile(`</?[a-zA-Z][^<>]*>`)
+)
+
+// Elements that end a line of text.
+var blockElements = map[string]bool{
+	"br": true, "div": true, "p": true, "li": true, "tr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// Elements that never have a closing tag.
+var voidElements = map[string]bool{
+	"br": true, "hr": true, "img": true, "input": true, "meta": true,
+	"link": true, "area": true, "base": true, "col": true, "wbr": true, "source": true,
+}
+
+// htmlToText converts an Anki field to plain text with a tolerant tokenizer.
+// Problems that had to be repaired along the way are returned as warnings.
+func htmlToText(s string) (string, []string) {
+	var warnings []string
+
+	if loc := truncatedTagPattern.FindStringIndex(s); loc != nil {
+		warnings = append(warnings, fmt.Sprintf("dropped truncated tag %q", s[loc[0]:]))
+		s = s[:loc[0]]
+	}
+
+	text, unclosed := stripTags(s)
+	for _, tag := range unclosed {
+		warnings = append(warnings, fmt.Sprintf("repaired unclosed <%s> tag", tag))
+	}
+
+	// Decoding once more only happens when a field was escaped twice, e.g. &amp;nbsp;
+	if entityPattern.MatchString(text) {
+		decoded := html.UnescapeString(text)
+		if decoded != text {
+			warnings = append(warnings, "decoded double-encoded entities")
+			text = decoded
+			if tagPattern.MatchString(text) {
+				text, _ = stripTags(text)
+			}
+		}
+	}
+
+	return strings.TrimSpace(text), warnings
+}
+
+// stripTags returns the text content of s and the names of elements left open.
+func stripTags(s string) (string, []string) {
+	var b strings.Builder
+	var open []string
+	skip := 0
+
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				b.WriteString(string(z.Raw()))
+			}
+			break
+		}
+		tok := z.Token()
+		switch tt {
+		case html.TextToken:
+			if skip == 0 {
+				b.WriteString(tok.Data)
+			}
+		case html.StartTagToken:
+			if tok.Data == "script" || tok.Data == "style" {
+				skip++
+			}
+			if blockElements[tok.Data] {
+				b.WriteString("\n")
+			}
+			if !voidElements[tok.Data] {
+				open = append(open, tok.Data)
+			}
+		case html.SelfClosingTagToken:
+			if blockElements[tok.Data] {
+				b.WriteString("\n")
+			}
+		case html.EndTagToken:
+			if (tok.Data == "script" || tok.Data == "style") && skip > 0 {
+				skip--
+			}
+			// Close the most recent matching element, tolerating mis-nested tags.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == tok.Data {
+					open = append(open[:i], open[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return b.String(), open
+}
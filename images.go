@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Michael-Manning/commuter-flashcards/pkg/ankiexport"
+	"github.com/atselvan/ankiconnect"
+)
+
+// Image policies for <img> tags in the word and definition fields. The policy is applied to
+// the card text before anything else sees it, so the CSV, the SQLite database, the e-book
+// and the TTS audio generated from the CSV all agree:
+//
+//	keep         leave the HTML as it is
+//	strip        remove the images
+//	placeholder  replace each image with "[image]"
+//	reference    download each image and replace it with "[image: <path>]"
+//	skip         leave out cards with images
+var imagePolicies = []string{"keep", "strip", "placeholder", "reference", "skip"}
+
+var imageTagPattern = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+
+// imageReplacer applies an image policy, downloading referenced images once each.
+type imageReplacer struct {
+	policy string
+	folder string
+	client *ankiconnect.Client
+	cache  *mediaCache
+	saved  map[string]string
+	// dryRun names the images without downloading them
+	dryRun bool
+}
+
+// hasImage reports whether an Anki field contains an image.
+func hasImage(field string) bool {
+	return imageTagPattern.MatchString(field)
+}
+
+// replace applies the policy to one field. skip is handled by the caller.
+func (r *imageReplacer) replace(field string) (string, error) {
+	var err error
+	switch r.policy {
+	case "strip":
+		return strings.TrimSpace(imageTagPattern.ReplaceAllString(field, "")), nil
+	case "placeholder":
+		return imageTagPattern.ReplaceAllString(field, "[image]"), nil
+	case "reference":
+		field = imageTagPattern.ReplaceAllStringFunc(field, func(tag string) string {
+			m := imageSrcPattern.FindStringSubmatch(tag)
+			if m == nil {
+				return "[image]"
+			}
+			path, saveErr := r.save(html.UnescapeString(m[1]))
+			if saveErr != nil {
+				if err == nil {
+					err = saveErr
+				}
+				return "[image]"
+			}
+			return "[image: " + path + "]"
+		})
+		return field, err
+	}
+	return field, nil
+}
+
+// save downloads an image from Anki's media folder into the image folder.
+func (r *imageReplacer) save(filename string) (string, error) {
+	if path, found := r.saved[filename]; found {
+		return path, nil
+	}
+	path := filepath.Join(r.folder, filepath.Base(filename))
+	if r.dryRun {
+		return path, nil
+	}
+	data, err := retrieveMedia(r.client, r.cache, filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve image %s: %v", filename, err)
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write image %s: %v", path, err)
+	}
+	r.saved[filename] = path
+	return path, nil
+}
+
+// ankiMediaMaxAge is how long Anki's media stays cached. A file can be replaced in Anki under
+// the same name, so it is only reused for about as long as a batch's profiles take to export.
+const ankiMediaMaxAge = time.Hour
+
+// ankiCollections holds the collection of each Anki-Connect address, see ankiCollection.
+var ankiCollections sync.Map
+
+// ankiCollection names the collection client reads from by its address and the Anki profile
+// open there, so the cache shared by every profile doesn't mix up two collections' files of
+// the same name. An Anki-Connect too old to say which profile is open is named by its address.
+func ankiCollection(client *ankiconnect.Client) string {
+	if name, found := ankiCollections.Load(client.Url); found {
+		return name.(string)
+	}
+	name := client.Url
+	if profile, err := ankiInvoke[string](client, "getActiveProfile", nil); err == nil && *profile != "" {
+		name += "#" + *profile
+	}
+	ankiCollections.Store(client.Url, name)
+	return name
+}
+
+// retrieveMedia retrieves a file from Anki's media folder, through the cache if there is one.
+// It is safe to call from several goroutines, which the ankiconnect package's calls are not.
+func retrieveMedia(client *ankiconnect.Client, cache *mediaCache, filename string) ([]byte, error) {
+	retrieve := func() ([]byte, error) {
+		res, restErr := ankiInvoke[json.RawMessage](client, "retrieveMediaFile", map[string]any{"filename": filename})
+		if restErr != nil {
+			return nil, fmt.Errorf("%s", restErr.Message)
+		}
+		// Anki-Connect answers false for a file it doesn't have, and an empty file, e.g. one
+		// a sync of a deleted file left, plays nothing either
+		var data string
+		if json.Unmarshal(*res, &data) != nil || data == "" {
+			return nil, ankiexport.ErrMediaNotFound
+		}
+		return base64.StdEncoding.DecodeString(*chaos.media(&data))
+	}
+	if cache != nil {
+		return cache.fetchFresh("anki-media:"+ankiCollection(client)+":"+filename, ankiMediaMaxAge, retrieve)
+	}
+	return retrieve()
+}
+
+// validImagePolicy reports whether policy is one of imagePolicies.
+func validImagePolicy(policy string) bool {
+	for _, p := range imagePolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+func imagePolicyNames() string {
+	return strings.Join(imagePolicies, ", ")
+}
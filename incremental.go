@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/atselvan/ankiconnect"
+	"github.com/privatesquare/bkst-go-utils/utils/errors"
+)
+
+// An --incremental export keeps what it exported in a state file, with the modification time
+// of every card and note. The next export only fetches the cards that are new or whose card
+// or note changed since, and only downloads their audio. Cards keep their rows and their
+// numbers, so their audio keeps its numbered file name, and new cards are added at the end
+// with numbers no card had before. Cards that no longer match the query are dropped, leaving
+// a gap in the numbers instead of renumbering the cards after them.
+const defaultExportStateFile = "export_state.json"
+
+type exportState struct {
+	// Settings identifies the flags the cards were exported with. With other ones the cards
+	// are exported again
+	Settings string `json:"settings"`
+	// NextNumber is the number the next new card gets
+	NextNumber int            `json:"next_number"`
+	Cards      []exportedCard `json:"cards"`
+}
+
+// exportedCard is a card as it was written by the last export.
+type exportedCard struct {
+	CardID  int64 `json:"card_id"`
+	NoteID  int64 `json:"note_id"`
+	CardMod int64 `json:"card_mod"`
+	NoteMod int64 `json:"note_mod"`
+	Number  int   `json:"number"`
+	// Skipped is set for cards --image_policy skip left out
+	Skipped bool `json:"skipped,omitempty"`
+
+	Deck       string   `json:"deck,omitempty"`
+	Template   int64    `json:"template,omitempty"`
+	Language   string   `json:"language,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Word       string   `json:"word"`
+	Definition string   `json:"definition"`
+	Reading    string   `json:"reading,omitempty"`
+	Answer     string   `json:"answer,omitempty"`
+	AudioFile  string   `json:"audio_file,omitempty"`
+	ExtraAudio []string `json:"extra_audio,omitempty"`
+	AudioPath  string   `json:"audio_path,omitempty"`
+	AudioHash  string   `json:"audio_hash,omitempty"`
+	AudioSize  int      `json:"audio_size,omitempty"`
+	Image      string   `json:"image,omitempty"`
+	// Fields holds the other fields of --fields
+	Fields map[string]string `json:"fields,omitempty"`
+	// Sources holds where the values the note left empty came from
+	Sources  map[string]string `json:"sources,omitempty"`
+	Interval int64             `json:"interval"`
+	Reps     int64             `json:"reps"`
+	Lapses   int64             `json:"lapses"`
+	CardType int64             `json:"card_type"`
+	Due      bool              `json:"due,omitempty"`
+}
+
+// exportSettings returns what identifies the cards an export writes: the flags that decide
+// which cards are exported and what is in them.
+func exportSettings(columns []metadataColumn) string {
+	parts := []string{*cardQuery, *wordField, *definitionField, *readingField, *language, *languageField,
+		*defaultLanguage, *imagePolicy, *imageFolder, fmt.Sprint(*stripHTML), fmt.Sprint(*autoSwap), *enrichList}
+	// Left out at its default so exports from before there was a choice aren't redone
+	if *clozeMode != "keep" {
+		parts = append(parts, *clozeMode)
+	}
+	if *scrapeAudio {
+		parts = append(parts, *wordAudioField, *recordingAudioField, *wordFolder, *ttsEngineName, *ttsVoice)
+		// Left out at their defaults so exports from before there was a choice aren't redone
+		if *soundTags != "first" {
+			parts = append(parts, *soundTags)
+		}
+		if *ttsWords != "all" {
+			parts = append(parts, *ttsWords)
+		}
+	}
+	for _, col := range columns {
+		parts = append(parts, col.name)
+	}
+	return hashHex([]byte(strings.Join(parts, "\x00")))
+}
+
+// loadExportState returns the state of the last export with settings, or nil if the cards
+// have to be exported again, saying why.
+func loadExportState(name, settings, output string) *exportState {
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		fmt.Printf("No earlier export in %s, exporting every card\n", name)
+		return nil
+	}
+	var state exportState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	switch {
+	case err != nil:
+		fmt.Printf("warning: failed to read %s: %v, exporting every card\n", name, err)
+		return nil
+	case state.Settings != settings:
+		fmt.Printf("The export settings changed since the last export, exporting every card\n")
+		return nil
+	}
+	if _, err := os.Stat(output); err != nil {
+		fmt.Printf("%s is missing, exporting every card\n", output)
+		return nil
+	}
+	// Earlier exports numbered the cards by their row
+	if state.NextNumber == 0 {
+		for i := range state.Cards {
+			if !state.Cards[i].Skipped {
+				state.Cards[i].Number = state.NextNumber
+				state.NextNumber++
+			}
+		}
+	}
+	return &state
+}
+
+func saveExportState(name string, state exportState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(name, append(data, '\n'), 0644)
+}
+
+// modTimes returns the modification time of each of ids, with action cardsModTime or
+// notesModTime.
+func modTimes(client *ankiconnect.Client, action, param string, ids []int64) (map[int64]int64, *errors.RestErr) {
+	const batchSize = 1000
+
+	mods := make(map[int64]int64, len(ids))
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+		res, err := ankiInvoke[[]struct {
+			CardID int64 `json:"cardId"`
+			NoteID int64 `json:"noteId"`
+			Mod    int64 `json:"mod"`
+		}](client, action, map[string]any{param: batch})
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range *res {
+			if m.CardID != 0 {
+				mods[m.CardID] = m.Mod
+			} else {
+				mods[m.NoteID] = m.Mod
+			}
+		}
+	}
+	return mods, nil
+}
+
+// changedCards returns which of ids have to be fetched: those that are new or changed since
+// the export of state, and those with a value from one of the regenerated sources. Without
+// a state every card is.
+func changedCards(client *ankiconnect.Client, state *exportState, ids []int64, regenerated map[string]bool) (fetch []int64, cardMods, noteMods map[int64]int64) {
+	cardMods = must(modTimes(client, "cardsModTime", "cards", ids))
+	if state == nil {
+		return ids, cardMods, map[int64]int64{}
+	}
+	known := map[int64]exportedCard{}
+	var noteIDs []int64
+	for _, c := range state.Cards {
+		known[c.CardID] = c
+		noteIDs = append(noteIDs, c.NoteID)
+	}
+	noteMods = must(modTimes(client, "notesModTime", "notes", noteIDs))
+	for _, id := range ids {
+		c, found := known[id]
+		if !found || cardMods[id] != c.CardMod || noteMods[c.NoteID] != c.NoteMod || c.regenerated(regenerated) {
+			fetch = append(fetch, id)
+		}
+	}
+	return fetch, cardMods, noteMods
+}
+
+// mergeExport returns the cards of the export of state that still match ids, with fetched
+// replacing the ones that changed, followed by the new cards in the order of ids. skipped
+// holds the note of each fetched card that was left out, and gets the ones the last export
+// skipped that didn't change. Cards keep their numbers and new cards get the next ones.
+// Audio that is still where the card's number puts it is kept, so only the rest is
+// downloaded again.
+func mergeExport(state *exportState, ids []int64, fetched []card, skipped map[int64]int64, namer *audioNamer) []card {
+	if state == nil {
+		for i := range fetched {
+			fetched[i].number = i
+		}
+		return fetched
+	}
+	matched := map[int64]bool{}
+	for _, id := range ids {
+		matched[id] = true
+	}
+	fresh := map[int64]card{}
+	for _, c := range fetched {
+		fresh[c.cardID] = c
+	}
+	refetched := map[int64]bool{}
+	for id := range skipped {
+		refetched[id] = true
+	}
+	for _, c := range fetched {
+		refetched[c.cardID] = true
+	}
+
+	var cards []card
+	seen := map[int64]bool{}
+	for _, old := range state.Cards {
+		seen[old.CardID] = true
+		switch {
+		case !matched[old.CardID]:
+		case refetched[old.CardID]:
+			if c, found := fresh[old.CardID]; found {
+				// A review changes the card too, but not its audio. Synthesized audio is
+				// only still right for the same text
+				if c.audioFile == old.AudioFile && slices.Equal(c.extraAudio, old.ExtraAudio) && (c.audioFile != "" || spokenText(c) == spokenText(old.card())) {
+					c.audioPath, c.audioHash, c.audioSize = old.AudioPath, old.AudioHash, old.AudioSize
+					if source := old.Sources["audio"]; source != "" {
+						if c.sources == nil {
+							c.sources = map[string]string{}
+						}
+						c.sources["audio"] = source
+					}
+				}
+				c.number = old.Number
+				cards = append(cards, c)
+			}
+		case old.Skipped:
+			skipped[old.CardID] = old.NoteID
+		default:
+			cards = append(cards, old.card())
+		}
+	}
+	for _, c := range fetched {
+		if !seen[c.cardID] {
+			c.number = state.NextNumber
+			state.NextNumber++
+			cards = append(cards, c)
+		}
+	}
+
+	namer.padTo(max(state.NextNumber, len(ids)))
+	for i, c := range cards {
+		if c.audioPath != "" {
+			want := filepath.Join(*wordFolder, namer.name(c))
+			if _, err := os.Stat(c.audioPath); err != nil || c.audioPath != want {
+				cards[i].audioPath = ""
+			}
+		}
+	}
+	return cards
+}
+
+// nextNumber returns the number the next new card of an export that wrote cards gets, past
+// every number given out so far, also to cards that were dropped since.
+func nextNumber(state *exportState, cards []card) int {
+	next := 0
+	if state != nil {
+		next = state.NextNumber
+	}
+	for _, c := range cards {
+		next = max(next, c.number+1)
+	}
+	return next
+}
+
+// newExportState returns the state of an export that wrote cards, with the modification
+// times of the notes that weren't known yet.
+func newExportState(client *ankiconnect.Client, settings string, cards []card, next int, skipped map[int64]int64, cardMods, noteMods map[int64]int64) exportState {
+	var unknown []int64
+	for _, c := range cards {
+		if _, found := noteMods[c.noteID]; !found {
+			unknown = append(unknown, c.noteID)
+		}
+	}
+	for _, note := range skipped {
+		if _, found := noteMods[note]; !found {
+			unknown = append(unknown, note)
+		}
+	}
+	for note, mod := range must(modTimes(client, "notesModTime", "notes", unknown)) {
+		noteMods[note] = mod
+	}
+
+	state := exportState{Settings: settings, NextNumber: next}
+	for _, c := range cards {
+		state.Cards = append(state.Cards, exportedCard{
+			CardID: c.cardID, NoteID: c.noteID, CardMod: cardMods[c.cardID], NoteMod: noteMods[c.noteID], Number: c.number,
+			Deck: c.deck, Template: c.template, Language: c.language, Tags: c.tags, Word: c.word, Definition: c.definition,
+			Reading: c.reading, Answer: c.answer, AudioFile: c.audioFile, ExtraAudio: c.extraAudio, AudioPath: c.audioPath, AudioHash: c.audioHash,
+			AudioSize: c.audioSize, Image: c.image, Fields: c.fields, Sources: c.sources, Interval: c.interval, Reps: c.reps, Lapses: c.lapses,
+			CardType: c.cardType, Due: c.due,
+		})
+	}
+	var skippedIDs []int64
+	for id := range skipped {
+		skippedIDs = append(skippedIDs, id)
+	}
+	sort.Slice(skippedIDs, func(i, j int) bool { return skippedIDs[i] < skippedIDs[j] })
+	for _, id := range skippedIDs {
+		note := skipped[id]
+		state.Cards = append(state.Cards, exportedCard{CardID: id, NoteID: note, CardMod: cardMods[id], NoteMod: noteMods[note], Skipped: true})
+	}
+	return state
+}
+
+// regenerated reports whether one of the card's values came from one of the sources.
+func (c exportedCard) regenerated(sources map[string]bool) bool {
+	for _, source := range c.Sources {
+		if fromSource(source, sources) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c exportedCard) card() card {
+	return card{
+		noteID: c.NoteID, cardID: c.CardID, number: c.Number, deck: c.Deck, template: c.Template, language: c.Language, tags: c.Tags,
+		word: c.Word, definition: c.Definition, reading: c.Reading, answer: c.Answer, audioFile: c.AudioFile, extraAudio: c.ExtraAudio,
+		audioPath: c.AudioPath, audioHash: c.AudioHash, audioSize: c.AudioSize, image: c.Image,
+		fields: c.Fields, sources: c.Sources, interval: c.Interval, reps: c.Reps, lapses: c.Lapses, cardType: c.CardType, due: c.Due,
+	}
+}
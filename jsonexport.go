@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+)
+
+// jsonNumbers are the metadata columns written as JSON numbers instead of strings.
+var jsonNumbers = map[string]func(c card) int64{
+	"note_id":  func(c card) int64 { return c.noteID },
+	"card_id":  func(c card) int64 { return c.cardID },
+	"number":   func(c card) int64 { return int64(c.number) },
+	"template": func(c card) int64 { return c.template },
+	"interval": func(c card) int64 { return c.interval },
+	"reps":     func(c card) int64 { return c.reps },
+	"lapses":   func(c card) int64 { return c.lapses },
+}
+
+// jsonCard returns a card as a JSON object with the keys of the CSV's headers in the same
+// order, columns with several values as arrays, and the downloaded audio file with audio.
+func jsonCard(c card, columns []metadataColumn, audio bool) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	enc := json.NewEncoder(&b)
+	// Definitions are HTML, kept readable instead of escaped to \u003c
+	enc.SetEscapeHTML(false)
+	add := func(key string, value any) error {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		enc.Encode(key)
+		b.Truncate(b.Len() - 1)
+		b.WriteByte(':')
+		if err := enc.Encode(value); err != nil {
+			return err
+		}
+		// Encode ends every value with a newline
+		b.Truncate(b.Len() - 1)
+		return nil
+	}
+	for _, col := range columns {
+		var value any
+		switch {
+		case jsonNumbers[col.name] != nil:
+			value = jsonNumbers[col.name](c)
+		case col.name == "due":
+			value = c.due
+		case col.values != nil:
+			values := col.values(c)
+			if values == nil {
+				values = []string{}
+			}
+			value = values
+		default:
+			value = col.value(c)
+		}
+		if err := add(col.header, value); err != nil {
+			return nil, err
+		}
+	}
+	if audio {
+		if err := add("AudioFile", filepath.ToSlash(c.audioPath)); err != nil {
+			return nil, err
+		}
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// writeJSON writes cards to name as a JSON array, or with lines as newline delimited JSON,
+// one card per line. Multi-line definitions stay one string, unlike in a CSV that a script
+// has to parse.
+func writeJSON(name string, cards []card, columns []metadataColumn, audio, lines bool) error {
+	file, err := createAtomic(name, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create JSON file %s: %v", name, err)
+	}
+	defer file.abort()
+
+	w := bufio.NewWriter(file)
+	if !lines {
+		w.WriteString("[\n")
+	}
+	for i, c := range cards {
+		data, err := jsonCard(c, columns, audio)
+		if err != nil {
+			return fmt.Errorf("failed to write record for word '%s': %v", c.word, err)
+		}
+		if !lines {
+			w.WriteString("  ")
+		}
+		w.Write(data)
+		if !lines && i < len(cards)-1 {
+			w.WriteByte(',')
+		}
+		w.WriteByte('\n')
+	}
+	if !lines {
+		w.WriteString("]\n")
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write JSON file %s: %v", name, err)
+	}
+	if err := file.commit(); err != nil {
+		return fmt.Errorf("failed to write JSON file %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Per-note language hints. Every language-dependent stage (word normalization, duplicate
+// detection, TTS voice selection in audio_sourcer.py) uses the language resolved here, in
+// order of precedence:
+//
+//  1. --language, which overrides every note
+//  2. a lang::xx tag on the note, e.g. lang::ja or lang::pt-BR
+//  3. the value of the --language_field field, "Language" by default
+//  4. a language code at the end of the note type name, e.g. "Vocab (ja)" or "Cloze-fr"
+//  5. --default_language
+const languageTagPrefix = "lang::"
+
+var (
+	languageCodePattern   = regexp.MustCompile(`^([a-z]{2,3})(?:[-_]([A-Za-z]{2,4}))?$`)
+	languageSuffixPattern = regexp.MustCompile(`[\s_(\[-]([a-z]{2,3}(?:-[A-Za-z]{2,4})?)[)\]]?$`)
+)
+
+// normalizeLanguage returns a language code in BCP 47 form (ja, pt-BR) or "" if s isn't one.
+func normalizeLanguage(s string) string {
+	m := languageCodePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return ""
+	}
+	if m[2] == "" {
+		return m[1]
+	}
+	region := m[2]
+	if len(region) == 2 {
+		region = strings.ToUpper(region)
+	} else {
+		region = strings.ToUpper(region[:1]) + region[1:]
+	}
+	return m[1] + "-" + region
+}
+
+// resolveLanguage picks the language of a note from its hints. See the precedence above.
+func resolveLanguage(override string, tags []string, fields map[string]string, languageField, modelName, fallback string) string {
+	if lang := normalizeLanguage(override); lang != "" {
+		return lang
+	}
+	for _, tag := range tags {
+		if len(tag) > len(languageTagPrefix) && strings.EqualFold(tag[:len(languageTagPrefix)], languageTagPrefix) {
+			if lang := normalizeLanguage(tag[len(languageTagPrefix):]); lang != "" {
+				return lang
+			}
+		}
+	}
+	if f, found := fields[languageField]; found && languageField != "" {
+		text, _ := htmlToText(f)
+		if lang := normalizeLanguage(text); lang != "" {
+			return lang
+		}
+	}
+	if m := languageSuffixPattern.FindStringSubmatch(modelName); m != nil {
+		if lang := normalizeLanguage(m[1]); lang != "" {
+			return lang
+		}
+	}
+	return normalizeLanguage(fallback)
+}
+
+// baseLanguage returns the primary subtag of a language code, e.g. "pt" for "pt-BR".
+func baseLanguage(lang string) string {
+	base, _, _ := strings.Cut(lang, "-")
+	return base
+}
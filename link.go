@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// linkedNote is one entry of the linkage file. Audio paths are relative to the file.
+type linkedNote struct {
+	Index           int    `json:"index"`
+	Word            string `json:"word"`
+	Definition      string `json:"definition"`
+	WordAudio       string `json:"word_audio,omitempty"`
+	DefinitionAudio string `json:"definition_audio,omitempty"`
+	VariantAudio    string `json:"variant_audio,omitempty"`
+}
+
+type linkageFile struct {
+	Created string                `json:"created"`
+	Source  string                `json:"source"`
+	Notes   map[string]linkedNote `json:"notes"`
+}
+
+// listClips returns the MP3 files in a folder sorted by name, so the position of a clip
+// is the CSV row it was generated from (the same rule concatenator.py uses).
+func listClips(folder string) ([]string, error) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	var clips []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".mp3") {
+			clips = append(clips, e.Name())
+		}
+	}
+	sort.Strings(clips)
+	return clips, nil
+}
+
+// runLink copies word and definition clips into separate folders named by note ID and
+// writes a JSON file linking each note to its clips, for apps that play them separately.
+func runLink(args []string) {
+	fs := flag.NewFlagSet("link", flag.ExitOnError)
+	csvName := fs.String("csv_name", "cards.csv", "CSV the clips were generated from, exported with --metadata_columns note_id")
+	wordFolder := fs.String("word_folder", "words", "Directory containing word audio files")
+	definitionFolder := fs.String("definition_folder", "definitions", "Directory containing definition audio files")
+	variantFolder := fs.String("word_variant_folder", "", "Directory containing second word pronunciations (optional)")
+	outputDir := fs.String("output_dir", "linked", "Directory to write the words/, definitions/ folders and linkage file to")
+	linkageName := fs.String("linkage_name", "linkage.json", "Name of the linkage file in --output_dir")
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{
+		"csv_name":          "cards.csv",
+		"word_folder":       filepath.Join("audio", "words"),
+		"definition_folder": filepath.Join("audio", "definitions"),
+		"output_dir":        "linked",
+		"history_file":      workspaceHistoryFile,
+	})
+	startRun("link", fs, *historyFile)
+
+	rows, err := readCardRows(*csvName)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	type source struct {
+		folder, subdir string
+		clips          []string
+	}
+	var sources []*source
+	for _, s := range []struct{ folder, subdir string }{
+		{*wordFolder, "words"},
+		{*definitionFolder, "definitions"},
+		{*variantFolder, "words_b"},
+	} {
+		if s.folder == "" {
+			sources = append(sources, nil)
+			continue
+		}
+		clips, err := listClips(s.folder)
+		if err != nil {
+			fatalf("failed to read %s: %v", s.folder, err)
+		}
+		if len(clips) != len(rows) {
+			fmt.Printf("warning: %s has %d clips but %s has %d rows\n", s.folder, len(clips), *csvName, len(rows))
+		}
+		if err := os.MkdirAll(filepath.Join(*outputDir, s.subdir), 0755); err != nil {
+			fatalf("failed to create directory: %v", err)
+		}
+		sources = append(sources, &source{s.folder, s.subdir, clips})
+	}
+
+	linkage := linkageFile{
+		Created: time.Now().Format(time.RFC3339),
+		Source:  *csvName,
+		Notes:   map[string]linkedNote{},
+	}
+	copied := 0
+	for i, row := range rows {
+		id := strconv.FormatInt(row.noteID, 10)
+		if _, found := linkage.Notes[id]; found {
+			// Notes with several cards export a row per card, all with the same fields
+			continue
+		}
+		note := linkedNote{Index: i, Word: row.word, Definition: row.definition}
+		paths := []*string{&note.WordAudio, &note.DefinitionAudio, &note.VariantAudio}
+		for j, s := range sources {
+			if s == nil || i >= len(s.clips) {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(s.folder, s.clips[i]))
+			if err != nil {
+				fatalf("failed to read clip: %v", err)
+			}
+			rel := s.subdir + "/" + id + ".mp3"
+			if err := writeFileAtomic(filepath.Join(*outputDir, filepath.FromSlash(rel)), data, 0644); err != nil {
+				fatalf("failed to write clip %s: %v", rel, err)
+			}
+			*paths[j] = rel
+			copied++
+		}
+		linkage.Notes[id] = note
+	}
+
+	data, err := json.MarshalIndent(linkage, "", "  ")
+	if err != nil {
+		fatalf("failed to encode linkage file: %v", err)
+	}
+	name := filepath.Join(*outputDir, *linkageName)
+	if err := writeFileAtomic(name, append(data, '\n'), 0644); err != nil {
+		fatalf("failed to write linkage file %s: %v", name, err)
+	}
+
+	recordCount("notes", len(linkage.Notes))
+	recordCount("clips", copied)
+	recordOutput(*outputDir)
+	fmt.Printf("Linked %d notes (%d clips) in %s\n", len(linkage.Notes), copied, name)
+	finishRun("ok")
+}
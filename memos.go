@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// Voice memos you record yourself, e.g. on the way home after a lesson, are attached to the
+// notes they pronounce by `memos`. A memo is named by the note's ID or its word, such as
+// 1700000000002.m4a or 入る.m4a, and is stored in Anki's media folder and set as the note's
+// --recording_field, which an export with the same --recording_field plays instead of the
+// note's other audio. Attached memos are moved to imported/ in the memo folder.
+var memoExtensions = []string{".mp3", ".m4a", ".aac", ".wav", ".ogg", ".opus", ".flac", ".3gp", ".amr"}
+
+// memoSettle is how long a memo must be left unchanged before --watch imports it, so a file
+// a sync app is still writing isn't attached half-written.
+const memoSettle = 5 * time.Second
+
+// noteIDName matches memos named by note ID. Anki's note IDs are millisecond timestamps.
+var noteIDName = regexp.MustCompile(`^[0-9]{13}$`)
+
+// memoImporter attaches the memos of a folder to their notes.
+type memoImporter struct {
+	client    *ankiconnect.Client
+	folder    string
+	field     string
+	wordField string
+	query     string
+	backupDir string
+	dryRun    bool
+	ffmpeg    string
+
+	// warned holds the memos already warned about, so --watch only warns once
+	warned              map[string]bool
+	attached, unmatched int
+}
+
+// runMemos attaches voice memos to the Anki notes they are named after, once or, with
+// --watch, whenever new ones appear in the folder.
+func runMemos(args []string) {
+	fs := flag.NewFlagSet("memos", flag.ExitOnError)
+	memoFolder := fs.String("memo_folder", "memos", "Folder of voice memos named by note ID or word, e.g. 1700000000002.m4a or 入る.m4a")
+	recordingField := fs.String("recording_field", "", "Field to attach the memos to, e.g. MyRecording. What it held before is replaced")
+	wordField := fs.String("word_field", "", "Field to find the notes of memos named by word in")
+	cardQuery := fs.String("card_query", "deck:*", "Only attach memos named by word to notes matching this search, e.g. \"deck:JP1K\"")
+	watch := fs.Bool("watch", false, "Keep watching --memo_folder and attach memos as they appear, until interrupted")
+	interval := fs.Duration("interval", 10*time.Second, "How often --watch looks for new memos")
+	dryRun := fs.Bool("dry_run", false, "Print the notes the memos would be attached to without changing them")
+	backupDir := fs.String("backup_dir", defaultBackupDir, "Directory to save the notes to before changing them, for rollback")
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{
+		"memo_folder":  "memos",
+		"backup_dir":   filepath.Join("state", defaultBackupDir),
+		"history_file": workspaceHistoryFile,
+	})
+	startRun("memos", fs, *historyFile)
+
+	if *recordingField == "" {
+		fatalf("must supply --recording_field")
+	}
+	if *interval <= 0 {
+		fatalf("--interval must be positive")
+	}
+	if info, err := os.Stat(*memoFolder); err != nil || !info.IsDir() {
+		fatalf("memo folder %s not found", *memoFolder)
+	}
+
+	m := &memoImporter{
+		client:    newAnkiClient(),
+		folder:    *memoFolder,
+		field:     *recordingField,
+		wordField: *wordField,
+		query:     *cardQuery,
+		backupDir: *backupDir,
+		dryRun:    *dryRun,
+		warned:    map[string]bool{},
+	}
+	if path, err := exec.LookPath("ffmpeg"); err == nil {
+		m.ffmpeg = path
+	} else {
+		skipFeature("converting memos to MP3", missingf("ffmpeg not found on the PATH, only MP3 memos can be attached"))
+	}
+
+	if !*watch {
+		if err := m.scan(0); err != nil {
+			fatalf("%v", err)
+		}
+		m.finish()
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Printf("Watching %s for voice memos, press Ctrl+C to stop\n", m.folder)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := m.scan(memoSettle); err != nil {
+			fatalf("%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			m.finish()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// finish prints what the run did and records it.
+func (m *memoImporter) finish() {
+	recordCount("memos_attached", m.attached)
+	recordCount("memos_unmatched", m.unmatched)
+	if m.dryRun {
+		fmt.Printf("dry run: %d memos would be attached\n", m.attached)
+		finishRun("dry run")
+		return
+	}
+	fmt.Printf("Attached %d memos\n", m.attached)
+	if m.unmatched > 0 {
+		finishRun("partial")
+		os.Exit(exitCode("partial"))
+	}
+	finishRun("ok")
+}
+
+// warnOnce prints a warning about a memo the first time there is one.
+func (m *memoImporter) warnOnce(memo, format string, args ...any) {
+	if m.warned[memo] {
+		return
+	}
+	m.warned[memo] = true
+	fmt.Printf("warning: memo %s: %s\n", filepath.Base(memo), fmt.Sprintf(format, args...))
+}
+
+// pendingMemos returns the memos in folder, oldest first, leaving out the ones changed in the
+// last settle.
+func pendingMemos(folder string, settle time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	type memo struct {
+		path    string
+		modTime time.Time
+	}
+	var memos []memo
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !slices.Contains(memoExtensions, strings.ToLower(filepath.Ext(e.Name()))) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < settle {
+			continue
+		}
+		memos = append(memos, memo{filepath.Join(folder, e.Name()), info.ModTime()})
+	}
+	sort.SliceStable(memos, func(i, j int) bool { return memos[i].modTime.Before(memos[j].modTime) })
+	paths := make([]string, len(memos))
+	for i, memo := range memos {
+		paths[i] = memo.path
+	}
+	return paths, nil
+}
+
+// scan attaches the memos in the folder that were left unchanged for settle. A note with
+// several memos ends up with the newest.
+func (m *memoImporter) scan(settle time.Duration) error {
+	memos, err := pendingMemos(m.folder, settle)
+	if err != nil {
+		return fmt.Errorf("failed to read memo folder %s: %v", m.folder, err)
+	}
+
+	type attachment struct {
+		memo  string
+		notes []int64
+	}
+	var attachments []attachment
+	var ids []int64
+	for _, memo := range memos {
+		if m.warned[memo] {
+			continue
+		}
+		stem := strings.TrimSpace(strings.TrimSuffix(filepath.Base(memo), filepath.Ext(memo)))
+		notes, err := m.memoNotes(stem)
+		if err != nil {
+			return err
+		}
+		if len(notes) == 0 {
+			m.unmatched++
+			if noteIDName.MatchString(stem) {
+				m.warnOnce(memo, "no note has ID %s, leaving it", stem)
+			} else if m.wordField == "" {
+				m.warnOnce(memo, "named by word, must supply --word_field to find its note, leaving it")
+			} else {
+				m.warnOnce(memo, "no note matching %q has %s %q, leaving it (name it by note ID instead)", m.query, m.wordField, stem)
+			}
+			continue
+		}
+		attachments = append(attachments, attachment{memo, notes})
+		ids = append(ids, notes...)
+	}
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	notes := map[int64]ankiconnect.ResultNotesInfo{}
+	for _, n := range fetchNotesByID(m.client, ids) {
+		notes[n.NoteId] = n
+	}
+	var affected []ankiconnect.ResultNotesInfo
+	backedUp := map[int64]bool{}
+	usable := attachments[:0]
+	for _, a := range attachments {
+		var found []int64
+		for _, id := range a.notes {
+			n := notes[id]
+			if _, ok := n.Fields[m.field]; !ok {
+				fmt.Printf("warning: note %d (%s) has no field %s, not attaching %s to it\n", id, n.ModelName, m.field, filepath.Base(a.memo))
+				continue
+			}
+			found = append(found, id)
+			if !backedUp[id] {
+				backedUp[id] = true
+				affected = append(affected, n)
+			}
+		}
+		if len(found) == 0 {
+			m.unmatched++
+			m.warnOnce(a.memo, "none of its notes has a %s field, leaving it", m.field)
+			continue
+		}
+		usable = append(usable, attachment{a.memo, found})
+	}
+	attachments = usable
+
+	if m.dryRun {
+		for _, a := range attachments {
+			// Only reported once by --watch, as the memo stays in the folder
+			m.warned[a.memo] = true
+			m.attached++
+			fmt.Printf("%s would be attached to note %s\n", filepath.Base(a.memo), joinIDs(a.notes))
+		}
+		return nil
+	}
+	if len(attachments) == 0 {
+		return nil
+	}
+	saved, err := backupNotes(m.backupDir, "memos", affected)
+	if err != nil {
+		return fmt.Errorf("failed to back up notes before updating them: %v", err)
+	}
+	recordOutput(saved)
+
+	for _, a := range attachments {
+		data, err := m.memoAudio(a.memo)
+		if err != nil {
+			m.unmatched++
+			m.warnOnce(a.memo, "%v, leaving it", err)
+			continue
+		}
+		// Named by content, like uploaded audio, so memos never overwrite each other
+		name := "commuter_memo_" + hashHex(data)[:16] + ".mp3"
+		if _, restErr := ankiInvoke[string](m.client, "storeMediaFile", map[string]string{
+			"filename": name,
+			"data":     base64.StdEncoding.EncodeToString(data),
+		}); restErr != nil {
+			return fmt.Errorf("failed to store %s in Anki: %s", filepath.Base(a.memo), restErr.Message)
+		}
+		for _, id := range a.notes {
+			if restErr := m.client.Notes.Update(ankiconnect.UpdateNote{Id: id, Fields: ankiconnect.Fields{m.field: "[sound:" + name + "]"}}); restErr != nil {
+				return fmt.Errorf("failed to update note %d: %s", id, restErr.Message)
+			}
+		}
+		moved, err := moveImported(a.memo)
+		if err != nil {
+			return fmt.Errorf("attached %s but failed to move it out of the memo folder: %v", filepath.Base(a.memo), err)
+		}
+		m.attached++
+		fmt.Printf("Attached %s to note %s (moved to %s)\n", filepath.Base(a.memo), joinIDs(a.notes), moved)
+	}
+	fmt.Printf("Backed up the notes to %s (undo with: rollback)\n", saved)
+	return nil
+}
+
+// memoNotes returns the notes a memo named stem is for: the note with that ID, or the notes
+// whose word field is stem.
+func (m *memoImporter) memoNotes(stem string) ([]int64, error) {
+	var query string
+	switch {
+	case noteIDName.MatchString(stem):
+		query = "nid:" + stem
+	case m.wordField != "":
+		query = fmt.Sprintf(`(%s) "%s:%s"`, m.query, ankiSearchEscaper.Replace(m.wordField), ankiSearchEscaper.Replace(stem))
+	default:
+		return nil, nil
+	}
+	ids, restErr := m.client.Notes.Search(query)
+	if restErr != nil {
+		return nil, fmt.Errorf("failed to find the notes of memo %s: %s", stem, restErr.Message)
+	}
+	return *ids, nil
+}
+
+// memoAudio returns a memo as an MP3 with the silence at its ends trimmed, or as it is if
+// it's an MP3 and ffmpeg isn't installed.
+func (m *memoImporter) memoAudio(memo string) ([]byte, error) {
+	if m.ffmpeg == "" {
+		if strings.ToLower(filepath.Ext(memo)) != ".mp3" {
+			return nil, fmt.Errorf("not an MP3, and ffmpeg isn't installed to convert it")
+		}
+		return os.ReadFile(memo)
+	}
+	dir, err := os.MkdirTemp("", "commuter-memo-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	mp3 := filepath.Join(dir, "memo.mp3")
+	trim := "silenceremove=start_periods=1:start_threshold=-50dB"
+	if out, err := exec.Command(m.ffmpeg, "-loglevel", "error", "-y", "-i", memo, "-vn",
+		"-af", trim+",areverse,"+trim+",areverse", "-codec:a", "libmp3lame", "-q:a", "4", mp3).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.ReadFile(mp3)
+}
+
+// moveImported moves an attached memo to imported/ in its folder, and returns where to.
+func moveImported(memo string) (string, error) {
+	dir := filepath.Join(filepath.Dir(memo), "imported")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, filepath.Base(memo))
+	if _, err := os.Stat(dest); err == nil {
+		// A newer recording of the same word, keep both
+		dest = filepath.Join(dir, time.Now().Format("20060102-150405")+"-"+filepath.Base(memo))
+	}
+	return dest, os.Rename(memo, dest)
+}
+
+// joinIDs returns note IDs separated by commas.
+func joinIDs(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metadataColumn is an optional CSV column derived from card metadata.
+type metadataColumn struct {
+	name   string
+	header string
+	value  func(c card) string
+	// values is set instead of value for columns with several values per card, written as
+	// --multi_value says
+	values func(c card) []string
+}
+
+// cardTypeNames maps Anki's card type numbers to readable names.
+var cardTypeNames = []string{"new", "learning", "review", "relearning"}
+
+var availableMetadataColumns = []metadataColumn{
+	{name: "note_id", header: "NoteID", value: func(c card) string { return strconv.FormatInt(c.noteID, 10) }},
+	{name: "card_id", header: "CardID", value: func(c card) string { return strconv.FormatInt(c.cardID, 10) }},
+	// The number the card's clips are named by, which audio_sourcer.py names its clips by too
+	{name: "number", header: "Number", value: func(c card) string { return strconv.Itoa(c.number) }},
+	// Anki's note IDs are the time the note was added, in milliseconds
+	{name: "created", header: "Created", value: func(c card) string { return time.UnixMilli(c.noteID).Format(time.DateOnly) }},
+	{name: "deck", header: "Deck", value: func(c card) string { return c.deck }},
+	{name: "template", header: "Template", value: func(c card) string { return strconv.FormatInt(c.template, 10) }},
+	{name: "language", header: "Language", value: func(c card) string { return c.language }},
+	{name: "tags", header: "Tags", values: func(c card) []string { return c.tags }},
+	// Where the values the note left empty came from, e.g. definition=dictionary:jmdict.tsv
+	{name: "sources", header: "Sources", values: cardSources},
+	// Whether the word's clip came from Anki or was read by a TTS engine, for auditing them
+	{name: "audio_source", header: "AudioSource", value: audioSource},
+	{name: "interval", header: "Interval", value: func(c card) string { return strconv.FormatInt(c.interval, 10) }},
+	{name: "reps", header: "Reps", value: func(c card) string { return strconv.FormatInt(c.reps, 10) }},
+	{name: "lapses", header: "Lapses", value: func(c card) string { return strconv.FormatInt(c.lapses, 10) }},
+	{name: "card_type", header: "CardType", value: func(c card) string {
+		if c.cardType >= 0 && int(c.cardType) < len(cardTypeNames) {
+			return cardTypeNames[c.cardType]
+		}
+		return strconv.FormatInt(c.cardType, 10)
+	}},
+	{name: "due", header: "Due", value: func(c card) string {
+		if c.due {
+			return "yes"
+		}
+		return "no"
+	}},
+}
+
+// parseMetadataColumns resolves a comma separated list of column names in the order given.
+func parseMetadataColumns(list string) ([]metadataColumn, error) {
+	var columns []metadataColumn
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, col := range availableMetadataColumns {
+			if col.name == name {
+				columns = append(columns, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown metadata column %q", name)
+		}
+	}
+	return columns, nil
+}
+
+// hasMetadataColumn reports whether the named column was requested.
+func hasMetadataColumn(columns []metadataColumn, name string) bool {
+	for _, col := range columns {
+		if col.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataColumnNames lists the names of all metadata columns, for use in flag help text.
+func metadataColumnNames() string {
+	names := make([]string, len(availableMetadataColumns))
+	for i, col := range availableMetadataColumns {
+		names[i] = col.name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// Bad imports sometimes put the definition in the word field and the word in the definition
+// field. In most decks the word and the definition are written in different scripts, e.g.
+// Japanese words with English definitions, so cards whose scripts are the other way around
+// than in most of the deck are flagged, and with --auto_swap_mismatched swapped back. Decks
+// whose two languages share a script, such as Spanish and English, can't be checked.
+
+// scripts are the writing systems told apart, with kana counted with Han so Japanese words
+// in kana or kanji are one script.
+var scripts = []struct {
+	name   string
+	tables []*unicode.RangeTable
+}{
+	{"Latin", []*unicode.RangeTable{unicode.Latin}},
+	{"CJK", []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana}},
+	{"Hangul", []*unicode.RangeTable{unicode.Hangul}},
+	{"Cyrillic", []*unicode.RangeTable{unicode.Cyrillic}},
+	{"Greek", []*unicode.RangeTable{unicode.Greek}},
+	{"Arabic", []*unicode.RangeTable{unicode.Arabic}},
+	{"Hebrew", []*unicode.RangeTable{unicode.Hebrew}},
+	{"Thai", []*unicode.RangeTable{unicode.Thai}},
+	{"Devanagari", []*unicode.RangeTable{unicode.Devanagari}},
+}
+
+// dominantScript returns the script most letters of text are written in, or "" for text
+// without letters.
+func dominantScript(text string) string {
+	counts := make([]int, len(scripts))
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		for i, s := range scripts {
+			if unicode.IsOneOf(s.tables, r) {
+				counts[i]++
+				break
+			}
+		}
+	}
+	best := -1
+	for i, n := range counts {
+		if n > 0 && (best < 0 || n > counts[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return scripts[best].name
+}
+
+// mismatchedCards returns the indexes of cards whose word is written in the script most of
+// the deck's definitions are, and definition in the script of its words, with a warning for
+// each. With swap, their word and definition are swapped.
+func mismatchedCards(cards []card, swap bool) ([]int, []string) {
+	type pair struct{ word, definition string }
+	pairs := make([]pair, len(cards))
+	counts := map[pair]int{}
+	for i, c := range cards {
+		word, _ := htmlToText(c.word)
+		definition, _ := htmlToText(c.definition)
+		pairs[i] = pair{dominantScript(word), dominantScript(definition)}
+		if p := pairs[i]; p.word != "" && p.definition != "" && p.word != p.definition {
+			counts[p]++
+		}
+	}
+
+	// The deck's usual pair has to outnumber the reverse, or there is nothing to go by
+	var usual pair
+	for p, n := range counts {
+		if n > counts[usual] || n == counts[usual] && p.word+p.definition < usual.word+usual.definition {
+			usual = p
+		}
+	}
+	reverse := pair{usual.definition, usual.word}
+	if counts[usual] <= counts[reverse] {
+		return nil, nil
+	}
+
+	var mismatched []int
+	var warnings []string
+	for i, p := range pairs {
+		if p != reverse {
+			continue
+		}
+		mismatched = append(mismatched, i)
+		word := cards[i].word
+		action := "swap them back with --auto_swap_mismatched"
+		if swap {
+			cards[i].word, cards[i].definition = cards[i].definition, cards[i].word
+			action = "swapped them"
+		}
+		warnings = append(warnings, fmt.Sprintf("note %d: the word %q is written in %s like the definitions and the definition in %s like the words, the fields may be the wrong way around (%s)",
+			cards[i].noteID, word, usual.definition, usual.word, action))
+	}
+	return mismatched, warnings
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/atselvan/ankiconnect"
+	"github.com/privatesquare/bkst-go-utils/utils/errors"
+)
+
+// modelMatch is a note type used by some of the cards a query matched.
+type modelMatch struct {
+	name   string
+	cards  int
+	fields []string
+}
+
+var ankiSearchEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `*`, `\*`, `_`, `\_`)
+
+// matchedModels finds the note types of the cards matched by query, and their fields,
+// without fetching the cards themselves. total is the number of cards the query matched,
+// which lets the search stop once every card is accounted for.
+func matchedModels(client *ankiconnect.Client, query string, total int) ([]modelMatch, *errors.RestErr) {
+	if models, found := snapshot.models(query); found {
+		return models, nil
+	}
+	names, err := ankiInvoke[[]string](client, "modelNames", nil)
+	if err != nil {
+		return nil, err
+	}
+	var models []modelMatch
+	counted := 0
+	for _, name := range *names {
+		if counted >= total {
+			break
+		}
+		ids, err := client.Cards.Search(fmt.Sprintf(`(%s) "note:%s"`, query, ankiSearchEscaper.Replace(name)))
+		if err != nil {
+			return nil, err
+		}
+		if len(*ids) == 0 {
+			continue
+		}
+		fields, err := ankiInvoke[[]string](client, "modelFieldNames", map[string]string{"modelName": name})
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, modelMatch{name: name, cards: len(*ids), fields: *fields})
+		counted += len(*ids)
+	}
+	return models, nil
+}
+
+// models returns the note types of a query's cards from the snapshot, if it has the query.
+func (s *ankiSnapshot) models(query string) ([]modelMatch, bool) {
+	if s == nil {
+		return nil, false
+	}
+	ids, found := s.Queries[query]
+	if !found {
+		return nil, false
+	}
+	index := map[string]int{}
+	var models []modelMatch
+	for _, id := range ids {
+		c, found := s.cardsByID[id]
+		if !found {
+			return nil, false
+		}
+		i, seen := index[c.ModelName]
+		if !seen {
+			fields := make([]string, 0, len(c.Fields))
+			for name := range c.Fields {
+				fields = append(fields, name)
+			}
+			sort.Slice(fields, func(a, b int) bool { return c.Fields[fields[a]].Order < c.Fields[fields[b]].Order })
+			i = len(models)
+			index[c.ModelName] = i
+			models = append(models, modelMatch{name: c.ModelName, fields: fields})
+		}
+		models[i].cards++
+	}
+	return models, true
+}
+
+// missingFields describes each note type in models that lacks one of the fields, listing
+// the fields it does have. Empty field names are not checked.
+func missingFields(models []modelMatch, fields map[string]string) []string {
+	flags := make([]string, 0, len(fields))
+	for flag := range fields {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+
+	var problems []string
+	for _, m := range models {
+		have := map[string]bool{}
+		for _, f := range m.fields {
+			have[f] = true
+		}
+		var missing []string
+		for _, flag := range flags {
+			if name := fields[flag]; name != "" && !have[name] {
+				if suggestion := closestName(name, m.fields); suggestion != "" {
+					missing = append(missing, fmt.Sprintf("%q (--%s, did you mean %q?)", name, flag, suggestion))
+				} else {
+					missing = append(missing, fmt.Sprintf("%q (--%s)", name, flag))
+				}
+			}
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("note type %q (%d cards) has no field %s. Its fields are: %s",
+				m.name, m.cards, strings.Join(missing, ", "), strings.Join(m.fields, ", ")))
+		}
+	}
+	return problems
+}
+
+// closestName returns the candidate a misspelled name most likely meant, ignoring case, or
+// "" if none is close: fewer than a third of its letters may differ.
+func closestName(name string, candidates []string) string {
+	best, bestDistance := "", len([]rune(name))/3+1
+	for _, c := range candidates {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(c)); d < bestDistance {
+			best, bestDistance = c, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b, counting a swap of two adjacent
+// letters as one edit.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	rows := make([][]int, len(ra)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(rb)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				rows[i][j] = min(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(ra)][len(rb)]
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scheduled runs tell automation how they went in two ways, so a perfect night, one that
+// produced usable output with some problems and a broken one can be told apart:
+//
+//	--partial_exit_code N  exit with N, e.g. 3, when a run finishes but with warnings or with
+//	                       some of its parts failing. The default 0 exits as if it succeeded.
+//	                       Failed runs always exit with 1.
+//	--notify_url URL       POST a JSON summary of every run to URL when it finishes, e.g.
+//	                       {"id": "...", "command": "batch", "status": "partial", "counts":
+//	                       {"profiles": 3, "failed": 1}, "errors": ["bob: exit status 1"]}
+//
+// Both work with every command, like --anki_url.
+var (
+	notifyURL       string
+	partialExitCode int
+)
+
+// notifyTimeout is how long a notification may take before the run gives up on it.
+const notifyTimeout = 10 * time.Second
+
+// extractRunFlags removes --notify_url and --partial_exit_code from the arguments, wherever
+// they are, and sets them.
+func extractRunFlags(args []string) []string {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.StringVar(&notifyURL, "notify_url", "", "")
+	fs.IntVar(&partialExitCode, "partial_exit_code", 0, "")
+
+	var rest, run []string
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || name != "notify_url" && name != "partial_exit_code" {
+			rest = append(rest, args[i])
+			continue
+		}
+		run = append(run, args[i])
+		if !hasValue && i+1 < len(args) {
+			i++
+			run = append(run, args[i])
+		}
+	}
+	if len(run) == 0 {
+		return args
+	}
+	fs.Parse(run)
+	if partialExitCode < 0 || partialExitCode > 125 {
+		fatalf("--partial_exit_code must be between 0 and 125")
+	}
+	return rest
+}
+
+// exitCode returns the exit status of a run that finished with status.
+func exitCode(status string) int {
+	switch status {
+	case "failed":
+		return 1
+	case "partial":
+		return partialExitCode
+	}
+	return 0
+}
+
+// notifyRun posts the summary of a finished run to --notify_url. A notification that fails
+// only warns, it never changes how the run went.
+func notifyRun(run *runRecord) {
+	if notifyURL == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]any{
+		"id":               run.ID,
+		"command":          run.Command,
+		"status":           run.Status,
+		"exit_code":        exitCode(run.Status),
+		"started":          run.Started,
+		"duration_seconds": run.Duration,
+		"counts":           run.Counts,
+		"outputs":          run.Outputs,
+		"errors":           run.Errors,
+	})
+	if err != nil {
+		fmt.Printf("warning: failed to encode the run summary: %v\n", err)
+		return
+	}
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(notifyURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("warning: failed to notify %s: %v\n", notifyURL, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Printf("warning: %s answered the notification with %s\n", notifyURL, resp.Status)
+	}
+}
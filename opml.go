@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const atomNamespace = "http://www.w3.org/2005/Atom"
+
+// rssFeed holds the parts of an RSS feed needed to list it in OPML.
+type rssFeed struct {
+	Channel struct {
+		Title string `xml:"title"`
+		// Both the RSS <link> and <atom:link rel="self"> elements
+		Links []struct {
+			XMLName xml.Name
+			Rel     string `xml:"rel,attr"`
+			Href    string `xml:"href,attr"`
+			Value   string `xml:",chardata"`
+		} `xml:"link"`
+	} `xml:"channel"`
+}
+
+type opmlOutline struct {
+	Type    string `xml:"type,attr"`
+	Text    string `xml:"text,attr"`
+	Title   string `xml:"title,attr"`
+	XMLURL  string `xml:"xmlUrl,attr"`
+	HTMLURL string `xml:"htmlUrl,attr,omitempty"`
+}
+
+type opmlDocument struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    struct {
+		Title       string `xml:"title"`
+		DateCreated string `xml:"dateCreated"`
+	} `xml:"head"`
+	Body struct {
+		Outlines []opmlOutline `xml:"outline"`
+	} `xml:"body"`
+}
+
+// runOPML writes an OPML subscription list for every RSS feed found in a directory,
+// so a podcast app can subscribe to all deck feeds with one import.
+func runOPML(args []string) {
+	fs := flag.NewFlagSet("opml", flag.ExitOnError)
+	feedsDir := fs.String("feeds_dir", "feeds", "Directory to search for RSS feed files (*.xml, *.rss)")
+	baseURL := fs.String("base_url", "", "URL the feeds directory is served from, used for feeds without an atom:link self reference")
+	output := fs.String("output", "feeds.opml", "Output OPML file name")
+	title := fs.String("title", "Commuter Flashcards", "Title of the subscription list")
+	fs.Parse(args)
+
+	var files []string
+	err := filepath.WalkDir(*feedsDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(p))
+		if !d.IsDir() && (ext == ".xml" || ext == ".rss") {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		fatalf("failed to read feeds directory %s: %v", *feedsDir, err)
+	}
+	sort.Strings(files)
+
+	doc := opmlDocument{Version: "2.0"}
+	doc.Head.Title = *title
+	doc.Head.DateCreated = time.Now().Format(time.RFC1123Z)
+
+	for _, f := range files {
+		outline, err := feedOutline(f, *feedsDir, *baseURL)
+		if err != nil {
+			fmt.Printf("warning: skipping %s: %v\n", f, err)
+			continue
+		}
+		doc.Body.Outlines = append(doc.Body.Outlines, outline)
+	}
+	if len(doc.Body.Outlines) == 0 {
+		fatalf("no RSS feeds found in %s", *feedsDir)
+	}
+
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		fatalf("failed to encode OPML: %v", err)
+	}
+	data = append([]byte(xml.Header), data...)
+	if err := writeFileAtomic(*output, data, 0644); err != nil {
+		fatalf("failed to write OPML file %s: %v", *output, err)
+	}
+	fmt.Printf("Successfully wrote %d feeds to %s\n", len(doc.Body.Outlines), *output)
+}
+
+// feedOutline reads a feed file and builds its OPML entry.
+func feedOutline(file, root, baseURL string) (opmlOutline, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return opmlOutline{}, err
+	}
+	var feed rssFeed
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		return opmlOutline{}, fmt.Errorf("not a valid RSS feed: %v", err)
+	}
+
+	feedURL, siteURL := "", ""
+	for _, l := range feed.Channel.Links {
+		if l.XMLName.Space == atomNamespace {
+			if l.Rel == "self" {
+				feedURL = l.Href
+			}
+		} else {
+			siteURL = strings.TrimSpace(l.Value)
+		}
+	}
+	if feedURL == "" {
+		if baseURL == "" {
+			return opmlOutline{}, fmt.Errorf("feed has no atom:link self reference, supply --base_url")
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return opmlOutline{}, err
+		}
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return opmlOutline{}, fmt.Errorf("invalid --base_url: %v", err)
+		}
+		u.Path = path.Join(u.Path, filepath.ToSlash(rel))
+		feedURL = u.String()
+	}
+
+	name := feed.Channel.Title
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	return opmlOutline{
+		Type:    "rss",
+		Text:    name,
+		Title:   name,
+		XMLURL:  feedURL,
+		HTMLURL: siteURL,
+	}, nil
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formulaStarts are the characters that make a spreadsheet read a cell as a formula.
+const formulaStarts = "=+-@"
+
+// escapeFormula prefixes a cell that a spreadsheet would run as a formula with ', which makes
+// it plain text. Numbers such as -3 are left alone.
+func escapeFormula(s string) string {
+	if s == "" || !strings.ContainsRune(formulaStarts, rune(s[0])) {
+		return s
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return s
+	}
+	return "'" + s
+}
+
+// unescapeFormula removes the prefix escapeFormula adds. Only the cells of CSVs written with
+// --spreadsheet_safe are read through it, see csvExport.cell, so a field starting with '= in
+// any other CSV is kept as it is.
+func unescapeFormula(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(formulaStarts, rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+// csvExport is the <csv>.export.json sidecar an export writes next to a CSV, saying how its
+// cells were written for the commands reading it back. A CSV without one, e.g. one made by
+// hand, is read as it is.
+type csvExport struct {
+	// SpreadsheetSafe is set when the cells were escaped with --spreadsheet_safe
+	SpreadsheetSafe bool `json:"spreadsheet_safe"`
+	// Transforms are the flags that changed the Word and Definition cells from what the
+	// note fields hold, e.g. --strip_html
+	Transforms []string `json:"transforms,omitempty"`
+}
+
+// csvExportName returns the name of the sidecar of the CSV csvName.
+func csvExportName(csvName string) string {
+	return csvName + ".export.json"
+}
+
+// saveCSVExport writes the sidecar of the CSV csvName.
+func saveCSVExport(csvName string, export csvExport) error {
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(csvExportName(csvName), append(data, '\n'), 0644)
+}
+
+// loadCSVExport reads the sidecar of the CSV csvName, or returns the zero csvExport if it
+// has none.
+func loadCSVExport(csvName string) (csvExport, error) {
+	var export csvExport
+	data, err := os.ReadFile(csvExportName(csvName))
+	if errors.Is(err, os.ErrNotExist) {
+		return export, nil
+	}
+	if err != nil {
+		return export, err
+	}
+	if err := json.Unmarshal(data, &export); err != nil {
+		return export, fmt.Errorf("invalid %s: %v", csvExportName(csvName), err)
+	}
+	return export, nil
+}
+
+// cell returns a cell of the CSV as it was before it was written.
+func (e csvExport) cell(s string) string {
+	if e.SpreadsheetSafe {
+		return unescapeFormula(s)
+	}
+	return s
+}
+
+// exportTransforms returns the download flags that change the Word and Definition cells
+// from what the note fields hold.
+func exportTransforms() []string {
+	var transforms []string
+	if *stripHTML {
+		transforms = append(transforms, "--strip_html")
+	}
+	if *clozeMode != "keep" {
+		transforms = append(transforms, "--cloze "+*clozeMode)
+	}
+	if *imagePolicy != "keep" && *imagePolicy != "skip" {
+		transforms = append(transforms, "--image_policy "+*imagePolicy)
+	}
+	if *duplicatePolicy == "merge" || *duplicatePolicy == "both" {
+		transforms = append(transforms, "--duplicates "+*duplicatePolicy)
+	}
+	if *autoSwap {
+		transforms = append(transforms, "--auto_swap_mismatched")
+	}
+	if *enrichList != "" {
+		transforms = append(transforms, "--enrich")
+	}
+	return transforms
+}
+
+// Columns with several values per card, like tags, are written as --multi_value says:
+//
+//	join     in one cell, separated by --multi_value_separator
+//	json     in one cell as a JSON array, e.g. ["JLPT::N5","verb"]
+//	columns  one value per column, numbered from 1 like Tags1, Tags2, as many columns as the
+//	         card with the most values needs
+//
+// audio_sourcer.py and concatenator.py read all three, but only a space as the separator.
+var multiValueModes = []string{"join", "json", "columns"}
+
+// csvOptions are how writeCSV encodes cells.
+type csvOptions struct {
+	// safe escapes cells that spreadsheets would run as formulas
+	safe bool
+	// quoteAll quotes every cell, not only those that need it
+	quoteAll       bool
+	multiValue     string
+	valueSeparator string
+}
+
+// csvCells returns the cells of a column with values: one holding them all, or with
+// --multi_value columns, width cells.
+func (o csvOptions) csvCells(values []string, width int) []string {
+	switch o.multiValue {
+	case "json":
+		if values == nil {
+			values = []string{}
+		}
+		data, _ := json.Marshal(values)
+		return []string{string(data)}
+	case "columns":
+		cells := make([]string, width)
+		copy(cells, values)
+		return cells
+	}
+	return []string{strings.Join(values, o.valueSeparator)}
+}
+
+// writeCSV writes cards to a CSV file with columns, which start with the note fields.
+func writeCSV(name string, cards []card, columns []metadataColumn, opts csvOptions) error {
+	file, err := createAtomic(name, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file %s: %v", name, err)
+	}
+	defer file.abort()
+
+	writer := csv.NewWriter(file)
+	write := writer.Write
+	if opts.quoteAll {
+		write = func(record []string) error { return writeQuotedCSV(file, record) }
+	}
+
+	// Write CSV header, with as many columns for each multi-value column as the card with the
+	// most values needs
+	widths := make([]int, len(columns))
+	var header []string
+	for i, col := range columns {
+		if col.values == nil || opts.multiValue != "columns" {
+			header = append(header, col.header)
+			continue
+		}
+		for _, c := range cards {
+			widths[i] = max(widths[i], len(col.values(c)))
+		}
+		for n := 1; n <= widths[i]; n++ {
+			header = append(header, col.header+strconv.Itoa(n))
+		}
+	}
+	if err := write(header); err != nil {
+		return fmt.Errorf("failed to write CSV header: %v", err)
+	}
+
+	// Write card data
+	for _, c := range cards {
+		var record []string
+		for i, col := range columns {
+			if col.values != nil {
+				record = append(record, opts.csvCells(col.values(c), widths[i])...)
+			} else {
+				record = append(record, col.value(c))
+			}
+		}
+		if opts.safe {
+			for i := range record {
+				record[i] = escapeFormula(record[i])
+			}
+		}
+		if err := write(record); err != nil {
+			return fmt.Errorf("failed to write record for word '%s': %v", c.word, err)
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV file %s: %v", name, err)
+	}
+	if err := file.commit(); err != nil {
+		return fmt.Errorf("failed to write CSV file %s: %v", name, err)
+	}
+	return nil
+}
+
+// writeQuotedCSV writes record as a CSV line with every cell quoted, for parsers that can't
+// read unquoted cells with spaces or quotes in them.
+func writeQuotedCSV(w io.Writer, record []string) error {
+	var line strings.Builder
+	for i, cell := range record {
+		if i > 0 {
+			line.WriteByte(',')
+		}
+		line.WriteString(`"` + strings.ReplaceAll(cell, `"`, `""`) + `"`)
+	}
+	line.WriteByte('\n')
+	_, err := io.WriteString(w, line.String())
+	return err
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS cards (
+	card_id    INTEGER PRIMARY KEY,
+	note_id    INTEGER NOT NULL,
+	deck       TEXT,
+	word       TEXT NOT NULL,
+	definition TEXT NOT NULL,
+	interval   INTEGER,
+	reps       INTEGER,
+	lapses     INTEGER,
+	card_type  TEXT,
+	first_session TEXT,
+	last_session  TEXT
+);
+CREATE INDEX IF NOT EXISTS cards_note_id ON cards(note_id);
+CREATE INDEX IF NOT EXISTS cards_deck ON cards(deck);
+CREATE INDEX IF NOT EXISTS cards_word ON cards(word);
+
+CREATE TABLE IF NOT EXISTS notes (
+	note_id       INTEGER PRIMARY KEY,
+	word          TEXT NOT NULL,
+	definition    TEXT NOT NULL,
+	reading       TEXT,
+	language      TEXT,
+	first_session TEXT NOT NULL,
+	last_session  TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS note_fields (
+	note_id INTEGER NOT NULL REFERENCES notes(note_id),
+	name    TEXT NOT NULL,
+	value   TEXT NOT NULL,
+	PRIMARY KEY (note_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS note_tags (
+	note_id INTEGER NOT NULL REFERENCES notes(note_id),
+	tag     TEXT NOT NULL,
+	PRIMARY KEY (note_id, tag)
+);
+CREATE INDEX IF NOT EXISTS note_tags_tag ON note_tags(tag);
+
+CREATE TABLE IF NOT EXISTS media (
+	card_id     INTEGER NOT NULL REFERENCES cards(card_id),
+	source_name TEXT,
+	path        TEXT NOT NULL,
+	sha256      TEXT,
+	size        INTEGER
+);
+CREATE INDEX IF NOT EXISTS media_card_id ON media(card_id);
+CREATE INDEX IF NOT EXISTS media_sha256 ON media(sha256);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id         TEXT PRIMARY KEY,
+	started    TEXT NOT NULL,
+	query      TEXT,
+	card_count INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS card_history (
+	session   TEXT NOT NULL REFERENCES sessions(id),
+	card_id   INTEGER NOT NULL REFERENCES cards(card_id),
+	interval  INTEGER,
+	reps      INTEGER,
+	lapses    INTEGER,
+	card_type TEXT,
+	due       INTEGER,
+	PRIMARY KEY (session, card_id)
+);
+CREATE INDEX IF NOT EXISTS card_history_card_id ON card_history(card_id);
+`
+
+// sqliteCardColumns are the columns the cards table got later, added to the databases of
+// older versions.
+var sqliteCardColumns = []string{"first_session TEXT", "last_session TEXT"}
+
+// sqliteViews are created once the cards table has every column.
+const sqliteViews = `
+CREATE VIEW IF NOT EXISTS current_cards AS
+	SELECT * FROM cards WHERE last_session = (SELECT id FROM sessions ORDER BY started DESC, id DESC LIMIT 1);
+`
+
+// sqlQuote quotes a string as an SQL literal.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// missingCardColumns returns the sqliteCardColumns the cards table of database doesn't have
+// yet.
+func missingCardColumns(sqlite, database string) ([]string, error) {
+	out, err := exec.Command(sqlite, database, "SELECT name FROM pragma_table_info('cards')").Output()
+	if err != nil {
+		return nil, err
+	}
+	have := map[string]bool{}
+	for _, name := range strings.Fields(string(out)) {
+		have[name] = true
+	}
+	var missing []string
+	for _, col := range sqliteCardColumns {
+		if name, _, _ := strings.Cut(col, " "); !have[name] {
+			missing = append(missing, col)
+		}
+	}
+	return missing, nil
+}
+
+// writeSQLite writes cards and downloaded media into an SQLite database using the sqlite3
+// command line tool. Notes and cards are updated by their ID, so the database keeps the cards
+// of earlier runs, with the first and last run that exported each one, and card_history
+// holds their scheduling numbers in every run, which is added to the sessions table. The
+// current_cards view has the cards of the latest run.
+func writeSQLite(name string, cards []card, query string) error {
+	sqlite, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return fmt.Errorf("writing SQLite requires the sqlite3 command line tool: %v", err)
+	}
+
+	session := time.Now().Format("20060102-150405")
+	if currentRun != nil {
+		session = currentRun.ID
+	}
+	var script strings.Builder
+	script.WriteString("BEGIN;\n")
+	fmt.Fprintf(&script, "INSERT OR REPLACE INTO sessions VALUES (%s, %s, %s, %d);\n",
+		sqlQuote(session), sqlQuote(time.Now().Format(time.RFC3339)), sqlQuote(query), len(cards))
+	notes := map[int64]bool{}
+	for _, c := range cards {
+		cardType := strconv.FormatInt(c.cardType, 10)
+		if c.cardType >= 0 && int(c.cardType) < len(cardTypeNames) {
+			cardType = cardTypeNames[c.cardType]
+		}
+		// Cards of notes with several cards share the note's row
+		if !notes[c.noteID] {
+			notes[c.noteID] = true
+			fmt.Fprintf(&script, "INSERT INTO notes VALUES (%d, %s, %s, %s, %s, %s, %s)\n"+
+				"\tON CONFLICT(note_id) DO UPDATE SET word = excluded.word, definition = excluded.definition, "+
+				"reading = excluded.reading, language = excluded.language, last_session = excluded.last_session;\n",
+				c.noteID, sqlQuote(c.word), sqlQuote(c.definition), sqlQuote(c.reading), sqlQuote(c.language), sqlQuote(session), sqlQuote(session))
+			fmt.Fprintf(&script, "DELETE FROM note_fields WHERE note_id = %d;\nDELETE FROM note_tags WHERE note_id = %d;\n", c.noteID, c.noteID)
+			fields := make([]string, 0, len(c.fields))
+			for field := range c.fields {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				fmt.Fprintf(&script, "INSERT INTO note_fields VALUES (%d, %s, %s);\n", c.noteID, sqlQuote(field), sqlQuote(c.fields[field]))
+			}
+			for _, tag := range c.tags {
+				fmt.Fprintf(&script, "INSERT OR IGNORE INTO note_tags VALUES (%d, %s);\n", c.noteID, sqlQuote(tag))
+			}
+		}
+		fmt.Fprintf(&script, "INSERT INTO cards VALUES (%d, %d, %s, %s, %s, %d, %d, %d, %s, %s, %s)\n"+
+			"\tON CONFLICT(card_id) DO UPDATE SET note_id = excluded.note_id, deck = excluded.deck, word = excluded.word, "+
+			"definition = excluded.definition, interval = excluded.interval, reps = excluded.reps, lapses = excluded.lapses, "+
+			"card_type = excluded.card_type, first_session = coalesce(cards.first_session, excluded.first_session), "+
+			"last_session = excluded.last_session;\n",
+			c.cardID, c.noteID, sqlQuote(c.deck), sqlQuote(c.word), sqlQuote(c.definition),
+			c.interval, c.reps, c.lapses, sqlQuote(cardType), sqlQuote(session), sqlQuote(session))
+		due := 0
+		if c.due {
+			due = 1
+		}
+		fmt.Fprintf(&script, "INSERT OR REPLACE INTO card_history VALUES (%s, %d, %d, %d, %d, %s, %d);\n",
+			sqlQuote(session), c.cardID, c.interval, c.reps, c.lapses, sqlQuote(cardType), due)
+		fmt.Fprintf(&script, "DELETE FROM media WHERE card_id = %d;\n", c.cardID)
+		if c.audioPath != "" {
+			fmt.Fprintf(&script, "INSERT INTO media VALUES (%d, %s, %s, %s, %d);\n",
+				c.cardID, sqlQuote(c.audioFile), sqlQuote(filepath.ToSlash(c.audioPath)), sqlQuote(c.audioHash), c.audioSize)
+		}
+	}
+	script.WriteString(sqliteViews)
+	script.WriteString("COMMIT;\n")
+
+	// Work on a copy so a failed run never leaves a half-written database behind.
+	tmp, err := createAtomic(name, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create database %s: %v", name, err)
+	}
+	defer tmp.abort()
+	if existing, err := os.ReadFile(name); err == nil {
+		if _, err := tmp.Write(existing); err != nil {
+			return fmt.Errorf("failed to copy database %s: %v", name, err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to copy database %s: %v", name, err)
+	}
+
+	if err := runSQLite(sqlite, tmp.Name(), sqliteSchema); err != nil {
+		return fmt.Errorf("failed to write database %s: %v", name, err)
+	}
+	missing, err := missingCardColumns(sqlite, tmp.Name())
+	if err != nil {
+		return fmt.Errorf("failed to read database %s: %v", name, err)
+	}
+	var alter strings.Builder
+	for _, col := range missing {
+		fmt.Fprintf(&alter, "ALTER TABLE cards ADD COLUMN %s;\n", col)
+	}
+	if err := runSQLite(sqlite, tmp.Name(), alter.String()+script.String()); err != nil {
+		return fmt.Errorf("failed to write database %s: %v", name, err)
+	}
+	if err := tmp.commit(); err != nil {
+		return fmt.Errorf("failed to write database %s: %v", name, err)
+	}
+	return nil
+}
+
+// runSQLite runs script on database with the sqlite3 tool, stopping at the first error.
+func runSQLite(sqlite, database, script string) error {
+	cmd := exec.Command(sqlite, "-bail", database)
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
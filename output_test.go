@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEscapeFormula(t *testing.T) {
+	tests := []struct {
+		cell, want string
+	}{
+		{"", ""},
+		{"入る", "入る"},
+		{"=SUM(A1:A3)", "'=SUM(A1:A3)"},
+		{"+1 555", "'+1 555"},
+		{"-ness", "'-ness"},
+		{"@user", "'@user"},
+		// Numbers stay numbers
+		{"-3", "-3"},
+		{"+2.5", "+2.5"},
+		{"a=b", "a=b"},
+		{"'quoted", "'quoted"},
+	}
+	for _, tt := range tests {
+		got := escapeFormula(tt.cell)
+		if got != tt.want {
+			t.Errorf("escapeFormula(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+		if back := unescapeFormula(got); back != tt.cell {
+			t.Errorf("unescapeFormula(%q) = %q, want %q", got, back, tt.cell)
+		}
+	}
+}
+
+func TestUnescapeFormula(t *testing.T) {
+	tests := []struct {
+		cell, want string
+	}{
+		{"'=A1", "=A1"},
+		{"'-ness", "-ness"},
+		{"'quoted", "'quoted"},
+		{"'", "'"},
+		{"=A1", "=A1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := unescapeFormula(tt.cell); got != tt.want {
+			t.Errorf("unescapeFormula(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+	}
+}
+
+func TestCSVExport(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cards.csv")
+
+	// A CSV without a sidecar, e.g. one made by hand, is read as it is
+	export, err := loadCSVExport(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := export.cell("'=A1"); got != "'=A1" {
+		t.Errorf("cell of a CSV without a sidecar = %q, want it kept", got)
+	}
+
+	want := csvExport{SpreadsheetSafe: true, Transforms: []string{"--strip_html", "--cloze strip"}}
+	if err := saveCSVExport(name, want); err != nil {
+		t.Fatal(err)
+	}
+	export, err = loadCSVExport(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(export, want) {
+		t.Errorf("loadCSVExport = %+v, want %+v", export, want)
+	}
+	if got := export.cell("'=A1"); got != "=A1" {
+		t.Errorf("cell of a --spreadsheet_safe CSV = %q, want =A1", got)
+	}
+
+	if err := os.WriteFile(csvExportName(name), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCSVExport(name); err == nil {
+		t.Error("loadCSVExport of an invalid sidecar succeeded")
+	}
+}
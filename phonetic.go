@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Confusables groups the words of an exported CSV that sound alike, so they can be drilled
+// side by side or kept apart in lessons. Each word gets a phonetic key for its language and
+// words sharing a key form a group:
+//
+//	ja     kana spelling without voicing marks, small kana, ー, っ or long vowels, so
+//	       かき, かぎ, かっき and かあき share a key. Words written with kanji are skipped.
+//	ko     Hangul jamo with plain, tense and aspirated consonants merged, ㅐ/ㅔ merged and
+//	       final consonants reduced to the seven that are pronounced
+//	other  Soundex of the word without diacritics, for words written in Latin letters
+type confusableGroup struct {
+	Language string   `json:"language"`
+	Key      string   `json:"key"`
+	Words    []string `json:"words"`
+}
+
+type confusablesReport struct {
+	Words   int               `json:"words"`
+	Skipped int               `json:"skipped"`
+	Groups  []confusableGroup `json:"groups"`
+}
+
+// runConfusables reports groups of phonetically similar words in an exported CSV.
+func runConfusables(args []string) {
+	fs := flag.NewFlagSet("confusables", flag.ExitOnError)
+	csvName := fs.String("csv_name", "cards.csv", "Exported CSV file to read words from")
+	languageFlag := fs.String("language", "", "Language of every word, overriding the CSV's Language column (e.g. ja)")
+	defaultLang := fs.String("default_language", "", "Language of words without a Language column value")
+	minGroup := fs.Int("min_group", 2, "Smallest number of words to report as a group")
+	output := fs.String("output", "", "JSON file to write the groups to (empty to only print them)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{"csv_name": "cards.csv"})
+
+	for name, value := range map[string]string{"language": *languageFlag, "default_language": *defaultLang} {
+		if value != "" && normalizeLanguage(value) == "" {
+			fatalf("invalid --%s %q, must be a language code such as ja or pt-BR", name, value)
+		}
+	}
+	words, err := readCSVWords(*csvName)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	report := confusablesReport{}
+	index := map[string]int{}
+	seen := map[string]bool{}
+	skipped := map[string]int{}
+	for _, w := range words {
+		lang := normalizeLanguage(*languageFlag)
+		if lang == "" {
+			lang = normalizeLanguage(w.language)
+		}
+		if lang == "" {
+			lang = normalizeLanguage(*defaultLang)
+		}
+		// Spelling variants of one word are duplicates, not confusables
+		spelling := lang + "\x00" + normalizeWord(w.word, lang)
+		if seen[spelling] {
+			continue
+		}
+		seen[spelling] = true
+		report.Words++
+
+		key := phoneticKey(w.word, lang)
+		if key == "" {
+			report.Skipped++
+			skipped[lang]++
+			continue
+		}
+		i, found := index[lang+"\x00"+key]
+		if !found {
+			i = len(report.Groups)
+			index[lang+"\x00"+key] = i
+			report.Groups = append(report.Groups, confusableGroup{Language: lang, Key: key})
+		}
+		report.Groups[i].Words = append(report.Groups[i].Words, w.word)
+	}
+
+	groups := report.Groups[:0]
+	for _, g := range report.Groups {
+		if len(g.Words) >= max(*minGroup, 2) {
+			groups = append(groups, g)
+		}
+	}
+	sort.SliceStable(groups, func(a, b int) bool { return len(groups[a].Words) > len(groups[b].Words) })
+	report.Groups = groups
+
+	langs := make([]string, 0, len(skipped))
+	for lang := range skipped {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		label := lang
+		if label == "" {
+			label = "unlabelled"
+		}
+		fmt.Printf("warning: skipped %d %s words without a phonetic key\n", skipped[lang], label)
+	}
+	fmt.Printf("Found %d confusable groups among %d words\n", len(report.Groups), report.Words)
+	for _, g := range report.Groups {
+		label := g.Key
+		if g.Language != "" {
+			label = g.Language + " " + label
+		}
+		fmt.Printf("  [%s] %s\n", label, strings.Join(g.Words, ", "))
+	}
+
+	if *output != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fatalf("failed to encode report: %v", err)
+		}
+		if err := writeFileAtomic(*output, append(data, '\n'), 0644); err != nil {
+			fatalf("failed to write %s: %v", *output, err)
+		}
+		fmt.Printf("Wrote the groups to %s\n", *output)
+	}
+}
+
+// readCSVWords reads the words of an exported CSV, in order, with their language if the
+// CSV has a Language column.
+func readCSVWords(name string) ([]card, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CSV file %s: %v", name, err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV file %s: %v", name, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("CSV file %s is empty", name)
+	}
+	index := map[string]int{}
+	for i, h := range records[0] {
+		index[strings.TrimSpace(h)] = i
+	}
+	wordCol, found := index["Word"]
+	if !found {
+		return nil, fmt.Errorf("CSV file %s has no Word column", name)
+	}
+	langCol, hasLang := index["Language"]
+	export, err := loadCSVExport(name)
+	if err != nil {
+		return nil, err
+	}
+
+	words := make([]card, 0, len(records)-1)
+	for _, r := range records[1:] {
+		text, _ := htmlToText(export.cell(r[wordCol]))
+		c := card{word: strings.TrimSpace(text)}
+		if hasLang && langCol < len(r) {
+			c.language = r[langCol]
+		}
+		if c.word != "" {
+			words = append(words, c)
+		}
+	}
+	return words, nil
+}
+
+// phoneticKey returns the key words that sound alike share in language, or "" if there is
+// no key for the word.
+func phoneticKey(word, language string) string {
+	switch baseLanguage(language) {
+	case "ja":
+		return kanaKey(word)
+	case "ko":
+		return hangulKey(word)
+	}
+	var keys []string
+	for _, w := range strings.Fields(normalizeWord(word, language)) {
+		key := soundex(w)
+		if key == "" {
+			return ""
+		}
+		keys = append(keys, key)
+	}
+	return strings.Join(keys, " ")
+}
+
+var soundexCodes = map[rune]byte{
+	'b': '1', 'f': '1', 'p': '1', 'v': '1',
+	'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+	'd': '3', 't': '3',
+	'l': '4',
+	'm': '5', 'n': '5',
+	'r': '6',
+}
+
+// soundex returns the American Soundex code of a lowercase word, ignoring anything that
+// isn't a-z, or "" if the word has other letters.
+func soundex(word string) string {
+	var key []byte
+	var last byte
+	for _, r := range word {
+		if unicode.IsLetter(r) && (r < 'a' || r > 'z') {
+			return ""
+		}
+		if r < 'a' || r > 'z' {
+			continue
+		}
+		code, found := soundexCodes[r]
+		if len(key) == 0 {
+			key = append(key, byte(unicode.ToUpper(r)))
+			last = code
+			continue
+		}
+		switch {
+		case r == 'h' || r == 'w':
+			// Letters with the same code either side of h and w count once
+		case !found:
+			last = 0
+		case code != last:
+			if len(key) < 4 {
+				key = append(key, code)
+			}
+			last = code
+		}
+	}
+	if len(key) == 0 {
+		return ""
+	}
+	for len(key) < 4 {
+		key = append(key, '0')
+	}
+	return string(key)
+}
+
+var (
+	kanaVoiced   = []rune("がぎぐげござじずぜぞだぢづでどばびぶべぼぱぴぷぺぽゔ")
+	kanaUnvoiced = []rune("かきくけこさしすせそたちつてとはひふへほはひふへほう")
+	kanaSmall    = []rune("ぁぃぅぇぉゃゅょゎ")
+	kanaLarge    = []rune("あいうえおやゆよわ")
+	kanaVowels   = map[rune]string{
+		'a': "あかさたなはまやらわ",
+		'i': "いきしちにひみり",
+		'u': "うくすつぬふむゆる",
+		'e': "えけせてねへめれ",
+		'o': "おこそとのほもよろを",
+	}
+	kanaPlain = map[rune]rune{}
+	kanaVowel = map[rune]rune{}
+)
+
+func init() {
+	for i, r := range kanaVoiced {
+		kanaPlain[r] = kanaUnvoiced[i]
+	}
+	for i, r := range kanaSmall {
+		kanaPlain[r] = kanaLarge[i]
+	}
+	for vowel, row := range kanaVowels {
+		for _, r := range row {
+			kanaVowel[r] = vowel
+		}
+	}
+}
+
+// kanaKey returns the kana of a Japanese word without the distinctions learners most often
+// mishear: voicing, small kana, doubled consonants and vowel length. Words with anything
+// but kana have no key.
+func kanaKey(word string) string {
+	var key []rune
+	var last rune
+	for _, r := range word {
+		if r >= 'ァ' && r <= 'ヶ' {
+			r -= 'ァ' - 'ぁ'
+		}
+		switch {
+		case r == 'ー' || r == 'っ' || unicode.IsSpace(r) || unicode.IsPunct(r):
+			continue
+		case !unicode.Is(unicode.Hiragana, r):
+			return ""
+		}
+		if plain, found := kanaPlain[r]; found {
+			r = plain
+		}
+		// A vowel that lengthens the one before it, as in おばあさん, おとうさん or せんせい
+		if v := kanaVowel[r]; strings.ContainsRune("あいうえお", r) && last != 0 &&
+			(last == v || v == 'u' && last == 'o' || v == 'i' && last == 'e') {
+			continue
+		}
+		key = append(key, r)
+		last = kanaVowel[r]
+	}
+	return string(key)
+}
+
+// Korean consonants that differ only in tension or aspiration, and final consonants by the
+// sound they are pronounced with, as indices into the Hangul syllable block.
+var (
+	hangulInitial = map[int]int{1: 0, 15: 0, 4: 3, 16: 3, 8: 7, 17: 7, 10: 9, 13: 12, 14: 12}
+	hangulMedial  = map[int]int{5: 1, 7: 3}
+	hangulFinal   = map[int]int{
+		2: 1, 3: 1, 9: 1, 24: 1,
+		5: 4, 6: 4,
+		19: 7, 20: 7, 22: 7, 23: 7, 25: 7, 27: 7,
+		11: 8, 12: 8, 13: 8, 15: 8,
+		10: 16,
+		14: 17, 18: 17, 26: 17,
+	}
+)
+
+// hangulKey returns the jamo of a Korean word with consonants and vowels that are easily
+// confused merged. Words with anything but Hangul syllables have no key.
+func hangulKey(word string) string {
+	var parts []string
+	for _, r := range word {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) {
+			continue
+		}
+		if r < 0xAC00 || r > 0xD7A3 {
+			return ""
+		}
+		s := int(r - 0xAC00)
+		initial, medial, final := s/588, s%588/28, s%28
+		if v, found := hangulInitial[initial]; found {
+			initial = v
+		}
+		if v, found := hangulMedial[medial]; found {
+			medial = v
+		}
+		if v, found := hangulFinal[final]; found {
+			final = v
+		}
+		parts = append(parts, fmt.Sprintf("%d.%d.%d", initial, medial, final))
+	}
+	return strings.Join(parts, " ")
+}
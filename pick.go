@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// `pick` asks which deck to export and which of its note type's fields hold the word, the
+// definition and the audio, showing an example of each field, and saves the answers to the
+// download section of the config file, so the field names of a shared deck don't have to be
+// looked up and typed.
+
+// sampleLength is how many characters of a field's value are shown as its example.
+const sampleLength = 40
+
+// ask prints question and returns the answer, trimmed. Running out of input stops the run.
+func ask(question string) string {
+	fmt.Print(question)
+	answer, err := stdin.ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Println()
+		fatalf("no answer, stopping")
+	}
+	return strings.TrimSpace(answer)
+}
+
+// choose asks for one of options by its number, or by typing part of it to narrow the list
+// down, and returns its index. details are shown next to the options if set. With optional
+// an empty answer chooses none, and -1 is returned.
+func choose(what string, options, details []string, optional bool) int {
+	all := make([]int, len(options))
+	for i := range all {
+		all[i] = i
+	}
+	shown := all
+	for {
+		for n, i := range shown {
+			line := fmt.Sprintf("  %2d) %s", n+1, options[i])
+			if details != nil && details[i] != "" {
+				line += "   " + details[i]
+			}
+			fmt.Println(line)
+		}
+		question := fmt.Sprintf("%s [1-%d", what, len(shown))
+		if optional {
+			question += ", empty for none"
+		}
+		answer := ask(question + ", or text to search]: ")
+		if answer == "" {
+			if optional {
+				return -1
+			}
+			continue
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(shown) {
+			return shown[n-1]
+		}
+		var matches []int
+		for _, i := range all {
+			if strings.Contains(strings.ToLower(options[i]), strings.ToLower(answer)) {
+				matches = append(matches, i)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			fmt.Printf("Nothing matches %q\n", answer)
+			shown = all
+		case 1:
+			fmt.Printf("%s: %s\n", what, options[matches[0]])
+			return matches[0]
+		default:
+			shown = matches
+		}
+	}
+}
+
+// fieldSamples returns the start of the value of each of fields in the first of a few cards
+// of the note type model that query matches that has one, as plain text on one line.
+func fieldSamples(client *ankiconnect.Client, query, model string, fields []string) []string {
+	samples := make([]string, len(fields))
+	ids := must(client.Cards.Search(fmt.Sprintf(`(%s) "note:%s"`, query, ankiSearchEscaper.Replace(model))))
+	if len(*ids) == 0 {
+		return samples
+	}
+	infos := must(ankiInvoke[[]ankiconnect.ResultCardsInfo](client, "cardsInfo", map[string]any{"cards": (*ids)[:min(len(*ids), 5)]}))
+	for i, name := range fields {
+		value := ""
+		for _, info := range *infos {
+			if value = info.Fields[name].Value; strings.TrimSpace(value) != "" {
+				break
+			}
+		}
+		// Sound tags are what tells the audio field apart, so they are kept
+		text, _ := htmlToText(value)
+		if strings.Contains(value, "[sound:") {
+			text = value
+		}
+		text = strings.Join(strings.Fields(text), " ")
+		if runes := []rune(text); len(runes) > sampleLength {
+			text = string(runes[:sampleLength]) + "..."
+		}
+		if text != "" {
+			samples[i] = "e.g. " + text
+		}
+	}
+	return samples
+}
+
+// deckChoice is a deck and the fields of its cards chosen with chooseDeckAndFields.
+type deckChoice struct {
+	deck, query             string
+	word, definition, audio string
+	// cards are the IDs of the deck's cards
+	cards []int64
+}
+
+// settings returns the download settings that export the chosen deck.
+func (d deckChoice) settings() []configSetting {
+	settings := []configSetting{
+		{"card_query", d.query},
+		{"word_field", d.word},
+		{"definition_field", d.definition},
+		{"get_audio", d.audio != ""},
+	}
+	if d.audio != "" {
+		settings = append(settings, configSetting{"word_audio_field", d.audio})
+	}
+	return settings
+}
+
+// chooseDeckAndFields asks which deck to export and which fields hold the word, the
+// definition and the audio.
+func chooseDeckAndFields(client *ankiconnect.Client) deckChoice {
+	decks := *must(client.Decks.GetAll())
+	if len(decks) == 0 {
+		fatalf("Anki has no decks")
+	}
+	sort.Strings(decks)
+	deck := decks[choose("Deck", decks, nil, false)]
+	query := fmt.Sprintf(`"deck:%s"`, ankiSearchEscaper.Replace(deck))
+	ids := must(client.Cards.Search(query))
+	if len(*ids) == 0 {
+		fatalf("deck %s has no cards", deck)
+	}
+
+	// The fields are picked from the note type most of the cards use
+	models := must(matchedModels(client, query, len(*ids)))
+	sort.SliceStable(models, func(i, j int) bool { return models[i].cards > models[j].cards })
+	model := models[0]
+	if len(models) > 1 {
+		fmt.Printf("The deck's cards are of %d note types, these are the fields of %s (%d of %d cards)\n", len(models), model.name, model.cards, len(*ids))
+	}
+	fields := model.fields
+	samples := fieldSamples(client, query, model.name, fields)
+
+	word := choose("Word field", fields, samples, false)
+	// The definition can't be the word too
+	var rest, restSamples []string
+	for i := range fields {
+		if i != word {
+			rest = append(rest, fields[i])
+			restSamples = append(restSamples, samples[i])
+		}
+	}
+	definition := rest[choose("Definition field", rest, restSamples, false)]
+	audio := ""
+	if i := choose("Audio field", fields, samples, true); i >= 0 {
+		audio = fields[i]
+	}
+
+	required := map[string]string{"word_field": fields[word], "definition_field": definition}
+	if audio != "" {
+		required["word_audio_field"] = audio
+	}
+	if problems := missingFields(models, required); len(problems) > 0 {
+		fmt.Printf("warning: the deck's other note types lack some of the fields, use --skip_errors to export without them:\n  %s\n", strings.Join(problems, "\n  "))
+	}
+	return deckChoice{deck: deck, query: query, word: fields[word], definition: definition, audio: audio, cards: *ids}
+}
+
+// runPick implements the `pick` command.
+func runPick(args []string) {
+	fs := flag.NewFlagSet("pick", flag.ExitOnError)
+	dryRun := fs.Bool("dry_run", false, "Print the settings instead of saving them to the config file")
+	fs.Parse(args)
+	if configFile == "" && !*dryRun {
+		fatalf("no config file to save to, pass --config file")
+	}
+
+	choice := chooseDeckAndFields(newAnkiClient())
+	settings := choice.settings()
+	fmt.Println("\ndownload:")
+	for _, s := range settings {
+		fmt.Printf("  %s: %v\n", s.key, s.value)
+	}
+	if *dryRun {
+		return
+	}
+	if !confirm(fmt.Sprintf("Save these to %s?", configFile)) {
+		fmt.Println("Nothing saved")
+		return
+	}
+	if err := saveConfig(configFile, configSection{"download", settings}); err != nil {
+		fatalf("failed to save config %s: %v", configFile, err)
+	}
+	fmt.Printf("Saved to %s, anki_downloader now exports %s with them\n", configFile, choice.deck)
+}
@@ -0,0 +1,390 @@
+// Package ankiexport queries Anki through the Anki-Connect add-on for the cards of a search
+// and downloads their audio. It is what the anki_downloader `download` command exports
+// with, for embedding in other tools:
+//
+//	exporter := &ankiexport.Exporter{
+//		Client:          ankiexport.NewAnkiConnect(""),
+//		Query:           "deck:JP1K",
+//		WordField:       "Word",
+//		DefinitionField: "Definition",
+//		AudioField:      "Audio",
+//	}
+//	cards, err := exporter.Export()
+//	...
+//	err = exporter.DownloadAudio(cards, "words_anki")
+//
+// Cards come back as Anki stores them, HTML and all; cleaning up the text is left to the
+// caller.
+package ankiexport
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// Card is one exported card with the fields of its note that were asked for.
+type Card struct {
+	NoteID int64
+	CardID int64
+	Deck   string
+	Model  string
+	// Template is the ordinal of the card's template in the note type, 0 for the first:
+	// which of a note's cards it is, e.g. recognition or recall
+	Template int64
+	// Fields holds every field of the note by name
+	Fields map[string]string
+	// Tags holds the note's tags, with Exporter.Tags
+	Tags []string
+
+	Word       string
+	Definition string
+	// Reading is the Exporter.ReadingField, if set
+	Reading string
+	// AudioFile is the media file the Exporter.AudioField plays, if set, the first of
+	// AudioFiles
+	AudioFile string
+	// AudioFiles holds every media file the field plays, for fields with several [sound:]
+	// tags, e.g. a male and a female voice
+	AudioFiles []string
+	// AudioPath is where DownloadAudio wrote the audio
+	AudioPath string
+
+	// Scheduling info
+	Interval int64
+	Reps     int64
+	Lapses   int64
+	Type     int64
+	// Due is whether the card is due for review today, with Exporter.Due
+	Due bool
+
+	// Sources holds the name of the Enricher that filled each value the note left empty
+	Sources map[Enrichable]string
+}
+
+// Exporter exports the cards matching Query.
+type Exporter struct {
+	Client Client
+	Query  string
+
+	WordField       string
+	DefinitionField string
+	// AudioField and ReadingField are optional fields holding a [sound:] tag for the word
+	// and how it is read
+	AudioField   string
+	ReadingField string
+	// RecordingField is an optional field holding the user's own recording of the word,
+	// played instead of AudioField's when a note has one. Notes may lack the field
+	RecordingField string
+
+	// Tags fetches the tags of each card's note, which takes a request per thousand notes
+	Tags bool
+	// Due asks Anki which cards are due today
+	Due bool
+	// ByNote exports each note once, as its matched card with the lowest template ordinal,
+	// instead of a row per card for note types with several cards per note
+	ByNote bool
+	// Order, if set, puts the cards Export returns in order, e.g. an orderer from
+	// LookupOrderer. Cards returns them in Anki's order.
+	Order Orderer
+	// Enrichers fill in the definitions, readings and frequency ranks the notes leave empty,
+	// the first with a value winning, see Enrich
+	Enrichers []Enricher
+	// FrequencyField is the field EnrichFrequency fills, Frequency if empty
+	FrequencyField string
+
+	// Concurrency is how many files DownloadAudio retrieves at a time, one if 0
+	Concurrency int
+
+	// SkipCard, if set, is called with each card that lacks one of the fields, which is
+	// then left out, instead of Cards failing on the first
+	SkipCard func(err *FieldError)
+}
+
+// FieldError is a card whose note lacks one of the fields an Exporter reads.
+type FieldError struct {
+	NoteID int64
+	CardID int64
+	Model  string
+	Field  string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("card %d does not contain field %s", e.CardID, e.Field)
+}
+
+// Export returns the cards matching the query.
+func (e *Exporter) Export() ([]Card, error) {
+	ids, err := e.Search()
+	if err != nil {
+		return nil, err
+	}
+	cards, err := e.Cards(ids)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.Enrich(cards); err != nil {
+		return nil, err
+	}
+	if e.Order == nil {
+		return cards, nil
+	}
+	return e.Order.Order(cards), nil
+}
+
+// Search returns the IDs of the cards matching the query, to check how many there are
+// before fetching them with Cards.
+func (e *Exporter) Search() ([]int64, error) {
+	if e.Query == "" {
+		return nil, fmt.Errorf("no query to export")
+	}
+	return e.Client.FindCards(e.Query)
+}
+
+// Cards fetches the cards with ids. Errors from the Client are returned as they are.
+func (e *Exporter) Cards(ids []int64) ([]Card, error) {
+	if e.WordField == "" || e.DefinitionField == "" {
+		return nil, fmt.Errorf("the word and definition fields must be set")
+	}
+	infos, err := e.Client.CardsInfo(ids)
+	if err != nil {
+		return nil, err
+	}
+	if e.ByNote {
+		infos = firstCardOfNotes(infos)
+		ids = make([]int64, len(infos))
+		for i, c := range infos {
+			ids[i] = c.CardId
+		}
+	}
+	var due []bool
+	if e.Due {
+		if due, err = e.Client.AreDue(ids); err != nil {
+			return nil, err
+		}
+	}
+	dueByID := map[int64]bool{}
+	for i, d := range due {
+		dueByID[ids[i]] = d
+	}
+
+	// Tags are only on the notes
+	tags := map[int64][]string{}
+	if e.Tags {
+		var noteIDs []int64
+		for _, c := range infos {
+			if _, found := tags[c.Note]; !found {
+				tags[c.Note] = nil
+				noteIDs = append(noteIDs, c.Note)
+			}
+		}
+		notes, err := e.Client.NotesInfo(noteIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range notes {
+			tags[n.NoteId] = n.Tags
+		}
+	}
+
+	cards := make([]Card, 0, len(infos))
+	for _, c := range infos {
+		fields := make(map[string]string, len(c.Fields))
+		for name, f := range c.Fields {
+			fields[name] = f.Value
+		}
+		field := func(name string) (string, error) {
+			value, found := fields[name]
+			if !found {
+				return "", &FieldError{NoteID: c.Note, CardID: c.CardId, Model: c.ModelName, Field: name}
+			}
+			return value, nil
+		}
+		card := Card{
+			NoteID:   c.Note,
+			CardID:   c.CardId,
+			Deck:     c.DeckName,
+			Model:    c.ModelName,
+			Template: c.Ord,
+			Fields:   fields,
+			Tags:     tags[c.Note],
+			Interval: c.Interval,
+			Reps:     c.Reps,
+			Lapses:   c.Lapses,
+			Type:     c.Type,
+			Due:      dueByID[c.CardId],
+		}
+		err := func() (err error) {
+			if card.Word, err = field(e.WordField); err != nil {
+				return err
+			}
+			if card.Definition, err = field(e.DefinitionField); err != nil {
+				return err
+			}
+			if e.ReadingField != "" {
+				if card.Reading, err = field(e.ReadingField); err != nil {
+					return err
+				}
+			}
+			if e.AudioField != "" {
+				sound, err := field(e.AudioField)
+				if err != nil {
+					return err
+				}
+				card.AudioFiles = SoundFiles(sound)
+				if recordings := SoundFiles(fields[e.RecordingField]); e.RecordingField != "" && len(recordings) > 0 {
+					card.AudioFiles = recordings
+				}
+				if len(card.AudioFiles) > 0 {
+					card.AudioFile = card.AudioFiles[0]
+				}
+			}
+			return nil
+		}()
+		if fieldErr, ok := err.(*FieldError); ok && e.SkipCard != nil {
+			e.SkipCard(fieldErr)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+	return cards, nil
+}
+
+// firstCardOfNotes returns the card with the lowest template ordinal of each note, in the
+// order the notes' first cards are in.
+func firstCardOfNotes(infos []ankiconnect.ResultCardsInfo) []ankiconnect.ResultCardsInfo {
+	first := map[int64]int{}
+	var kept []ankiconnect.ResultCardsInfo
+	for _, c := range infos {
+		i, found := first[c.Note]
+		if !found {
+			first[c.Note] = len(kept)
+			kept = append(kept, c)
+		} else if c.Ord < kept[i].Ord {
+			kept[i] = c
+		}
+	}
+	return kept
+}
+
+var soundTag = regexp.MustCompile(`\[sound:([^\]]*)\]`)
+
+// SoundFiles returns the media files the [sound:] tags of a field play, in order. A field
+// without tags is taken to hold a file name.
+func SoundFiles(value string) []string {
+	var files []string
+	for _, m := range soundTag.FindAllStringSubmatch(value, -1) {
+		if name := strings.TrimSpace(m[1]); name != "" {
+			files = append(files, name)
+		}
+	}
+	if files == nil && !strings.Contains(value, "[sound:") {
+		if name := strings.TrimSpace(value); name != "" {
+			files = []string{name}
+		}
+	}
+	return files
+}
+
+// SoundFile returns the media file the first [sound:] tag of a field plays.
+func SoundFile(value string) string {
+	if files := SoundFiles(value); len(files) > 0 {
+		return files[0]
+	}
+	return ""
+}
+
+// AudioFileName is the name the audio of the i-th card is downloaded as.
+func AudioFileName(i int) string {
+	return fmt.Sprintf("word_%04d.mp3", i)
+}
+
+// DownloadAudio writes the audio of each card with an AudioFile to folder, named by
+// AudioFileName, and sets its AudioPath. The first failure stops the downloads that haven't
+// started.
+func (e *Exporter) DownloadAudio(cards []Card, folder string) error {
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return err
+	}
+	jobs := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for w := 0; w < max(e.Concurrency, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				err := e.downloadAudio(&cards[i], filepath.Join(folder, AudioFileName(i)))
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range cards {
+		mu.Lock()
+		stop := firstErr != nil
+		mu.Unlock()
+		if stop {
+			break
+		}
+		if cards[i].AudioFile != "" {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return firstErr
+}
+
+// downloadAudio writes the audio of c to name.
+func (e *Exporter) downloadAudio(c *Card, name string) error {
+	data, err := e.Client.RetrieveMediaFile(c.AudioFile)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve %s: %w", c.AudioFile, err)
+	}
+	if err := writeFileAtomic(name, data, 0644); err != nil {
+		return err
+	}
+	c.AudioPath = name
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to name and renames it into place, so
+// a failed download never leaves a truncated clip under name.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
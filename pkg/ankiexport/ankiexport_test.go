@@ -0,0 +1,210 @@
+package ankiexport
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// fakeClient answers an Exporter from memory.
+type fakeClient struct {
+	cards []ankiconnect.ResultCardsInfo
+	notes []ankiconnect.ResultNotesInfo
+	due   map[int64]bool
+	media map[string][]byte
+	// queries are the searches asked for
+	queries []string
+}
+
+func (f *fakeClient) FindCards(query string) ([]int64, error) {
+	f.queries = append(f.queries, query)
+	ids := make([]int64, len(f.cards))
+	for i, c := range f.cards {
+		ids[i] = c.CardId
+	}
+	return ids, nil
+}
+
+func (f *fakeClient) CardsInfo(ids []int64) ([]ankiconnect.ResultCardsInfo, error) {
+	return f.cards, nil
+}
+
+func (f *fakeClient) NotesInfo(ids []int64) ([]ankiconnect.ResultNotesInfo, error) {
+	return f.notes, nil
+}
+
+func (f *fakeClient) AreDue(ids []int64) ([]bool, error) {
+	due := make([]bool, len(ids))
+	for i, id := range ids {
+		due[i] = f.due[id]
+	}
+	return due, nil
+}
+
+func (f *fakeClient) RetrieveMediaFile(filename string) ([]byte, error) {
+	data, found := f.media[filename]
+	if !found {
+		return nil, ErrMediaNotFound
+	}
+	return data, nil
+}
+
+// fields returns Anki-Connect's fields of a note from names and values.
+func fields(nameValues ...string) map[string]ankiconnect.FieldData {
+	fields := map[string]ankiconnect.FieldData{}
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		fields[nameValues[i]] = ankiconnect.FieldData{Value: nameValues[i+1], Order: int64(i / 2)}
+	}
+	return fields
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		cards: []ankiconnect.ResultCardsInfo{
+			{CardId: 11, Note: 1, DeckName: "JP::Core", ModelName: "Basic JP", Interval: 5, Reps: 3, Lapses: 1, Type: 2,
+				Fields: fields("Word", "入る", "Definition", "to enter", "Reading", "はいる", "Audio", "[sound:hairu.mp3]")},
+			{CardId: 12, Note: 2, DeckName: "JP::Core", ModelName: "Basic JP",
+				Fields: fields("Word", "部屋", "Definition", "room", "Reading", "へや", "Audio", "")},
+		},
+		notes: []ankiconnect.ResultNotesInfo{{NoteId: 1, Tags: []string{"verb"}}, {NoteId: 2, Tags: []string{"noun"}}},
+		due:   map[int64]bool{12: true},
+		media: map[string][]byte{"hairu.mp3": []byte("ID3 hairu")},
+	}
+}
+
+func TestExport(t *testing.T) {
+	client := newFakeClient()
+	e := &Exporter{
+		Client:          client,
+		Query:           "deck:JP::Core",
+		WordField:       "Word",
+		DefinitionField: "Definition",
+		ReadingField:    "Reading",
+		AudioField:      "Audio",
+		Tags:            true,
+		Due:             true,
+	}
+	cards, err := e.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(client.queries, []string{"deck:JP::Core"}) {
+		t.Errorf("searched for %q", client.queries)
+	}
+	if len(cards) != 2 {
+		t.Fatalf("exported %d cards, want 2", len(cards))
+	}
+	c := cards[0]
+	if c.NoteID != 1 || c.CardID != 11 || c.Deck != "JP::Core" || c.Model != "Basic JP" {
+		t.Errorf("card 1 IDs = %+v", c)
+	}
+	if c.Word != "入る" || c.Definition != "to enter" || c.Reading != "はいる" || c.AudioFile != "hairu.mp3" {
+		t.Errorf("card 1 = %q, %q, %q, %q", c.Word, c.Definition, c.Reading, c.AudioFile)
+	}
+	if c.Interval != 5 || c.Reps != 3 || c.Lapses != 1 || c.Type != 2 || c.Due {
+		t.Errorf("card 1 scheduling = %+v", c)
+	}
+	if !reflect.DeepEqual(c.Tags, []string{"verb"}) || c.Fields["Audio"] != "[sound:hairu.mp3]" {
+		t.Errorf("card 1 tags %v, fields %v", c.Tags, c.Fields)
+	}
+	if c := cards[1]; c.AudioFile != "" || !c.Due || !reflect.DeepEqual(c.Tags, []string{"noun"}) {
+		t.Errorf("card 2 = audio %q, due %v, tags %v", c.AudioFile, c.Due, c.Tags)
+	}
+}
+
+func TestExportWithoutOptions(t *testing.T) {
+	e := &Exporter{Client: newFakeClient(), Query: "deck:*", WordField: "Word", DefinitionField: "Definition"}
+	cards, err := e.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cards {
+		if c.Tags != nil || c.Due || c.Reading != "" || c.AudioFile != "" {
+			t.Errorf("card %d has values that weren't asked for: %+v", c.CardID, c)
+		}
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		e    Exporter
+	}{
+		{"no query", Exporter{WordField: "Word", DefinitionField: "Definition"}},
+		{"no word field", Exporter{Query: "deck:*", DefinitionField: "Definition"}},
+		{"missing field", Exporter{Query: "deck:*", WordField: "Expression", DefinitionField: "Definition"}},
+		{"missing audio field", Exporter{Query: "deck:*", WordField: "Word", DefinitionField: "Definition", AudioField: "Sound"}},
+	}
+	for _, tt := range tests {
+		tt.e.Client = newFakeClient()
+		if _, err := tt.e.Export(); err == nil {
+			t.Errorf("%s: Export succeeded", tt.name)
+		}
+	}
+}
+
+func TestSoundFiles(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"[sound:hairu.mp3]", []string{"hairu.mp3"}},
+		{"[sound:word_male.mp3][sound:word_female.mp3]", []string{"word_male.mp3", "word_female.mp3"}},
+		{"入る [sound:a.mp3]<br>[sound: b.mp3 ]", []string{"a.mp3", "b.mp3"}},
+		{"hairu.mp3", []string{"hairu.mp3"}},
+		{"[sound:]", nil},
+		{"", nil},
+		{"   ", nil},
+	}
+	for _, tt := range tests {
+		if got := SoundFiles(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SoundFiles(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+		want := ""
+		if len(tt.want) > 0 {
+			want = tt.want[0]
+		}
+		if got := SoundFile(tt.value); got != want {
+			t.Errorf("SoundFile(%q) = %q, want %q", tt.value, got, want)
+		}
+	}
+}
+
+func TestDownloadAudio(t *testing.T) {
+	client := newFakeClient()
+	e := &Exporter{Client: client, Query: "deck:*", WordField: "Word", DefinitionField: "Definition", AudioField: "Audio"}
+	cards, err := e.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := filepath.Join(t.TempDir(), "words")
+	if err := e.DownloadAudio(cards, folder); err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(folder, AudioFileName(0))
+	if cards[0].AudioPath != want || cards[1].AudioPath != "" {
+		t.Errorf("AudioPaths = %q, %q, want %q and none", cards[0].AudioPath, cards[1].AudioPath, want)
+	}
+	if data, err := os.ReadFile(want); err != nil || string(data) != "ID3 hairu" {
+		t.Errorf("%s = %q, %v", want, data, err)
+	}
+	entries, _ := os.ReadDir(folder)
+	if len(entries) != 1 {
+		t.Errorf("%d files in the audio folder, want 1", len(entries))
+	}
+
+	cards[0].AudioFile = "missing.mp3"
+	if err := e.DownloadAudio(cards, folder); !errors.Is(err, ErrMediaNotFound) {
+		t.Errorf("DownloadAudio of a missing file = %v, want ErrMediaNotFound", err)
+	}
+}
+
+func TestAudioFileName(t *testing.T) {
+	if got := AudioFileName(42); got != "word_0042.mp3" {
+		t.Errorf("AudioFileName(42) = %q", got)
+	}
+}
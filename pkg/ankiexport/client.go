@@ -0,0 +1,148 @@
+package ankiexport
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// Client is the part of Anki-Connect an export uses. AnkiConnect implements it over HTTP;
+// pass your own to an Exporter to answer from a cache, a fixture or another source.
+type Client interface {
+	// FindCards returns the IDs of the cards matching an Anki search query
+	FindCards(query string) ([]int64, error)
+	// CardsInfo returns the cards with ids
+	CardsInfo(ids []int64) ([]ankiconnect.ResultCardsInfo, error)
+	// NotesInfo returns the notes with ids, with their tags
+	NotesInfo(ids []int64) ([]ankiconnect.ResultNotesInfo, error)
+	// AreDue reports for each of ids if the card is due for review today
+	AreDue(ids []int64) ([]bool, error)
+	// RetrieveMediaFile returns a file from Anki's media folder
+	RetrieveMediaFile(filename string) ([]byte, error)
+}
+
+// DefaultURL is where the Anki-Connect add-on listens unless configured otherwise.
+const DefaultURL = "http://localhost:8765"
+
+// Version is the Anki-Connect API version requests are made with.
+const Version = 6
+
+// batchSize is how many cards or notes are asked for per request, so large decks don't
+// make one huge request.
+const batchSize = 1000
+
+// ErrMediaNotFound is returned by RetrieveMediaFile for a file Anki doesn't have.
+var ErrMediaNotFound = errors.New("not found in Anki's media folder")
+
+// An Error is an Anki-Connect request that failed.
+type Error struct {
+	Action string
+	// Message is Anki-Connect's answer, or why it couldn't be asked
+	Message string
+	// Unreachable is set when Anki-Connect didn't answer or its answer couldn't be read,
+	// usually because Anki isn't running
+	Unreachable bool
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("anki-connect %s: %s", e.Action, e.Message)
+}
+
+// AnkiConnect is a Client for the Anki-Connect add-on at URL.
+type AnkiConnect struct {
+	URL     string
+	Version int
+	// HTTPClient makes the requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// NewAnkiConnect returns a client for the Anki-Connect at url, or DefaultURL if url is "".
+func NewAnkiConnect(url string) *AnkiConnect {
+	if url == "" {
+		url = DefaultURL
+	}
+	return &AnkiConnect{URL: url, Version: Version}
+}
+
+// Invoke calls an Anki-Connect action and decodes its result, for actions Client doesn't
+// cover. Failures are returned as an *Error.
+func Invoke[R any](c *AnkiConnect, action string, params any) (R, error) {
+	var result struct {
+		Result R       `json:"result"`
+		Error  *string `json:"error"`
+	}
+	payload := map[string]any{"action": action, "version": c.Version}
+	if params != nil {
+		payload["params"] = params
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return result.Result, &Error{Action: action, Message: err.Error()}
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(c.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return result.Result, &Error{Action: action, Message: err.Error(), Unreachable: true}
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result.Result, &Error{Action: action, Message: "invalid response: " + err.Error(), Unreachable: true}
+	}
+	if result.Error != nil && *result.Error != "" {
+		return result.Result, &Error{Action: action, Message: *result.Error}
+	}
+	return result.Result, nil
+}
+
+// batched calls action for ids in batches of batchSize, joining the results.
+func batched[R any](c *AnkiConnect, action, param string, ids []int64) ([]R, error) {
+	results := make([]R, 0, len(ids))
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+		res, err := Invoke[[]R](c, action, map[string]any{param: batch})
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res...)
+	}
+	return results, nil
+}
+
+func (c *AnkiConnect) FindCards(query string) ([]int64, error) {
+	return Invoke[[]int64](c, "findCards", map[string]any{"query": query})
+}
+
+func (c *AnkiConnect) CardsInfo(ids []int64) ([]ankiconnect.ResultCardsInfo, error) {
+	return batched[ankiconnect.ResultCardsInfo](c, "cardsInfo", "cards", ids)
+}
+
+func (c *AnkiConnect) NotesInfo(ids []int64) ([]ankiconnect.ResultNotesInfo, error) {
+	return batched[ankiconnect.ResultNotesInfo](c, "notesInfo", "notes", ids)
+}
+
+func (c *AnkiConnect) AreDue(ids []int64) ([]bool, error) {
+	return batched[bool](c, "areDue", "cards", ids)
+}
+
+func (c *AnkiConnect) RetrieveMediaFile(filename string) ([]byte, error) {
+	// Anki-Connect answers false rather than an error for a missing file. An empty one plays
+	// nothing, so it is missing too
+	res, err := Invoke[json.RawMessage](c, "retrieveMediaFile", map[string]any{"filename": filename})
+	if err != nil {
+		return nil, err
+	}
+	var data string
+	if json.Unmarshal(res, &data) != nil || data == "" {
+		return nil, fmt.Errorf("%s: %w", filename, ErrMediaNotFound)
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
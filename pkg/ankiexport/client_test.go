@@ -0,0 +1,134 @@
+package ankiexport
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// ankiRequest is a request to Anki-Connect.
+type ankiRequest struct {
+	Action  string          `json:"action"`
+	Version int             `json:"version"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// fakeAnkiConnect serves answer's result, or error if it returns one, for each request.
+func fakeAnkiConnect(t *testing.T, answer func(req ankiRequest) (any, string)) *AnkiConnect {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ankiRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid request: %v", err)
+		}
+		result, errText := answer(req)
+		var errValue any
+		if errText != "" {
+			errValue = errText
+		}
+		json.NewEncoder(w).Encode(map[string]any{"result": result, "error": errValue})
+	}))
+	t.Cleanup(server.Close)
+	return NewAnkiConnect(server.URL)
+}
+
+func TestNewAnkiConnect(t *testing.T) {
+	if c := NewAnkiConnect(""); c.URL != DefaultURL || c.Version != Version {
+		t.Errorf("NewAnkiConnect(\"\") = %+v", c)
+	}
+	if c := NewAnkiConnect("http://desktop:8765"); c.URL != "http://desktop:8765" {
+		t.Errorf("URL = %q", c.URL)
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	c := fakeAnkiConnect(t, func(req ankiRequest) (any, string) {
+		if req.Version != Version {
+			t.Errorf("version %d, want %d", req.Version, Version)
+		}
+		if req.Action == "fail" {
+			return nil, "collection is not available"
+		}
+		var params map[string]string
+		json.Unmarshal(req.Params, &params)
+		return req.Action + ":" + params["name"], ""
+	})
+
+	got, err := Invoke[string](c, "hello", map[string]string{"name": "anki"})
+	if err != nil || got != "hello:anki" {
+		t.Errorf("Invoke = %q, %v", got, err)
+	}
+
+	_, err = Invoke[string](c, "fail", nil)
+	var ankiErr *Error
+	if !errors.As(err, &ankiErr) || ankiErr.Action != "fail" || ankiErr.Message != "collection is not available" || ankiErr.Unreachable {
+		t.Errorf("Invoke error = %#v", err)
+	}
+}
+
+func TestInvokeUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>not Anki-Connect</html>")
+	}))
+	defer server.Close()
+	var ankiErr *Error
+	if _, err := Invoke[int](NewAnkiConnect(server.URL), "version", nil); !errors.As(err, &ankiErr) || !ankiErr.Unreachable {
+		t.Errorf("Invoke of something that isn't Anki-Connect = %#v, want an unreachable *Error", err)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	if _, err := Invoke[int](NewAnkiConnect(closed.URL), "version", nil); !errors.As(err, &ankiErr) || !ankiErr.Unreachable {
+		t.Errorf("Invoke of a closed port = %#v, want an unreachable *Error", err)
+	}
+}
+
+func TestBatched(t *testing.T) {
+	var batches []int
+	c := fakeAnkiConnect(t, func(req ankiRequest) (any, string) {
+		var params struct{ Cards []int64 }
+		json.Unmarshal(req.Params, &params)
+		batches = append(batches, len(params.Cards))
+		due := make([]bool, len(params.Cards))
+		for i, id := range params.Cards {
+			due[i] = id%2 == 0
+		}
+		return due, ""
+	})
+	ids := make([]int64, 2*batchSize+5)
+	for i := range ids {
+		ids[i] = int64(i)
+	}
+	due, err := c.AreDue(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(batches) != fmt.Sprint([]int{batchSize, batchSize, 5}) {
+		t.Errorf("batches of %v, want %d, %d and 5", batches, batchSize, batchSize)
+	}
+	if len(due) != len(ids) || !due[batchSize] || due[batchSize+1] {
+		t.Errorf("AreDue joined the batches wrong: %d results", len(due))
+	}
+}
+
+func TestRetrieveMediaFile(t *testing.T) {
+	c := fakeAnkiConnect(t, func(req ankiRequest) (any, string) {
+		var params struct{ Filename string }
+		json.Unmarshal(req.Params, &params)
+		if params.Filename == "hairu.mp3" {
+			return base64.StdEncoding.EncodeToString([]byte("ID3 hairu")), ""
+		}
+		return false, ""
+	})
+	data, err := c.RetrieveMediaFile("hairu.mp3")
+	if err != nil || string(data) != "ID3 hairu" {
+		t.Errorf("RetrieveMediaFile = %q, %v", data, err)
+	}
+	if _, err := c.RetrieveMediaFile("missing.mp3"); !errors.Is(err, ErrMediaNotFound) {
+		t.Errorf("RetrieveMediaFile of a missing file = %v, want ErrMediaNotFound", err)
+	}
+}
@@ -0,0 +1,74 @@
+package ankiexport
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Enrichable is a value of a card an Enricher can fill in.
+type Enrichable string
+
+const (
+	EnrichDefinition Enrichable = "definition"
+	EnrichReading    Enrichable = "reading"
+	// EnrichFrequency is the frequency rank in the Exporter.FrequencyField, which
+	// FieldOrder sorts by
+	EnrichFrequency Enrichable = "frequency"
+)
+
+// An Enricher fills in values a card's note leaves empty, such as the definition of a note
+// that only has the word, from a dictionary, a translation service or a frequency list.
+type Enricher interface {
+	// Name identifies the enricher in Card.Sources, e.g. dictionary:jmdict.tsv
+	Name() string
+	// Enrich returns the value of what for c, or false if it has none
+	Enrich(c Card, what Enrichable) (string, bool, error)
+}
+
+// Enrich fills in the values cards leave empty with the Exporter.Enrichers, asking them in
+// order until one has a value, and records which one it was in the card's Sources. Export
+// enriches the cards before putting them in order.
+func (e *Exporter) Enrich(cards []Card) error {
+	if len(e.Enrichers) == 0 {
+		return nil
+	}
+	frequencyField := e.FrequencyField
+	if frequencyField == "" {
+		frequencyField = "Frequency"
+	}
+	for i := range cards {
+		c := &cards[i]
+		frequency := c.Fields[frequencyField]
+		values := []struct {
+			what  Enrichable
+			value *string
+		}{{EnrichDefinition, &c.Definition}, {EnrichReading, &c.Reading}, {EnrichFrequency, &frequency}}
+		for _, v := range values {
+			if strings.TrimSpace(*v.value) != "" {
+				continue
+			}
+			for _, enricher := range e.Enrichers {
+				value, found, err := enricher.Enrich(*c, v.what)
+				if err != nil {
+					return fmt.Errorf("%s: failed to find the %s of note %d: %v", enricher.Name(), v.what, c.NoteID, err)
+				}
+				if !found {
+					continue
+				}
+				*v.value = value
+				if c.Sources == nil {
+					c.Sources = map[Enrichable]string{}
+				}
+				c.Sources[v.what] = enricher.Name()
+				break
+			}
+		}
+		if _, filled := c.Sources[EnrichFrequency]; filled {
+			if c.Fields == nil {
+				c.Fields = map[string]string{}
+			}
+			c.Fields[frequencyField] = frequency
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package ankiexport
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// mapEnricher has the values of words by what they are.
+type mapEnricher struct {
+	name   string
+	values map[Enrichable]map[string]string
+	err    error
+}
+
+func (m mapEnricher) Name() string { return m.name }
+
+func (m mapEnricher) Enrich(c Card, what Enrichable) (string, bool, error) {
+	if m.err != nil {
+		return "", false, m.err
+	}
+	value, found := m.values[what][c.Word]
+	return value, found, nil
+}
+
+func TestEnrich(t *testing.T) {
+	dictionary := mapEnricher{name: "dictionary", values: map[Enrichable]map[string]string{
+		EnrichDefinition: {"入る": "to enter", "部屋": "room"},
+		EnrichReading:    {"入る": "はいる"},
+	}}
+	frequencies := mapEnricher{name: "frequencies", values: map[Enrichable]map[string]string{
+		EnrichDefinition: {"食べる": "to eat"},
+		EnrichFrequency:  {"入る": "120"},
+	}}
+	e := &Exporter{Enrichers: []Enricher{dictionary, frequencies}}
+	cards := []Card{
+		{NoteID: 1, Word: "入る", Fields: map[string]string{"Frequency": ""}},
+		{NoteID: 2, Word: "部屋", Definition: "a room", Reading: "へや"},
+		{NoteID: 3, Word: "食べる"},
+		{NoteID: 4, Word: "unknown"},
+	}
+	if err := e.Enrich(cards); err != nil {
+		t.Fatal(err)
+	}
+
+	c := cards[0]
+	if c.Definition != "to enter" || c.Reading != "はいる" || c.Fields["Frequency"] != "120" {
+		t.Errorf("card 1 = %q, %q, frequency %q", c.Definition, c.Reading, c.Fields["Frequency"])
+	}
+	want := map[Enrichable]string{EnrichDefinition: "dictionary", EnrichReading: "dictionary", EnrichFrequency: "frequencies"}
+	for what, source := range want {
+		if c.Sources[what] != source {
+			t.Errorf("card 1's %s came from %q, want %s", what, c.Sources[what], source)
+		}
+	}
+	// Values the note has are kept
+	if c := cards[1]; c.Definition != "a room" || c.Reading != "へや" || len(c.Sources) != 0 {
+		t.Errorf("card 2 = %q, %q from %v, want its own values", c.Definition, c.Reading, c.Sources)
+	}
+	// The next enricher is asked when one has no value
+	if c := cards[2]; c.Definition != "to eat" || c.Sources[EnrichDefinition] != "frequencies" {
+		t.Errorf("card 3 = %q from %v", c.Definition, c.Sources)
+	}
+	if c := cards[3]; c.Definition != "" || c.Sources != nil {
+		t.Errorf("card 4 = %q from %v, want nothing filled in", c.Definition, c.Sources)
+	}
+}
+
+func TestEnrichFrequencyField(t *testing.T) {
+	e := &Exporter{FrequencyField: "Rank", Enrichers: []Enricher{mapEnricher{name: "list", values: map[Enrichable]map[string]string{
+		EnrichFrequency: {"入る": "7"},
+	}}}}
+	cards := []Card{{Word: "入る"}}
+	if err := e.Enrich(cards); err != nil {
+		t.Fatal(err)
+	}
+	if got := cards[0].Fields["Rank"]; got != "7" {
+		t.Errorf("Rank = %q, want 7", got)
+	}
+}
+
+func TestEnrichError(t *testing.T) {
+	failed := errors.New("service down")
+	e := &Exporter{Enrichers: []Enricher{mapEnricher{name: "translate", err: failed}}}
+	err := e.Enrich([]Card{{NoteID: 5, Word: "入る"}})
+	if err == nil || !strings.Contains(err.Error(), "translate") || !strings.Contains(err.Error(), "note 5") {
+		t.Errorf("Enrich error = %v, want one naming the enricher and the note", err)
+	}
+	if err := (&Exporter{}).Enrich([]Card{{Word: "入る"}}); err != nil {
+		t.Errorf("Enrich without enrichers = %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package ankiexport
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Orderer puts exported cards in order. Lessons are built from ranges of the exported
+// rows, so the order also decides which cards share a lesson. Order may reorder cards in
+// place and returns the cards in their new order.
+type Orderer interface {
+	Order(cards []Card) []Card
+}
+
+// OrderFunc is a function used as an Orderer.
+type OrderFunc func(cards []Card) []Card
+
+func (f OrderFunc) Order(cards []Card) []Card { return f(cards) }
+
+var (
+	orderersMu sync.RWMutex
+	orderers   = map[string]Orderer{}
+)
+
+// RegisterOrderer makes o available by name, replacing any orderer of that name, so a tool
+// embedding the package can add its own next to the built-in ones:
+//
+//	anki        the order Anki returned the cards in
+//	shuffle     a random order
+//	frequency   by the number in the note's Frequency field, lowest first
+//	ramp        from mature, rarely failed cards to new ones, see Difficulty
+//	interleave  taking turns between the decks, each deck's cards in Anki's order
+func RegisterOrderer(name string, o Orderer) {
+	orderersMu.Lock()
+	defer orderersMu.Unlock()
+	orderers[name] = o
+}
+
+// LookupOrderer returns the orderer registered as name.
+func LookupOrderer(name string) (Orderer, bool) {
+	orderersMu.RLock()
+	defer orderersMu.RUnlock()
+	o, found := orderers[name]
+	return o, found
+}
+
+// OrdererNames returns the names of the registered orderers, sorted.
+func OrdererNames() []string {
+	orderersMu.RLock()
+	defer orderersMu.RUnlock()
+	names := make([]string, 0, len(orderers))
+	for name := range orderers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterOrderer("anki", OrderFunc(func(cards []Card) []Card { return cards }))
+	RegisterOrderer("shuffle", Shuffle{})
+	RegisterOrderer("frequency", FieldOrder{Field: "Frequency"})
+	RegisterOrderer("ramp", OrderFunc(rampOrder))
+	RegisterOrderer("interleave", OrderFunc(interleaveDecks))
+}
+
+// Shuffle puts cards in a random order, the same one for the same Seed. A zero Seed is a
+// different order every time.
+type Shuffle struct {
+	Seed int64
+}
+
+func (s Shuffle) Order(cards []Card) []Card {
+	seed := s.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(cards), func(i, j int) { cards[i], cards[j] = cards[j], cards[i] })
+	return cards
+}
+
+// FieldOrder sorts cards by the number in their note's Field, lowest first, such as a
+// frequency rank. Cards without a number in it come last, in the order they were in.
+type FieldOrder struct {
+	Field string
+}
+
+func (o FieldOrder) Order(cards []Card) []Card {
+	key := func(c Card) (float64, bool) {
+		n, err := strconv.ParseFloat(strings.TrimSpace(c.Fields[o.Field]), 64)
+		return n, err == nil
+	}
+	sort.SliceStable(cards, func(i, j int) bool {
+		a, okA := key(cards[i])
+		b, okB := key(cards[j])
+		if okA != okB {
+			return okA
+		}
+		return okA && a < b
+	})
+	return cards
+}
+
+// Difficulty estimates how hard a card is from its scheduling info, from 0 for a mature
+// card to 1 for a new one, the same way concatenator.py's --order ramp does.
+func Difficulty(c Card) float64 {
+	if c.Reps == 0 || c.Type == 0 {
+		return 1
+	}
+	maturity := 1 / (1 + float64(max(c.Interval, 0))/21)
+	lapseRate := min(float64(c.Lapses)/float64(c.Reps), 1)
+	return 0.7*maturity + 0.3*lapseRate
+}
+
+func rampOrder(cards []Card) []Card {
+	sort.SliceStable(cards, func(i, j int) bool { return Difficulty(cards[i]) < Difficulty(cards[j]) })
+	return cards
+}
+
+func interleaveDecks(cards []Card) []Card {
+	var decks []string
+	byDeck := map[string][]Card{}
+	for _, c := range cards {
+		if _, found := byDeck[c.Deck]; !found {
+			decks = append(decks, c.Deck)
+		}
+		byDeck[c.Deck] = append(byDeck[c.Deck], c)
+	}
+	ordered := make([]Card, 0, len(cards))
+	for len(ordered) < len(cards) {
+		for _, deck := range decks {
+			if rest := byDeck[deck]; len(rest) > 0 {
+				ordered = append(ordered, rest[0])
+				byDeck[deck] = rest[1:]
+			}
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,141 @@
+package ankiexport
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// noteIDs returns the note IDs of cards in order.
+func noteIDs(cards []Card) []int64 {
+	ids := make([]int64, len(cards))
+	for i, c := range cards {
+		ids[i] = c.NoteID
+	}
+	return ids
+}
+
+func TestBuiltInOrderers(t *testing.T) {
+	for _, name := range []string{"anki", "shuffle", "frequency", "ramp", "interleave"} {
+		if _, found := LookupOrderer(name); !found {
+			t.Errorf("orderer %s isn't registered", name)
+		}
+	}
+	if !slices.IsSorted(OrdererNames()) {
+		t.Errorf("OrdererNames() = %v, want them sorted", OrdererNames())
+	}
+}
+
+func TestRegisterOrderer(t *testing.T) {
+	reverse := OrderFunc(func(cards []Card) []Card {
+		slices.Reverse(cards)
+		return cards
+	})
+	RegisterOrderer("test-reverse", reverse)
+	o, found := LookupOrderer("test-reverse")
+	if !found {
+		t.Fatal("a registered orderer isn't found")
+	}
+	if got := noteIDs(o.Order([]Card{{NoteID: 1}, {NoteID: 2}})); !reflect.DeepEqual(got, []int64{2, 1}) {
+		t.Errorf("Order = %v, want [2 1]", got)
+	}
+	if !slices.Contains(OrdererNames(), "test-reverse") {
+		t.Errorf("OrdererNames() = %v, want test-reverse in it", OrdererNames())
+	}
+	if _, found := LookupOrderer("no-such-order"); found {
+		t.Error("LookupOrderer found an orderer that isn't registered")
+	}
+}
+
+func TestAnkiOrder(t *testing.T) {
+	o, _ := LookupOrderer("anki")
+	if got := noteIDs(o.Order([]Card{{NoteID: 3}, {NoteID: 1}, {NoteID: 2}})); !reflect.DeepEqual(got, []int64{3, 1, 2}) {
+		t.Errorf("Order = %v, want Anki's order", got)
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	cards := func() []Card {
+		var cards []Card
+		for i := int64(1); i <= 20; i++ {
+			cards = append(cards, Card{NoteID: i})
+		}
+		return cards
+	}
+	a := noteIDs(Shuffle{Seed: 7}.Order(cards()))
+	b := noteIDs(Shuffle{Seed: 7}.Order(cards()))
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("the same seed shuffled differently: %v and %v", a, b)
+	}
+	if reflect.DeepEqual(a, noteIDs(cards())) {
+		t.Error("Shuffle left 20 cards in order")
+	}
+	sorted := slices.Clone(a)
+	slices.Sort(sorted)
+	if !reflect.DeepEqual(sorted, noteIDs(cards())) {
+		t.Errorf("Shuffle lost or duplicated cards: %v", a)
+	}
+}
+
+func TestFieldOrder(t *testing.T) {
+	cards := []Card{
+		{NoteID: 1, Fields: map[string]string{"Frequency": "300"}},
+		{NoteID: 2, Fields: map[string]string{"Frequency": ""}},
+		{NoteID: 3, Fields: map[string]string{"Frequency": " 20 "}},
+		{NoteID: 4},
+		{NoteID: 5, Fields: map[string]string{"Frequency": "1.5"}},
+	}
+	// Cards without a number keep their order, after the rest
+	want := []int64{5, 3, 1, 2, 4}
+	if got := noteIDs(FieldOrder{Field: "Frequency"}.Order(cards)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Order = %v, want %v", got, want)
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	tests := []struct {
+		name string
+		card Card
+		want float64
+	}{
+		{"new", Card{}, 1},
+		{"learning without reviews", Card{Type: 1}, 1},
+		{"young", Card{Type: 2, Reps: 4, Interval: 0}, 0.7},
+		{"mature", Card{Type: 2, Reps: 10, Interval: 21}, 0.35},
+		{"lapsed", Card{Type: 2, Reps: 4, Lapses: 4, Interval: 0}, 1},
+		{"more lapses than reps", Card{Type: 2, Reps: 1, Lapses: 3, Interval: 0}, 1},
+	}
+	for _, tt := range tests {
+		if got := Difficulty(tt.card); got < tt.want-1e-9 || got > tt.want+1e-9 {
+			t.Errorf("%s: Difficulty = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRampOrder(t *testing.T) {
+	cards := []Card{
+		{NoteID: 1},
+		{NoteID: 2, Type: 2, Reps: 10, Interval: 100},
+		{NoteID: 3, Type: 2, Reps: 4, Interval: 2},
+		{NoteID: 4, Type: 2, Reps: 10, Interval: 100},
+	}
+	o, _ := LookupOrderer("ramp")
+	if got := noteIDs(o.Order(cards)); !reflect.DeepEqual(got, []int64{2, 4, 3, 1}) {
+		t.Errorf("Order = %v, want easy to hard with ties in Anki's order", got)
+	}
+}
+
+func TestInterleaveDecks(t *testing.T) {
+	cards := []Card{
+		{NoteID: 1, Deck: "A"}, {NoteID: 2, Deck: "A"}, {NoteID: 3, Deck: "A"},
+		{NoteID: 4, Deck: "B"},
+		{NoteID: 5, Deck: "C"}, {NoteID: 6, Deck: "C"},
+	}
+	o, _ := LookupOrderer("interleave")
+	if got := noteIDs(o.Order(cards)); !reflect.DeepEqual(got, []int64{1, 4, 5, 2, 6, 3}) {
+		t.Errorf("Order = %v, want the decks taking turns", got)
+	}
+	if got := o.Order(nil); len(got) != 0 {
+		t.Errorf("Order(nil) = %v", got)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writePlaylist writes an extended M3U playlist of the downloaded clips in the order of the
+// cards, for playing a deck in a music app. With pairs each card's definition clip in
+// definitionFolder follows its word, if there is one. Entries are relative to the playlist,
+// so it keeps working when it is copied to a phone together with the clips. Returns how many
+// entries it has.
+func writePlaylist(name string, cards []card, definitionFolder string, pairs bool) (int, error) {
+	dir, err := filepath.Abs(filepath.Dir(name))
+	if err != nil {
+		return 0, err
+	}
+	entry := func(b *strings.Builder, path, title string) error {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil {
+			// On another drive than the playlist
+			rel = abs
+		}
+		// Players don't read titles with line breaks, and -1 is an unknown length
+		title = strings.Join(strings.Fields(title), " ")
+		fmt.Fprintf(b, "#EXTINF:-1,%s\n%s\n", title, filepath.ToSlash(rel))
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	entries := 0
+	for _, c := range cards {
+		word, _ := htmlToText(c.word)
+		definition, _ := htmlToText(c.definition)
+		if c.audioPath != "" {
+			title := word
+			if !pairs {
+				title = word + " - " + definition
+			}
+			if err := entry(&b, c.audioPath, title); err != nil {
+				return 0, err
+			}
+			entries++
+		}
+		if pairs {
+			clip := filepath.Join(definitionFolder, definitionFileName(c.number))
+			if _, err := os.Stat(clip); err != nil {
+				continue
+			}
+			if err := entry(&b, clip, definition); err != nil {
+				return 0, err
+			}
+			entries++
+		}
+	}
+	if entries == 0 {
+		return 0, fmt.Errorf("no clips to write to playlist %s", name)
+	}
+	if err := writeFileAtomic(name, []byte(b.String()), 0644); err != nil {
+		return 0, fmt.Errorf("failed to write playlist %s: %v", name, err)
+	}
+	return entries, nil
+}
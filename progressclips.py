@@ -0,0 +1,38 @@
+"""
+Spoken progress announcements shared by audio_sourcer.py and concatenator.py.
+
+audio_sourcer.py --download_numbers synthesizes a clip per number and one per joining
+word into the number folder, and concatenator.py builds announcements such as
+"twenty of eighty" or "fifty percent" from them, so no TTS is needed while building lessons.
+"""
+
+progressWords = ('of', 'percent')
+
+
+def numberClipFile(n):
+    return f"number_{n:05d}.mp3"
+
+
+def wordClipFile(word):
+    return f"word_{word}.mp3"
+
+
+def progressPhrase(played, total, every=0, milestones=()):
+    """
+    Returns the announcement due after the played-th card of total as a list of parts, each
+    a number or one of progressWords, or None. Counts every N cards take precedence over
+    percentage milestones when both fall on the same card. Nothing is announced after the
+    last card.
+    """
+    if played <= 0 or played >= total:
+        return None
+    if every and played % every == 0:
+        return [played, 'of', total]
+    for milestone in milestones:
+        if (played - 1) * 100 < milestone * total <= played * 100:
+            return [milestone, 'percent']
+    return None
+
+
+def progressClipFiles(parts):
+    return [numberClipFile(p) if isinstance(p, int) else wordClipFile(p) for p in parts]
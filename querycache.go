@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Michael-Manning/commuter-flashcards/pkg/ankiexport"
+	"github.com/atselvan/ankiconnect"
+)
+
+// With --query_cache, the cards and notes a query matched are kept for that long, so
+// exports run again and again while trying voices or patterns don't ask Anki for them each
+// time. The cache is a snapshot like a batch build's, one file per query in the cache
+// directory's queries folder. Whether cards are due and their media aren't part of it: due
+// cards change during the day and media has its own cache.
+const queryCacheFolder = "queries"
+
+type queryCacheFile struct {
+	Query string    `json:"query"`
+	Saved time.Time `json:"saved"`
+	ankiSnapshot
+}
+
+func queryCachePath(cacheDir, query string) string {
+	return filepath.Join(cacheDir, queryCacheFolder, hashHex([]byte(query))+".json")
+}
+
+// loadQueryCache makes the cached cards of query the snapshot exports read, if they were
+// cached less than ttl ago. It reports whether they were.
+func loadQueryCache(cacheDir, query string, ttl time.Duration) bool {
+	data, err := os.ReadFile(queryCachePath(cacheDir, query))
+	if err != nil {
+		return false
+	}
+	var cached queryCacheFile
+	if err := json.Unmarshal(data, &cached); err != nil {
+		fmt.Printf("warning: ignoring the query cache of --card_query: %v\n", err)
+		return false
+	}
+	age := time.Since(cached.Saved)
+	if cached.Query != query || age < 0 || age >= ttl {
+		return false
+	}
+	snapshot = &cached.ankiSnapshot
+	snapshot.index()
+	fmt.Printf("Using the cards --card_query matched %s ago, from the query cache\n", age.Round(time.Second))
+	return true
+}
+
+// saveQueryCache caches the cards, and the notes if any were fetched, that query matched.
+func saveQueryCache(cacheDir, query string, ids []int64, recorded *ankiSnapshot) error {
+	cached := queryCacheFile{Query: query, Saved: time.Now(), ankiSnapshot: *recorded}
+	cached.Queries = map[string][]int64{query: ids}
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	name := queryCachePath(cacheDir, query)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(name, data, 0644)
+}
+
+// recordingSource is an ankiexport.Client that keeps the cards and notes it fetched, to
+// cache them.
+type recordingSource struct {
+	ankiexport.Client
+	recorded *ankiSnapshot
+}
+
+func (s recordingSource) CardsInfo(ids []int64) ([]ankiconnect.ResultCardsInfo, error) {
+	cards, err := s.Client.CardsInfo(ids)
+	s.recorded.Cards = append(s.recorded.Cards, cards...)
+	return cards, err
+}
+
+func (s recordingSource) NotesInfo(ids []int64) ([]ankiconnect.ResultNotesInfo, error) {
+	notes, err := s.Client.NotesInfo(ids)
+	s.recorded.Notes = append(s.recorded.Notes, notes...)
+	return notes, err
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+	"github.com/go-resty/resty/v2"
+	"github.com/privatesquare/bkst-go-utils/utils/errors"
+)
+
+// Anki-Connect requests that fail because Anki didn't answer, e.g. while it syncs or the
+// laptop it runs on wakes up, are tried again with exponential backoff before the run gives
+// up. Every command supports the flags:
+//
+//	--anki_retries 3    retries after the first attempt (0 to give up at once)
+//	--anki_backoff 1s   wait before the first retry, doubled for each one after it
+//	--anki_timeout 1m   how long a single request may take
+//
+// Errors Anki-Connect answered with, such as an unknown note type, are never retried.
+var (
+	ankiRetries = 3
+	ankiBackoff = time.Second
+	ankiTimeout = time.Minute
+)
+
+var retryFlagNames = map[string]bool{"anki_retries": true, "anki_backoff": true, "anki_timeout": true}
+
+// extractRetryFlags removes the retry flags from args, so every command supports them.
+func extractRetryFlags(args []string) []string {
+	fs := flag.NewFlagSet("retry", flag.ExitOnError)
+	fs.IntVar(&ankiRetries, "anki_retries", ankiRetries, "")
+	fs.DurationVar(&ankiBackoff, "anki_backoff", ankiBackoff, "")
+	fs.DurationVar(&ankiTimeout, "anki_timeout", ankiTimeout, "")
+
+	var rest, retry []string
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || !retryFlagNames[name] {
+			rest = append(rest, args[i])
+			continue
+		}
+		retry = append(retry, args[i])
+		if !hasValue && i+1 < len(args) {
+			i++
+			retry = append(retry, args[i])
+		}
+	}
+	if len(retry) == 0 {
+		return args
+	}
+	fs.Parse(retry)
+	if ankiRetries < 0 {
+		fatalf("--anki_retries cannot be negative")
+	}
+	if ankiTimeout <= 0 {
+		fatalf("--anki_timeout must be positive")
+	}
+	return rest
+}
+
+// retryArgs returns the retry flags as arguments for another run of this program.
+func retryArgs() []string {
+	return []string{"--anki_retries=" + strconv.Itoa(ankiRetries), "--anki_backoff=" + ankiBackoff.String(), "--anki_timeout=" + ankiTimeout.String()}
+}
+
+// withRetry makes an Anki-Connect request with call, trying again while it fails without
+// an answer from Anki-Connect. Requests that write to Anki wait for it to be idle first.
+func withRetry[T any](action string, call func() (T, *errors.RestErr)) (T, *errors.RestErr) {
+	waitForAnkiIdle(ankiURL, action)
+	wait := ankiBackoff
+	for attempt := 1; ; attempt++ {
+		v, err := call()
+		if err == nil || err.StatusCode < http.StatusInternalServerError {
+			return v, err
+		}
+		if attempt > ankiRetries {
+			if attempt > 1 {
+				err.Message = fmt.Sprintf("%s (gave up after %d attempts)", err.Message, attempt)
+			}
+			return v, err
+		}
+		fmt.Printf("warning: anki-connect %s failed: %s, retrying in %v\n", action, restErrDetail(err), wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// retryErr is withRetry for requests without a result.
+func retryErr(action string, call func() *errors.RestErr) *errors.RestErr {
+	_, err := withRetry(action, func() (struct{}, *errors.RestErr) { return struct{}{}, call() })
+	return err
+}
+
+// restErrDetail returns what went wrong in err. The ankiconnect package puts a generic
+// message in Message when Anki-Connect didn't answer, and the reason in Error.
+func restErrDetail(err *errors.RestErr) string {
+	if err.Error != "" && err.Error != err.Message {
+		return err.Error
+	}
+	return err.Message
+}
+
+// ankiHTTPClient returns the HTTP client for Anki-Connect requests.
+func ankiHTTPClient() *http.Client {
+	return &http.Client{Timeout: ankiTimeout}
+}
+
+// withRetries makes the requests of an Anki-Connect client time out after ankiTimeout and
+// retries them.
+func withRetries(client *ankiconnect.Client) *ankiconnect.Client {
+	client.SetHTTPClient(resty.New().SetTimeout(ankiTimeout))
+	client.Cards = retryCards{client.Cards}
+	client.Notes = retryNotes{client.Notes}
+	client.Decks = retryDecks{client.Decks}
+	return client
+}
+
+type retryCards struct{ ankiconnect.CardsManager }
+
+func (m retryCards) Search(query string) (*[]int64, *errors.RestErr) {
+	return withRetry("findCards", func() (*[]int64, *errors.RestErr) { return m.CardsManager.Search(query) })
+}
+
+func (m retryCards) Get(query string) (*[]ankiconnect.ResultCardsInfo, *errors.RestErr) {
+	return withRetry("cardsInfo", func() (*[]ankiconnect.ResultCardsInfo, *errors.RestErr) { return m.CardsManager.Get(query) })
+}
+
+type retryNotes struct{ ankiconnect.NotesManager }
+
+func (m retryNotes) Search(query string) (*[]int64, *errors.RestErr) {
+	return withRetry("findNotes", func() (*[]int64, *errors.RestErr) { return m.NotesManager.Search(query) })
+}
+
+func (m retryNotes) Get(query string) (*[]ankiconnect.ResultNotesInfo, *errors.RestErr) {
+	return withRetry("notesInfo", func() (*[]ankiconnect.ResultNotesInfo, *errors.RestErr) { return m.NotesManager.Get(query) })
+}
+
+func (m retryNotes) Update(note ankiconnect.UpdateNote) *errors.RestErr {
+	return retryErr("updateNoteFields", func() *errors.RestErr { return m.NotesManager.Update(note) })
+}
+
+// Add is retried too. An attempt whose answer got lost may still have added the note, which
+// Anki-Connect then refuses as a duplicate on the next one, so that refusal means it's added.
+func (m retryNotes) Add(note ankiconnect.Note) *errors.RestErr {
+	attempts := 0
+	err := retryErr("addNote", func() *errors.RestErr {
+		attempts++
+		return m.NotesManager.Add(note)
+	})
+	if err != nil && attempts > 1 && isDuplicateErr(err) {
+		return nil
+	}
+	return err
+}
+
+// isDuplicateErr reports whether Anki-Connect refused to add a note because it exists.
+func isDuplicateErr(err *errors.RestErr) bool {
+	return err.StatusCode < http.StatusInternalServerError && strings.Contains(err.Message, "duplicate")
+}
+
+type retryDecks struct{ ankiconnect.DecksManager }
+
+func (m retryDecks) GetAll() (*[]string, *errors.RestErr) {
+	return withRetry("deckNames", m.DecksManager.GetAll)
+}
+
+func (m retryDecks) Create(name string) *errors.RestErr {
+	return retryErr("createDeck", func() *errors.RestErr { return m.DecksManager.Create(name) })
+}
+
+// failedFor adds the cards or notes a failed batch request was for to err.
+func failedFor(err *errors.RestErr, what string, ids []int64) *errors.RestErr {
+	if err == nil || len(ids) == 0 {
+		return err
+	}
+	if len(ids) == 1 {
+		err.Message = fmt.Sprintf("%s, for %s %d", err.Message, strings.TrimSuffix(what, "s"), ids[0])
+	} else {
+		err.Message = fmt.Sprintf("%s, for the %d %s %d to %d", err.Message, len(ids), what, ids[0], ids[len(ids)-1])
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+	"github.com/privatesquare/bkst-go-utils/utils/errors"
+)
+
+// addNotes answers addNote with the errors in order, then succeeds.
+type addNotes struct {
+	ankiconnect.NotesManager
+	errs  []*errors.RestErr
+	calls int
+}
+
+func (m *addNotes) Add(note ankiconnect.Note) *errors.RestErr {
+	m.calls++
+	if m.calls <= len(m.errs) {
+		return m.errs[m.calls-1]
+	}
+	return nil
+}
+
+func TestRetryNotesAdd(t *testing.T) {
+	defer func(policy string, retries int, backoff time.Duration) {
+		ankiBusyPolicy, ankiRetries, ankiBackoff = policy, retries, backoff
+	}(ankiBusyPolicy, ankiRetries, ankiBackoff)
+	ankiBusyPolicy, ankiRetries, ankiBackoff = "ignore", 2, 0
+
+	lost := func() *errors.RestErr {
+		return &errors.RestErr{Message: "Internal Server Error", StatusCode: http.StatusInternalServerError}
+	}
+	duplicate := func() *errors.RestErr {
+		return &errors.RestErr{Message: "cannot create note because it is a duplicate", StatusCode: http.StatusBadRequest}
+	}
+	tests := []struct {
+		name    string
+		errs    []*errors.RestErr
+		wantErr bool
+		calls   int
+	}{
+		{"added", nil, false, 1},
+		{"added on a retry", []*errors.RestErr{lost()}, false, 2},
+		{"added by a lost attempt", []*errors.RestErr{lost(), duplicate()}, false, 2},
+		{"already there", []*errors.RestErr{duplicate()}, true, 1},
+		{"unreachable", []*errors.RestErr{lost(), lost(), lost()}, true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notes := &addNotes{errs: tt.errs}
+			err := retryNotes{notes}.Add(ankiconnect.Note{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Add() = %v, want error %v", err, tt.wantErr)
+			}
+			if notes.calls != tt.calls {
+				t.Errorf("Add() made %d attempts, want %d", notes.calls, tt.calls)
+			}
+		})
+	}
+}
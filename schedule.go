@@ -0,0 +1,258 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// Scheduled builds are run by cron, launchd or Task Scheduler, not by a program of ours, so
+// `schedule preview` is told the schedule with --days and --session_cards. It counts the
+// cards Anki has due on each of the coming days and lays them out on the days a session is
+// built, carrying the cards of days without one, and the ones over the limit, to the next.
+// Cards reviewed in the meantime are rescheduled by Anki and new cards aren't counted, so
+// it's a forecast of the reviews already scheduled, not a promise.
+
+// defaultSecondsPerCard is how long a card plays when there are no lessons to measure.
+const defaultSecondsPerCard = 20
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWeekdays parses a comma separated list of weekdays, e.g. mon,wed,fri, or daily.
+func parseWeekdays(s string) (map[time.Weekday]bool, error) {
+	days := map[time.Weekday]bool{}
+	if strings.TrimSpace(s) == "daily" {
+		for _, d := range weekdayNames {
+			days[d] = true
+		}
+		return days, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		d, found := weekdayNames[strings.ToLower(strings.TrimSpace(name))]
+		if !found {
+			return nil, fmt.Errorf("unknown weekday %q, must be mon, tue, wed, thu, fri, sat, sun or daily", name)
+		}
+		days[d] = true
+	}
+	return days, nil
+}
+
+// dueForecast returns how many cards of query are due on each of the next days, today's
+// including the overdue and learning cards.
+func dueForecast(client *ankiconnect.Client, query string, days int) ([]int, error) {
+	counts := make([]int, days)
+	for i := range counts {
+		filter := "is:due"
+		if i > 0 {
+			filter = fmt.Sprintf("prop:due=%d", i)
+		}
+		ids, restErr := client.Cards.Search(fmt.Sprintf("(%s) %s -is:suspended -is:buried", query, filter))
+		if restErr != nil {
+			return nil, fmt.Errorf("failed to find the cards due in %d days: %v", i, restErr.Message)
+		}
+		if ids != nil {
+			counts[i] = len(*ids)
+		}
+	}
+	return counts, nil
+}
+
+// measureSecondsPerCard returns how long a card played on average in the newest lessons of
+// sessionsDir, from their timelines, and how many lessons it measured.
+func measureSecondsPerCard(sessionsDir string, lessons int) (float64, int) {
+	names, _ := filepath.Glob(filepath.Join(sessionsDir, "*.timeline.json"))
+	sort.Slice(names, func(i, j int) bool {
+		a, errA := os.Stat(names[i])
+		b, errB := os.Stat(names[j])
+		return errA == nil && errB == nil && a.ModTime().After(b.ModTime())
+	})
+	var totalMS int64
+	cards, measured := 0, 0
+	for _, name := range names {
+		if measured == lessons {
+			break
+		}
+		t, err := loadTimeline(name)
+		if err != nil || len(t.Cards) == 0 {
+			continue
+		}
+		keys := map[string]bool{}
+		var end int64
+		for _, c := range t.Cards {
+			keys[c.Key] = true
+			end = max(end, c.EndMS)
+		}
+		totalMS += end
+		cards += len(keys)
+		measured++
+	}
+	if cards == 0 {
+		return 0, 0
+	}
+	return float64(totalMS) / 1000 / float64(cards), measured
+}
+
+// scheduledSession is the forecast of one day.
+type scheduledSession struct {
+	date     time.Time
+	session  bool
+	cards    int
+	duration time.Duration
+}
+
+// planSessions lays the due counts starting at today out on the session days, at most limit
+// cards a session (0 for no limit), and returns the days and the cards left over at the end.
+func planSessions(today time.Time, due []int, days map[time.Weekday]bool, limit int, perCard float64) ([]scheduledSession, int) {
+	plan := make([]scheduledSession, len(due))
+	waiting := 0
+	for i, n := range due {
+		date := today.AddDate(0, 0, i)
+		waiting += n
+		plan[i] = scheduledSession{date: date, session: days[date.Weekday()]}
+		if !plan[i].session {
+			continue
+		}
+		cards := waiting
+		if limit > 0 {
+			cards = min(cards, limit)
+		}
+		waiting -= cards
+		plan[i].cards = cards
+		plan[i].duration = time.Duration(float64(cards) * perCard * float64(time.Second))
+	}
+	return plan, waiting
+}
+
+// formatMinutes formats a session's length, e.g. 42m or 1h05m.
+func formatMinutes(d time.Duration) string {
+	minutes := int(d.Round(time.Minute).Minutes())
+	if minutes >= 60 {
+		return fmt.Sprintf("%dh%02dm", minutes/60, minutes%60)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+// printCalendar prints the plan as a calendar of weeks from Monday to Sunday.
+func printCalendar(plan []scheduledSession) {
+	const width = 12
+	header := fmt.Sprintf("%-8s", "")
+	for _, name := range []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"} {
+		header += fmt.Sprintf("%-*s", width, name)
+	}
+	fmt.Println(strings.TrimRight(header, " "))
+	// Go counts weekdays from Sunday
+	column := func(d time.Time) int { return (int(d.Weekday()) + 6) % 7 }
+	for i := 0; i < len(plan); {
+		monday := plan[i].date.AddDate(0, 0, -column(plan[i].date))
+		dates, cells := fmt.Sprintf("%-8s", monday.Format("Jan 2")), fmt.Sprintf("%-8s", "")
+		for c := 0; c < 7; c++ {
+			if i >= len(plan) || column(plan[i].date) != c {
+				dates += strings.Repeat(" ", width)
+				cells += strings.Repeat(" ", width)
+				continue
+			}
+			s := plan[i]
+			dates += fmt.Sprintf("%-*d", width, s.date.Day())
+			cell := "-"
+			if s.session {
+				cell = fmt.Sprintf("%d %s", s.cards, formatMinutes(s.duration))
+			}
+			cells += fmt.Sprintf("%-*s", width, cell)
+			i++
+		}
+		fmt.Println(strings.TrimRight(dates, " "))
+		fmt.Println(strings.TrimRight(cells, " "))
+	}
+}
+
+// runSchedule implements the `schedule` command.
+func runSchedule(args []string) {
+	if len(args) == 0 || args[0] != "preview" {
+		fatalf("usage: schedule preview --card_query query [--days mon,tue,...] [--session_cards n]")
+	}
+	fs := flag.NewFlagSet("schedule preview", flag.ExitOnError)
+	cardQuery := fs.String("card_query", "", "Anki search query of the cards the scheduled build exports (required)")
+	sessionDays := fs.String("days", "mon,tue,wed,thu,fri", "Comma separated weekdays a session is built on, e.g. mon,wed,fri, or daily")
+	sessionCards := fs.Int("session_cards", 0, "Most cards a session plays, the rest wait for the next one (0 for no limit)")
+	daysAhead := fs.Int("days_ahead", 14, "Number of days to preview, starting today")
+	sessionsDir := fs.String("sessions_dir", "output", "Directory of the lessons built so far, to measure how long a card plays from their timelines")
+	secondsPerCard := fs.Float64("seconds_per_card", 0, fmt.Sprintf("How long a card plays, in seconds (default: measured from --sessions_dir, or %d without lessons)", defaultSecondsPerCard))
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args[1:])
+	useWorkspace(fs, *workspace, map[string]string{
+		"sessions_dir": "sessions",
+		"history_file": workspaceHistoryFile,
+	})
+	if *cardQuery == "" {
+		fatalf("must supply --card_query")
+	}
+	days, err := parseWeekdays(*sessionDays)
+	if err != nil {
+		fatalf("invalid --days: %v", err)
+	}
+	if *daysAhead < 1 {
+		fatalf("--days_ahead must be at least 1")
+	}
+	if *sessionCards < 0 {
+		fatalf("--session_cards cannot be negative")
+	}
+	startRun("schedule", fs, *historyFile)
+
+	perCard := *secondsPerCard
+	if perCard <= 0 {
+		measured := 0
+		if perCard, measured = measureSecondsPerCard(*sessionsDir, 10); measured > 0 {
+			fmt.Printf("A card plays for %.0fs on average, measured over %d lessons in %s\n", perCard, measured, *sessionsDir)
+		} else {
+			perCard = defaultSecondsPerCard
+			fmt.Printf("No lessons in %s to measure, assuming a card plays for %ds (--seconds_per_card)\n", *sessionsDir, defaultSecondsPerCard)
+		}
+	}
+
+	due, err := dueForecast(newAnkiClient(), *cardQuery, *daysAhead)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	plan, waiting := planSessions(today, due, days, *sessionCards, perCard)
+	fmt.Println()
+	printCalendar(plan)
+	fmt.Println()
+
+	var busiest *scheduledSession
+	sessions, total := 0, 0
+	for i, s := range plan {
+		if !s.session {
+			continue
+		}
+		sessions++
+		total += s.cards
+		if busiest == nil || s.cards > busiest.cards {
+			busiest = &plan[i]
+		}
+	}
+	recordCount("sessions", sessions)
+	recordCount("cards", total)
+	if sessions == 0 {
+		fmt.Printf("No sessions in the next %d days on --days %s\n", *daysAhead, *sessionDays)
+	} else {
+		fmt.Printf("%d sessions, %d cards, busiest %s with %d cards (%s)\n", sessions, total,
+			busiest.date.Format("Mon Jan 2"), busiest.cards, formatMinutes(busiest.duration))
+	}
+	if waiting > 0 {
+		recordCount("waiting", waiting)
+		fmt.Printf("warning: %d due cards are still waiting after the last session, raise --session_cards or add --days\n", waiting)
+	}
+	finishRun("ok")
+}
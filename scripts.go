@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// The pipeline runs in steps, each its own command, so one step can be re-run without
+// the others: `download` queries Anki and writes the cards, `audio` sources their clips
+// with audio_sourcer.py, `lesson` builds lessons with concatenator.py and `apply` syncs CSV
+// edits back to Anki. The audio and lesson commands pass their flags on to the scripts.
+const commandList = `Commands:
+  download       export cards (and their audio with --get_audio) from Anki, the default
+  audio          source word and definition clips with audio_sourcer.py
+  lesson         build lessons with concatenator.py
+  apply          push CSV edits back to Anki (rollback undoes them)
+  upload         add the rows of a CSV to Anki as new notes
+  memos          attach voice memos you recorded to their notes
+  batch          download several profiles at once
+  bury           bury the cards of a lesson in Anki for the day
+  schedule       preview the sessions of the next two weeks (schedule preview)
+  link           copy clips into folders named by note ID
+  verify-output  check lessons copied to a phone against their checksums
+  skips          import skipped cards from playback logs
+  confusables    find words that sound alike
+  opml           write an OPML file of several podcast feeds
+  site           render lessons into a static web player site and publish it
+  runs           list, show and compare past runs
+  doctor         check Anki, Python, ffmpeg and API keys
+  selftest       run the whole pipeline on a bundled mini-deck
+  update         install the latest release from GitHub
+  pick           choose the deck and fields to export from lists, saved to the config file
+  setup          answer a few questions to set everything up, with a sample lesson
+  config         migrate the config file to renamed flags (config migrate)
+`
+
+// usage prints how to use the program, its commands and the download flags.
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [command] [flags]\n\n%s\nDownload flags:\n", filepath.Base(os.Args[0]), commandList)
+	flag.PrintDefaults()
+}
+
+// findScriptsDir returns the directory audio_sourcer.py and concatenator.py are in: the current
+// directory, or the one this program is in.
+func findScriptsDir() string {
+	if _, err := os.Stat("concatenator.py"); err == nil {
+		return "."
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "."
+	}
+	return filepath.Dir(exe)
+}
+
+// runScript runs one of the Python steps with args, exiting with its exit status.
+func runScript(script string, args []string) {
+	python, err := pythonPath()
+	if err != nil {
+		fatalf("%v, install Python 3 from https://www.python.org", err)
+	}
+	path := filepath.Join(findScriptsDir(), script)
+	if _, err := os.Stat(path); err != nil {
+		fatalf("%s not found, run from the Commuter Flashcards folder", script)
+	}
+	cmd := exec.Command(python, append([]string{path}, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		fatalf("failed to run %s: %v", script, err)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// Selftest runs the whole pipeline on a bundled mini-deck: the export against a fake
+// Anki-Connect served from this process, audio_sourcer.py with its stub voices, which need
+// no API keys or network connection, and concatenator.py. Each step's outputs are checked
+// before the next one runs, so a broken install shows which part is missing.
+type selftestNote struct {
+	id         int64
+	word       string
+	definition string
+	tags       []string
+}
+
+var selftestDeck = []selftestNote{
+	{1000000000001, "いぬ", "dog", []string{"animals"}},
+	{1000000000002, "ねこ", "<b>cat</b>", []string{"animals"}},
+	{1000000000003, "みず", "water", nil},
+	{1000000000004, "やま", "mountain; hill", []string{"nature"}},
+}
+
+const selftestRepeats = 2
+
+// serveFakeAnki answers the Anki-Connect actions an export makes from the notes in deck, one
+// card per note, and returns its address and a function to stop it.
+func serveFakeAnki(deck []selftestNote) (string, func(), error) {
+	notes := map[int64]selftestNote{}
+	for _, n := range deck {
+		notes[n.id] = n
+	}
+	fields := func(n selftestNote) map[string]ankiconnect.FieldData {
+		return map[string]ankiconnect.FieldData{
+			"Word":       {Value: n.word, Order: 0},
+			"Definition": {Value: n.definition, Order: 1},
+		}
+	}
+	// Card IDs are the note ID times ten, so either can be found from the other
+	result := func(action string, params json.RawMessage) (any, error) {
+		var ids struct {
+			Cards []int64 `json:"cards"`
+			Notes []int64 `json:"notes"`
+		}
+		json.Unmarshal(params, &ids)
+		switch action {
+		case "version":
+			return minAnkiConnectVersion, nil
+		case "findCards", "findNotes":
+			found := []int64{}
+			for _, n := range deck {
+				if action == "findCards" {
+					found = append(found, n.id*10)
+				} else {
+					found = append(found, n.id)
+				}
+			}
+			return found, nil
+		case "cardsInfo":
+			cards := []ankiconnect.ResultCardsInfo{}
+			for _, id := range ids.Cards {
+				if n, found := notes[id/10]; found {
+					cards = append(cards, ankiconnect.ResultCardsInfo{CardId: id, Note: n.id, DeckName: "Selftest",
+						ModelName: "Selftest", Fields: fields(n), Type: 2, Queue: 2, Interval: 3, Reps: 2, Mod: 1700000000})
+				}
+			}
+			return cards, nil
+		case "notesInfo":
+			infos := []ankiconnect.ResultNotesInfo{}
+			for _, id := range ids.Notes {
+				if n, found := notes[id]; found {
+					infos = append(infos, ankiconnect.ResultNotesInfo{NoteId: n.id, ModelName: "Selftest", Fields: fields(n), Tags: n.tags})
+				}
+			}
+			return infos, nil
+		case "modelNames":
+			return []string{"Selftest"}, nil
+		case "modelFieldNames":
+			return []string{"Word", "Definition"}, nil
+		}
+		return nil, fmt.Errorf("unsupported action %s", action)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Action string          `json:"action"`
+			Params json.RawMessage `json:"params"`
+		}
+		if r.Method != http.MethodPost {
+			fmt.Fprint(w, "Anki-Connect")
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := result(req.Action, req.Params)
+		reply := map[string]any{"result": res, "error": nil}
+		if err != nil {
+			reply["error"] = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reply)
+	})}
+	go server.Serve(listener)
+	return "http://" + listener.Addr().String(), func() { server.Close() }, nil
+}
+
+// runSelftest checks the install by building a lesson from the bundled mini-deck.
+func runSelftest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	scriptsDir := fs.String("scripts_dir", "", "Directory containing audio_sourcer.py and concatenator.py (default: the current directory, or the one this program is in)")
+	keep := fs.Bool("keep", false, "Keep the test workspace after a successful run")
+	fs.Parse(args)
+
+	failed := 0
+	report := func(name string, r checkResult) {
+		fmt.Printf("[%s] %s: %s\n", r.status, name, r.detail)
+		if r.fix != "" {
+			fmt.Printf("       fix: %s\n", r.fix)
+		}
+		if r.status == "FAIL" {
+			failed++
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fatalf("selftest: %v", err)
+	}
+	scripts := *scriptsDir
+	if scripts == "" {
+		scripts = findScriptsDir()
+	}
+	python, err := pythonPath()
+	if err != nil {
+		report("Python", fail(err.Error(), "install Python 3 from https://www.python.org"))
+	}
+	for _, script := range []string{"audio_sourcer.py", "concatenator.py"} {
+		if _, err := os.Stat(filepath.Join(scripts, script)); err != nil {
+			report("Scripts", fail(script+" not found in "+scripts, "run selftest from the Commuter Flashcards folder or pass --scripts_dir"))
+			break
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+
+	root, err := os.MkdirTemp("", "commuter-selftest-")
+	if err != nil {
+		fatalf("selftest: %v", err)
+	}
+	url, stop, err := serveFakeAnki(selftestDeck)
+	if err != nil {
+		fatalf("selftest: failed to start the fake Anki-Connect: %v", err)
+	}
+	defer stop()
+	fmt.Printf("Testing in %s with a fake Anki-Connect at %s\n", root, url)
+
+	// run runs one step, returning false with its output's last error line if it fails
+	run := func(name string, cmd *exec.Cmd) bool {
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			logName := filepath.Join(root, "logs", strings.ToLower(strings.ReplaceAll(name, " ", "_"))+".log")
+			os.WriteFile(logName, out.Bytes(), 0644)
+			report(name, fail(lastErrorLine(out.String()), "see the full output in "+logName))
+			return false
+		}
+		return true
+	}
+	finish := func() {
+		if failed > 0 {
+			fmt.Printf("%d checks failed, the test workspace is kept in %s\n", failed, root)
+			os.Exit(1)
+		}
+		if *keep {
+			fmt.Printf("All checks passed, the test workspace is kept in %s\n", root)
+			return
+		}
+		os.RemoveAll(root)
+		fmt.Println("All checks passed")
+	}
+
+	// Step 1: export the mini-deck from the fake Anki
+	n := len(selftestDeck)
+	if !run("Export", exec.Command(exe, "--config=", "--anki_url="+url, "--workspace="+root, "--card_query=deck:Selftest",
+		"--word_field=Word", "--definition_field=Definition", "--metadata_columns=note_id", "--yes")) {
+		finish()
+		return
+	}
+	report("Export", checkSelftestCSV(filepath.Join(root, "cards.csv"), selftestDeck))
+	if failed > 0 {
+		finish()
+		return
+	}
+
+	// Step 2: source the audio with the stub voices
+	if !run("Audio sourcing", exec.Command(python, filepath.Join(scripts, "audio_sourcer.py"), "--workspace", root,
+		"--download_words", "--word_source", "Stub", "--download_definitions", "--definition_source", "Stub")) {
+		finish()
+		return
+	}
+	for _, kind := range []string{"word", "definition"} {
+		clips, err := listClips(filepath.Join(root, "audio", kind+"s"))
+		switch {
+		case err != nil:
+			report("Audio sourcing", fail(err.Error(), ""))
+		case len(clips) != n:
+			report("Audio sourcing", fail(fmt.Sprintf("%d %s clips, expected %d", len(clips), kind, n), ""))
+		default:
+			report("Audio sourcing", pass(fmt.Sprintf("%d %s clips", len(clips), kind)))
+		}
+	}
+	if failed > 0 {
+		finish()
+		return
+	}
+
+	// Step 3: build a lesson and check where every card plays in it
+	if !run("Lesson", exec.Command(python, filepath.Join(scripts, "concatenator.py"), "--workspace", root,
+		"--start_index", "0", "--end_index", strconv.Itoa(n), "--repeat_count", strconv.Itoa(selftestRepeats))) {
+		finish()
+		return
+	}
+	report("Lesson", checkSelftestLesson(filepath.Join(root, "sessions", fmt.Sprintf("cards_0-%d.mp3", n)), selftestDeck))
+	finish()
+}
+
+// checkSelftestCSV checks the exported CSV has a row for every note of deck, in any order.
+func checkSelftestCSV(name string, deck []selftestNote) checkResult {
+	file, err := os.Open(name)
+	if err != nil {
+		return fail(err.Error(), "")
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil || len(records) == 0 {
+		return fail(fmt.Sprintf("unreadable CSV %s: %v", name, err), "")
+	}
+	index := map[string]int{}
+	for i, h := range records[0] {
+		index[h] = i
+	}
+	words := map[string]string{}
+	for _, n := range deck {
+		words[strconv.FormatInt(n.id, 10)] = n.word
+	}
+	for _, r := range records[1:] {
+		id := r[index["NoteID"]]
+		if words[id] != r[index["Word"]] {
+			return fail(fmt.Sprintf("unexpected row %q", strings.Join(r, ",")), "")
+		}
+		delete(words, id)
+	}
+	if len(words) > 0 {
+		return fail(fmt.Sprintf("%d notes missing from the CSV", len(words)), "")
+	}
+	return pass(fmt.Sprintf("%d cards written to cards.csv", len(deck)))
+}
+
+// checkSelftestLesson checks the lesson was written and its timeline plays every card of
+// deck selftestRepeats times, one after another.
+func checkSelftestLesson(lesson string, deck []selftestNote) checkResult {
+	info, err := os.Stat(lesson)
+	if err != nil || info.Size() == 0 {
+		return fail(fmt.Sprintf("no lesson audio %s", lesson), "check ffmpeg is installed and on your PATH")
+	}
+	t, err := loadTimeline(lesson + ".timeline.json")
+	if err != nil {
+		return fail(err.Error(), "")
+	}
+	plays := map[string]int{}
+	var last int64
+	for _, c := range t.Cards {
+		if c.StartMS < last || c.EndMS <= c.StartMS {
+			return fail(fmt.Sprintf("card %s plays out of order at %dms", c.Key, c.StartMS), "")
+		}
+		last = c.EndMS
+		plays[c.Key]++
+	}
+	for _, n := range deck {
+		if got := plays[strconv.FormatInt(n.id, 10)]; got != selftestRepeats {
+			return fail(fmt.Sprintf("%s played %d times, expected %d", n.word, got, selftestRepeats), "")
+		}
+	}
+	return pass(fmt.Sprintf("%s, %d cards in %.1fs", filepath.Base(lesson), len(t.Cards), float64(last)/1000))
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// `setup` walks a first run through everything a lesson needs, one question at a time: it
+// waits until Anki can be reached, asks for the deck and its fields like pick does, how the
+// cards are read aloud, how long a lesson should be and where the files go, and builds a
+// lesson of a few of the cards so the choices can be heard before they are saved to the
+// config file.
+
+// setupEngines describes each TTS engine for the question which one to read with.
+var setupEngines = map[string]string{
+	"google": `Google Cloud, needs "googleTTS" in the API key file`,
+	"polly":  "Amazon Polly, needs AWS keys in the API key file",
+	"azure":  `Azure AI Speech, needs "azureSpeechKey" and "azureSpeechRegion" in the API key file`,
+	"piper":  "offline with natural voices, needs piper and a voice model",
+	"espeak": "offline and robotic, but needs no account, needs espeak-ng",
+}
+
+// setupRepeats is how many times a lesson set up by setup plays each card.
+const setupRepeats = 3
+
+// connectToAnki returns once Anki-Connect answers, explaining how to get it running until
+// it does.
+func connectToAnki(client *ankiconnect.Client) {
+	for {
+		version, err := ankiInvoke[int](client, "version", nil)
+		switch {
+		case err == nil && *version >= minAnkiConnectVersion:
+			fmt.Printf("Connected to Anki at %s\n\n", client.Url)
+			return
+		case err == nil:
+			fmt.Printf("Anki-Connect is version %d, update it to %d or newer from Tools > Add-ons in Anki\n", *version, minAnkiConnectVersion)
+		default:
+			fmt.Printf("Can't reach Anki at %s: %s\n", client.Url, err.Error)
+			fmt.Println("Start Anki and check the Anki-Connect add-on is installed: in Anki, Tools > Add-ons > Get Add-ons, code 2055492159, then restart Anki.")
+		}
+		if strings.EqualFold(ask("Press Enter to try again, or q to quit: "), "q") {
+			os.Exit(1)
+		}
+	}
+}
+
+// chooseTTS asks which engine reads the words without audio and the definitions, and with
+// which voice model for piper, until one that can be used is chosen. It returns "" for none.
+func chooseTTS(keyFile string) (engine, voice string) {
+	var keys map[string]string
+	if _, err := os.Stat(keyFile); err == nil {
+		if keys, err = loadAPIKeys(keyFile); err != nil {
+			fmt.Printf("warning: %v\n", err)
+		}
+	}
+	details := make([]string, len(ttsEngineNames))
+	for i, name := range ttsEngineNames {
+		details[i] = setupEngines[name]
+	}
+	for {
+		i := choose("Text-to-speech engine", ttsEngineNames, details, true)
+		if i < 0 {
+			return "", ""
+		}
+		engine, voice = ttsEngineNames[i], ""
+		if engine == "piper" {
+			voice = ask("Voice model for piper, e.g. ja_JP-voice-medium.onnx: ")
+		}
+		if _, err := newTTSEngine(engine, voice, keys); err != nil {
+			fmt.Printf("Can't read with %s: %v\n", engine, err)
+			continue
+		}
+		return engine, voice
+	}
+}
+
+// askMinutes asks how long a lesson should last.
+func askMinutes() float64 {
+	for {
+		answer := ask("How many minutes should a lesson last, e.g. your commute? [20]: ")
+		if answer == "" {
+			return 20
+		}
+		if minutes, err := strconv.ParseFloat(answer, 64); err == nil && minutes > 0 {
+			return minutes
+		}
+		fmt.Println("Enter a number of minutes, e.g. 30")
+	}
+}
+
+// settingArgs returns settings as command line arguments.
+func settingArgs(settings []configSetting, script bool) []string {
+	var args []string
+	for _, s := range settings {
+		values, err := configArgs(s.key, s.value, script)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		args = append(args, values...)
+	}
+	return args
+}
+
+// buildSample exports the first cards of choice into root with the download settings and
+// builds a lesson of them, and returns the lesson's file. It returns "" if a step failed,
+// saying why.
+func buildSample(client *ankiconnect.Client, choice deckChoice, download []configSetting, root string, cards int) string {
+	exe, err := os.Executable()
+	if err != nil {
+		fatalf("setup: %v", err)
+	}
+	// run runs one step, keeping its output in the sample's logs if it fails
+	run := func(name string, cmd *exec.Cmd) bool {
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			logName := filepath.Join(root, "logs", "sample_"+name+".log")
+			os.WriteFile(logName, out.Bytes(), 0644)
+			fmt.Printf("The sample %s failed: %s\nSee the full output in %s\n", name, lastErrorLine(out.String()), logName)
+			return false
+		}
+		return true
+	}
+
+	ids := make([]string, min(cards, len(choice.cards)))
+	for i := range ids {
+		ids[i] = strconv.FormatInt(choice.cards[i], 10)
+	}
+	fmt.Printf("Building a sample lesson of %d cards in %s...\n", len(ids), root)
+	args := []string{"--config=", "--anki_url=" + client.Url, "--workspace=" + root, "--yes"}
+	var settings []configSetting
+	for _, s := range download {
+		if s.key != "card_query" && s.key != "workspace" {
+			settings = append(settings, s)
+		}
+	}
+	args = append(append(args, settingArgs(settings, false)...), fmt.Sprintf("--card_query=%s cid:%s", choice.query, strings.Join(ids, ",")))
+	if !run("export", exec.Command(exe, args...)) {
+		return ""
+	}
+
+	python, err := pythonPath()
+	if err != nil {
+		fmt.Printf("Lessons are built with Python, which isn't installed: %v. Install Python 3 from https://www.python.org and run setup again\n", err)
+		return ""
+	}
+	if !run("lesson", exec.Command(python, filepath.Join(findScriptsDir(), "concatenator.py"), "--workspace", root,
+		"--start_index", "0", "--end_index", strconv.Itoa(len(ids)), "--repeat_count", "1",
+		"--word_folder", filepath.Join(root, "audio", "words_anki"))) {
+		return ""
+	}
+	return filepath.Join(root, "sessions", fmt.Sprintf("cards_0-%d.mp3", len(ids)))
+}
+
+// runSetup implements the `setup` command.
+func runSetup(args []string) {
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	sampleCards := fs.Int("sample_cards", 3, "Cards to build the sample lesson of (0 to skip the sample)")
+	apiKeyFile := fs.String("API_key_file", "API_keys.json", "File containing TTS API keys")
+	fs.Parse(args)
+	if configFile == "" {
+		fatalf("no config file to save to, pass --config file")
+	}
+
+	fmt.Println("This sets up Commuter Flashcards in a few questions and saves the answers to " + configFile + ".\n")
+	client := newAnkiClient()
+	connectToAnki(client)
+
+	fmt.Println("Which deck do you want to listen to, and which fields of its cards hold what?")
+	choice := chooseDeckAndFields(client)
+	download := choice.settings()
+
+	fmt.Println("\nCards without a recording can have their word read by a text-to-speech voice, which also reads the definitions.")
+	engine, voice := chooseTTS(*apiKeyFile)
+	if engine != "" {
+		language := ""
+		for normalizeLanguage(language) == "" {
+			if language = ask("What language are the definitions in? [en]: "); language == "" {
+				language = "en"
+			}
+		}
+		// The engine reads the words of the cards without audio
+		for i := range download {
+			if download[i].key == "get_audio" {
+				download[i].value = true
+			}
+		}
+		if engine == "google" || engine == "polly" || engine == "azure" {
+			if abs, err := filepath.Abs(*apiKeyFile); err == nil {
+				download = append(download, configSetting{"API_key_file", abs})
+			}
+		}
+		download = append(download, configSetting{"tts_engine", engine}, configSetting{"tts_definitions", true},
+			configSetting{"tts_definition_language", language})
+		if voice != "" {
+			if abs, err := filepath.Abs(voice); err == nil {
+				voice = abs
+			}
+			download = append(download, configSetting{"tts_voice", voice})
+		}
+	} else {
+		fmt.Printf("Without text-to-speech, the definition clips are made with `%s audio` and an ElevenLabs or Google key, see the README.\n", filepath.Base(os.Args[0]))
+	}
+
+	fmt.Println()
+	minutes := askMinutes()
+	workspace := ask("Folder for the cards, clips and lessons [" + defaultWorkspace + "]: ")
+	if workspace == "" {
+		workspace = defaultWorkspace
+	}
+	if abs, err := filepath.Abs(workspace); err == nil {
+		workspace = abs
+	}
+	download = append(download, configSetting{"workspace", workspace})
+	// Cards come back in their 2nd, 4th, 8th... lesson, making room for the ones the time
+	// didn't leave room for
+	lesson := []configSetting{
+		{"workspace", workspace},
+		{"start_index", 0},
+		{"end_index", len(choice.cards)},
+		{"repeat_count", setupRepeats},
+		{"minutes", minutes},
+		{"schedule", "exponential"},
+	}
+	if engine != "" || choice.audio != "" {
+		lesson = append(lesson, configSetting{"word_folder", filepath.Join(workspace, "audio", "words_anki")})
+	}
+
+	if *sampleCards > 0 {
+		fmt.Println()
+		switch {
+		case engine == "" && choice.audio == "":
+			fmt.Println("Skipping the sample lesson: without an audio field or text-to-speech the cards have nothing to play")
+		case engine == "":
+			fmt.Println("Skipping the sample lesson: without text-to-speech the definitions have no clips yet")
+		default:
+			if sample := buildSample(client, choice, download, filepath.Join(workspace, "sample"), *sampleCards); sample != "" {
+				fmt.Printf("Listen to the sample lesson: %s\n", sample)
+			}
+		}
+	}
+
+	sections := []configSection{{"download", download}, {"audio", []configSetting{{"workspace", workspace}}}, {"lesson", lesson}}
+	fmt.Println()
+	for _, section := range sections {
+		fmt.Printf("%s:\n", section.name)
+		for _, s := range section.settings {
+			fmt.Printf("  %s: %v\n", s.key, s.value)
+		}
+	}
+	if !confirm(fmt.Sprintf("Save these to %s?", configFile)) {
+		fmt.Println("Nothing saved")
+		return
+	}
+	if err := saveConfig(configFile, sections...); err != nil {
+		fatalf("failed to save config %s: %v", configFile, err)
+	}
+	name := filepath.Base(os.Args[0])
+	fmt.Printf("Saved to %s. From now on:\n", configFile)
+	fmt.Printf("  %s          exports the %d cards of %s\n", name, len(choice.cards), choice.deck)
+	fmt.Printf("  %s lesson   builds a lesson of about %g minutes, each card played %d times\n", name, minutes, setupRepeats)
+	fmt.Printf("Cards added to the deck later only play once end_index in the lesson section is raised.\n")
+}
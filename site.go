@@ -0,0 +1,380 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The `site` command renders the lessons into a static site a study group can use without a
+// server of ours: an index.html web player listing every lesson, the lessons themselves with
+// their cue sheets and timelines, and the podcast feed if there is one. The folder can be
+// served by anything that serves files, or published straight away with --publish:
+//
+//	ipfs     added and pinned with the ipfs command line tool, printing its gateway address
+//	netlify  deployed to --netlify_site through the Netlify API, with $NETLIFY_AUTH_TOKEN
+//	github   committed to --github_branch (default gh-pages) and force-pushed to
+//	         --github_remote, for GitHub Pages, with your git credentials
+//
+// A marker file keeps the command from clearing a folder it didn't create.
+const siteMarker = ".commuter-site"
+
+var siteAudio = map[string]bool{".mp3": true, ".m4a": true, ".m4b": true, ".mka": true}
+
+const netlifyAPI = "https://api.netlify.com/api/v1"
+
+// siteLesson is one lesson on the site's player page.
+type siteLesson struct {
+	File     string
+	Title    string
+	Built    time.Time
+	Cards    int
+	Duration string
+}
+
+// feedItems maps the file names of a feed's episodes to their titles, and returns the
+// feed's copyright, the credit concatenator.py gives the deck.
+func feedItems(name string) (map[string]string, string) {
+	var feed struct {
+		Copyright string `xml:"channel>copyright"`
+		Items     []struct {
+			Title     string `xml:"title"`
+			Enclosure struct {
+				URL string `xml:"url,attr"`
+			} `xml:"enclosure"`
+		} `xml:"channel>item"`
+	}
+	titles := map[string]string{}
+	data, err := os.ReadFile(name)
+	if err != nil || xml.Unmarshal(data, &feed) != nil {
+		return titles, ""
+	}
+	for _, item := range feed.Items {
+		if u, err := url.Parse(item.Enclosure.URL); err == nil {
+			titles[path.Base(u.Path)] = item.Title
+		}
+	}
+	return titles, feed.Copyright
+}
+
+var sitePage = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 1em auto; padding: 0 1em; }
+audio { width: 100%; position: sticky; top: 0; background: #fff; }
+li { margin: .5em 0; cursor: pointer; }
+li.playing { font-weight: bold; }
+small { color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Feed}}<p><a href="{{.Feed}}">Subscribe to the podcast feed</a></p>{{end}}
+<audio id="player" controls preload="none"></audio>
+<ol>
+{{range .Lessons}}<li data-file="{{.File}}">{{.Title}} <small>{{.Built.Format "2006-01-02"}}{{if .Cards}}, {{.Cards}} cards{{end}}{{if .Duration}}, {{.Duration}}{{end}}</small></li>
+{{end}}</ol>
+{{if .Credits}}<p><small>{{.Credits}}</small></p>{{end}}
+<script>
+// Play a lesson when it is tapped and remember where each one was left
+var player = document.getElementById('player');
+var current = null;
+document.querySelectorAll('li[data-file]').forEach(function (li) {
+  li.addEventListener('click', function () {
+    if (current) current.classList.remove('playing');
+    current = li;
+    li.classList.add('playing');
+    player.src = li.dataset.file;
+    player.currentTime = Number(localStorage.getItem('position:' + li.dataset.file) || 0);
+    player.play();
+  });
+});
+player.addEventListener('timeupdate', function () {
+  if (current) localStorage.setItem('position:' + current.dataset.file, player.currentTime);
+});
+</script>
+</body>
+</html>
+`))
+
+// runSite implements the `site` command, rendering the lessons into a static site.
+func runSite(args []string) {
+	fs := flag.NewFlagSet("site", flag.ExitOnError)
+	sessionsDir := fs.String("sessions_dir", "output", "Directory containing the lessons and feed built by concatenator.py")
+	outputDir := fs.String("output_dir", "site", "Directory to render the site into")
+	title := fs.String("title", "Commuter Flashcards", "Title of the player page")
+	publish := fs.String("publish", "", "Where to publish the site after rendering it: ipfs, netlify or github (default: only render it)")
+	netlifySite := fs.String("netlify_site", "", "Netlify site ID or name for --publish netlify")
+	githubRemote := fs.String("github_remote", "", "Git remote URL of the repository for --publish github")
+	githubBranch := fs.String("github_branch", "gh-pages", "Branch GitHub Pages serves, for --publish github")
+	attribution := fs.String("attribution", "", "Credit for the deck, shown under the lessons (default: the feed's, from concatenator.py --attribution)")
+	license := fs.String("license", "", "License of the deck, shown with --attribution")
+	bwlimit := fs.String("bwlimit", "", "Most bytes per second to upload with --publish netlify, e.g. 500K or 2M (default: no limit)")
+	window := fs.String("transfer_window", "", "Time of day to publish in, e.g. 02:00-06:00, waiting until it opens (default: any time)")
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{
+		"sessions_dir": "sessions",
+		"output_dir":   "site",
+		"history_file": workspaceHistoryFile,
+	})
+	switch *publish {
+	case "", "ipfs":
+	case "netlify":
+		if *netlifySite == "" {
+			fatalf("--publish netlify needs --netlify_site")
+		}
+		if os.Getenv("NETLIFY_AUTH_TOKEN") == "" {
+			fatalf("--publish netlify needs a personal access token in $NETLIFY_AUTH_TOKEN")
+		}
+	case "github":
+		if *githubRemote == "" {
+			fatalf("--publish github needs --github_remote")
+		}
+	default:
+		fatalf("unknown --publish %q, must be ipfs, netlify or github", *publish)
+	}
+	limits, err := newTransferLimits(*bwlimit, *window)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if limits.rate > 0 && *publish != "netlify" {
+		fmt.Printf("warning: --bwlimit only limits --publish netlify, ipfs and git upload at their own speed\n")
+	}
+	startRun("site", fs, *historyFile)
+
+	entries, err := os.ReadDir(*sessionsDir)
+	if err != nil {
+		fatalf("failed to read %s: %v", *sessionsDir, err)
+	}
+	titles, credits := feedItems(filepath.Join(*sessionsDir, "feed.xml"))
+	if *attribution != "" || *license != "" {
+		credits = creditLine(*attribution, *license)
+	}
+	var lessons []siteLesson
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !siteAudio[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			fatalf("%v", err)
+		}
+		lesson := siteLesson{File: name, Title: titles[name], Built: info.ModTime()}
+		if lesson.Title == "" {
+			lesson.Title = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		files = append(files, name)
+		for _, extra := range []string{strings.TrimSuffix(name, filepath.Ext(name)) + ".cue", name + ".timeline.json"} {
+			if _, err := os.Stat(filepath.Join(*sessionsDir, extra)); err == nil {
+				files = append(files, extra)
+			}
+		}
+		if t, err := loadTimeline(filepath.Join(*sessionsDir, name+".timeline.json")); err == nil && len(t.Cards) > 0 {
+			lesson.Cards = len(t.Cards)
+			lesson.Duration = (time.Duration(t.Cards[len(t.Cards)-1].EndMS) * time.Millisecond).Round(time.Second).String()
+		}
+		lessons = append(lessons, lesson)
+	}
+	if len(lessons) == 0 {
+		fatalf("no lessons in %s", *sessionsDir)
+	}
+	sort.SliceStable(lessons, func(a, b int) bool { return lessons[a].Built.After(lessons[b].Built) })
+	feed := ""
+	if _, err := os.Stat(filepath.Join(*sessionsDir, "feed.xml")); err == nil {
+		feed = "feed.xml"
+		files = append(files, feed)
+	}
+
+	if err := prepareSiteDir(*outputDir); err != nil {
+		fatalf("%v", err)
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Join(*sessionsDir, name))
+		if err != nil {
+			fatalf("failed to read %s: %v", name, err)
+		}
+		if err := writeFileAtomic(filepath.Join(*outputDir, name), data, 0644); err != nil {
+			fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	var page strings.Builder
+	if err := sitePage.Execute(&page, map[string]any{"Title": *title, "Feed": feed, "Lessons": lessons, "Credits": credits}); err != nil {
+		fatalf("failed to render the player page: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(*outputDir, "index.html"), []byte(page.String()), 0644); err != nil {
+		fatalf("failed to write index.html: %v", err)
+	}
+	recordCount("lessons", len(lessons))
+	recordOutput(*outputDir)
+	fmt.Printf("Rendered %d lessons into %s\n", len(lessons), *outputDir)
+
+	if *publish != "" {
+		limits.waitForWindow()
+	}
+	switch *publish {
+	case "ipfs":
+		err = publishIPFS(*outputDir)
+	case "netlify":
+		err = publishNetlify(*outputDir, *netlifySite, os.Getenv("NETLIFY_AUTH_TOKEN"), limits)
+	case "github":
+		err = publishGitHub(*outputDir, *githubRemote, *githubBranch)
+	}
+	if err != nil {
+		fatalf("failed to publish the site: %v", err)
+	}
+	finishRun("ok")
+}
+
+// prepareSiteDir empties a site directory rendered before, or creates it, so lessons
+// deleted since the last render disappear from the site. Hidden files such as the .git of
+// --publish github are kept.
+func prepareSiteDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, siteMarker), nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, siteMarker)); err != nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty and wasn't rendered by site, choose another --output_dir", dir)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, siteMarker), nil, 0644)
+}
+
+// publishIPFS adds the site to IPFS and pins it.
+func publishIPFS(dir string) error {
+	out, err := exec.Command("ipfs", "add", "--recursive", "--quieter", "--pin=true", dir).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("ipfs add: %v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return fmt.Errorf("ipfs add: %v (is IPFS installed? see https://docs.ipfs.tech/install/)", err)
+	}
+	cid := strings.TrimSpace(string(out))
+	fmt.Printf("Pinned to IPFS as %s: https://ipfs.io/ipfs/%s/\n", cid, cid)
+	return nil
+}
+
+// publishNetlify deploys the site as a zip through the Netlify API, streaming it so large
+// lessons are never held in memory, at the rate of limits.
+func publishNetlify(dir, site, token string, limits *transferLimits) error {
+	body, writer := io.Pipe()
+	go func() {
+		archive := zip.NewWriter(writer)
+		err := filepath.WalkDir(dir, func(name string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+				return err
+			}
+			rel, err := filepath.Rel(dir, name)
+			if err != nil {
+				return err
+			}
+			w, err := archive.Create(filepath.ToSlash(rel))
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		})
+		if err == nil {
+			err = archive.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, netlifyAPI+"/sites/"+url.PathEscape(site)+"/deploys", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/zip")
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{}
+	limitClient(client, limits)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("netlify: %v", err)
+	}
+	defer resp.Body.Close()
+	var deploy struct {
+		URL     string `json:"ssl_url"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&deploy)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("netlify answered %s: %s", resp.Status, deploy.Message)
+	}
+	fmt.Printf("Deployed to Netlify: %s\n", deploy.URL)
+	return nil
+}
+
+// publishGitHub commits the site to branch and force-pushes it to remote, replacing what
+// was published before.
+func publishGitHub(dir, remote, branch string) error {
+	git := func(args ...string) error {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		if err := git("init", "--quiet"); err != nil {
+			return err
+		}
+	}
+	// Pages would otherwise run the site through Jekyll
+	if err := os.WriteFile(filepath.Join(dir, ".nojekyll"), nil, 0644); err != nil {
+		return err
+	}
+	steps := [][]string{
+		{"checkout", "--quiet", "-B", branch},
+		{"add", "--all"},
+		{"-c", "user.name=Commuter Flashcards", "-c", "user.email=commuter@localhost", "commit", "--quiet", "--allow-empty", "-m", "Publish lessons " + time.Now().Format(time.DateOnly)},
+		{"push", "--quiet", "--force", remote, branch},
+	}
+	for _, args := range steps {
+		if err := git(args...); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Pushed the site to the %s branch of %s\n", branch, remote)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+
+	"github.com/Michael-Manning/commuter-flashcards/pkg/ankiexport"
+)
+
+// reportSkippedCards lists the cards --skip_errors left out, and writes them to name too if
+// it is set, so they can be fixed in Anki's browser with a nid: search.
+func reportSkippedCards(skipped []*ankiexport.FieldError, name string) error {
+	if len(skipped) == 0 {
+		return nil
+	}
+	fmt.Printf("Skipped %d cards with errors (--skip_errors):\n", len(skipped))
+	for _, e := range skipped {
+		fmt.Printf("  note %d (card %d, %s): no field %s\n", e.NoteID, e.CardID, e.Model, e.Field)
+	}
+	if name == "" {
+		return nil
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{"NoteID", "CardID", "NoteType", "MissingField"})
+	for _, e := range skipped {
+		w.Write([]string{strconv.FormatInt(e.NoteID, 10), strconv.FormatInt(e.CardID, 10), e.Model, e.Field})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(name, b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	fmt.Printf("Wrote the skipped cards to %s\n", name)
+	return nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Cards skipped within a couple of seconds of starting are probably already known. The
+// `skips import` command matches playback logs against the timelines concatenator.py writes
+// next to each lesson and collects those cards as candidates, and `skips confirm` moves them
+// to the exclusion list concatenator.py leaves out of future lessons.
+//
+// A playback log is a CSV with a header and one row per forward seek:
+//
+//	file,from,to
+//	cards_0-15.mp3,62.4,75
+//	cards_0-15.mp3,1:43,2:10
+//
+// Positions are seconds or [h:]mm:ss in the lesson file.
+
+// timelineCard is one play of a card in a lesson, from the .timeline.json sidecar.
+type timelineCard struct {
+	Index   int    `json:"index"`
+	Key     string `json:"key"`
+	Word    string `json:"word"`
+	StartMS int64  `json:"start_ms"`
+	EndMS   int64  `json:"end_ms"`
+}
+
+type timeline struct {
+	Output string         `json:"output"`
+	Cards  []timelineCard `json:"cards"`
+}
+
+// skipCandidate is a card skipped during playback but not yet excluded.
+type skipCandidate struct {
+	Word  string `json:"word"`
+	Skips int    `json:"skips"`
+	Last  string `json:"last"`
+}
+
+type skipCandidates struct {
+	// Imported holds the digests of logs already imported, so importing one twice is harmless
+	Imported []string                 `json:"imported"`
+	Cards    map[string]skipCandidate `json:"cards"`
+}
+
+// parseLogPosition parses a playback position in seconds or [h:]mm:ss.
+func parseLogPosition(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid position %q", s)
+	}
+	var seconds float64
+	for _, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid position %q", s)
+		}
+		seconds = seconds*60 + v
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func loadSkipCandidates(name string) (skipCandidates, error) {
+	candidates := skipCandidates{Cards: map[string]skipCandidate{}}
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return candidates, nil
+	}
+	if err != nil {
+		return candidates, err
+	}
+	if err := json.Unmarshal(data, &candidates); err != nil {
+		return candidates, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	if candidates.Cards == nil {
+		candidates.Cards = map[string]skipCandidate{}
+	}
+	return candidates, nil
+}
+
+func saveSkipCandidates(name string, candidates skipCandidates) error {
+	data, err := json.MarshalIndent(candidates, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, append(data, '\n'), 0644)
+}
+
+// loadExclusions reads the exclusion list, one card key per line. "#" starts a comment.
+func loadExclusions(name string) (map[string]bool, error) {
+	keys := map[string]bool{}
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.TrimSpace(line); line != "" {
+			keys[line] = true
+		}
+	}
+	return keys, nil
+}
+
+// runSkips implements the `skips import`, `skips list` and `skips confirm` commands.
+func runSkips(args []string) {
+	if len(args) == 0 {
+		fatalf("usage: skips import <log.csv>... | skips list | skips confirm [key]...")
+	}
+	fs := flag.NewFlagSet("skips", flag.ExitOnError)
+	sessionsDir := fs.String("sessions_dir", "output", "Directory containing the lessons and their .timeline.json files")
+	candidatesFile := fs.String("candidates_file", "skip_candidates.json", "File collecting cards skipped during playback")
+	excludeFile := fs.String("exclude_file", "excluded.txt", "Exclusion list read by concatenator.py --exclude_file")
+	within := fs.Duration("within", 2*time.Second, "Count a card as skipped when the listener seeks past it within this long of it starting")
+	yes := fs.Bool("yes", false, "Exclude candidates without asking for confirmation")
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args[1:])
+	useWorkspace(fs, *workspace, map[string]string{
+		"sessions_dir":    "sessions",
+		"candidates_file": filepath.Join("state", "skip_candidates.json"),
+		"exclude_file":    filepath.Join("state", "excluded.txt"),
+		"history_file":    workspaceHistoryFile,
+	})
+
+	candidates, err := loadSkipCandidates(*candidatesFile)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	switch args[0] {
+	case "import":
+		if fs.NArg() == 0 {
+			fatalf("usage: skips import <log.csv>...")
+		}
+		startRun("skips import", fs, *historyFile)
+		skipped, added := 0, 0
+		for _, name := range fs.Args() {
+			s, a, err := importPlaybackLog(name, *sessionsDir, *within, &candidates)
+			if err != nil {
+				fatalf("%v", err)
+			}
+			skipped += s
+			added += a
+		}
+		if err := saveSkipCandidates(*candidatesFile, candidates); err != nil {
+			fatalf("failed to write %s: %v", *candidatesFile, err)
+		}
+		recordCount("skipped", skipped)
+		recordCount("new_candidates", added)
+		recordOutput(*candidatesFile)
+		fmt.Printf("Found %d quick skips, %d new candidates (%d total). Review them with `skips confirm`\n", skipped, added, len(candidates.Cards))
+		finishRun("ok")
+	case "list":
+		printSkipCandidates(candidates, nil)
+	case "confirm":
+		startRun("skips confirm", fs, *historyFile)
+		keys := fs.Args()
+		if len(keys) == 0 {
+			for key := range candidates.Cards {
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range keys {
+			if _, found := candidates.Cards[key]; !found {
+				fatalf("%s is not a skip candidate", key)
+			}
+		}
+		if len(keys) == 0 {
+			fmt.Println("No skip candidates")
+			finishRun("ok")
+			return
+		}
+		printSkipCandidates(candidates, keys)
+		if !*yes && !confirm(fmt.Sprintf("Exclude %d cards from future lessons?", len(keys))) {
+			fmt.Println("Aborted")
+			finishRun("aborted")
+			return
+		}
+
+		excluded, err := loadExclusions(*excludeFile)
+		if err != nil {
+			fatalf("failed to read %s: %v", *excludeFile, err)
+		}
+		var added []string
+		for _, key := range keys {
+			if !excluded[key] {
+				excluded[key] = true
+				added = append(added, key)
+			}
+			delete(candidates.Cards, key)
+		}
+		if err := appendExclusions(*excludeFile, added); err != nil {
+			fatalf("failed to write %s: %v", *excludeFile, err)
+		}
+		if err := saveSkipCandidates(*candidatesFile, candidates); err != nil {
+			fatalf("failed to write %s: %v", *candidatesFile, err)
+		}
+		recordCount("excluded", len(keys))
+		recordOutput(*excludeFile)
+		fmt.Printf("Excluded %d cards (%d in %s)\n", len(keys), len(excluded), *excludeFile)
+		finishRun("ok")
+	default:
+		fatalf("unknown skips command %q", args[0])
+	}
+}
+
+// importPlaybackLog adds the cards skipped in one playback log to candidates, returning the
+// number of quick skips found and of cards that became candidates.
+func importPlaybackLog(name, sessionsDir string, within time.Duration, candidates *skipCandidates) (int, int, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read playback log %s: %v", name, err)
+	}
+	digest := hashHex(data)
+	for _, d := range candidates.Imported {
+		if d == digest {
+			fmt.Printf("warning: %s was already imported, skipping\n", name)
+			return 0, 0, nil
+		}
+	}
+
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read playback log %s: %v", name, err)
+	}
+	if len(records) == 0 {
+		return 0, 0, fmt.Errorf("playback log %s is empty", name)
+	}
+	index := map[string]int{}
+	for i, h := range records[0] {
+		index[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, h := range []string{"file", "from", "to"} {
+		if _, found := index[h]; !found {
+			return 0, 0, fmt.Errorf("playback log %s has no %s column", name, h)
+		}
+	}
+
+	timelines := map[string]*timeline{}
+	skipped, added := 0, 0
+	now := time.Now().Format(time.RFC3339)
+	for line, r := range records[1:] {
+		from, err := parseLogPosition(r[index["from"]])
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s row %d: %v", name, line+1, err)
+		}
+		to, err := parseLogPosition(r[index["to"]])
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s row %d: %v", name, line+1, err)
+		}
+		if to <= from {
+			continue // rewinds say nothing about known cards
+		}
+
+		lesson := filepath.Base(strings.TrimSpace(r[index["file"]]))
+		t, loaded := timelines[lesson]
+		if !loaded {
+			t, err = loadTimeline(filepath.Join(sessionsDir, lesson+".timeline.json"))
+			if err != nil {
+				fmt.Printf("warning: %v, ignoring skips in %s\n", err, lesson)
+			}
+			timelines[lesson] = t
+		}
+		if t == nil {
+			continue
+		}
+
+		for _, c := range t.Cards {
+			start := time.Duration(c.StartMS) * time.Millisecond
+			end := time.Duration(c.EndMS) * time.Millisecond
+			if from < start || from >= end || from-start > within || to < end {
+				continue
+			}
+			skipped++
+			candidate, found := candidates.Cards[c.Key]
+			if !found {
+				added++
+			}
+			candidate.Word = c.Word
+			candidate.Skips++
+			candidate.Last = now
+			candidates.Cards[c.Key] = candidate
+		}
+	}
+	candidates.Imported = append(candidates.Imported, digest)
+	return skipped, added, nil
+}
+
+func loadTimeline(name string) (*timeline, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("no timeline %s (built before timelines were written?)", name)
+	}
+	var t timeline
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("failed to read timeline %s: %v", name, err)
+	}
+	return &t, nil
+}
+
+// printSkipCandidates lists candidates, or only the ones in keys, most skipped first.
+func printSkipCandidates(candidates skipCandidates, keys []string) {
+	if keys == nil {
+		for key := range candidates.Cards {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		fmt.Println("No skip candidates")
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := candidates.Cards[keys[i]], candidates.Cards[keys[j]]
+		if a.Skips != b.Skips {
+			return a.Skips > b.Skips
+		}
+		return keys[i] < keys[j]
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tWORD\tSKIPS\tLAST")
+	for _, key := range keys {
+		c := candidates.Cards[key]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", key, c.Word, c.Skips, c.Last)
+	}
+	w.Flush()
+}
+
+// appendExclusions adds keys to the end of the exclusion list, keeping what's already there.
+func appendExclusions(name string, keys []string) error {
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		data = []byte("# Cards left out of lessons by concatenator.py, one note ID or word per line\n")
+	} else if err != nil {
+		return err
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		data = append(data, key+"\n"...)
+	}
+	return writeFileAtomic(name, data, 0644)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// An audio field can play several files, e.g. [sound:word_male.mp3][sound:word_female.mp3].
+// --sound_tags decides which of them become the word's clip: the first or last of them, the
+// Nth, or all of them played one after the other.
+
+// checkSoundTags returns an error if how isn't a --sound_tags value.
+func checkSoundTags(how string) error {
+	switch how {
+	case "first", "last", "all":
+		return nil
+	}
+	if n, err := strconv.Atoi(how); err == nil && n >= 1 {
+		return nil
+	}
+	return fmt.Errorf("--sound_tags must be first, last, all or the number of the tag to play, got %q", how)
+}
+
+// pickSounds returns the file of files the word's clip plays with --sound_tags how, and the
+// ones played after it. A field with fewer tags than the Nth plays its last.
+func pickSounds(files []string, how string) (string, []string) {
+	if len(files) == 0 {
+		return "", nil
+	}
+	switch how {
+	case "first":
+		return files[0], nil
+	case "last":
+		return files[len(files)-1], nil
+	case "all":
+		return files[0], files[1:]
+	}
+	n, _ := strconv.Atoi(how)
+	return files[min(n, len(files))-1], nil
+}
+
+// joinMP3 joins MP3 clips into one that plays them in order. MP3 frames play back to back,
+// so only the ID3 tags between the clips have to go: the ID3v2 header of every clip but the
+// first and the ID3v1 trailer of every clip but the last.
+func joinMP3(clips [][]byte) []byte {
+	var b bytes.Buffer
+	for i, data := range clips {
+		if i > 0 {
+			data = data[id3v2Size(data):]
+		}
+		if i < len(clips)-1 && len(data) >= 128 && bytes.HasPrefix(data[len(data)-128:], []byte("TAG")) {
+			data = data[:len(data)-128]
+		}
+		b.Write(data)
+	}
+	return b.Bytes()
+}
+
+// id3v2Size returns the length of the ID3v2 tag data starts with, or 0 without one.
+func id3v2Size(data []byte) int {
+	if len(data) < 10 || !bytes.HasPrefix(data, []byte("ID3")) {
+		return 0
+	}
+	// The size is 4 bytes of 7 bits each, and leaves out the header and the footer
+	size := 10 + (int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9]))
+	if data[5]&0x10 != 0 {
+		size += 10
+	}
+	return min(size, len(data))
+}
+
+// isMP3 reports whether a media file is an MP3 by its name.
+func isMP3(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".mp3")
+}
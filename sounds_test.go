@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCheckSoundTags(t *testing.T) {
+	for _, how := range []string{"first", "last", "all", "1", "3"} {
+		if err := checkSoundTags(how); err != nil {
+			t.Errorf("checkSoundTags(%q) = %v", how, err)
+		}
+	}
+	for _, how := range []string{"", "0", "-1", "second", "1.5"} {
+		if err := checkSoundTags(how); err == nil {
+			t.Errorf("checkSoundTags(%q) succeeded", how)
+		}
+	}
+}
+
+func TestPickSounds(t *testing.T) {
+	files := []string{"a.mp3", "b.mp3", "c.mp3"}
+	tests := []struct {
+		how   string
+		first string
+		rest  []string
+	}{
+		{"first", "a.mp3", nil},
+		{"last", "c.mp3", nil},
+		{"all", "a.mp3", []string{"b.mp3", "c.mp3"}},
+		{"2", "b.mp3", nil},
+		// A field with fewer tags plays its last
+		{"5", "c.mp3", nil},
+	}
+	for _, tt := range tests {
+		first, rest := pickSounds(files, tt.how)
+		if first != tt.first || !reflect.DeepEqual(rest, tt.rest) {
+			t.Errorf("pickSounds(%s) = %q, %q, want %q, %q", tt.how, first, rest, tt.first, tt.rest)
+		}
+	}
+	if first, rest := pickSounds(nil, "all"); first != "" || rest != nil {
+		t.Errorf("pickSounds(nil) = %q, %q", first, rest)
+	}
+	if first, rest := pickSounds([]string{"a.mp3"}, "all"); first != "a.mp3" || len(rest) != 0 {
+		t.Errorf("pickSounds of one file = %q, %q", first, rest)
+	}
+}
+
+// id3v2 returns an ID3v2 tag of size bytes after its header, with a footer if footer is set.
+func id3v2(size int, footer bool) []byte {
+	header := []byte{'I', 'D', '3', 4, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	if footer {
+		header[5] = 0x10
+	}
+	tag := append(header, bytes.Repeat([]byte{0}, size)...)
+	if footer {
+		tag = append(tag, []byte("3DI\x04\x00\x10\x00\x00\x00\x00")...)
+	}
+	return tag
+}
+
+// id3v1 returns an ID3v1 trailer.
+func id3v1() []byte {
+	return append([]byte("TAG"), bytes.Repeat([]byte{' '}, 125)...)
+}
+
+func TestID3v2Size(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no tag", []byte("\xff\xfbframes"), 0},
+		{"short", []byte("ID3"), 0},
+		{"tag", append(id3v2(20, false), "frames"...), 30},
+		{"large tag", append(id3v2(300, false), "frames"...), 310},
+		{"tag with footer", append(id3v2(20, true), "frames"...), 40},
+		{"truncated", id3v2(20, false)[:15], 15},
+	}
+	for _, tt := range tests {
+		if got := id3v2Size(tt.data); got != tt.want {
+			t.Errorf("%s: id3v2Size = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJoinMP3(t *testing.T) {
+	first := append(append(id3v2(10, false), "frames1"...), id3v1()...)
+	second := append(append(id3v2(20, true), "frames2"...), id3v1()...)
+	third := append(id3v2(5, false), "frames3"...)
+
+	got := joinMP3([][]byte{first, second, third})
+	// The first clip's header and the last clip's trailer stay
+	want := append(id3v2(10, false), "frames1frames2frames3"...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("joinMP3 = %q, want %q", got, want)
+	}
+
+	last := append([]byte("frames1"), id3v1()...)
+	if got := joinMP3([][]byte{[]byte("frames0"), last}); !bytes.Equal(got, append([]byte("frames0frames1"), id3v1()...)) {
+		t.Errorf("joinMP3 dropped the last clip's trailer: %q", got)
+	}
+	if got := joinMP3([][]byte{first}); !bytes.Equal(got, first) {
+		t.Errorf("joinMP3 of one clip changed it")
+	}
+}
+
+func TestIsMP3(t *testing.T) {
+	for name, want := range map[string]bool{"a.mp3": true, "A.MP3": true, "a.ogg": false, "mp3": false} {
+		if got := isMP3(name); got != want {
+			t.Errorf("isMP3(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
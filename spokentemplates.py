@@ -0,0 +1,62 @@
+"""
+Spoken framing of card segments shared by audio_sourcer.py and concatenator.py.
+
+A bare word followed by a bare definition is hard to follow by ear. A template per segment
+frames it in a short sentence, e.g.
+
+    --word_template "What is ... {word}?" --definition_template "{word} means: {definition}"
+
+{word} and {definition} stand for the card's own word and definition clips. audio_sourcer.py
+synthesizes the text between them once into the template folder, and concatenator.py
+joins the pieces when building the lesson, so the word keeps its native pronunciation.
+"""
+import re
+import hashlib
+
+from workspace import safeName
+
+templateFields = ('word', 'definition')
+
+_placeholder = re.compile(r'\{(\w*)\}')
+
+
+def parseTemplate(template):
+    """
+    Splits a template into its pieces, in order: ('field', name) for a placeholder and
+    ('text', text) for the words around them. Text with nothing to say, such as the "?"
+    after a placeholder, is dropped.
+    """
+    parts = []
+    pos = 0
+    for m in _placeholder.finditer(template):
+        if m.group(1) not in templateFields:
+            raise ValueError(f"unknown placeholder {m.group(0)} in \"{template}\", expected "
+                             + " or ".join('{' + f + '}' for f in templateFields))
+        parts.append(('text', template[pos:m.start()]))
+        parts.append(('field', m.group(1)))
+        pos = m.end()
+    parts.append(('text', template[pos:]))
+    parts = [(kind, value.strip()) for kind, value in parts
+             if kind == 'field' or any(c.isalnum() for c in value)]
+    if not any(kind == 'field' for kind, _ in parts):
+        raise ValueError(f"template \"{template}\" has no {{word}} or {{definition}}")
+    return parts
+
+
+def templateTexts(*templates):
+    """
+    Returns the text pieces of templates that need a clip, without repeats.
+    """
+    texts = []
+    for template in templates:
+        if template:
+            texts += [value for kind, value in parseTemplate(template) if kind == 'text']
+    return list(dict.fromkeys(texts))
+
+
+def templateClipFile(text):
+    """
+    Returns the clip file name of a piece of template text.
+    """
+    digest = hashlib.sha1(text.encode('utf-8')).hexdigest()[:8]
+    return f"frame_{safeName(text.lower())}_{digest}.mp3"
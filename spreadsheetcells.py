@@ -0,0 +1,74 @@
+"""
+CSV cells escaped for spreadsheets, shared by audio_sourcer.py and concatenator.py.
+
+Spreadsheets run a cell starting with =, +, - or @ as a formula, so anki_downloader
+--spreadsheet_safe writes those cells with a ' in front, e.g. "'-ness", and says so in the
+<csv>.export.json file it writes next to the CSV. The prefix is removed again when the tools
+read a CSV exported that way; the cells of any other CSV are read as they are.
+
+Columns with several values per card, like Tags, can be exported with --multi_value json as a
+JSON array in the cell, or with --multi_value columns as numbered columns Tags1, Tags2, ...
+Rows are read back with the values in one cell separated by spaces, the default export.
+"""
+
+import json
+import os
+import re
+
+formulaStarts = ('=', '+', '-', '@')
+
+# Columns anki_downloader may write with several values
+multiValueColumns = ('Tags',)
+
+
+def isSpreadsheetSafe(csvFile):
+    """
+    Reports whether csvFile was exported with --spreadsheet_safe, by its .export.json file.
+    """
+    try:
+        with open(csvFile + '.export.json', 'r', encoding='utf-8') as f:
+            return bool(json.load(f).get('spreadsheet_safe'))
+    except FileNotFoundError:
+        return False
+    except (OSError, ValueError, AttributeError) as e:
+        raise ValueError(f"invalid {csvFile}.export.json: {e}")
+
+
+def unescapeCell(value):
+    if isinstance(value, str) and len(value) > 1 and value[0] == "'" and value[1] in formulaStarts:
+        return value[1:]
+    return value
+
+
+def joinValues(row, name):
+    """
+    Folds the multi-value column name of row into one cell of values separated by spaces.
+    """
+    numbered = re.compile(re.escape(name) + r'(\d+)')
+    if name not in row:
+        cells = sorted((int(m.group(1)), key) for key in row if key and (m := numbered.fullmatch(key)))
+        if cells:
+            row[name] = ' '.join(value for value in (row.pop(key) for _, key in cells) if value)
+        return
+    value = row[name]
+    if isinstance(value, str) and value.startswith('[') and value.endswith(']'):
+        try:
+            values = json.loads(value)
+        except ValueError:
+            return
+        if isinstance(values, list):
+            row[name] = ' '.join(str(v) for v in values)
+
+
+def unescapeRow(row, safe):
+    """
+    Reads a row of a CSV back as it was exported: with safe, from isSpreadsheetSafe, the
+    cells are unescaped, and multi-value columns are folded into one cell.
+    """
+    if safe:
+        row = {name: unescapeCell(value) for name, value in row.items()}
+    else:
+        row = dict(row)
+    for name in multiValueColumns:
+        joinValues(row, name)
+    return row
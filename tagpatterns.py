@@ -0,0 +1,69 @@
+"""
+Per-card audio patterns chosen by tag, for concatenator.py.
+
+Most cards suit the session's --mode and pauses, but some card types need different
+treatment, e.g. sentence cards that work better definition first. A JSON file maps tags to
+patterns, each listing the settings that change for cards with the tag:
+
+    {"pattern::sentence-first": {"mode": "shadowing", "shadow_repeat": true},
+     "grammar": {"pause_after_word": 5000}}
+
+A pattern can also be just a mode, e.g. {"pattern::sentence-first": "shadowing"}. As with
+tag phrases, a tag also matches its child tags and the first matching entry in the file wins.
+"""
+import json
+
+from tagphrases import tagMatches
+from validation import didYouMean
+
+patternModes = ('recall', 'shadowing')
+
+# The settings a pattern can change, with the types of their values
+patternSettings = {
+    'mode': str,
+    'pause_after_word': int,
+    'pause_after_definition': int,
+    'shadow_pause': int,
+    'shadow_pause_factor': (int, float),
+    'shadow_repeat': bool,
+}
+
+
+def loadTagPatterns(filename):
+    """
+    Loads a tag pattern file as a list of (tag, {setting: value}), in file order.
+    """
+    with open(filename, 'r', encoding='utf-8') as f:
+        mapping = json.load(f)
+    if not isinstance(mapping, dict):
+        raise ValueError(f"{filename}: expected an object mapping tags to patterns")
+    patterns = []
+    for tag, pattern in mapping.items():
+        if isinstance(pattern, str):
+            pattern = {'mode': pattern}
+        if not isinstance(pattern, dict) or not pattern:
+            raise ValueError(f"{filename}: pattern for tag \"{tag}\" must be a mode or an object of settings")
+        for name, value in pattern.items():
+            kind = patternSettings.get(name)
+            if kind is None:
+                raise ValueError(f"{filename}: unknown setting \"{name}\" for tag \"{tag}\", expected one of "
+                                 + ", ".join(patternSettings) + didYouMean(name, patternSettings))
+            if not isinstance(value, kind) or (isinstance(value, bool) and kind is not bool):
+                raise ValueError(f"{filename}: {name} for tag \"{tag}\" has the wrong type")
+            if name == 'mode' and value not in patternModes:
+                raise ValueError(f"{filename}: unknown mode \"{value}\" for tag \"{tag}\", expected "
+                                 + " or ".join(patternModes) + didYouMean(value, patternModes))
+            if kind is not bool and kind is not str and value < 0:
+                raise ValueError(f"{filename}: {name} for tag \"{tag}\" cannot be negative")
+        patterns.append((tag.strip().lower(), pattern))
+    return patterns
+
+
+def tagPatternFor(tags, patterns):
+    """
+    Returns the pattern of a card with these tags, or None to use the session's settings.
+    """
+    for tag, pattern in patterns:
+        if tagMatches(tags, tag):
+            return pattern
+    return None
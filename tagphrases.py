@@ -0,0 +1,58 @@
+"""
+Spoken tag announcements shared by audio_sourcer.py and concatenator.py.
+
+When cards from many subjects are mixed in one session, a short phrase such as
+"chemistry:" before a card gives the context that helps recall. The phrases are set in a
+JSON file mapping tags to what to say, e.g.
+
+    {"chemistry": "chemistry:", "medical::cardio": "cardiology:"}
+
+A tag also matches its child tags ("medical" matches "medical::cardio"), and the first
+entry in the file that matches one of a card's tags is used. audio_sourcer.py synthesizes
+each phrase once into the tag folder, and concatenator.py plays it before the card.
+"""
+import json
+import hashlib
+
+from workspace import safeName
+
+
+def loadTagPhrases(filename):
+    """
+    Loads a tag phrase file as a list of (tag, phrase), in file order.
+    """
+    with open(filename, 'r', encoding='utf-8') as f:
+        mapping = json.load(f)
+    if not isinstance(mapping, dict):
+        raise ValueError(f"{filename}: expected an object mapping tags to phrases")
+    phrases = []
+    for tag, phrase in mapping.items():
+        if not isinstance(phrase, str) or not phrase.strip():
+            raise ValueError(f"{filename}: phrase for tag \"{tag}\" must be non-empty text")
+        phrases.append((tag.strip().lower(), phrase.strip()))
+    return phrases
+
+
+def tagMatches(tags, tag):
+    """
+    Reports whether a card with these tags has tag or one of its child tags.
+    """
+    return any(t.lower() == tag or t.lower().startswith(tag + '::') for t in tags)
+
+
+def tagPhraseFor(tags, phrases):
+    """
+    Returns the phrase to announce for a card with these tags, or None.
+    """
+    for tag, phrase in phrases:
+        if tagMatches(tags, tag):
+            return phrase
+    return None
+
+
+def tagPhraseFile(phrase):
+    """
+    Returns the clip file name of a phrase. Tags sharing a phrase share the clip.
+    """
+    digest = hashlib.sha1(phrase.encode('utf-8')).hexdigest()[:8]
+    return f"tag_{safeName(phrase.lower())}_{digest}.mp3"
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cards without audio in Anki can have their words read by a text-to-speech engine instead,
+// with --tts_engine:
+//
+//	google  Google Cloud Text-to-Speech, with the service account of "googleTTS" in the API
+//	        key file that audio_sourcer.py uses too
+//	polly   Amazon Polly, with "awsAccessKeyId", "awsSecretAccessKey" and "awsRegion" from
+//	        the API key file or the usual AWS_ environment variables
+//	azure   Azure AI Speech, with "azureSpeechKey" and "azureSpeechRegion"
+//	piper   the offline piper, reading with the voice model given as --tts_voice
+//	espeak  the offline espeak-ng
+//
+// The offline engines write WAV, so they need ffmpeg to make MP3s.
+var ttsEngineNames = []string{"google", "polly", "azure", "piper", "espeak"}
+
+// ttsWordModes are the --tts_words values: which cards without audio from Anki the engine
+// reads the word of. missing leaves cards meant to be silent alone and only fills in the
+// audio of notes whose file was deleted from Anki's media folder.
+var ttsWordModes = []string{"all", "missing", "none"}
+
+// A ttsEngine reads text aloud.
+type ttsEngine interface {
+	// synthesize returns text read in language, a code such as ja or pt-BR, as MP3
+	synthesize(text, language string) ([]byte, error)
+	// voice identifies the engine and the voice it reads language with, for cache keys
+	voice(language string) string
+}
+
+var ttsHTTP = &http.Client{Timeout: time.Minute}
+
+// Where the engines are asked, variables so a build can point them at a proxy.
+var (
+	googleTTSURL = "https://texttospeech.googleapis.com/v1/text:synthesize"
+	pollyURL     = "https://polly.%s.amazonaws.com/v1/speech"
+	azureTTSURL  = "https://%s.tts.speech.microsoft.com/cognitiveservices/v1"
+)
+
+// ttsLocales are the regions voices are picked from for languages given without one.
+var ttsLocales = map[string]string{
+	"ja": "ja-JP", "en": "en-US", "zh": "cmn-CN", "ko": "ko-KR", "es": "es-ES",
+	"fr": "fr-FR", "de": "de-DE", "pt": "pt-BR", "it": "it-IT",
+}
+
+// ttsLocale returns language with a region, e.g. ja-JP for ja.
+func ttsLocale(language string) string {
+	if strings.Contains(language, "-") {
+		return language
+	}
+	if locale, found := ttsLocales[strings.ToLower(language)]; found {
+		return locale
+	}
+	return language
+}
+
+// Default voices of the engines that need one named.
+var (
+	pollyVoices = map[string]string{"ja": "Takumi", "en": "Joanna", "zh": "Zhiyu", "ko": "Seoyeon", "es": "Lucia",
+		"fr": "Lea", "de": "Vicki", "pt": "Camila", "it": "Bianca"}
+	azureVoices = map[string]string{"ja": "ja-JP-NanamiNeural", "en": "en-US-JennyNeural", "zh": "zh-CN-XiaoxiaoNeural",
+		"ko": "ko-KR-SunHiNeural", "es": "es-ES-ElviraNeural", "fr": "fr-FR-DeniseNeural", "de": "de-DE-KatjaNeural",
+		"pt": "pt-BR-FranciscaNeural", "it": "it-IT-ElsaNeural"}
+)
+
+// defaultVoice returns voice, or the voice of voices for language.
+func defaultVoice(voice string, voices map[string]string, language string) (string, error) {
+	if voice != "" {
+		return voice, nil
+	}
+	base, _, _ := strings.Cut(strings.ToLower(language), "-")
+	if v, found := voices[base]; found {
+		return v, nil
+	}
+	return "", fmt.Errorf("no default voice for language %q, choose one with --tts_voice", language)
+}
+
+// missingError is the error of an engine whose credentials or programs aren't there. The
+// export goes on without the engine, rather than stopping for what it can do without.
+type missingError struct{ msg string }
+
+func (e missingError) Error() string { return e.msg }
+
+func missingf(format string, args ...any) error {
+	return missingError{fmt.Sprintf(format, args...)}
+}
+
+// newTTSEngine returns the engine name reading with voice, or each language's default voice
+// if voice is "". keys is the API key file.
+func newTTSEngine(name, voice string, keys map[string]string) (ttsEngine, error) {
+	key := func(name, env string) string {
+		if v := os.Getenv(env); v != "" {
+			return v
+		}
+		return keys[name]
+	}
+	switch name {
+	case "google":
+		path := key("googleTTS", "GOOGLE_APPLICATION_CREDENTIALS")
+		if path == "" {
+			return nil, missingf("--tts_engine google needs \"googleTTS\" in the API key file, the path of a service account JSON file")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		engine := &googleTTS{name: voice}
+		if err := json.Unmarshal(data, &engine.account); err != nil || engine.account.PrivateKey == "" {
+			return nil, fmt.Errorf("%s is not a service account key file", path)
+		}
+		if engine.account.TokenURI == "" {
+			engine.account.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+		return engine, nil
+	case "polly":
+		engine := &pollyTTS{
+			name:         voice,
+			accessKey:    key("awsAccessKeyId", "AWS_ACCESS_KEY_ID"),
+			secretKey:    key("awsSecretAccessKey", "AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			region:       key("awsRegion", "AWS_REGION"),
+		}
+		if engine.accessKey == "" || engine.secretKey == "" {
+			return nil, missingf("--tts_engine polly needs \"awsAccessKeyId\" and \"awsSecretAccessKey\" in the API key file or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		if engine.region == "" {
+			engine.region = "us-east-1"
+		}
+		return engine, nil
+	case "azure":
+		engine := &azureTTS{name: voice, key: key("azureSpeechKey", "AZURE_SPEECH_KEY"), region: key("azureSpeechRegion", "AZURE_SPEECH_REGION")}
+		if engine.key == "" || engine.region == "" {
+			return nil, missingf("--tts_engine azure needs \"azureSpeechKey\" and \"azureSpeechRegion\" in the API key file or AZURE_SPEECH_KEY and AZURE_SPEECH_REGION")
+		}
+		return engine, nil
+	case "piper":
+		if voice == "" {
+			return nil, fmt.Errorf("--tts_engine piper needs the voice model to read with as --tts_voice, e.g. ja_JP-voice-medium.onnx")
+		}
+		if _, err := os.Stat(voice); err != nil {
+			return nil, fmt.Errorf("piper voice model: %v", err)
+		}
+		return offlineTTS("piper", voice)
+	case "espeak":
+		return offlineTTS("espeak", voice)
+	}
+	return nil, fmt.Errorf("unknown --tts_engine %q, must be one of %s", name, strings.Join(ttsEngineNames, ", "))
+}
+
+// googleTTS reads with Google Cloud Text-to-Speech.
+type googleTTS struct {
+	name    string
+	account struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (g *googleTTS) voice(language string) string {
+	return "google:" + ttsLocale(language) + ":" + g.name
+}
+
+func (g *googleTTS) synthesize(text, language string) ([]byte, error) {
+	token, err := g.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	voice := map[string]string{"languageCode": ttsLocale(language)}
+	if g.name != "" {
+		voice["name"] = g.name
+	}
+	body, _ := json.Marshal(map[string]any{
+		"input":       map[string]string{"text": text},
+		"voice":       voice,
+		"audioConfig": map[string]string{"audioEncoding": "MP3"},
+	})
+	req, err := http.NewRequest(http.MethodPost, googleTTSURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	data, err := ttsRequest("Google TTS", req)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		AudioContent []byte `json:"audioContent"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("Google TTS: invalid response: %v", err)
+	}
+	return result.AudioContent, nil
+}
+
+// accessToken returns an OAuth token for the service account, signing in again shortly
+// before the last one expires.
+func (g *googleTTS) accessToken() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" && time.Until(g.expires) > time.Minute {
+		return g.token, nil
+	}
+
+	block, _ := pem.Decode([]byte(g.account.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("Google TTS: invalid private key in the service account file")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("Google TTS: invalid private key in the service account file: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("Google TTS: the service account key is not an RSA key")
+	}
+	now := time.Now()
+	jwtPart := func(v any) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := jwtPart(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + jwtPart(map[string]any{
+		"iss":   g.account.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/cloud-platform",
+		"aud":   g.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)},
+	}
+	req, err := http.NewRequest(http.MethodPost, g.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	data, err := ttsRequest("Google sign in", req)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil || result.AccessToken == "" {
+		return "", fmt.Errorf("Google sign in: no access token in the response")
+	}
+	g.token, g.expires = result.AccessToken, now.Add(time.Duration(result.ExpiresIn)*time.Second)
+	return g.token, nil
+}
+
+// pollyTTS reads with Amazon Polly's neural voices.
+type pollyTTS struct {
+	name                               string
+	accessKey, secretKey, sessionToken string
+	region                             string
+}
+
+func (p *pollyTTS) voice(language string) string {
+	voice, _ := defaultVoice(p.name, pollyVoices, language)
+	return "polly:" + voice
+}
+
+func (p *pollyTTS) synthesize(text, language string) ([]byte, error) {
+	voice, err := defaultVoice(p.name, pollyVoices, language)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(map[string]string{"Engine": "neural", "OutputFormat": "mp3", "Text": text, "VoiceId": voice})
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(pollyURL, p.region), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signAWS(req, body, p.accessKey, p.secretKey, p.sessionToken, p.region, "polly", time.Now())
+	return ttsRequest("Amazon Polly", req)
+}
+
+// signAWS signs req with AWS Signature Version 4.
+func signAWS(req *http.Request, body []byte, accessKey, secretKey, sessionToken, region, service string, now time.Time) {
+	sum := func(data []byte) string {
+		h := sha256.Sum256(data)
+		return hex.EncodeToString(h[:])
+	}
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	payload := sum(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	headers := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+		headers = append(headers, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		value := req.Header.Get(h)
+		if h == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonicalHeaders.String(), signedHeaders, payload}, "\n")
+
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	key := mac([]byte("AWS4"+secretKey), amzDate[:8])
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = mac(key, part)
+	}
+	signature := hex.EncodeToString(mac(key, "AWS4-HMAC-SHA256\n"+amzDate+"\n"+scope+"\n"+sum([]byte(canonical))))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// azureTTS reads with Azure AI Speech.
+type azureTTS struct {
+	name        string
+	key, region string
+}
+
+func (a *azureTTS) voice(language string) string {
+	voice, _ := defaultVoice(a.name, azureVoices, language)
+	return "azure:" + voice
+}
+
+func (a *azureTTS) synthesize(text, language string) ([]byte, error) {
+	voice, err := defaultVoice(a.name, azureVoices, language)
+	if err != nil {
+		return nil, err
+	}
+	ssml := fmt.Sprintf(`<speak version="1.0" xml:lang="%s"><voice name="%s">%s</voice></speak>`,
+		html.EscapeString(ttsLocale(language)), html.EscapeString(voice), html.EscapeString(text))
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(azureTTSURL, a.region), strings.NewReader(ssml))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ssml+xml")
+	req.Header.Set("Ocp-Apim-Subscription-Key", a.key)
+	req.Header.Set("X-Microsoft-OutputFormat", "audio-24khz-48kbitrate-mono-mp3")
+	req.Header.Set("User-Agent", "commuter-flashcards")
+	return ttsRequest("Azure Speech", req)
+}
+
+// ttsRequest sends req to the engine service and returns the body of its answer.
+func ttsRequest(service string, req *http.Request) ([]byte, error) {
+	transfers.waitForWindow()
+	resp, err := ttsHTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", service, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", service, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s: %s", service, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// commandTTS reads with an offline engine run as a command, converting its WAV to MP3.
+type commandTTS struct {
+	engine, path, ffmpeg string
+	name                 string
+}
+
+// offlineTTS returns the offline engine reading with voice, if it and ffmpeg are installed.
+func offlineTTS(engine, voice string) (ttsEngine, error) {
+	names := []string{engine}
+	if engine == "espeak" {
+		names = []string{"espeak-ng", "espeak"}
+	}
+	t := &commandTTS{engine: engine, name: voice}
+	for _, name := range names {
+		if path, err := exec.LookPath(name); err == nil {
+			t.path = path
+			break
+		}
+	}
+	if t.path == "" {
+		return nil, missingf("--tts_engine %s needs %s on the PATH", engine, names[0])
+	}
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, missingf("--tts_engine %s needs ffmpeg on the PATH to write MP3s", engine)
+	}
+	t.ffmpeg = path
+	return t, nil
+}
+
+func (t *commandTTS) voice(language string) string {
+	if t.name == "" {
+		base, _, _ := strings.Cut(strings.ToLower(language), "-")
+		return t.engine + ":" + base
+	}
+	return t.engine + ":" + filepath.Base(t.name)
+}
+
+func (t *commandTTS) synthesize(text, language string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "commuter-tts-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	wav := filepath.Join(dir, "speech.wav")
+
+	var cmd *exec.Cmd
+	if t.engine == "piper" {
+		cmd = exec.Command(t.path, "--model", t.name, "--output_file", wav)
+	} else {
+		voice := strings.TrimPrefix(t.voice(language), "espeak:")
+		// On stdin, a word like -ing isn't taken for an option
+		cmd = exec.Command(t.path, "-v", voice, "-w", wav, "--stdin")
+	}
+	cmd.Stdin = strings.NewReader(text)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", t.engine, err, strings.TrimSpace(string(out)))
+	}
+	mp3 := filepath.Join(dir, "speech.mp3")
+	if out, err := exec.Command(t.ffmpeg, "-loglevel", "error", "-y", "-i", wav, "-codec:a", "libmp3lame", "-q:a", "4", mp3).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.ReadFile(mp3)
+}
+
+// synthesizeClip returns text read by engine, through the cache if there is one.
+func synthesizeClip(engine ttsEngine, cache *mediaCache, text, language string) ([]byte, error) {
+	synthesize := func() ([]byte, error) { return engine.synthesize(text, language) }
+	if cache != nil {
+		return cache.fetch("tts:"+engine.voice(language)+":"+text, synthesize)
+	}
+	return synthesize()
+}
+
+// ttsDefaultLanguage is the language of words without one, the same audio_sourcer.py assumes.
+const ttsDefaultLanguage = "ja"
+
+// spokenLanguage returns the language to read a card's word in.
+func spokenLanguage(c card) string {
+	if c.language == "" {
+		return ttsDefaultLanguage
+	}
+	return c.language
+}
+
+// spokenText returns what to read for a card's word: its reading if it has one, as plain text.
+func spokenText(c card) string {
+	text := c.reading
+	if text == "" {
+		text, _ = htmlToText(c.word)
+	}
+	return strings.TrimSpace(text)
+}
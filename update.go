@@ -0,0 +1,358 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// `update` replaces this program with the newest GitHub release, so nobody has to build it
+// from source to get a fix. A release has a binary per platform, named by
+// releaseAssetName, a checksums.txt listing the SHA-256 of every file the way sha256sum
+// writes it, and optionally checksums.txt.sig, an Ed25519 signature of checksums.txt made
+// with the key whose public half is releasePublicKey. When the Python scripts are next to
+// the program, they are updated from the release's scripts.zip too.
+
+// version is the release this program was built as, set with
+// -ldflags "-X main.version=v1.4.0". Builds from source are "dev".
+var version = "dev"
+
+// releasePublicKey is the hex Ed25519 key releases are signed with, set with
+// -ldflags "-X main.releasePublicKey=...". Programs built with one refuse unsigned releases.
+var releasePublicKey = ""
+
+const (
+	defaultUpdateRepo = "Michael-Manning/Commuter-Flashcards"
+	githubAPI         = "https://api.github.com"
+	updateTimeout     = 5 * time.Minute
+)
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	HTMLURL string `json:"html_url"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// asset returns the download URL of the release's file name, or "" if it has none.
+func (r githubRelease) asset(name string) string {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+// releaseAssetName is the name of this platform's binary in a release, e.g.
+// anki_downloader_linux_amd64 or anki_downloader_windows_amd64.exe.
+func releaseAssetName() string {
+	name := fmt.Sprintf("anki_downloader_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// runUpdate implements the `update` command.
+func runUpdate(args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	repo := fs.String("repo", defaultUpdateRepo, "GitHub repository to download releases from, as owner/name")
+	apiURL := fs.String("api_url", githubAPI, "GitHub API to ask, for GitHub Enterprise or a mirror")
+	check := fs.Bool("check", false, "Only say whether a newer release is available")
+	force := fs.Bool("force", false, "Install the latest release even if it is not newer, e.g. over a build from source")
+	fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		fatalf("failed to find this program: %v", err)
+	}
+	// Windows can't replace a running program, so the last update left the old one behind
+	os.Remove(exe + ".old")
+
+	client := &http.Client{Timeout: updateTimeout}
+	var release githubRelease
+	if err := getJSON(client, strings.TrimSuffix(*apiURL, "/")+"/repos/"+*repo+"/releases/latest", &release); err != nil {
+		fatalf("failed to find the latest release of %s: %v", *repo, err)
+	}
+	newer, known := newerVersion(release.TagName, version)
+	switch {
+	case !known && !*force:
+		fmt.Printf("The latest release is %s. This program was built from source, so it can't tell if that is newer. Use --force to install it\n", release.TagName)
+		return
+	case !newer && !*force:
+		fmt.Printf("Already up to date (%s)\n", version)
+		return
+	case *check:
+		fmt.Printf("%s is available, this is %s. Run `update` to install it: %s\n", release.TagName, version, release.HTMLURL)
+		return
+	}
+
+	checksums, err := releaseChecksums(client, release)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	name := releaseAssetName()
+	binary, err := verifiedAsset(client, release, checksums, name)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	// Scripts next to the program are the ones it runs, so they move with it
+	var scripts map[string][]byte
+	scriptsDir := filepath.Dir(exe)
+	if _, err := os.Stat(filepath.Join(scriptsDir, "concatenator.py")); err == nil && release.asset("scripts.zip") != "" {
+		archive, err := verifiedAsset(client, release, checksums, "scripts.zip")
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if scripts, err = pythonScripts(archive); err != nil {
+			fatalf("scripts.zip: %v", err)
+		}
+	}
+
+	if err := replaceExecutable(exe, binary); err != nil {
+		fatalf("failed to replace %s: %v", exe, err)
+	}
+	for file, data := range scripts {
+		if err := writeFileAtomic(filepath.Join(scriptsDir, file), data, 0644); err != nil {
+			fatalf("failed to update %s: %v", file, err)
+		}
+	}
+	fmt.Printf("Updated %s from %s to %s", filepath.Base(exe), version, release.TagName)
+	if len(scripts) > 0 {
+		fmt.Printf(", with %d scripts", len(scripts))
+	}
+	fmt.Println()
+}
+
+// getJSON decodes the JSON at url into v.
+func getJSON(client *http.Client, url string, v any) error {
+	data, err := download(client, url)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// download returns the body of url.
+func download(client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// GitHub refuses API requests without a User-Agent
+	req.Header.Set("User-Agent", "commuter-flashcards/"+version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// newerVersion reports whether release is a later version than current, both like v1.2.3.
+// known is false when current isn't a release version.
+func newerVersion(release, current string) (newer, known bool) {
+	r, rOK := parseVersion(release)
+	c, cOK := parseVersion(current)
+	if !rOK || !cOK {
+		return false, false
+	}
+	for i := range r {
+		if r[i] != c[i] {
+			return r[i] > c[i], true
+		}
+	}
+	return false, true
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+	// Pre-release and build suffixes such as -rc1 are ignored
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	fields := strings.Split(v, ".")
+	if len(fields) > 3 {
+		return parts, false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// releaseChecksums downloads and verifies the release's checksums.txt, returning the
+// SHA-256 of each file by name.
+func releaseChecksums(client *http.Client, release githubRelease) (map[string]string, error) {
+	url := release.asset("checksums.txt")
+	if url == "" {
+		return nil, fmt.Errorf("release %s has no checksums.txt, refusing to install it", release.TagName)
+	}
+	data, err := download(client, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download checksums.txt: %v", err)
+	}
+
+	switch sigURL := release.asset("checksums.txt.sig"); {
+	case releasePublicKey == "":
+		fmt.Println("warning: this program has no release key to check signatures with, only checksums are verified")
+	case sigURL == "":
+		return nil, fmt.Errorf("release %s is not signed, refusing to install it", release.TagName)
+	default:
+		key, err := hex.DecodeString(releasePublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid release key built into this program")
+		}
+		encoded, err := download(client, sigURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download checksums.txt.sig: %v", err)
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || !ed25519.Verify(key, data, sig) {
+			return nil, fmt.Errorf("the signature of release %s doesn't match, refusing to install it", release.TagName)
+		}
+	}
+
+	checksums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// sha256sum marks files read in binary mode with *
+		sum, file, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if found {
+			checksums[strings.TrimPrefix(strings.TrimSpace(file), "*")] = strings.ToLower(sum)
+		}
+	}
+	return checksums, nil
+}
+
+// verifiedAsset downloads the release's file name and checks it against its checksum.
+func verifiedAsset(client *http.Client, release githubRelease, checksums map[string]string, name string) ([]byte, error) {
+	url := release.asset(name)
+	if url == "" {
+		return nil, fmt.Errorf("release %s has no %s for this platform", release.TagName, name)
+	}
+	want, found := checksums[name]
+	if !found {
+		return nil, fmt.Errorf("checksums.txt of release %s has no checksum for %s", release.TagName, name)
+	}
+	fmt.Printf("Downloading %s\n", name)
+	data, err := download(client, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", name, err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != want {
+		return nil, fmt.Errorf("%s doesn't match its checksum, refusing to install it", name)
+	}
+	return data, nil
+}
+
+// pythonScripts returns the .py files at the top of a zip archive.
+func pythonScripts(archive []byte) (map[string][]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, err
+	}
+	scripts := map[string][]byte{}
+	for _, f := range r.File {
+		name := filepath.Base(f.Name)
+		if path := strings.TrimPrefix(f.Name, "./"); path != name || !strings.HasSuffix(name, ".py") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		scripts[name] = data
+	}
+	if len(scripts) == 0 {
+		return nil, fmt.Errorf("no scripts in the archive")
+	}
+	return scripts, nil
+}
+
+// syncedFile is the part of an *os.File writeSynced uses.
+type syncedFile interface {
+	io.WriteCloser
+	Sync() error
+}
+
+// writeSynced writes data to f, flushes it to disk and closes it, returning the first error.
+func writeSynced(f syncedFile, data []byte) error {
+	_, err := f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// replaceExecutable puts data in place of the program at exe. The new program is written
+// next to it first, so a failed download or a full disk leaves the old one working.
+func replaceExecutable(exe string, data []byte) error {
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), "."+filepath.Base(exe)+".new-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeSynced(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()|0111); err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" {
+		// The running program keeps its old file open, so it can be replaced
+		return os.Rename(tmp.Name(), exe)
+	}
+	// Windows can't replace a program that is running, but it can rename it
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		os.Rename(old, exe)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		v    string
+		want [3]int
+		ok   bool
+	}{
+		{"v1.2.3", [3]int{1, 2, 3}, true},
+		{"1.2.3", [3]int{1, 2, 3}, true},
+		{"v1.2", [3]int{1, 2, 0}, true},
+		{"v2", [3]int{2, 0, 0}, true},
+		{"v1.2.3-rc1", [3]int{1, 2, 3}, true},
+		{"v1.2.3.4", [3]int{}, false},
+		{"dev", [3]int{}, false},
+		{"v1.x.3", [3]int{}, false},
+		{"", [3]int{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseVersion(tt.v)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v, %v", tt.v, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	tests := []struct {
+		release, current string
+		newer, known     bool
+	}{
+		{"v1.2.4", "v1.2.3", true, true},
+		{"v1.10.0", "v1.9.9", true, true},
+		{"v2.0.0", "v1.99.99", true, true},
+		{"v1.2.3", "v1.2.3", false, true},
+		{"v1.2.2", "v1.2.3", false, true},
+		{"v1.2.3", "v1.2.3-rc1", false, true},
+		{"v1.2.3", "dev", false, false},
+		{"latest", "v1.2.3", false, false},
+	}
+	for _, tt := range tests {
+		newer, known := newerVersion(tt.release, tt.current)
+		if newer != tt.newer || known != tt.known {
+			t.Errorf("newerVersion(%q, %q) = %v, %v, want %v, %v", tt.release, tt.current, newer, known, tt.newer, tt.known)
+		}
+	}
+}
+
+// zipArchive returns a zip archive of files by name.
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestPythonScripts(t *testing.T) {
+	archive := zipArchive(t, map[string]string{
+		"concatenator.py":     "a",
+		"./audio_sourcer.py":  "b",
+		"README.md":           "c",
+		"tests/test_audio.py": "d",
+	})
+	scripts, err := pythonScripts(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) != 2 || string(scripts["concatenator.py"]) != "a" || string(scripts["audio_sourcer.py"]) != "b" {
+		t.Errorf("pythonScripts = %q, want concatenator.py and audio_sourcer.py only", scripts)
+	}
+
+	if _, err := pythonScripts(zipArchive(t, map[string]string{"README.md": "c"})); err == nil {
+		t.Error("pythonScripts of an archive without scripts succeeded")
+	}
+	if _, err := pythonScripts([]byte("not a zip")); err == nil {
+		t.Error("pythonScripts of something that isn't a zip succeeded")
+	}
+}
+
+// failingFile fails the step of writing a file named by failing.
+type failingFile struct {
+	failing string
+	closed  bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.failing == "write" {
+		return len(p) / 2, errors.New("no space left on device")
+	}
+	return len(p), nil
+}
+
+func (f *failingFile) Sync() error {
+	if f.failing == "sync" {
+		return errors.New("input/output error")
+	}
+	return nil
+}
+
+func (f *failingFile) Close() error {
+	f.closed = true
+	if f.failing == "close" {
+		return errors.New("input/output error")
+	}
+	return nil
+}
+
+func TestWriteSynced(t *testing.T) {
+	for _, failing := range []string{"", "write", "sync", "close"} {
+		f := &failingFile{failing: failing}
+		err := writeSynced(f, []byte("program"))
+		if (err != nil) != (failing != "") {
+			t.Errorf("writeSynced failing to %s = %v", failing, err)
+		}
+		if !f.closed {
+			t.Errorf("writeSynced failing to %s left the file open", failing)
+		}
+	}
+}
+
+func TestReplaceExecutable(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "anki_downloader")
+	if err := os.WriteFile(exe, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceExecutable(exe, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(exe); string(data) != "new" {
+		t.Errorf("the program is %q after replacing it, want new", data)
+	}
+	if info, err := os.Stat(exe); err != nil || info.Mode().Perm()&0111 == 0 {
+		t.Errorf("the new program isn't executable: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files left next to the program, want only it", len(entries))
+	}
+}
+
+func TestReplaceExecutableReadOnly(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("needs a directory the test can't write to")
+	}
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "anki_downloader")
+	if err := os.WriteFile(exe, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(dir, 0555)
+	defer os.Chmod(dir, 0755)
+	if err := replaceExecutable(exe, []byte("new")); err == nil {
+		t.Error("replacing a program in a read-only directory succeeded")
+	}
+	if data, _ := os.ReadFile(exe); string(data) != "old" {
+		t.Errorf("the program is %q after a failed replace, want old", data)
+	}
+}
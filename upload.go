@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/atselvan/ankiconnect"
+)
+
+// uploadRow is a CSV row to be added to Anki as a new note.
+type uploadRow struct {
+	line       int
+	word       string
+	definition string
+	audio      string
+}
+
+// runUpload adds the rows of a CSV to Anki as new notes, the opposite of an export: for
+// cards written or corrected in a spreadsheet rather than in Anki. Audio files named in the
+// CSV are stored in Anki's media folder and attached to the notes.
+func runUpload(args []string) {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	csvName := fs.String("csv_name", "cards.csv", "CSV file with Word and Definition columns, and optionally an Audio column of audio file paths")
+	deck := fs.String("deck", "", "Deck to add the notes to, created if it doesn't exist")
+	noteType := fs.String("note_type", "", "Note type of the new notes, e.g. Basic")
+	wordField := fs.String("word_field", "", "Field the Word column is written to")
+	definitionField := fs.String("definition_field", "", "Field the Definition column is written to")
+	audioField := fs.String("audio_field", "", "Field the audio files of the Audio column are attached to")
+	tags := fs.String("tags", "", "Space separated tags to give the new notes, e.g. \"imported laptop\"")
+	dryRun := fs.Bool("dry_run", false, "Print the notes without adding them")
+	yes := fs.Bool("yes", false, "Add the notes without asking for confirmation")
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{
+		"csv_name":     "cards.csv",
+		"history_file": workspaceHistoryFile,
+	})
+	startRun("upload", fs, *historyFile)
+
+	for _, required := range []struct{ name, value string }{
+		{"deck", *deck}, {"note_type", *noteType}, {"word_field", *wordField}, {"definition_field", *definitionField},
+	} {
+		if required.value == "" {
+			fatalf("must supply --%s", required.name)
+		}
+	}
+
+	rows, err := readUploadRows(*csvName)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if len(rows) == 0 {
+		fatalf("CSV contains no rows")
+	}
+	for _, r := range rows {
+		if r.audio == "" {
+			continue
+		}
+		if *audioField == "" {
+			fatalf("row %d has an audio file, must supply --audio_field to attach it to", r.line)
+		}
+		if _, err := os.Stat(r.audio); err != nil {
+			fatalf("row %d: %v", r.line, err)
+		}
+	}
+
+	client := newAnkiClient()
+
+	res, restErr := ankiInvoke[[]string](client, "modelFieldNames", map[string]string{"modelName": *noteType})
+	if restErr != nil && restErr.StatusCode != 500 {
+		fatalf("Anki has no note type %q: %s", *noteType, restErr.Message)
+	}
+	fields := *must(res, restErr)
+	for _, field := range []string{*wordField, *definitionField, *audioField} {
+		if field != "" && !slices.Contains(fields, field) {
+			fatalf("note type %s has no field %s (it has %s)", *noteType, field, strings.Join(fields, ", "))
+		}
+	}
+
+	for _, r := range rows {
+		fmt.Printf("row %d: %q: %q", r.line, r.word, r.definition)
+		if r.audio != "" {
+			fmt.Printf(" with %s", r.audio)
+		}
+		fmt.Println()
+	}
+	if *dryRun {
+		fmt.Printf("dry run: %d notes would be added to %s\n", len(rows), *deck)
+		finishRun("dry run")
+		return
+	}
+	if !*yes && !confirm(fmt.Sprintf("Add %d notes to %s?", len(rows), *deck)) {
+		fmt.Println("Aborted")
+		finishRun("aborted")
+		return
+	}
+
+	decks := *must(client.Decks.GetAll())
+	if !slices.Contains(decks, *deck) {
+		if err := client.Decks.Create(*deck); err != nil {
+			fatalf("failed to create deck %s: %s", *deck, err.Message)
+		}
+		fmt.Printf("Created deck %s\n", *deck)
+	}
+
+	added := 0
+	for _, r := range rows {
+		note := ankiconnect.Note{
+			DeckName:  *deck,
+			ModelName: *noteType,
+			Fields:    ankiconnect.Fields{*wordField: r.word, *definitionField: r.definition},
+			Options:   &ankiconnect.Options{DuplicateScope: "deck"},
+			Tags:      strings.Fields(*tags),
+		}
+		if r.audio != "" {
+			data, err := os.ReadFile(r.audio)
+			if err != nil {
+				fatalf("row %d: %v", r.line, err)
+			}
+			// Named by content, so uploading the same clip again doesn't store it twice and
+			// clips with the same name from different exports don't overwrite each other
+			note.Audio = []ankiconnect.Audio{{
+				Data:     base64.StdEncoding.EncodeToString(data),
+				Filename: "commuter_" + hashHex(data)[:16] + strings.ToLower(filepath.Ext(r.audio)),
+				Fields:   []string{*audioField},
+			}}
+		}
+		if err := client.Notes.Add(note); err != nil {
+			fmt.Printf("warning: row %d: failed to add %q: %s\n", r.line, r.word, err.Message)
+			continue
+		}
+		added++
+	}
+	recordCount("notes_added", added)
+	recordCount("notes_failed", len(rows)-added)
+	fmt.Printf("Successfully added %d notes to %s\n", added, *deck)
+	if added < len(rows) {
+		finishRun("partial")
+		os.Exit(exitCode("partial"))
+	}
+	finishRun("ok")
+}
+
+// readUploadRows reads the rows of a CSV to upload. Audio paths are relative to the CSV.
+func readUploadRows(name string) ([]uploadRow, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CSV file %s: %v", name, err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV file %s: %v", name, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("CSV file %s is empty", name)
+	}
+
+	index := map[string]int{}
+	for i, h := range records[0] {
+		index[strings.TrimSpace(h)] = i
+	}
+	for _, h := range []string{"Word", "Definition"} {
+		if _, found := index[h]; !found {
+			return nil, fmt.Errorf("CSV file %s has no %s column", name, h)
+		}
+	}
+
+	export, err := loadCSVExport(name)
+	if err != nil {
+		return nil, err
+	}
+	var rows []uploadRow
+	for i, r := range records[1:] {
+		row := uploadRow{
+			line:       i + 1,
+			word:       export.cell(r[index["Word"]]),
+			definition: export.cell(r[index["Definition"]]),
+		}
+		if strings.TrimSpace(row.word) == "" {
+			fmt.Printf("warning: row %d has no word, skipping\n", row.line)
+			continue
+		}
+		if col, found := index["Audio"]; found && strings.TrimSpace(r[col]) != "" {
+			row.audio = strings.TrimSpace(r[col])
+			if !filepath.IsAbs(row.audio) {
+				row.audio = filepath.Join(filepath.Dir(name), row.audio)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
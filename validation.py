@@ -0,0 +1,79 @@
+"""
+Up-front validation of settings shared by audio_sourcer.py and concatenator.py.
+
+Both tools check their arguments against each other and against the card CSV before doing
+any work, collecting every problem into one report instead of stopping at the first.
+Errors stop the run; warnings point out settings that have no effect. Misspelled names get
+a "did you mean" suggestion from the values that would have been valid. Parts of a run that
+need a missing API key or program are skipped with a warning, and listed again at the end.
+"""
+import sys
+import difflib
+
+
+def didYouMean(value, candidates):
+    """
+    Returns ' (did you mean "x"?)' for the candidate closest to value, or '' if none is close.
+    """
+    candidates = [str(c) for c in candidates]
+    matches = difflib.get_close_matches(str(value), candidates, n=1, cutoff=0.6)
+    if not matches:
+        lowered = {c.lower(): c for c in candidates}
+        matches = [lowered[m] for m in difflib.get_close_matches(str(value).lower(), list(lowered), n=1, cutoff=0.6)]
+    return f' (did you mean "{matches[0]}"?)' if matches else ''
+
+
+def isSet(parser, opt, name):
+    """
+    Reports whether an argument was given a value other than its default.
+    """
+    return getattr(opt, name) != parser.get_default(name)
+
+
+class ValidationReport:
+    def __init__(self):
+        self.errors = []
+        self.warnings = []
+        self.skipped = []
+
+    def error(self, message, value=None, candidates=()):
+        self.errors.append(message + (didYouMean(value, candidates) if value is not None else ''))
+
+    def warning(self, message, value=None, candidates=()):
+        self.warnings.append(message + (didYouMean(value, candidates) if value is not None else ''))
+
+    def unused(self, parser, opt, name, needs):
+        """
+        Warns that --name was set but has no effect unless needs is also set.
+        """
+        if isSet(parser, opt, name):
+            self.warning(f"--{name} has no effect without {needs}")
+
+    def skip(self, feature, reason):
+        """
+        Warns that feature is left out of the run because a key or program it needs is missing.
+        """
+        self.skipped.append(feature)
+        self.warning(f"skipping {feature}: {reason}")
+
+    def summary(self):
+        """
+        Prints what was left out of the run, if anything.
+        """
+        if self.skipped:
+            print(f"Skipped for a missing API key or program: {', '.join(self.skipped)}")
+
+    def finish(self):
+        """
+        Prints the problems found. Exits if any of them are errors.
+        """
+        if not self.errors and not self.warnings:
+            return
+        print("Problems found in the settings:" if self.errors else "Warnings about the settings:")
+        for message in self.errors:
+            print(f"  error: {message}")
+        for message in self.warnings:
+            print(f"  warning: {message}")
+        if self.errors:
+            print(f"{len(self.errors)} errors, {len(self.warnings)} warnings. Nothing was done.")
+            sys.exit(1)
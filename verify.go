@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// concatenator.py writes a <lesson>.sha256 sidecar next to every lesson it builds, in the
+// format of sha256sum, and copies it to the phone with the lesson. verify-output checks the
+// lessons against their sidecars, to catch a copy silently cut short by a flaky SD card or
+// MTP connection.
+
+// checksumEntry is a lesson named by a sidecar.
+type checksumEntry struct {
+	sidecar, name, digest string
+}
+
+// readChecksums returns the lessons named by the .sha256 sidecars in folder, sorted by name.
+func readChecksums(folder string) ([]checksumEntry, error) {
+	sidecars, err := filepath.Glob(filepath.Join(folder, "*.sha256"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []checksumEntry
+	for _, sidecar := range sidecars {
+		f, err := os.Open(sidecar)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			digest, name, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+			// sha256sum marks files read in binary mode with a *
+			name = strings.TrimPrefix(strings.TrimSpace(name), "*")
+			if !found || len(digest) != sha256.Size*2 || name == "" {
+				f.Close()
+				return nil, fmt.Errorf("%s is not a sha256sum checksum file", sidecar)
+			}
+			entries = append(entries, checksumEntry{sidecar, name, strings.ToLower(digest)})
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", sidecar, err)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// fileSHA256 returns the SHA-256 of a file and its size.
+func fileSHA256(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// runVerifyOutput checks the lessons in a folder, e.g. the phone's, against the checksums
+// concatenator.py wrote when it built them.
+func runVerifyOutput(args []string) {
+	fs := flag.NewFlagSet("verify-output", flag.ExitOnError)
+	folder := fs.String("folder", "output", "Folder of the lessons to check, e.g. the phone's podcast folder")
+	checksums := fs.String("checksums", "", "Folder of the .sha256 files to check them against (default: --folder). Give the lessons' output folder to check a device the sidecars weren't copied to")
+	historyFile := fs.String("history_file", defaultHistoryFile, "File to record run history in (empty to disable)")
+	workspace := workspaceFlag(fs)
+	fs.Parse(args)
+	useWorkspace(fs, *workspace, map[string]string{
+		"folder":       "sessions",
+		"history_file": workspaceHistoryFile,
+	})
+	startRun("verify-output", fs, *historyFile)
+	if *checksums == "" {
+		*checksums = *folder
+	}
+	for _, dir := range []string{*folder, *checksums} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			fatalf("folder %s not found, is the phone connected and mounted?", dir)
+		}
+	}
+
+	entries, err := readChecksums(*checksums)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if len(entries) == 0 {
+		fatalf("no .sha256 files in %s, lessons built before verify-output existed have none", *checksums)
+	}
+
+	var ok, missing, bad int
+	for _, e := range entries {
+		name := filepath.Join(*folder, e.name)
+		digest, size, err := fileSHA256(name)
+		switch {
+		case os.IsNotExist(err):
+			missing++
+			fmt.Printf("MISSING  %s\n", e.name)
+		case err != nil:
+			bad++
+			fmt.Printf("FAILED   %s: %v\n", e.name, err)
+		case digest != e.digest:
+			bad++
+			// The original, if it's still next to its sidecar, tells a cut-off copy apart
+			if _, want, err := fileSHA256(filepath.Join(filepath.Dir(e.sidecar), e.name)); err == nil && size < want {
+				fmt.Printf("BAD      %s: truncated, %d of %d bytes\n", e.name, size, want)
+			} else {
+				fmt.Printf("BAD      %s: checksum doesn't match\n", e.name)
+			}
+		default:
+			ok++
+			fmt.Printf("OK       %s\n", e.name)
+		}
+	}
+	recordCount("ok", ok)
+	recordCount("missing", missing)
+	recordCount("bad", bad)
+
+	fmt.Printf("%d of %d lessons match their checksums", ok, len(entries))
+	if missing > 0 {
+		fmt.Printf(", %d missing", missing)
+	}
+	if bad > 0 {
+		fmt.Printf(", %d damaged: copy them again", bad)
+	}
+	fmt.Println()
+	if bad > 0 {
+		finishRun("failed")
+		os.Exit(1)
+	}
+	if missing > 0 {
+		finishRun("partial")
+		os.Exit(exitCode("partial"))
+	}
+	finishRun("ok")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+)
+
+// Output workspace. Every command keeps its files under one root instead of the current
+// directory, laid out the same way as audio_sourcer.py and concatenator.py do:
+//
+//	commuter/
+//	  cards.csv, cards.db, cards.epub   exports
+//	  audio/                            word and definition clips
+//	  sessions/                         built lessons
+//	  cache/                            download cache
+//	  logs/                             run history
+//	  state/                            schedule and session state
+//
+// Paths given on the command line are used as given.
+const defaultWorkspace = "commuter"
+
+var workspaceDirs = []string{"sessions", "audio", "cache", "logs", "state"}
+
+// workspaceHistoryFile is the run history location inside a workspace.
+var workspaceHistoryFile = filepath.Join("logs", defaultHistoryFile)
+
+// workspaceFlag adds --workspace to fs.
+func workspaceFlag(fs *flag.FlagSet) *string {
+	return fs.String("workspace", defaultWorkspace, "Root directory for output files left at their default paths (empty for the current directory)")
+}
+
+// useWorkspace creates the workspace under root and moves the flags in paths that were left
+// at their defaults to their location inside it. Does nothing when root is empty.
+func useWorkspace(fs *flag.FlagSet, root string, paths map[string]string) {
+	if root == "" {
+		return
+	}
+	for _, dir := range workspaceDirs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			fatalf("failed to create workspace %s: %v", root, err)
+		}
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, rel := range paths {
+		if !set[name] {
+			fs.Set(name, filepath.Join(root, rel))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+"""
+Workspaces shared by audio_sourcer.py and concatenator.py.
+
+The output workspace (--workspace, "commuter" by default) holds everything the tools
+write, laid out the same way as anki_downloader's:
+
+    commuter/
+      cards.csv   the card export
+      audio/      word and definition clips
+      sessions/   built lessons
+      cache/      download cache
+      logs/       run history
+      state/      schedule and session state
+
+The per-run temp workspace holds intermediate files (processed clips, SSML payloads, raw
+API responses). It is removed when the run succeeds, or kept for debugging bad audio when
+the run fails or --keep_temp is given.
+"""
+import os
+import sys
+import time
+import shutil
+import tempfile
+
+defaultWorkspace = "commuter"
+workspaceDirs = ("sessions", "audio", "cache", "logs", "state")
+
+# The workspace of the current run, if any
+currentWorkspace = None
+
+
+def addWorkspaceArgument(parser):
+    parser.add_argument('--workspace', type=str, default=defaultWorkspace,
+        help=f'Root directory for output files left at their default paths, empty for the current directory (default "{defaultWorkspace}")')
+
+
+def useWorkspace(parser, opt, paths):
+    """
+    Creates the output workspace and moves the options in paths that were left at their
+    defaults to their location inside it, e.g. {"card_file": "cards.csv"}. Paths given on
+    the command line are used as given. Does nothing when --workspace is empty.
+    """
+    if not opt.workspace:
+        return
+    for directory in workspaceDirs:
+        os.makedirs(os.path.join(opt.workspace, directory), exist_ok=True)
+    for name, relative in paths.items():
+        if getattr(opt, name) == parser.get_default(name):
+            setattr(opt, name, os.path.join(opt.workspace, relative))
+
+
+class RunWorkspace:
+    def __init__(self, tool, root=None, keep=False):
+        if root:
+            os.makedirs(root, exist_ok=True)
+        self.root = tempfile.mkdtemp(prefix=f"{tool}-{time.strftime('%Y%m%d-%H%M%S')}-", dir=root or None)
+        self.keep = keep
+
+    def path(self, *parts):
+        """
+        Returns a path inside the workspace, creating its directory.
+        """
+        path = os.path.join(self.root, *parts)
+        os.makedirs(os.path.dirname(path), exist_ok=True)
+        return path
+
+    def save(self, name, data):
+        """
+        Keeps a copy of an intermediate, e.g. save("responses/forvo_word.json", body).
+        """
+        mode = 'wb' if isinstance(data, (bytes, bytearray)) else 'w'
+        with open(self.path(name), mode, **({} if mode == 'wb' else {'encoding': 'utf-8'})) as f:
+            f.write(data)
+
+    def __enter__(self):
+        global currentWorkspace
+        currentWorkspace = self
+        return self
+
+    def __exit__(self, exc_type, exc, tb):
+        global currentWorkspace
+        currentWorkspace = None
+        failed = exc_type is not None and not (exc_type is SystemExit and exc.code in (0, None))
+        if self.keep or failed:
+            print(f"Temp files kept in {self.root}", file=sys.stderr if failed else sys.stdout)
+        else:
+            shutil.rmtree(self.root, ignore_errors=True)
+        return False
+
+
+def saveDebug(name, data):
+    """
+    Saves an intermediate to the current workspace. Does nothing outside a run.
+    """
+    if currentWorkspace is not None:
+        currentWorkspace.save(name, data)
+
+
+def safeName(text, limit=40):
+    """
+    Turns text into something usable in a file name.
+    """
+    name = ''.join(c if c.isalnum() or c in '-_' else '_' for c in text)
+    return name[:limit] or '_'